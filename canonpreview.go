@@ -0,0 +1,52 @@
+package exif44
+
+import (
+	"encoding/binary"
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// Support for rewriting JPEG files with Canon maker notes containing a
+// PreviewImageInfo field, as written by the EOS 300D, 10D and other
+// models. The preview image is stored after the end of the JPEG
+// image, outside the Exif segment, and is located by an offset from
+// the TIFF header of the Exif segment.
+
+// Indexes of values in the Canon1 PreviewImageInfo field.
+const (
+	canonPreviewLengthIdx = 2
+	canonPreviewStartIdx  = 5
+)
+
+// Return the PreviewImageInfo field of a Canon1 maker note, or nil if
+// not present.
+func canonPreviewInfo(exif Exif) *tiff.Field {
+	if exif.MakerNote == nil || exif.MakerNote.GetSpace() != tiff.Canon1Space {
+		return nil
+	}
+	info := findField(exif.MakerNote, Canon1PreviewImageInfo)
+	if info == nil || info.Type != tiff.LONG || info.Count <= canonPreviewStartIdx {
+		return nil
+	}
+	return info
+}
+
+// Return the length and offset of a Canon preview image.
+func canonOutsidePreview(exif Exif) (uint32, uint32, bool) {
+	info := canonPreviewInfo(exif)
+	if info == nil {
+		return 0, 0, false
+	}
+	order := exif.MakerNote.Order
+	return info.Long(canonPreviewLengthIdx, order), info.Long(canonPreviewStartIdx, order), true
+}
+
+// Return the positions of the length and offset of a Canon preview
+// image in TIFF data. The Canon1 maker note has no label, and its
+// offsets are relative to the TIFF header.
+func canonPreviewFields(tiffData []byte, order binary.ByteOrder, makerPos uint32) (uint32, uint32, bool) {
+	pos, found := fieldDataPos(tiffData, order, makerPos, Canon1PreviewImageInfo)
+	if !found {
+		return 0, 0, false
+	}
+	return pos + canonPreviewLengthIdx*4, pos + canonPreviewStartIdx*4, true
+}
@@ -0,0 +1,64 @@
+package exif44
+
+import (
+	"bytes"
+	"testing"
+
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// Return TIFF data with a Canon maker note with an empty
+// PreviewImageInfo field, to be set by testSetPreview.
+func testCanonTIFF(t *testing.T) []byte {
+	return testMakerNoteTIFF(t, "Canon", func(pos uint32) []byte {
+		return testRawIFD(pos, []testEntry{
+			{Canon1PreviewImageInfo, tiff.LONG, 6, make([]byte, 24)},
+		})
+	})
+}
+
+func TestCanonPreview(t *testing.T) {
+	preview := testInsertSegment(testJPEG(t, 32, 24), jseg.COM, []byte("preview"))
+	tests := []struct {
+		name    string
+		exif    ReadWriteExif
+		trailer ReadWriteTrailer
+		found   bool // Preview found in the output.
+	}{
+		{"unchanged", nil, nil, true},
+		{"Exif grown", testGrowExif, nil, true},
+		{"trailer callback", testGrowExif, testTrailerFunc(func(b []byte) []byte { return append([]byte("prefix"), b...) }), true},
+		{"trailer removed", testGrowExif, testTrailerFunc(func([]byte) []byte { return nil }), true},
+		{"maker note removed", testExifFunc(func(exif *Exif) { exif.Exif.DeleteFields([]tiff.Tag{MakerNote}) }), nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := testJPEGFile(t, [][]byte{testCanonTIFF(t)}, preview)
+			testSetPreview(t, in, uint32(len(in)-len(preview)), uint32(len(preview)))
+			out, err := testReadWrite(t, in, ReadWriteControl{ReadWriteExif: test.exif, ReadWriteTrailer: test.trailer})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.found {
+				if exif, _ := GetExifTree(testJPEGTIFF(t, out)); canonPreviewInfo(*exif) != nil {
+					t.Error("maker note not removed")
+				}
+				return
+			}
+			data, pos := testGetPreview(t, out)
+			if !bytes.Equal(data, preview) {
+				t.Errorf("preview at %d not found", pos)
+			}
+			if count := bytes.Count(out, []byte("preview")); count != 1 {
+				t.Errorf("%d copies of the preview", count)
+			}
+		})
+	}
+	// A preview that extends past the end of the file.
+	in := testJPEGFile(t, [][]byte{testCanonTIFF(t)}, nil)
+	testSetPreview(t, in, uint32(len(in)), 100)
+	if _, err := testReadWrite(t, in, ReadWriteControl{ReadWriteExif: testGrowExif}); err == nil {
+		t.Error("missing preview not reported")
+	}
+}
@@ -0,0 +1,398 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	tiff "github.com/garyhouston/tiff66"
+	"github.com/hashicorp/go-multierror"
+	"math"
+	"time"
+)
+
+// Support for reading the Camera Image File Format (CIFF), used in
+// the CRW raw files of older Canon cameras. CIFF isn't based on TIFF,
+// so the Exif-equivalent data is copied into a synthesized Exif tree.
+// Record names are from ExifTool 10.63, CanonRaw tags.
+
+// CIFFTag is the type of a record in a CIFF heap. The two most
+// significant bits, which give the location of the data, are not
+// included.
+type CIFFTag uint16
+
+// Bits in a CIFF record type.
+const (
+	ciffLocationMask = 0xC000 // Location of data.
+	ciffInRecord     = 0x4000 // Data is stored in the record itself.
+	ciffTagMask      = 0x3FFF // Data type and index.
+	ciffTypeMask     = 0x3800 // Data type.
+	ciffSubHeap1     = 0x2800 // Data types for sub-heaps.
+	ciffSubHeap2     = 0x3000
+)
+
+// Some of the record types that may be found in CIFF heaps.
+const (
+	CIFFRawMakeModel        = 0x080A
+	CIFFFirmwareVersion     = 0x080B
+	CIFFOwnerName           = 0x0810
+	CIFFImageType           = 0x0815
+	CIFFOriginalFileName    = 0x0816
+	CIFFThumbnailFileName   = 0x0817
+	CIFFFocalLength         = 0x1029
+	CIFFShotInfo            = 0x102A
+	CIFFCameraSettings      = 0x102D
+	CIFFSensorInfo          = 0x1031
+	CIFFCustomFunctions     = 0x1033
+	CIFFAFInfo              = 0x1038
+	CIFFColorBalance        = 0x10A9
+	CIFFColorSpace          = 0x10B4
+	CIFFSerialNumber        = 0x180B
+	CIFFTimeStamp           = 0x180E
+	CIFFImageInfo           = 0x1810
+	CIFFExposureInfo        = 0x1818
+	CIFFFileNumber          = 0x1817
+	CIFFModelID             = 0x1834
+	CIFFSerialNumberFormat  = 0x183B
+	CIFFRawData             = 0x2005
+	CIFFJpgFromRaw          = 0x2007
+	CIFFThumbnailImage      = 0x2008
+	CIFFImageDescription    = 0x2804
+	CIFFCameraObject        = 0x2807
+	CIFFShootingRecord      = 0x3002
+	CIFFMeasuredInfo        = 0x3003
+	CIFFCameraSpecification = 0x3004
+	CIFFImageProps          = 0x300A
+	CIFFExifInformation     = 0x300B
+)
+
+// Mapping from CIFF record types to strings.
+var CIFFTagNames = map[CIFFTag]string{
+	CIFFRawMakeModel:        "RawMakeModel",
+	CIFFFirmwareVersion:     "FirmwareVersion",
+	CIFFOwnerName:           "OwnerName",
+	CIFFImageType:           "ImageType",
+	CIFFOriginalFileName:    "OriginalFileName",
+	CIFFThumbnailFileName:   "ThumbnailFileName",
+	CIFFFocalLength:         "FocalLength",
+	CIFFShotInfo:            "ShotInfo",
+	CIFFCameraSettings:      "CameraSettings",
+	CIFFSensorInfo:          "SensorInfo",
+	CIFFCustomFunctions:     "CustomFunctions",
+	CIFFAFInfo:              "AFInfo",
+	CIFFColorBalance:        "ColorBalance",
+	CIFFColorSpace:          "ColorSpace",
+	CIFFSerialNumber:        "SerialNumber",
+	CIFFTimeStamp:           "TimeStamp",
+	CIFFImageInfo:           "ImageInfo",
+	CIFFExposureInfo:        "ExposureInfo",
+	CIFFFileNumber:          "FileNumber",
+	CIFFModelID:             "ModelID",
+	CIFFSerialNumberFormat:  "SerialNumberFormat",
+	CIFFRawData:             "RawData",
+	CIFFJpgFromRaw:          "JpgFromRaw",
+	CIFFThumbnailImage:      "ThumbnailImage",
+	CIFFImageDescription:    "ImageDescription",
+	CIFFCameraObject:        "CameraObject",
+	CIFFShootingRecord:      "ShootingRecord",
+	CIFFMeasuredInfo:        "MeasuredInfo",
+	CIFFCameraSpecification: "CameraSpecification",
+	CIFFImageProps:          "ImageProps",
+	CIFFExifInformation:     "ExifInformation",
+}
+
+// CIFF records that contain the same arrays of SHORT values as fields
+// in the Canon1 maker note.
+var ciffCanon1Arrays = map[CIFFTag]tiff.Tag{
+	CIFFCameraSettings:  Canon1CameraSettings,
+	CIFFFocalLength:     Canon1FocalLength,
+	CIFFShotInfo:        Canon1ShotInfo,
+	CIFFSensorInfo:      Canon1SensorInfo,
+	CIFFCustomFunctions: Canon1CustomFunctions,
+	CIFFAFInfo:          Canon1AFInfo,
+	CIFFColorBalance:    Canon1ColorBalance,
+	CIFFColorSpace:      Canon1ColorSpace,
+}
+
+// CIFF records that contain a single LONG value, as per fields in the
+// Canon1 maker note.
+var ciffCanon1Longs = map[CIFFTag]tiff.Tag{
+	CIFFSerialNumber:       Canon1SerialNumber,
+	CIFFFileNumber:         Canon1FileNumber,
+	CIFFModelID:            Canon1ModelID,
+	CIFFSerialNumberFormat: Canon1SerialNumberFormat,
+}
+
+// CIFF records that contain strings, as per fields in the Canon1 maker note.
+var ciffCanon1Strings = map[CIFFTag]tiff.Tag{
+	CIFFFirmwareVersion: Canon1FirmwareVersion,
+	CIFFOwnerName:       Canon1OwnerName,
+	CIFFImageType:       Canon1ImageType,
+}
+
+// CIFF header, found at byte 6 of a CRW file following the byte
+// order and header length.
+var ciffHeader = []byte("HEAPCCDR")
+
+// Size of the start of a CRW file that's needed to identify it.
+const CIFFHeaderSize = 14
+
+// Check if a slice starts with a CIFF file header. Returns an
+// indication of validity, the byte order, and the position of the
+// root heap.
+func GetCIFFHeader(buf []byte) (bool, binary.ByteOrder, uint32) {
+	var order binary.ByteOrder
+	if len(buf) < CIFFHeaderSize {
+		return false, order, 0
+	}
+	if buf[0] == 0x49 && buf[1] == 0x49 {
+		order = binary.LittleEndian
+	} else if buf[0] == 0x4d && buf[1] == 0x4d {
+		order = binary.BigEndian
+	} else {
+		return false, order, 0
+	}
+	if bytes.Compare(buf[6:CIFFHeaderSize], ciffHeader) != 0 {
+		return false, order, 0
+	}
+	return true, order, order.Uint32(buf[2:])
+}
+
+// A record in a CIFF heap.
+type CIFFRecord struct {
+	Tag  CIFFTag   // Record type, without the location bits.
+	Data []byte    // Record data, which points into the original buffer.
+	Heap *CIFFHeap // Decoded sub-heap, if the record contains one.
+}
+
+// Decoded CIFF heap, containing records and possibly sub-heaps.
+type CIFFHeap struct {
+	Order   binary.ByteOrder
+	Records []CIFFRecord
+}
+
+// Return the data type bits of a record type.
+func (tag CIFFTag) dataType() uint16 {
+	return uint16(tag) & ciffTypeMask
+}
+
+// Return true if a record type contains a sub-heap.
+func (tag CIFFTag) IsHeap() bool {
+	return tag.dataType() == ciffSubHeap1 || tag.dataType() == ciffSubHeap2
+}
+
+// Decode a CIFF heap, where 'buf' contains exactly the heap data, and
+// recursively decode any sub-heaps. Data will be read if possible
+// even if errors occur, and a multierror structure may be returned.
+func GetCIFFHeap(buf []byte, order binary.ByteOrder) (*CIFFHeap, error) {
+	heap := &CIFFHeap{Order: order}
+	bufsize := uint32(len(buf))
+	if bufsize < 4 {
+		return heap, errors.New("CIFF heap is too small")
+	}
+	tablePos := order.Uint32(buf[bufsize-4:])
+	if tablePos+2 < tablePos || tablePos+2 > bufsize {
+		return heap, fmt.Errorf("CIFF record table at %d is past end of heap", tablePos)
+	}
+	count := uint32(order.Uint16(buf[tablePos:]))
+	pos := tablePos + 2
+	var err error
+	if pos+count*10 > bufsize {
+		count = (bufsize - pos) / 10
+		err = multierror.Append(err, fmt.Errorf("CIFF record table extends past end of heap, attempting to read %d records", count))
+	}
+	heap.Records = make([]CIFFRecord, 0, count)
+	for i := uint32(0); i < count; i++ {
+		typ := order.Uint16(buf[pos:])
+		rec := CIFFRecord{Tag: CIFFTag(typ & ciffTagMask)}
+		switch typ & ciffLocationMask {
+		case 0:
+			size := order.Uint32(buf[pos+2:])
+			offset := order.Uint32(buf[pos+6:])
+			if offset+size < offset || offset+size > tablePos {
+				err = multierror.Append(err, fmt.Errorf("Skipping CIFF record 0x%04X: data at %d past end of heap", rec.Tag, offset))
+				pos += 10
+				continue
+			}
+			rec.Data = buf[offset : offset+size]
+		case ciffInRecord:
+			rec.Data = buf[pos+2 : pos+10]
+		default:
+			err = multierror.Append(err, fmt.Errorf("Skipping CIFF record 0x%04X: invalid location bits", rec.Tag))
+			pos += 10
+			continue
+		}
+		pos += 10
+		if rec.Tag.IsHeap() {
+			if uint32(len(rec.Data)) >= bufsize {
+				err = multierror.Append(err, fmt.Errorf("CIFF sub-heap 0x%04X isn't smaller than its parent", rec.Tag))
+			} else {
+				var heapErr error
+				rec.Heap, heapErr = GetCIFFHeap(rec.Data, order)
+				if heapErr != nil {
+					err = multierror.Append(err, heapErr)
+				}
+			}
+		}
+		heap.Records = append(heap.Records, rec)
+	}
+	return heap, err
+}
+
+// Decode the CIFF heap tree from the full contents of a CRW file.
+func GetCIFFTree(buf []byte) (*CIFFHeap, error) {
+	valid, order, heapPos := GetCIFFHeader(buf)
+	if !valid {
+		return &CIFFHeap{Order: binary.LittleEndian}, errors.New("Invalid CIFF header")
+	}
+	if heapPos > uint32(len(buf)) {
+		return &CIFFHeap{Order: order}, errors.New("CIFF header length is past end of input")
+	}
+	return GetCIFFHeap(buf[heapPos:], order)
+}
+
+// Return the first record with the given type found in a depth-first
+// search of the heap and its sub-heaps, or nil if not found.
+func (heap CIFFHeap) FindRecord(tag CIFFTag) *CIFFRecord {
+	for i := range heap.Records {
+		if heap.Records[i].Tag == tag {
+			return &heap.Records[i]
+		}
+		if heap.Records[i].Heap != nil {
+			if rec := heap.Records[i].Heap.FindRecord(tag); rec != nil {
+				return rec
+			}
+		}
+	}
+	return nil
+}
+
+// Make an ASCII field from a NUL-terminated string in a byte slice.
+func asciiField(tag tiff.Tag, data []byte) tiff.Field {
+	if end := bytes.IndexByte(data, 0); end >= 0 {
+		data = data[:end]
+	}
+	field := tiff.Field{Tag: tag, Type: tiff.ASCII, Count: uint32(len(data) + 1), Data: make([]byte, len(data)+1)}
+	copy(field.Data, data)
+	return field
+}
+
+// Make a RATIONAL or SRATIONAL field with a single value, approximating
+// a floating point number to three decimal places.
+func rationalField(tag tiff.Tag, typ tiff.Type, val float64, order binary.ByteOrder) tiff.Field {
+	field := tiff.Field{Tag: tag, Type: typ, Count: 1, Data: make([]byte, typ.Size())}
+	num, denom := int64(math.Floor(val*1000+0.5)), int64(1000)
+	if tag == ExposureTime && val > 0 && val < 1 {
+		// Represent exposure times such as 1/250 exactly.
+		num = 1
+		denom = int64(math.Floor(1/val + 0.5))
+	}
+	// tiff66's PutAnyRational can't be used, it always panics.
+	if typ == tiff.SRATIONAL {
+		field.PutSRational(int32(num), int32(denom), 0, order)
+	} else {
+		field.PutRational(uint32(num), uint32(denom), 0, order)
+	}
+	return field
+}
+
+// Make a field with a single integer value.
+func integerField(tag tiff.Tag, typ tiff.Type, val int64, order binary.ByteOrder) tiff.Field {
+	field := tiff.Field{Tag: tag, Type: typ, Count: 1, Data: make([]byte, typ.Size())}
+	field.PutAnyInteger(val, 0, order)
+	return field
+}
+
+// Create an Exif tree from the records in a CIFF heap tree, containing
+// the camera make and model, capture time, exposure details and image
+// dimensions. Canon-specific records are placed in a Canon1 maker note
+// and any thumbnail image becomes the next IFD after IFD0. The tree is
+// serialized and decoded again, so that it's consistent with trees
+// read from TIFF data.
+func (heap CIFFHeap) MakeExif() (*Exif, error) {
+	order := heap.Order
+	var tiffFields, exifFields, makerFields []tiff.Field
+	if rec := heap.FindRecord(CIFFRawMakeModel); rec != nil {
+		parts := bytes.SplitN(rec.Data, []byte{0}, 3)
+		tiffFields = append(tiffFields, asciiField(tiff.Make, parts[0]))
+		if len(parts) > 1 {
+			tiffFields = append(tiffFields, asciiField(tiff.Model, parts[1]))
+		}
+	}
+	if rec := heap.FindRecord(CIFFTimeStamp); rec != nil && len(rec.Data) >= 4 {
+		// Seconds since 1970, in local time.
+		date := time.Unix(int64(order.Uint32(rec.Data)), 0).UTC().Format("2006:01:02 15:04:05")
+		tiffFields = append(tiffFields, asciiField(tiff.DateTime, []byte(date)))
+		exifFields = append(exifFields, asciiField(DateTimeOriginal, []byte(date)))
+	}
+	if rec := heap.FindRecord(CIFFImageInfo); rec != nil && len(rec.Data) >= 8 {
+		exifFields = append(exifFields, integerField(PixelXDimension, tiff.LONG, int64(order.Uint32(rec.Data)), order))
+		exifFields = append(exifFields, integerField(PixelYDimension, tiff.LONG, int64(order.Uint32(rec.Data[4:])), order))
+	}
+	if rec := heap.FindRecord(CIFFExposureInfo); rec != nil && len(rec.Data) >= 12 {
+		bias := float64(math.Float32frombits(order.Uint32(rec.Data)))
+		tv := float64(math.Float32frombits(order.Uint32(rec.Data[4:])))
+		av := float64(math.Float32frombits(order.Uint32(rec.Data[8:])))
+		exifFields = append(exifFields, rationalField(ExposureTime, tiff.RATIONAL, math.Pow(2, -tv), order))
+		exifFields = append(exifFields, rationalField(FNumber, tiff.RATIONAL, math.Pow(2, av/2), order))
+		exifFields = append(exifFields, rationalField(ShutterSpeedValue, tiff.SRATIONAL, tv, order))
+		exifFields = append(exifFields, rationalField(ApertureValue, tiff.RATIONAL, av, order))
+		exifFields = append(exifFields, rationalField(ExposureBiasValue, tiff.SRATIONAL, bias, order))
+	}
+	if rec := heap.FindRecord(CIFFFocalLength); rec != nil && len(rec.Data) >= 4 {
+		exifFields = append(exifFields, rationalField(FocalLength, tiff.RATIONAL, float64(order.Uint16(rec.Data[2:])), order))
+	}
+	for ciffTag, tag := range ciffCanon1Arrays {
+		if rec := heap.FindRecord(ciffTag); rec != nil && len(rec.Data) >= 2 {
+			count := uint32(len(rec.Data) / 2)
+			makerFields = append(makerFields, tiff.Field{Tag: tag, Type: tiff.SHORT, Count: count, Data: rec.Data[:count*2]})
+		}
+	}
+	for ciffTag, tag := range ciffCanon1Longs {
+		if rec := heap.FindRecord(ciffTag); rec != nil && len(rec.Data) >= 4 {
+			makerFields = append(makerFields, integerField(tag, tiff.LONG, int64(order.Uint32(rec.Data)), order))
+		}
+	}
+	for ciffTag, tag := range ciffCanon1Strings {
+		if rec := heap.FindRecord(ciffTag); rec != nil {
+			makerFields = append(makerFields, asciiField(tag, rec.Data))
+		}
+	}
+
+	root := tiff.NewIFDNode(tiff.TIFFSpace)
+	root.Order = order
+	root.AddFields(tiffFields)
+	exif := Exif{TIFF: root}
+	addExifIFD(&exif)
+	exif.Exif.AddFields(exifFields)
+	if len(makerFields) > 0 {
+		maker := tiff.NewIFDNode(tiff.Canon1Space)
+		maker.Order = order
+		maker.AddFields(makerFields)
+		// Count and data will be set when the tree is serialized.
+		exif.Exif.AddFields([]tiff.Field{{Tag: MakerNote, Type: tiff.UNDEFINED}})
+		exif.Exif.SubIFDs = append(exif.Exif.SubIFDs, tiff.SubIFD{Tag: MakerNote, Node: maker})
+	}
+	var thumb []byte
+	if rec := heap.FindRecord(CIFFThumbnailImage); rec != nil && len(rec.Data) > 0 {
+		thumb = rec.Data
+		ifd1 := tiff.NewIFDNode(tiff.TIFFSpace)
+		ifd1.Order = order
+		// Thumbnail offset will be set below.
+		ifd1.AddFields([]tiff.Field{
+			integerField(tiff.Compression, tiff.SHORT, 6, order),
+			integerField(tiff.JPEGInterchangeFormat, tiff.LONG, 0, order),
+			integerField(tiff.JPEGInterchangeFormatLength, tiff.LONG, int64(len(thumb)), order)})
+		root.Next = ifd1
+	}
+	size := exif.TreeSize()
+	if thumb != nil {
+		root.Next.FindFields([]tiff.Tag{tiff.JPEGInterchangeFormat})[0].PutLong(size, 0, order)
+	}
+	buf := make([]byte, size+uint32(len(thumb)))
+	if _, err := exif.Put(buf); err != nil {
+		return nil, err
+	}
+	copy(buf[size:], thumb)
+	return GetExifTree(buf)
+}
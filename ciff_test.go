@@ -0,0 +1,274 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// A record for testCIFFHeap.
+type testCIFFRecord struct {
+	tag      CIFFTag
+	data     []byte
+	inRecord bool // Data of up to 8 bytes is stored in the record.
+}
+
+// Return a little-endian CIFF heap with the given records.
+func testCIFFHeap(records []testCIFFRecord) []byte {
+	order := binary.LittleEndian
+	var buf []byte
+	table := make([]byte, 2+10*len(records))
+	order.PutUint16(table, uint16(len(records)))
+	for i, rec := range records {
+		entry := table[2+i*10:]
+		if rec.inRecord {
+			order.PutUint16(entry, uint16(rec.tag)|ciffInRecord)
+			copy(entry[2:10], rec.data)
+			continue
+		}
+		order.PutUint16(entry, uint16(rec.tag))
+		order.PutUint32(entry[2:], uint32(len(rec.data)))
+		order.PutUint32(entry[6:], uint32(len(buf)))
+		buf = append(buf, rec.data...)
+	}
+	tablePos := uint32(len(buf))
+	buf = append(buf, table...)
+	return append(buf, byte(tablePos), byte(tablePos>>8), byte(tablePos>>16), byte(tablePos>>24))
+}
+
+// Return a CRW file with a root heap.
+func testCRW(heap []byte) []byte {
+	buf := []byte("II\016\000\000\000HEAPCCDR")
+	return append(buf, heap...)
+}
+
+// Return the data of a FLOAT value.
+func testFloat(val float32) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, math.Float32bits(val))
+	return buf
+}
+
+// Return a CIFF heap with records for each supported Exif field, in
+// a sub-heap as in camera files.
+func testCIFFRecords(t *testing.T) []byte {
+	order := binary.LittleEndian
+	imageInfo := make([]byte, 8)
+	order.PutUint32(imageInfo, 640)
+	order.PutUint32(imageInfo[4:], 480)
+	exposure := append(append(testFloat(-1), testFloat(8)...), testFloat(4)...)
+	props := testCIFFHeap([]testCIFFRecord{
+		{CIFFRawMakeModel, []byte("Canon\000Canon PowerShot G1\000"), false},
+		{CIFFTimeStamp, []byte{0, 0, 0, 0x40, 0, 0, 0, 0}, true},
+		{CIFFImageInfo, imageInfo, false},
+		{CIFFExposureInfo, exposure, false},
+		{CIFFFocalLength, []byte{0, 0, 35, 0}, true},
+		{CIFFSerialNumber, []byte{1, 2, 3, 4}, true},
+		{CIFFOwnerName, []byte("Owner\000"), true},
+		{CIFFCameraSettings, make([]byte, 10), false},
+	})
+	return testCIFFHeap([]testCIFFRecord{
+		{CIFFImageProps, props, false},
+		{CIFFThumbnailImage, testJPEG(t, 16, 16), false},
+	})
+}
+
+func TestGetCIFFTree(t *testing.T) {
+	valid := testCIFFRecords(t)
+	// Record table count larger than the table.
+	truncated := testCIFFHeap([]testCIFFRecord{{CIFFOwnerName, []byte("Owner"), false}})
+	truncated[5] = 10
+	tests := []struct {
+		name    string
+		file    []byte
+		records int // Records in the root heap.
+		fail    bool
+	}{
+		{"valid", testCRW(valid), 2, false},
+		{"empty", testCRW(testCIFFHeap(nil)), 0, false},
+		{"invalid header", append([]byte("XX"), testCRW(valid)[2:]...), 0, true},
+		{"heap past end", []byte("II\377\000\000\000HEAPCCDR"), 0, true},
+		{"table past end", testCRW([]byte{0, 0, 0, 1}), 0, true},
+		{"table truncated", testCRW(truncated), 1, true},
+		{"data past end", testCRW(testCIFFHeap([]testCIFFRecord{{CIFFOwnerName, []byte("Owner"), false}})[:5]), 0, true},
+		{"record past end", testCRW([]byte{1, 0, 0x10, 0x08, 5, 0, 0, 0, 100, 0, 0, 0, 0, 0, 0, 0}), 0, true},
+		{"invalid location", testCRW(testCIFFHeap([]testCIFFRecord{{CIFFOwnerName | 0x8000, nil, false}})), 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			heap, err := GetCIFFTree(test.file)
+			if (err != nil) != test.fail {
+				t.Errorf("error %v", err)
+			}
+			if heap == nil {
+				t.Fatal("nil heap")
+			}
+			if len(heap.Records) != test.records {
+				t.Errorf("%d records, expected %d", len(heap.Records), test.records)
+			}
+		})
+	}
+}
+
+func TestCIFFMakeExif(t *testing.T) {
+	heap, err := GetCIFFTree(testCRW(testCIFFRecords(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := heap.FindRecord(CIFFOwnerName); rec == nil || rec.Heap != nil {
+		t.Fatal("record in sub-heap not found")
+	}
+	exif, err := heap.MakeExif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := exif.TIFF.Order
+	ascii := func(node *tiff.IFDNode, tag tiff.Tag) string {
+		if node == nil {
+			return ""
+		}
+		if fields := node.FindFields([]tiff.Tag{tag}); len(fields) > 0 {
+			return fields[0].ASCII()
+		}
+		return ""
+	}
+	integer := func(node *tiff.IFDNode, tag tiff.Tag) int64 {
+		if fields := node.FindFields([]tiff.Tag{tag}); len(fields) > 0 {
+			return fields[0].AnyInteger(0, order)
+		}
+		return -1
+	}
+	rational := func(tag tiff.Tag) float64 {
+		if fields := exif.Exif.FindFields([]tiff.Tag{tag}); len(fields) > 0 {
+			if fields[0].Type == tiff.SRATIONAL {
+				num, denom := fields[0].SRational(0, order)
+				return float64(num) / float64(denom)
+			}
+			num, denom := fields[0].Rational(0, order)
+			return float64(num) / float64(denom)
+		}
+		return math.NaN()
+	}
+	strings := []struct {
+		node *tiff.IFDNode
+		tag  tiff.Tag
+		want string
+	}{
+		{exif.TIFF, tiff.Make, "Canon"},
+		{exif.TIFF, tiff.Model, "Canon PowerShot G1"},
+		{exif.TIFF, tiff.DateTime, "2004:01:10 13:37:04"},
+		{exif.Exif, DateTimeOriginal, "2004:01:10 13:37:04"},
+		{exif.MakerNote, Canon1OwnerName, "Owner"},
+	}
+	for _, s := range strings {
+		if got := ascii(s.node, s.tag); got != s.want {
+			t.Errorf("tag 0x%04X is %q, expected %q", s.tag, got, s.want)
+		}
+	}
+	if x, y := integer(exif.Exif, PixelXDimension), integer(exif.Exif, PixelYDimension); x != 640 || y != 480 {
+		t.Errorf("dimensions %dx%d", x, y)
+	}
+	if exif.MakerNote == nil || exif.MakerNote.GetSpace() != tiff.Canon1Space {
+		t.Fatal("Canon maker note not created")
+	}
+	if serial := integer(exif.MakerNote, Canon1SerialNumber); serial != 0x04030201 {
+		t.Errorf("serial number 0x%X", serial)
+	}
+	rationals := []struct {
+		tag  tiff.Tag
+		want float64
+	}{
+		{ExposureTime, 1.0 / 256},
+		{FNumber, 4},
+		{ShutterSpeedValue, 8},
+		{ApertureValue, 4},
+		{ExposureBiasValue, -1},
+		{FocalLength, 35},
+	}
+	for _, r := range rationals {
+		if got := rational(r.tag); got != r.want {
+			t.Errorf("tag 0x%04X is %v, expected %v", r.tag, got, r.want)
+		}
+	}
+	if thumbnail, found := exif.Thumbnail(); !found || !bytes.Equal(thumbnail, testJPEG(t, 16, 16)) {
+		t.Error("thumbnail not found")
+	}
+	// Fractional APEX values, from the bias, Tv and Av floats.
+	fractions := []struct {
+		name         string
+		bias, tv, av float32
+		want         map[tiff.Tag]float64
+	}{
+		{"positive", 0.67, 8.5, 0.97, map[tiff.Tag]float64{ExposureTime: 1.0 / 362, FNumber: 1.4, ShutterSpeedValue: 8.5, ApertureValue: 0.97, ExposureBiasValue: 0.67}},
+		{"negative", -0.58, -1, 5, map[tiff.Tag]float64{ExposureTime: 2, FNumber: 5.657, ShutterSpeedValue: -1, ApertureValue: 5, ExposureBiasValue: -0.58}},
+	}
+	for _, f := range fractions {
+		t.Run(f.name, func(t *testing.T) {
+			exposure := append(append(testFloat(f.bias), testFloat(f.tv)...), testFloat(f.av)...)
+			heap, err := GetCIFFTree(testCRW(testCIFFHeap([]testCIFFRecord{{CIFFExposureInfo, exposure, false}})))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exif, err = heap.MakeExif(); err != nil {
+				t.Fatal(err)
+			}
+			for tag, want := range f.want {
+				if got := rational(tag); math.Abs(got-want) > 0.0005 {
+					t.Errorf("tag 0x%04X is %v, expected %v", tag, got, want)
+				}
+			}
+		})
+	}
+}
+
+// ReadExif callback that calls a function on each tree.
+type testReadExifFunc func(Exif, error)
+
+func (f testReadExifFunc) ReadExif(format FileFormat, imageIdx uint32, exif Exif, err error) error {
+	f(exif, err)
+	return nil
+}
+
+func TestReadCRW(t *testing.T) {
+	tests := []struct {
+		name string
+		file []byte
+		fail bool // Decoding error passed to the callback.
+	}{
+		{"valid", testCRW(testCIFFRecords(t)), false},
+		{"truncated", testCRW(testCIFFRecords(t)[:100]), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			callback := testReadExifFunc(func(exif Exif, err error) {
+				calls++
+				if (err != nil) != test.fail {
+					t.Errorf("error %v", err)
+				}
+			})
+			if err := Read(bytes.NewReader(test.file), ReadControl{ReadExif: callback}); err != nil {
+				t.Fatal(err)
+			}
+			if calls != 1 {
+				t.Errorf("%d calls of the Exif callback", calls)
+			}
+			// The image info callback is made without an Exif
+			// callback.
+			var infos testImageInfoRecorder
+			if err := Read(bytes.NewReader(test.file), ReadControl{ReadImageInfo: &infos}); err != nil {
+				t.Fatal(err)
+			}
+			if len(infos) != 1 || infos[0].Format != FileCRW {
+				t.Errorf("image info %+v", infos)
+			}
+			var out WriteBuffer
+			if err := ReadWrite(bytes.NewReader(test.file), &out, ReadWriteControl{}); err == nil {
+				t.Error("CRW file written")
+			}
+		})
+	}
+}
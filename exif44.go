@@ -5,7 +5,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	jseg "github.com/garyhouston/jpegsegs"
 	tiff "github.com/garyhouston/tiff66"
+	"strings"
 )
 
 // Tags in the Exif IFD.
@@ -25,6 +27,9 @@ const (
 	ExifVersion               = 0x9000
 	DateTimeOriginal          = 0x9003
 	DateTimeDigitized         = 0x9004
+	OffsetTime                = 0x9010
+	OffsetTimeOriginal        = 0x9011
+	OffsetTimeDigitized       = 0x9012
 	ComponentsConfiguration   = 0x9101
 	CompressedBitsPerPixel    = 0x9102
 	ShutterSpeedValue         = 0x9201
@@ -80,6 +85,7 @@ const (
 	LensModel                 = 0xA434
 	LensSerialNumber          = 0xA435
 	Gamma                     = 0xA500
+	OffsetSchema              = 0xEA1D // Microsoft extension.
 )
 
 // Mapping from Exif tags to strings.
@@ -99,6 +105,9 @@ var ExifTagNames = map[tiff.Tag]string{
 	ExifVersion:               "ExifVersion",
 	DateTimeOriginal:          "DateTimeOriginal",
 	DateTimeDigitized:         "DateTimeDigitized",
+	OffsetTime:                "OffsetTime",
+	OffsetTimeOriginal:        "OffsetTimeOriginal",
+	OffsetTimeDigitized:       "OffsetTimeDigitized",
 	ComponentsConfiguration:   "ComponentsConfiguration",
 	CompressedBitsPerPixel:    "CompressedBitsPerPixel",
 	ShutterSpeedValue:         "ShutterSpeedValue",
@@ -154,6 +163,7 @@ var ExifTagNames = map[tiff.Tag]string{
 	LensModel:                 "LensModel",
 	LensSerialNumber:          "LensSerialNumber",
 	Gamma:                     "Gamma",
+	OffsetSchema:              "OffsetSchema",
 }
 
 // Tags in the Interoperability IFD, from "Design rule for Camera File
@@ -290,6 +300,10 @@ func TagNameMap(space tiff.TagSpace) map[tiff.Tag]string {
 		names = Nikon2ScanIFDTagNames
 	case tiff.Sony1Space:
 		names = Sony1TagNames
+	case tiff.MPFIndexSpace:
+		names = jseg.MPFIndexTagNames
+	case tiff.MPFAttributeSpace:
+		names = jseg.MPFAttributeTagNames
 	}
 	return names
 }
@@ -415,13 +429,27 @@ func (exif Exif) CheckMakerNote() error {
 			if len(maker) < 9 && bytes.Compare(maker[0:4], []byte("MKEM")) == 0 {
 				return nil
 			}
-			// Unsupported maker note, return an error.
+			// Unsupported maker note, return an error,
+			// identifying it if possible.
 			plen := len(maker)
 			cont := ""
 			if plen > 15 {
 				plen = 15
 				cont = "..."
 			}
+			var info MakerNoteInfo
+			identifyUndecoded(&info, exif, maker)
+			desc := strings.TrimSpace(info.Vendor + " " + info.Format)
+			switch info.Base {
+			case MakerNoteBaseUnknown:
+			case MakerNoteBaseNone:
+				desc += ", no known offsets"
+			default:
+				desc += ", offsets relative to " + MakerNoteBaseNames[info.Base]
+			}
+			if desc != "" {
+				cont += " (" + desc + ")"
+			}
 			return errors.New(fmt.Sprintf("Unsupported maker note: %q%s", maker[0:plen], cont))
 		}
 	}
@@ -431,20 +459,47 @@ func (exif Exif) CheckMakerNote() error {
 // Return an error if an Exif tree contains a maker note that requires
 // special processing (i.e., library functionality to get and put the
 // Exif tree won't process it correctly.) This is for applications
-// that don't bother to handle these cases.
+// that don't bother to handle these cases. ReadWrite doesn't report
+// maker note previews stored outside the Exif data of the first image
+// of a JPEG file, since it relocates them itself.
 func (exif Exif) MakerNoteComplexities() error {
+	return exif.makerNoteComplexities(false)
+}
+
+// As per MakerNoteComplexities, but if relocatePreview is true, a
+// Canon or Sony preview stored outside the Exif data isn't reported.
+func (exif Exif) makerNoteComplexities(relocatePreview bool) error {
 	if exif.MakerNote != nil {
 		if exif.MakerNote.GetSpace() == tiff.Canon1Space {
 			// Preview images in Canon EOS 300D maker notes
 			// are stored outside the Exif JPEG segment.
 			fields := exif.MakerNote.FindFields([]tiff.Tag{Canon1PreviewImageInfo})
-			if len(fields) > 0 {
+			if len(fields) > 0 && !(relocatePreview && canonPreviewInfo(exif) != nil) {
 				return errors.New(fmt.Sprintf("Unsupported PreviewImageInfo field in Canon maker note"))
 			}
 		} else if exif.MakerNote.GetSpace() == tiff.Sony1Space {
-			// Various preview image / subifd / sub array fields not supported.
-			return errors.New(fmt.Sprintf("Sony1 maker note not supported well enough for writing"))
+			// Large preview images are stored outside the
+			// Exif JPEG segment. The enciphered blocks and
+			// other arrays don't contain offsets and are
+			// copied unchanged, but the DSLR-A100 has a
+			// pointer to a Minolta maker note, which isn't
+			// decoded.
+			if !relocatePreview && sonyPreviewImage(exif) != nil {
+				return errors.New(fmt.Sprintf("Unsupported PreviewImage field in Sony maker note: data is outside the Exif segment"))
+			}
+			if sonyMinoltaPointer(exif) {
+				return errors.New(fmt.Sprintf("Unsupported MinoltaMakerNote field in Sony maker note"))
+			}
 		}
 	}
 	return nil
 }
+
+// Check if a Sony1 maker note has a pointer to a Minolta maker note.
+func sonyMinoltaPointer(exif Exif) bool {
+	if exif.MakerNote == nil || exif.MakerNote.GetSpace() != tiff.Sony1Space {
+		return false
+	}
+	minolta := findField(exif.MakerNote, Sony1MinoltaMakerNote)
+	return minolta != nil && minolta.Count > 0 && minolta.Type.IsIntegral() && minolta.AnyInteger(0, exif.MakerNote.Order) != 0
+}
@@ -85,11 +85,25 @@ func putGPS(lat, long float64, root *tiff.IFDNode) {
 // Exif handlers.
 type handlerData struct {
 	latitude, longitude float64
+	primary             bool // Whether the current image is a primary image.
 }
 
-func (opts handlerData) ReadWriteExif(format exif.FileFormat, imageIdx uint32, xif *exif.Exif, err error) error {
-	// Add GPS info to the first image only.
-	if imageIdx == 0 {
+func (opts *handlerData) ReadImageInfo(info exif.ImageInfo) error {
+	if info.Format == exif.FileTIFF {
+		// Raw formats such as DNG and NEF mark IFD0 as a
+		// reduced-resolution image, but it carries the Exif
+		// IFD for the whole file.
+		opts.primary = info.ImageIdx == 0
+	} else {
+		opts.primary = info.Primary()
+	}
+	return nil
+}
+
+func (opts *handlerData) ReadWriteExif(format exif.FileFormat, imageIdx uint32, xif *exif.Exif, err error) error {
+	// Add GPS info to primary images only, not to thumbnails or
+	// other views.
+	if opts.primary {
 		putGPS(opts.latitude, opts.longitude, xif.TIFF)
 	}
 	if err != nil {
@@ -98,9 +112,9 @@ func (opts handlerData) ReadWriteExif(format exif.FileFormat, imageIdx uint32, x
 	return nil
 }
 
-func (handlerData) ExifRequired(format exif.FileFormat, imageIdx uint32) bool {
-	// Require an Exif block in the first image.
-	return imageIdx == 0
+func (opts *handlerData) ExifRequired(format exif.FileFormat, imageIdx uint32) bool {
+	// Require an Exif block in primary images.
+	return opts.primary
 }
 
 func usage() {
@@ -135,7 +149,8 @@ func main() {
 	}
 
 	var control exif.ReadWriteControl
-	handlerData := handlerData{latitude: lat, longitude: long}
+	handlerData := &handlerData{latitude: lat, longitude: long}
+	control.ReadImageInfo = handlerData
 	control.ReadWriteExif = handlerData
 	control.ExifRequired = handlerData
 	if err := exif.ReadWriteFile(in, out, control); err != nil {
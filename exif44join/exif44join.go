@@ -0,0 +1,73 @@
+package main
+
+// Join JPEG files into a Multi-Picture Format (MPO) file.
+
+import (
+	"flag"
+	"fmt"
+	exif "github.com/garyhouston/exif44"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// MP types for the -t option, for images other than a baseline
+// primary image.
+var types = map[string]uint32{
+	"thumbnail":  exif.MPTypeLargeThumbnailVGA,
+	"disparity":  exif.MPTypeDisparity,
+	"panorama":   exif.MPTypePanorama,
+	"multiangle": exif.MPTypeMultiAngle,
+}
+
+// Return the MP entries for a set of images. For thumbnails, the
+// first image is a baseline primary image with the others as its
+// dependents. Otherwise all the images are multi-frame images of the
+// same type, with the first as the representative image.
+func entries(mpType uint32, count int) []exif.MPEntry {
+	entries := make([]exif.MPEntry, count)
+	for i := range entries {
+		entries[i].Attribute = mpType
+	}
+	if mpType == exif.MPTypeLargeThumbnailVGA {
+		entries[0].Attribute = exif.MPRepresentative | exif.MPDependentParent | exif.MPTypeBaselinePrimary
+		entries[0].Dependent1 = 2
+		if count > 2 {
+			entries[0].Dependent2 = 3
+		}
+		for i := 1; i < count; i++ {
+			entries[i].Attribute |= exif.MPDependentChild
+		}
+	} else {
+		entries[0].Attribute |= exif.MPRepresentative
+	}
+	return entries
+}
+
+func main() {
+	var typeName string
+	flag.StringVar(&typeName, "t", "thumbnail", "type of the images: thumbnail, disparity, panorama or multiangle")
+	flag.Parse()
+	mpType, found := types[typeName]
+	if !found || flag.NArg() < 3 {
+		fmt.Printf("Usage: %s [-t type] outfile primary image...\nThe type is thumbnail (the default) for a primary image and large\nthumbnails, or disparity (e.g., stereo left and right), panorama or\nmultiangle for a set of multi-frame images.\n", os.Args[0])
+		return
+	}
+	files := flag.Args()[1:]
+	images := make([]exif.MPFImage, len(files))
+	for i, entry := range entries(mpType, len(files)) {
+		data, err := ioutil.ReadFile(files[i])
+		if err != nil {
+			log.Fatal(err)
+		}
+		images[i] = exif.MPFImage{Entry: entry, Data: data}
+	}
+	writer, err := os.Create(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer writer.Close()
+	if err := exif.JoinMPF(writer, images); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+// Report, extract or remove the video in a Motion Photo.
+
+import (
+	"flag"
+	"fmt"
+	exif "github.com/garyhouston/exif44"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Locate the video in a Motion Photo file, exiting if there's none.
+func find(file string) (exif.MotionPhoto, []byte) {
+	reader, err := os.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer reader.Close()
+	mp, trailer, err := exif.ReadMotionPhoto(reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if mp.Format == exif.MotionPhotoNone {
+		log.Fatal("No Motion Photo video found in ", file)
+	}
+	return mp, trailer
+}
+
+// Handlers for removing the video.
+type strip struct {
+	meta *exif.XMPMeta
+}
+
+func (s *strip) ReadWriteXMP(format exif.FileFormat, imageIdx uint32, xmp *exif.XMP, err error) error {
+	if imageIdx != 0 || xmp.Packet == nil {
+		return nil
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	// The original properties are kept for locating the video in
+	// the trailer, and removed from a second copy for the output.
+	var metaErr error
+	if s.meta, metaErr = xmp.Meta(); metaErr != nil {
+		fmt.Fprintln(os.Stderr, metaErr)
+	}
+	meta, _ := xmp.Meta()
+	if exif.StripMotionPhotoXMP(meta) {
+		xmp.SetMeta(meta)
+	}
+	return nil
+}
+
+func (s *strip) ReadWriteTrailer(format exif.FileFormat, trailer []byte) ([]byte, error) {
+	mp, err := exif.FindMotionPhoto(s.meta, trailer)
+	if err != nil {
+		return nil, err
+	}
+	if mp.Format == exif.MotionPhotoNone {
+		fmt.Fprintln(os.Stderr, "No Motion Photo video found")
+	}
+	return exif.StripMotionPhoto(mp, trailer)
+}
+
+func usage() {
+	fmt.Printf("Usage: %s file\n       %s -x video file\n       %s -s file outfile\nThe first form reports the position of the video in a Motion Photo.\nThe second extracts the video to a file.\nThe third writes a copy of the file without the video.\n", os.Args[0], os.Args[0], os.Args[0])
+}
+
+func main() {
+	var extract string
+	var stripVideo bool
+	flag.StringVar(&extract, "x", "", "extract the video to a file")
+	flag.BoolVar(&stripVideo, "s", false, "remove the video")
+	flag.Parse()
+	switch {
+	case extract != "" && !stripVideo && flag.NArg() == 1:
+		mp, trailer := find(flag.Arg(0))
+		if err := ioutil.WriteFile(extract, mp.Video(trailer), 0666); err != nil {
+			log.Fatal(err)
+		}
+	case stripVideo && extract == "" && flag.NArg() == 2:
+		var control exif.ReadWriteControl
+		handler := &strip{}
+		control.ReadWriteXMP = handler
+		control.ReadWriteTrailer = handler
+		if err := exif.ReadWriteFile(flag.Arg(0), flag.Arg(1), control); err != nil {
+			log.Fatal(err)
+		}
+	case extract == "" && !stripVideo && flag.NArg() == 1:
+		mp, _ := find(flag.Arg(0))
+		fmt.Printf("%s: video at offset %d, length %d\n", exif.MotionPhotoFormatNames[mp.Format], mp.TrailerOffset+mp.Offset, mp.Length)
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+// List the preview images embedded in the Exif data of a JPEG or TIFF
+// file, or extract the largest.
+
+import (
+	"flag"
+	"fmt"
+	exif "github.com/garyhouston/exif44"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Return the index of the largest preview with data, or -1 if none.
+func largest(previews []exif.Preview) int {
+	best := -1
+	for i, preview := range previews {
+		if preview.Data == nil {
+			continue
+		}
+		if best < 0 || preview.Width*preview.Height > previews[best].Width*previews[best].Height || preview.Width*preview.Height == previews[best].Width*previews[best].Height && len(preview.Data) > len(previews[best].Data) {
+			best = i
+		}
+	}
+	return best
+}
+
+func usage() {
+	fmt.Printf("Usage: %s file\n       %s -x preview file\nThe first form lists the preview images in the file.\nThe second extracts the largest to a file.\n", os.Args[0], os.Args[0])
+}
+
+func main() {
+	var extract string
+	flag.StringVar(&extract, "x", "", "extract the largest preview to a file")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		return
+	}
+	reader, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer reader.Close()
+	previews, err := exif.ReadPreviews(reader)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if extract == "" {
+		for _, preview := range previews {
+			fmt.Printf("%s: %dx%d, offset %d, length %d", exif.PreviewSourceNames[preview.Source], preview.Width, preview.Height, preview.Offset, preview.Length)
+			if preview.Data == nil {
+				fmt.Print(", not found")
+			}
+			fmt.Println()
+		}
+		return
+	}
+	best := largest(previews)
+	if best < 0 {
+		log.Fatal("No preview found in ", flag.Arg(0))
+	}
+	if err := ioutil.WriteFile(extract, previews[best].Data, 0666); err != nil {
+		log.Fatal(err)
+	}
+}
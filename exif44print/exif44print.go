@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/binary"
 	"flag"
 	"fmt"
 	exif "github.com/garyhouston/exif44"
@@ -11,9 +12,19 @@ import (
 
 // Recursively print an IFD node, its subIFDs, and next IFD.
 func printTree(format exif.FileFormat, node *tiff.IFDNode, maxLen uint32) {
+	printIFD(node, node.GetSpace(), maxLen)
+	for i := 0; i < len(node.SubIFDs); i++ {
+		printTree(format, node.SubIFDs[i].Node, maxLen)
+	}
+	if format != exif.FileTIFF && node.Next != nil {
+		printTree(format, node.Next, maxLen)
+	}
+}
+
+// Print the fields of an IFD node in a given space.
+func printIFD(node *tiff.IFDNode, space tiff.TagSpace, maxLen uint32) {
 	fmt.Println()
 	fields := node.Fields
-	space := node.GetSpace()
 	fmt.Printf("%s IFD with %d ", space.Name(), len(fields))
 	if len(fields) != 1 {
 		fmt.Println("entries:")
@@ -25,11 +36,56 @@ func printTree(format exif.FileFormat, node *tiff.IFDNode, maxLen uint32) {
 	for i := 0; i < len(fields); i++ {
 		fields[i].Print(order, names, maxLen)
 	}
-	for i := 0; i < len(node.SubIFDs); i++ {
-		printTree(format, node.SubIFDs[i].Node, maxLen)
+}
+
+// Print the identification of the maker note in an Exif tree, if any.
+func printMakerNoteInfo(xif exif.Exif) {
+	info, found := xif.IdentifyMakerNote()
+	if !found {
+		return
 	}
-	if format == exif.FileJPEG && node.Next != nil {
-		printTree(format, node.Next, maxLen)
+	fmt.Println()
+	vendor := info.Vendor
+	if vendor == "" {
+		vendor = "unknown vendor"
+	}
+	format := info.Format
+	if format == "" {
+		format = "unidentified"
+	}
+	fmt.Printf("Maker note: %s, %s format", vendor, format)
+	if info.IFD {
+		order := "unknown"
+		switch info.Order {
+		case binary.BigEndian:
+			order = "big-endian"
+		case binary.LittleEndian:
+			order = "little-endian"
+		}
+		fmt.Printf(", %s IFD", order)
+	}
+	switch info.Base {
+	case exif.MakerNoteBaseNone:
+		fmt.Println(", no known offsets")
+	case exif.MakerNoteBaseUnknown:
+		fmt.Println(", unknown offset base")
+	default:
+		fmt.Printf(", offsets relative to %s\n", exif.MakerNoteBaseNames[info.Base])
+	}
+	if info.Space != 0 {
+		fmt.Print("Decoded")
+	} else {
+		fmt.Print("Not decoded")
+	}
+	if info.Relocatable {
+		fmt.Print(", relocatable")
+	} else {
+		fmt.Print(", not relocatable")
+	}
+	if info.Writable {
+		fmt.Println(", writable")
+	} else {
+		fmt.Println(", not writable:", info.Problem)
 	}
 }
 
@@ -44,14 +100,54 @@ func (readExif readExif) ReadExif(format exif.FileFormat, imageIdx uint32, exif
 		fmt.Println("== Processing Image ", imageIdx+1, "==")
 	}
 	printTree(format, exif.TIFF, readExif.maxLen)
+	printMakerNoteInfo(exif)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return nil
+}
+
+// RAF handler.
+func (readExif readExif) ReadRAF(header exif.RAFHeader, records []exif.RAFRecord, err error) error {
+	fmt.Println()
+	fmt.Printf("RAF directory for %s with %d records:\n", header.Camera, len(records))
+	for _, rec := range records {
+		name, found := exif.RAFTagNames[rec.Tag]
+		if !found {
+			name = fmt.Sprintf("0x%04X", rec.Tag)
+		}
+		fmt.Printf("%s (%d bytes)\n", name, len(rec.Data))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return nil
+}
+
+// MPF handler.
+func (readExif readExif) ReadMPF(format exif.FileFormat, imageIdx uint32, mpf exif.MPF, err error) error {
+	if mpf.Index != nil {
+		printIFD(mpf.Index, tiff.MPFIndexSpace, readExif.maxLen)
+		entries, entryErr := mpf.Entries()
+		for i, entry := range entries {
+			fmt.Printf("Image %d: %s, %d bytes\n", i+1, exif.MPTypeNames[entry.Type()], entry.Size)
+		}
+		if entryErr != nil {
+			fmt.Fprintln(os.Stderr, entryErr)
+		}
+	}
+	if mpf.Attribute != nil {
+		printIFD(mpf.Attribute, tiff.MPFAttributeSpace, readExif.maxLen)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 	}
 	return nil
 }
 
-// Read and print all the IFDs of a TIFF file, or Exif segment of a
-// JPEG file, including any private IFDs that can be detected.
+// Read and print all the IFDs of a TIFF file, Exif segment of a JPEG
+// file, or Exif tree synthesized from a CRW file, including any
+// private IFDs that can be detected, and the MPF IFDs of a JPEG file.
 func main() {
 	var maxLen uint
 	flag.UintVar(&maxLen, "m", 20, "maximum values to print or 0 for no limit")
@@ -61,7 +157,10 @@ func main() {
 		return
 	}
 	var control exif.ReadControl
-	control.ReadExif = readExif{maxLen: uint32(maxLen)}
+	handler := readExif{maxLen: uint32(maxLen)}
+	control.ReadExif = handler
+	control.ReadRAF = handler
+	control.ReadMPF = handler
 	if err := exif.ReadFile(flag.Arg(0), control); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,155 @@
+package main
+
+// Generate an XMP sidecar file from the Exif data in an image file,
+// or apply the properties in a sidecar to a JPEG or TIFF file.
+
+import (
+	"flag"
+	"fmt"
+	exif "github.com/garyhouston/exif44"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Exif handler for generating sidecars.
+type readExif struct {
+	meta  *exif.XMPMeta
+	found *bool
+}
+
+func (r readExif) ReadExif(format exif.FileFormat, imageIdx uint32, xif exif.Exif, err error) error {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	// Use the first Exif tree, which describes the main image.
+	if !*r.found {
+		exif.ExifToXMP(xif, r.meta)
+		exif.MakerNoteToXMP(xif, r.meta)
+		*r.found = true
+	}
+	return nil
+}
+
+// Return the default sidecar name for an image file, replacing its
+// extension with ".xmp".
+func sidecarName(file string) string {
+	return strings.TrimSuffix(file, filepath.Ext(file)) + ".xmp"
+}
+
+// Read the properties from a sidecar file.
+func readSidecar(file string) (*exif.XMPMeta, error) {
+	packet, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return exif.ParseXMP(packet)
+}
+
+// Write a sidecar for an image file. Properties in an existing sidecar
+// are retained unless replaced by values from the image.
+func export(in, sidecar string) {
+	meta := &exif.XMPMeta{Prefixes: make(map[string]string)}
+	if _, err := os.Stat(sidecar); err == nil {
+		if meta, err = readSidecar(sidecar); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var found bool
+	var control exif.ReadControl
+	control.ReadExif = readExif{meta: meta, found: &found}
+	if err := exif.ReadFile(in, control); err != nil {
+		log.Fatal(err)
+	}
+	if !found {
+		log.Fatal("No Exif data found in ", in)
+	}
+	if err := ioutil.WriteFile(sidecar, meta.Packet(2048), 0666); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Handlers for applying sidecars.
+type readWrite struct {
+	meta *exif.XMPMeta
+}
+
+func (rw readWrite) ReadWriteExif(format exif.FileFormat, imageIdx uint32, xif *exif.Exif, err error) error {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if imageIdx == 0 {
+		if err := exif.XMPToExif(rw.meta, xif); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	return nil
+}
+
+func (readWrite) ExifRequired(format exif.FileFormat, imageIdx uint32) bool {
+	return imageIdx == 0
+}
+
+func (rw readWrite) ReadWriteXMP(format exif.FileFormat, imageIdx uint32, xmp *exif.XMP, err error) error {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if imageIdx != 0 {
+		return nil
+	}
+	// Merge the sidecar into any XMP already in the image.
+	meta, err := xmp.Meta()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	for ns, prefix := range rw.meta.Prefixes {
+		if _, found := meta.Prefixes[ns]; !found {
+			meta.Prefixes[ns] = prefix
+		}
+	}
+	for _, prop := range rw.meta.Properties {
+		meta.Set(prop)
+	}
+	xmp.SetMeta(meta)
+	return nil
+}
+
+// Apply a sidecar to an image file, writing a new file. The Exif
+// fields with XMP equivalents are updated, and in JPEG files the
+// sidecar properties are also merged into the embedded XMP.
+func apply(sidecar, in, out string) {
+	meta, err := readSidecar(sidecar)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var control exif.ReadWriteControl
+	handler := readWrite{meta: meta}
+	control.ReadWriteExif = handler
+	control.ExifRequired = handler
+	control.ReadWriteXMP = handler
+	if err := exif.ReadWriteFile(in, out, control); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Printf("Usage: %s file [sidecar]\n       %s -i sidecar file outfile\nThe first form writes a sidecar, by default file with its extension replaced by .xmp.\nThe second applies a sidecar to a JPEG or TIFF file.\n", os.Args[0], os.Args[0])
+}
+
+func main() {
+	var importSidecar bool
+	flag.BoolVar(&importSidecar, "i", false, "apply a sidecar to a file")
+	flag.Parse()
+	switch {
+	case importSidecar && flag.NArg() == 3:
+		apply(flag.Arg(0), flag.Arg(1), flag.Arg(2))
+	case !importSidecar && flag.NArg() == 1:
+		export(flag.Arg(0), sidecarName(flag.Arg(0)))
+	case !importSidecar && flag.NArg() == 2:
+		export(flag.Arg(0), flag.Arg(1))
+	default:
+		usage()
+	}
+}
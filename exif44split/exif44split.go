@@ -0,0 +1,45 @@
+package main
+
+// Split a Multi-Picture Format (MPO) file into standalone JPEG files.
+
+import (
+	"fmt"
+	exif "github.com/garyhouston/exif44"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	if len(os.Args) != 2 && len(os.Args) != 3 {
+		fmt.Printf("Usage: %s file [prefix]\nWrites each image to prefix-1.jpg, prefix-2.jpg, etc. The default\nprefix is the file name without its extension.\n", os.Args[0])
+		return
+	}
+	file := os.Args[1]
+	prefix := strings.TrimSuffix(file, filepath.Ext(file))
+	if len(os.Args) == 3 {
+		prefix = os.Args[2]
+	}
+	reader, err := os.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer reader.Close()
+	images, err := exif.SplitMPF(reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, image := range images {
+		name := fmt.Sprintf("%s-%d.jpg", prefix, i+1)
+		if err := ioutil.WriteFile(name, image.Data, 0666); err != nil {
+			log.Fatal(err)
+		}
+		mpType, found := exif.MPTypeNames[image.Entry.Type()]
+		if !found {
+			mpType = fmt.Sprintf("MP type 0x%06X", image.Entry.Type())
+		}
+		fmt.Printf("%s: %s\n", name, mpType)
+	}
+}
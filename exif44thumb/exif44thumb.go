@@ -0,0 +1,169 @@
+package main
+
+// Report, extract, replace, delete or regenerate the Exif thumbnail
+// of a JPEG file.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	exif "github.com/garyhouston/exif44"
+	"image/jpeg"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Exif handler for reading the thumbnail of the primary image.
+type readThumb struct {
+	primary   bool
+	thumbnail []byte
+	isJPEG    bool
+}
+
+// In TIFF files, the next IFD is another image rather than an Exif
+// thumbnail.
+func (r *readThumb) ReadImageInfo(info exif.ImageInfo) error {
+	r.primary = info.Primary() && info.Format != exif.FileTIFF
+	return nil
+}
+
+func (r *readThumb) ReadExif(format exif.FileFormat, imageIdx uint32, xif exif.Exif, err error) error {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if r.primary && r.thumbnail == nil {
+		r.thumbnail, r.isJPEG = xif.Thumbnail()
+	}
+	return nil
+}
+
+// Exif handler for replacing or deleting the thumbnail of the primary
+// image. A nil thumbnail deletes it.
+type writeThumb struct {
+	primary   bool
+	done      bool
+	thumbnail []byte
+}
+
+func (w *writeThumb) ReadImageInfo(info exif.ImageInfo) error {
+	w.primary = info.Primary() && info.Format != exif.FileTIFF && !w.done
+	return nil
+}
+
+func (w *writeThumb) ReadWriteExif(format exif.FileFormat, imageIdx uint32, xif *exif.Exif, err error) error {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if !w.primary {
+		return nil
+	}
+	w.done = true
+	if w.thumbnail == nil {
+		xif.DeleteThumbnail()
+		return nil
+	}
+	return xif.SetThumbnail(w.thumbnail)
+}
+
+func (w *writeThumb) ExifRequired(format exif.FileFormat, imageIdx uint32) bool {
+	// A new thumbnail needs an Exif segment to go in.
+	return w.primary && w.thumbnail != nil
+}
+
+// Return the thumbnail of the primary image in a file.
+func read(file string) ([]byte, bool) {
+	var control exif.ReadControl
+	handler := &readThumb{}
+	control.ReadImageInfo = handler
+	control.ReadExif = handler
+	if err := exif.ReadFile(file, control); err != nil {
+		log.Fatal(err)
+	}
+	return handler.thumbnail, handler.isJPEG
+}
+
+// Write a copy of a file with the thumbnail of its primary image
+// replaced, or deleted if 'thumbnail' is nil.
+func write(infile, outfile string, thumbnail []byte) {
+	var control exif.ReadWriteControl
+	handler := &writeThumb{thumbnail: thumbnail}
+	control.ReadImageInfo = handler
+	control.ReadWriteExif = handler
+	control.ExifRequired = handler
+	if err := exif.ReadWriteFile(infile, outfile, control); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Make a thumbnail from the primary image of a JPEG file, which is
+// the first image in a Multi-Picture Format file.
+func generate(file string) []byte {
+	reader, err := os.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer reader.Close()
+	img, err := jpeg.Decode(reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	thumbnail, err := exif.MakeThumbnail(img)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return thumbnail
+}
+
+func usage() {
+	fmt.Printf("Usage: %s file\n       %s -x thumbnail file\n       %s -r thumbnail file outfile\n       %s -d file outfile\n       %s -g file outfile\nThe first form reports the thumbnail of the primary image.\nThe second extracts it to a file.\nThe third replaces it with a JPEG file.\nThe fourth deletes it.\nThe fifth regenerates it from the primary image.\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+}
+
+func main() {
+	var extract, replace string
+	var del, generateThumb bool
+	flag.StringVar(&extract, "x", "", "extract the thumbnail to a file")
+	flag.StringVar(&replace, "r", "", "replace the thumbnail with a JPEG file")
+	flag.BoolVar(&del, "d", false, "delete the thumbnail")
+	flag.BoolVar(&generateThumb, "g", false, "regenerate the thumbnail from the primary image")
+	flag.Parse()
+	options := 0
+	for _, set := range []bool{extract != "", replace != "", del, generateThumb} {
+		if set {
+			options++
+		}
+	}
+	switch {
+	case options == 0 && flag.NArg() == 1:
+		thumbnail, isJPEG := read(flag.Arg(0))
+		if thumbnail == nil {
+			fmt.Println("No thumbnail found")
+		} else if !isJPEG {
+			fmt.Printf("Uncompressed thumbnail, %d bytes\n", len(thumbnail))
+		} else if config, err := jpeg.DecodeConfig(bytes.NewReader(thumbnail)); err != nil {
+			fmt.Printf("JPEG thumbnail, %d bytes: %v\n", len(thumbnail), err)
+		} else {
+			fmt.Printf("JPEG thumbnail, %dx%d, %d bytes\n", config.Width, config.Height, len(thumbnail))
+		}
+	case extract != "" && options == 1 && flag.NArg() == 1:
+		thumbnail, _ := read(flag.Arg(0))
+		if thumbnail == nil {
+			log.Fatal("No thumbnail found in ", flag.Arg(0))
+		}
+		if err := ioutil.WriteFile(extract, thumbnail, 0666); err != nil {
+			log.Fatal(err)
+		}
+	case replace != "" && options == 1 && flag.NArg() == 2:
+		thumbnail, err := ioutil.ReadFile(replace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		write(flag.Arg(0), flag.Arg(1), thumbnail)
+	case del && options == 1 && flag.NArg() == 2:
+		write(flag.Arg(0), flag.Arg(1), nil)
+	case generateThumb && options == 1 && flag.NArg() == 2:
+		write(flag.Arg(0), flag.Arg(1), generate(flag.Arg(0)))
+	default:
+		usage()
+	}
+}
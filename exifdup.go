@@ -0,0 +1,189 @@
+package exif44
+
+import (
+	"errors"
+	"fmt"
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+	"github.com/hashicorp/go-multierror"
+	"io"
+)
+
+// Handling of JPEG images with more than one Exif segment, which are
+// sometimes left by broken editors.
+
+// Handling of duplicate Exif segments when writing.
+type DuplicateExifPolicy uint8
+
+const (
+	DuplicateExifKeepAll   DuplicateExifPolicy = iota // Process and write each segment separately.
+	DuplicateExifKeepFirst                            // Keep only the first segment.
+	DuplicateExifKeepLast                             // Keep only the last segment, written in place of the first.
+	DuplicateExifMerge                                // Merge the segments into the first.
+)
+
+// Error passed to Exif callbacks for a JPEG image with more than one
+// Exif segment, possibly as part of a multierror structure, which
+// identifies the segment being processed. It can be found with
+// errors.As.
+type DuplicateExifError struct {
+	ImageIdx uint32
+	Ordinal  uint32 // Position of the segment among the image's Exif segments, from 0.
+	Count    uint32 // Number of Exif segments in the image.
+}
+
+func (e *DuplicateExifError) Error() string {
+	return fmt.Sprintf("Image %d has %d Exif segments, processing segment %d", e.ImageIdx, e.Count, e.Ordinal)
+}
+
+// Return the TIFF data from each Exif segment in a JPEG image, with
+// the data from any continuation segments appended. The reader's
+// position is unchanged.
+func getExifSegments(reader io.ReadSeeker) ([][]byte, error) {
+	readerSave, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	scanner, err := jseg.NewScanner(reader)
+	if err != nil {
+		return nil, err
+	}
+	var segments [][]byte
+	for {
+		marker, buf, err := scanner.Scan()
+		if err != nil {
+			return nil, err
+		}
+		if marker == jseg.SOS || marker == jseg.EOI {
+			// No more metadata expected.
+			break
+		}
+		if marker == jseg.APP0+1 {
+			if isExif, next := GetHeader(buf); isExif {
+				tiffData, err := readExifSegments(reader, scanner, buf[next:], nil)
+				if err != nil {
+					return nil, err
+				}
+				segments = append(segments, tiffData)
+			}
+		}
+	}
+	// Reset the file position.
+	if _, err = reader.Seek(readerSave, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+// Return the error to be passed to an Exif callback for a segment, or
+// nil if the image has a single Exif segment.
+func duplicateExifError(imageIdx uint32, ordinal, count int) error {
+	if count <= 1 {
+		return nil
+	}
+	return &DuplicateExifError{ImageIdx: imageIdx, Ordinal: uint32(ordinal), Count: uint32(count)}
+}
+
+// Tags of fields that locate image data, which can't be merged
+// independently of the data.
+var imageDataTags = map[tiff.Tag]bool{
+	tiff.StripOffsets:                true,
+	tiff.StripByteCounts:             true,
+	tiff.TileOffsets:                 true,
+	tiff.TileByteCounts:              true,
+	tiff.FreeOffsets:                 true,
+	tiff.FreeByteCounts:              true,
+	tiff.JPEGInterchangeFormat:       true,
+	tiff.JPEGInterchangeFormatLength: true,
+}
+
+// Add fields and sub-IFDs from one IFD to another where they're
+// missing. Maker notes aren't merged, but a maker note is added if
+// the destination doesn't have one.
+func mergeIFD(dst, src *tiff.IFDNode) {
+	subTags := make(map[tiff.Tag]bool)
+	for _, sub := range src.SubIFDs {
+		subTags[sub.Tag] = true
+		merged := false
+		for _, dstSub := range dst.SubIFDs {
+			if dstSub.Tag == sub.Tag {
+				if !dstSub.Node.IsMakerNote() && !sub.Node.IsMakerNote() {
+					mergeIFD(dstSub.Node, sub.Node)
+				}
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			if fields := src.FindFields([]tiff.Tag{sub.Tag}); len(fields) > 0 {
+				dst.AddFields([]tiff.Field{*fields[0]})
+				dst.SubIFDs = append(dst.SubIFDs, sub)
+			}
+		}
+	}
+	for _, field := range src.Fields {
+		if subTags[field.Tag] || imageDataTags[field.Tag] {
+			continue
+		}
+		if len(dst.FindFields([]tiff.Tag{field.Tag})) == 0 {
+			dst.AddFields([]tiff.Field{field})
+		}
+	}
+	// The next IFD normally contains a thumbnail, which is only
+	// taken if the destination has none.
+	if dst.Next == nil {
+		dst.Next = src.Next
+	}
+}
+
+// Return the index of the duplicate Exif segment whose maker note is
+// kept by mergeExifSegments: the first with a maker note and the same
+// byte order as the first segment. Returns 0 if none has a maker note.
+func makerNoteSegment(segments [][]byte) int {
+	first, _ := GetExifTree(segments[0])
+	if first == nil || first.TIFF == nil {
+		return 0
+	}
+	for i, data := range segments {
+		exif, _ := GetExifTree(data)
+		if exif == nil || exif.TIFF == nil || exif.TIFF.Order != first.TIFF.Order {
+			continue
+		}
+		if exif.Exif != nil && findField(exif.Exif, MakerNote) != nil {
+			return i
+		}
+	}
+	return 0
+}
+
+// Merge the TIFF data from duplicate Exif segments, adding fields and
+// IFDs from the later segments where they're missing in the first.
+// Segments with a different byte order from the first aren't merged.
+// Returns the serialized result and a multierror structure if any
+// segments couldn't be decoded or merged.
+func mergeExifSegments(segments [][]byte) ([]byte, error) {
+	exif, err := GetExifTree(segments[0])
+	if exif == nil || exif.TIFF == nil {
+		return segments[0], err
+	}
+	for i, data := range segments[1:] {
+		other, otherErr := GetExifTree(data)
+		if otherErr != nil {
+			err = multierror.Append(err, otherErr)
+		}
+		if other == nil || other.TIFF == nil {
+			continue
+		}
+		if other.TIFF.Order != exif.TIFF.Order {
+			err = multierror.Append(err, fmt.Errorf("Exif segment %d has a different byte order and wasn't merged", i+1))
+			continue
+		}
+		mergeIFD(exif.TIFF, other.TIFF)
+	}
+	exif = makeExif(exif.TIFF)
+	buf := make([]byte, exif.TreeSize())
+	if _, putErr := exif.Put(buf); putErr != nil {
+		return segments[0], multierror.Append(err, errors.New("Merged Exif segments couldn't be encoded, keeping the first"))
+	}
+	return buf, err
+}
@@ -0,0 +1,127 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	tiff "github.com/garyhouston/tiff66"
+	"github.com/hashicorp/go-multierror"
+)
+
+// Return the Make from an Exif tree.
+func testMake(exif Exif) string {
+	if field := findField(exif.TIFF, tiff.Make); field != nil {
+		return field.ASCII()
+	}
+	return ""
+}
+
+func TestReadDuplicateExif(t *testing.T) {
+	first := testTIFF(t, testExif("First"))
+	second := testTIFF(t, testExif("Second"))
+	tests := []struct {
+		name     string
+		segments [][]byte
+	}{
+		{"single", [][]byte{first}},
+		{"duplicate", [][]byte{first, second}},
+		{"triplicate", [][]byte{first, second, first}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var makes []string
+			callback := testReadExifFunc(func(exif Exif, err error) {
+				var dupErr *DuplicateExifError
+				if len(test.segments) == 1 {
+					if err != nil {
+						t.Error(err)
+					}
+				} else if !errors.As(err, &dupErr) || dupErr.Ordinal != uint32(len(makes)) || dupErr.Count != uint32(len(test.segments)) {
+					t.Errorf("error %v for segment %d", err, len(makes))
+				}
+				makes = append(makes, testMake(exif))
+			})
+			file := testJPEGFile(t, test.segments, nil)
+			if err := Read(bytes.NewReader(file), ReadControl{ReadExif: callback}); err != nil {
+				t.Fatal(err)
+			}
+			if len(makes) != len(test.segments) || makes[0] != "First" {
+				t.Errorf("makes %q", makes)
+			}
+		})
+	}
+}
+
+func TestReadWriteDuplicateExif(t *testing.T) {
+	first := testTIFF(t, testExif("First"))
+	second := testExif("Second", testASCII(ImageUniqueID, "0123456789abcdef0123456789abcdef"))
+	little := testExif("Little", testASCII(ImageUniqueID, "0123456789abcdef0123456789abcdef"))
+	little.TIFF.Order = binary.LittleEndian
+	little.Exif.Order = binary.LittleEndian
+	tests := []struct {
+		name     string
+		segments [][]byte
+		policy   DuplicateExifPolicy
+		makes    []string // Expected makes of the output segments.
+		uniqueID bool     // ImageUniqueID found in the first segment.
+		cbErr    bool     // Merge error passed to the callback.
+	}{
+		{"keep all", [][]byte{first, testTIFF(t, second)}, DuplicateExifKeepAll, []string{"First", "Second"}, false, false},
+		{"keep first", [][]byte{first, testTIFF(t, second)}, DuplicateExifKeepFirst, []string{"First"}, false, false},
+		{"keep last", [][]byte{first, testTIFF(t, second)}, DuplicateExifKeepLast, []string{"Second"}, true, false},
+		{"merge", [][]byte{first, testTIFF(t, second)}, DuplicateExifMerge, []string{"First"}, true, false},
+		{"merge byte order", [][]byte{first, testTIFF(t, little)}, DuplicateExifMerge, []string{"First"}, false, true},
+		{"merge undecodable", [][]byte{first, []byte("MM\000\052\377\377\377\377")}, DuplicateExifMerge, []string{"First"}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			var cbErr error
+			errCallback := testReadWriteExifErr(func(exif *Exif, err error) {
+				// Merge errors are appended to the
+				// DuplicateExifError.
+				if merr, ok := err.(*multierror.Error); ok && len(merr.Errors) > 1 {
+					cbErr = err
+				}
+				calls++
+			})
+			in := testJPEGFile(t, test.segments, nil)
+			out, err := testReadWrite(t, in, ReadWriteControl{ReadWriteExif: errCallback, DuplicateExif: test.policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (cbErr != nil) != test.cbErr {
+				t.Errorf("callback error %v", cbErr)
+			}
+			if calls != len(test.makes) {
+				t.Errorf("%d calls of the Exif callback", calls)
+			}
+			var trees []Exif
+			read := testReadExifFunc(func(exif Exif, err error) { trees = append(trees, exif) })
+			if err := Read(bytes.NewReader(out), ReadControl{ReadExif: read}); err != nil {
+				t.Fatal(err)
+			}
+			if len(trees) != len(test.makes) {
+				t.Fatalf("%d Exif segments, expected %d", len(trees), len(test.makes))
+			}
+			for i, exif := range trees {
+				if testMake(exif) != test.makes[i] {
+					t.Errorf("segment %d has make %q", i, testMake(exif))
+				}
+			}
+			if (findField(trees[0].Exif, ImageUniqueID) != nil) != test.uniqueID {
+				t.Errorf("ImageUniqueID found: %v", !test.uniqueID)
+			}
+		})
+	}
+}
+
+// Exif callback that calls a function on each tree and its error.
+type testReadWriteExifErr func(*Exif, error)
+
+func (f testReadWriteExifErr) ReadWriteExif(format FileFormat, imageIdx uint32, exif *Exif, err error) error {
+	f(exif, err)
+	return nil
+}
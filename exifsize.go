@@ -0,0 +1,173 @@
+package exif44
+
+import (
+	"fmt"
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+	"io"
+)
+
+// Handling of Exif data that's too large for a single JPEG APP1
+// segment. Some software writes such data over multiple consecutive
+// APP1 segments, each with an Exif header: the first starts with the
+// TIFF header and the others contain the continuation of the data.
+
+// Maximum size of the TIFF data in a single Exif segment.
+var MaxExifSegmentData = maxSegmentData - HeaderSize
+
+// Identifies a field in an Exif tree.
+type ExifFieldID struct {
+	Space tiff.TagSpace
+	Tag   tiff.Tag
+}
+
+// Policy for Exif data that's too large for a single APP1 segment.
+// The enabled steps are applied in the order of the fields, until the
+// data fits. If it still doesn't fit, an *ExifSizeError is returned.
+// The zero value returns the error without modifying the data.
+type ExifOverflowPolicy struct {
+	ShrinkThumbnail bool          // Repeatedly halve the size of the IFD1 thumbnail.
+	DropThumbnail   bool          // Remove IFD1 and its thumbnail.
+	DropFields      []ExifFieldID // Remove these fields, in order, e.g., the maker note.
+	MultiSegment    bool          // Split the data over multiple APP1 segments.
+}
+
+// Error returned when Exif data is too large for a JPEG segment.
+type ExifSizeError struct {
+	ImageIdx uint32
+	Size     int // Size of the TIFF data.
+}
+
+func (e *ExifSizeError) Error() string {
+	return fmt.Sprintf("Exif data for image %d is %d bytes, more than the maximum of %d for a JPEG segment", e.ImageIdx, e.Size, MaxExifSegmentData)
+}
+
+// Remove a field from an Exif tree, including any sub-IFD that it
+// refers to.
+func deleteExifField(exif *Exif, id ExifFieldID) {
+	node := exifSpaceNode(exif, id.Space)
+	if node == nil {
+		return
+	}
+	for i := len(node.SubIFDs) - 1; i >= 0; i-- {
+		if node.SubIFDs[i].Tag == id.Tag {
+			node.DeleteSubIFD(i)
+		}
+	}
+	node.DeleteFields([]tiff.Tag{id.Tag})
+	*exif = *makeExif(exif.TIFF)
+}
+
+// Reduce the size of serialized Exif data according to a policy,
+// returning the new TIFF data, which may still be too large.
+func reduceExif(tiffData []byte, policy ExifOverflowPolicy) ([]byte, error) {
+	exif, err := GetExifTree(tiffData)
+	if err != nil {
+		return nil, err
+	}
+	maxSize := uint32(MaxExifSegmentData)
+	if policy.ShrinkThumbnail {
+		for exif.TreeSize() > maxSize {
+			thumbnail := getThumbnail(*exif)
+			if thumbnail == nil {
+				break
+			}
+			smaller, err := shrinkJPEG(thumbnail)
+			if err != nil || smaller == nil {
+				break
+			}
+			if err := setThumbnail(*exif, smaller); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if policy.DropThumbnail && exif.TreeSize() > maxSize {
+		exif.TIFF.Next = nil
+	}
+	for _, id := range policy.DropFields {
+		if exif.TreeSize() <= maxSize {
+			break
+		}
+		deleteExifField(exif, id)
+	}
+	buf := make([]byte, exif.TreeSize())
+	if _, err := exif.Put(buf); err != nil {
+		return nil, err
+	}
+	// An undecoded maker note may have moved again.
+	if err := updateOffsetSchema(tiffData, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Return the Exif segment data for serialized TIFF data, applying an
+// overflow policy if it's too large for a single segment.
+func makeExifSegments(imageIdx uint32, tiffData []byte, policy ExifOverflowPolicy) ([][]byte, error) {
+	if len(tiffData) > MaxExifSegmentData && (policy.ShrinkThumbnail || policy.DropThumbnail || len(policy.DropFields) > 0) {
+		var err error
+		if tiffData, err = reduceExif(tiffData, policy); err != nil {
+			return nil, err
+		}
+	}
+	if len(tiffData) > MaxExifSegmentData && !policy.MultiSegment {
+		return nil, &ExifSizeError{ImageIdx: imageIdx, Size: len(tiffData)}
+	}
+	var segments [][]byte
+	for start := 0; start < len(tiffData); start += MaxExifSegmentData {
+		end := start + MaxExifSegmentData
+		if end > len(tiffData) {
+			end = len(tiffData)
+		}
+		segment := make([]byte, HeaderSize+end-start)
+		PutHeader(segment)
+		copy(segment[HeaderSize:], tiffData[start:end])
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// Check if the next segment in a JPEG stream continues multi-segment
+// Exif data: an APP1 segment with an Exif header that isn't followed
+// by a TIFF header. The reader's position is unchanged.
+func isExifContinuation(reader io.ReadSeeker) (bool, error) {
+	pos, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	// Marker, length, Exif header and TIFF header.
+	buf := make([]byte, 4+HeaderSize+tiff.HeaderSize)
+	_, readErr := io.ReadFull(reader, buf)
+	if _, err := reader.Seek(pos, io.SeekStart); err != nil {
+		return false, err
+	}
+	if readErr != nil || buf[0] != 0xFF || buf[1] != 0xE1 {
+		return false, nil
+	}
+	isExif, _ := GetHeader(buf[4:])
+	validTIFF, _, _ := tiff.GetHeader(buf[4+HeaderSize:])
+	return isExif && !validTIFF, nil
+}
+
+// Return a copy of the TIFF data from an Exif segment, with the data
+// from any continuation segments appended. The continuation segments
+// are read from the scanner, and passed to 'segment' if it's not nil.
+func readExifSegments(reader io.ReadSeeker, scanner *jseg.Scanner, data []byte, segment func(buf []byte) error) ([]byte, error) {
+	tiffData := append([]byte{}, data...)
+	for {
+		more, err := isExifContinuation(reader)
+		if err != nil || !more {
+			return tiffData, err
+		}
+		_, buf, err := scanner.Scan()
+		if err != nil {
+			return nil, err
+		}
+		if segment != nil {
+			if err := segment(buf); err != nil {
+				return nil, err
+			}
+		}
+		tiffData = append(tiffData, buf[HeaderSize:]...)
+	}
+}
@@ -0,0 +1,138 @@
+package exif44
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// Return a JPEG image of random noise, which compresses badly.
+func testNoiseJPEG(t *testing.T, width, height int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 0xFF})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Return the number of Exif segments in the first image of a JPEG
+// file, and its Exif tree.
+func testReadExifSegments(t *testing.T, file []byte) (int, *Exif) {
+	count := 0
+	for _, seg := range testSegments(t, file) {
+		if seg.Marker == jseg.APP0+1 && isExifSegment(seg.Data) {
+			count++
+		}
+	}
+	var exif *Exif
+	callback := testReadExifFunc(func(e Exif, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		exif = &e
+	})
+	if err := Read(bytes.NewReader(file), ReadControl{ReadExif: callback}); err != nil {
+		t.Fatal(err)
+	}
+	return count, exif
+}
+
+func TestExifOverflow(t *testing.T) {
+	in := testJPEGFile(t, [][]byte{testTIFF(t, testExif("Acme"))}, nil)
+	comment := bytes.Repeat([]byte("c"), 70000)
+	addComment := func(exif *Exif) {
+		exif.Exif.AddFields([]tiff.Field{{Tag: UserComment, Type: tiff.UNDEFINED, Count: uint32(len(comment)), Data: comment}})
+	}
+	thumbnail := testNoiseJPEG(t, 256, 256)
+	if len(thumbnail) <= MaxExifSegmentData {
+		t.Fatalf("thumbnail of %d bytes isn't large enough", len(thumbnail))
+	}
+	addThumbnail := func(exif *Exif) {
+		if err := exif.SetThumbnail(thumbnail); err != nil {
+			t.Fatal(err)
+		}
+	}
+	smallComment := func(exif *Exif) {
+		exif.Exif.AddFields([]tiff.Field{{Tag: UserComment, Type: tiff.UNDEFINED, Count: 8, Data: []byte("comment!")}})
+		addThumbnail(exif)
+	}
+	userComment := ExifFieldID{tiff.ExifSpace, UserComment}
+	tests := []struct {
+		name      string
+		add       func(*Exif)
+		policy    ExifOverflowPolicy
+		segments  int  // Expected Exif segments, or 0 for an error.
+		comment   bool // UserComment retained.
+		thumbnail int  // 0: no thumbnail, 1: original, 2: reduced.
+	}{
+		{"default", addComment, ExifOverflowPolicy{}, 0, false, 0},
+		{"multiple segments", addComment, ExifOverflowPolicy{MultiSegment: true}, 2, true, 0},
+		{"drop field", addComment, ExifOverflowPolicy{DropFields: []ExifFieldID{userComment}}, 1, false, 0},
+		{"drop other field", addComment, ExifOverflowPolicy{DropFields: []ExifFieldID{{tiff.ExifSpace, MakerNote}}}, 0, false, 0},
+		{"shrink thumbnail", addThumbnail, ExifOverflowPolicy{ShrinkThumbnail: true}, 1, false, 2},
+		{"drop thumbnail", addThumbnail, ExifOverflowPolicy{DropThumbnail: true}, 1, false, 0},
+		{"thumbnail multiple segments", addThumbnail, ExifOverflowPolicy{MultiSegment: true}, 2, false, 1},
+		{"shrink before dropping fields", smallComment, ExifOverflowPolicy{ShrinkThumbnail: true, DropFields: []ExifFieldID{userComment}}, 1, true, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			control := ReadWriteControl{ReadWriteExif: testExifFunc(test.add), ExifOverflow: test.policy}
+			out, err := testReadWrite(t, in, control)
+			if test.segments == 0 {
+				if _, ok := err.(*ExifSizeError); !ok {
+					t.Errorf("error %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			count, exif := testReadExifSegments(t, out)
+			if count != test.segments {
+				t.Errorf("%d Exif segments, expected %d", count, test.segments)
+			}
+			if exif == nil {
+				t.Fatal("Exif data not read")
+			}
+			if field := findField(exif.Exif, UserComment); (field != nil) != test.comment {
+				t.Errorf("UserComment found: %v", field != nil)
+			}
+			data, _ := exif.Thumbnail()
+			switch {
+			case test.thumbnail == 0 && data != nil:
+				t.Error("thumbnail not removed")
+			case test.thumbnail == 1 && !bytes.Equal(data, thumbnail):
+				t.Error("thumbnail changed")
+			case test.thumbnail == 2 && (data == nil || len(data) >= len(thumbnail)):
+				t.Error("thumbnail not reduced")
+			}
+			if test.segments > 1 {
+				// Multi-segment data is read and written
+				// again unchanged.
+				again, err := testReadWrite(t, out, ReadWriteControl{ExifOverflow: test.policy})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(again, out) {
+					t.Error("multi-segment Exif data changed")
+				}
+				if _, err := testReadWrite(t, out, ReadWriteControl{}); err == nil {
+					t.Error("multi-segment Exif data written without policy")
+				}
+			}
+		})
+	}
+}
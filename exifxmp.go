@@ -0,0 +1,773 @@
+package exif44
+
+import (
+	"encoding/binary"
+	"fmt"
+	tiff "github.com/garyhouston/tiff66"
+	"github.com/hashicorp/go-multierror"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Mapping between Exif fields and XMP properties, following "Exif
+// 2.3 metadata for XMP" (CIPA DC-010-2012) and the Metadata Working
+// Group's "Guidelines for Handling Image Metadata" 2.0.
+
+// Conversion between an Exif field value and an XMP property value.
+type xmpConversion uint8
+
+const (
+	convText        xmpConversion = iota // ASCII and simple text.
+	convInteger                          // Single integer and text.
+	convIntegerSeq                       // Integer array and Seq.
+	convUndefInt                         // Single UNDEFINED byte and text.
+	convRational                         // Single rational and "n/d" text.
+	convRationalSeq                      // Rational array and Seq.
+	convVersion                          // 4 byte UNDEFINED version and text.
+	convLangAlt                          // ASCII and language alternative.
+	convCreator                          // ASCII with ';' separators and Seq.
+	convComment                          // UNDEFINED with character code and language alternative.
+	convDate                             // ASCII date, with subsecond and offset fields, and ISO 8601 date.
+	convFlash                            // SHORT and Flash structure.
+	convGPSVersion                       // 4 BYTEs and dotted text.
+	convGPSCoord                         // Rationals and reference, and "DDD,MM.mmk" text.
+	convGPSTime                          // Time stamp and date stamp, and ISO 8601 date.
+)
+
+// Mapping between an Exif field and an XMP property.
+type xmpMapping struct {
+	space tiff.TagSpace
+	tag   tiff.Tag
+	typ   tiff.Type // Type of the Exif field.
+	ns    string
+	name  string
+	conv  xmpConversion
+}
+
+// Fields that accompany a date field.
+var dateAuxTags = map[tiff.Tag][2]tiff.Tag{
+	tiff.DateTime:     {SubSecTime, OffsetTime},
+	DateTimeOriginal:  {SubSecTimeOriginal, OffsetTimeOriginal},
+	DateTimeDigitized: {SubSecTimeDigitized, OffsetTimeDigitized},
+}
+
+// Mappings between Exif fields and XMP properties. Where a field has
+// more than one mapping, the first is preferred when converting XMP to
+// Exif and the others are written for compatibility.
+var xmpMappings = []xmpMapping{
+	{tiff.TIFFSpace, tiff.ImageWidth, tiff.LONG, NStiff, "ImageWidth", convInteger},
+	{tiff.TIFFSpace, tiff.ImageLength, tiff.LONG, NStiff, "ImageLength", convInteger},
+	{tiff.TIFFSpace, tiff.BitsPerSample, tiff.SHORT, NStiff, "BitsPerSample", convIntegerSeq},
+	{tiff.TIFFSpace, tiff.Compression, tiff.SHORT, NStiff, "Compression", convInteger},
+	{tiff.TIFFSpace, tiff.PhotometricInterpretation, tiff.SHORT, NStiff, "PhotometricInterpretation", convInteger},
+	{tiff.TIFFSpace, tiff.Orientation, tiff.SHORT, NStiff, "Orientation", convInteger},
+	{tiff.TIFFSpace, tiff.SamplesPerPixel, tiff.SHORT, NStiff, "SamplesPerPixel", convInteger},
+	{tiff.TIFFSpace, tiff.PlanarConfiguration, tiff.SHORT, NStiff, "PlanarConfiguration", convInteger},
+	{tiff.TIFFSpace, tiff.YCbCrPositioning, tiff.SHORT, NStiff, "YCbCrPositioning", convInteger},
+	{tiff.TIFFSpace, tiff.XResolution, tiff.RATIONAL, NStiff, "XResolution", convRational},
+	{tiff.TIFFSpace, tiff.YResolution, tiff.RATIONAL, NStiff, "YResolution", convRational},
+	{tiff.TIFFSpace, tiff.ResolutionUnit, tiff.SHORT, NStiff, "ResolutionUnit", convInteger},
+	{tiff.TIFFSpace, tiff.Make, tiff.ASCII, NStiff, "Make", convText},
+	{tiff.TIFFSpace, tiff.Model, tiff.ASCII, NStiff, "Model", convText},
+	{tiff.TIFFSpace, tiff.Software, tiff.ASCII, NSxmp, "CreatorTool", convText},
+	{tiff.TIFFSpace, tiff.DateTime, tiff.ASCII, NSxmp, "ModifyDate", convDate},
+	{tiff.TIFFSpace, tiff.ImageDescription, tiff.ASCII, NSdc, "description", convLangAlt},
+	{tiff.TIFFSpace, tiff.Artist, tiff.ASCII, NSdc, "creator", convCreator},
+	{tiff.TIFFSpace, tiff.Copyright, tiff.ASCII, NSdc, "rights", convLangAlt},
+	{tiff.TIFFSpace, Rating, tiff.SHORT, NSxmp, "Rating", convInteger},
+
+	{tiff.ExifSpace, ExposureTime, tiff.RATIONAL, NSexif, "ExposureTime", convRational},
+	{tiff.ExifSpace, FNumber, tiff.RATIONAL, NSexif, "FNumber", convRational},
+	{tiff.ExifSpace, ExposureProgram, tiff.SHORT, NSexif, "ExposureProgram", convInteger},
+	{tiff.ExifSpace, SpectralSensitivity, tiff.ASCII, NSexif, "SpectralSensitivity", convText},
+	{tiff.ExifSpace, PhotographicSensitivity, tiff.SHORT, NSexifEX, "PhotographicSensitivity", convInteger},
+	{tiff.ExifSpace, PhotographicSensitivity, tiff.SHORT, NSexif, "ISOSpeedRatings", convIntegerSeq},
+	{tiff.ExifSpace, SensitivityType, tiff.SHORT, NSexifEX, "SensitivityType", convInteger},
+	{tiff.ExifSpace, StandardOutputSensitivity, tiff.LONG, NSexifEX, "StandardOutputSensitivity", convInteger},
+	{tiff.ExifSpace, RecommendedExposureIndex, tiff.LONG, NSexifEX, "RecommendedExposureIndex", convInteger},
+	{tiff.ExifSpace, ISOSpeed, tiff.LONG, NSexifEX, "ISOSpeed", convInteger},
+	{tiff.ExifSpace, ExifVersion, tiff.UNDEFINED, NSexif, "ExifVersion", convVersion},
+	{tiff.ExifSpace, DateTimeOriginal, tiff.ASCII, NSphotoshop, "DateCreated", convDate},
+	{tiff.ExifSpace, DateTimeOriginal, tiff.ASCII, NSexif, "DateTimeOriginal", convDate},
+	{tiff.ExifSpace, DateTimeDigitized, tiff.ASCII, NSxmp, "CreateDate", convDate},
+	{tiff.ExifSpace, DateTimeDigitized, tiff.ASCII, NSexif, "DateTimeDigitized", convDate},
+	{tiff.ExifSpace, CompressedBitsPerPixel, tiff.RATIONAL, NSexif, "CompressedBitsPerPixel", convRational},
+	{tiff.ExifSpace, ShutterSpeedValue, tiff.SRATIONAL, NSexif, "ShutterSpeedValue", convRational},
+	{tiff.ExifSpace, ApertureValue, tiff.RATIONAL, NSexif, "ApertureValue", convRational},
+	{tiff.ExifSpace, BrightnessValue, tiff.SRATIONAL, NSexif, "BrightnessValue", convRational},
+	{tiff.ExifSpace, ExposureBiasValue, tiff.SRATIONAL, NSexif, "ExposureBiasValue", convRational},
+	{tiff.ExifSpace, MaxApertureValue, tiff.RATIONAL, NSexif, "MaxApertureValue", convRational},
+	{tiff.ExifSpace, SubjectDistance, tiff.RATIONAL, NSexif, "SubjectDistance", convRational},
+	{tiff.ExifSpace, MeteringMode, tiff.SHORT, NSexif, "MeteringMode", convInteger},
+	{tiff.ExifSpace, LightSource, tiff.SHORT, NSexif, "LightSource", convInteger},
+	{tiff.ExifSpace, Flash, tiff.SHORT, NSexif, "Flash", convFlash},
+	{tiff.ExifSpace, FocalLength, tiff.RATIONAL, NSexif, "FocalLength", convRational},
+	{tiff.ExifSpace, SubjectArea, tiff.SHORT, NSexif, "SubjectArea", convIntegerSeq},
+	{tiff.ExifSpace, UserComment, tiff.UNDEFINED, NSexif, "UserComment", convComment},
+	{tiff.ExifSpace, FlashpixVersion, tiff.UNDEFINED, NSexif, "FlashpixVersion", convVersion},
+	{tiff.ExifSpace, ColorSpace, tiff.SHORT, NSexif, "ColorSpace", convInteger},
+	{tiff.ExifSpace, PixelXDimension, tiff.LONG, NSexif, "PixelXDimension", convInteger},
+	{tiff.ExifSpace, PixelYDimension, tiff.LONG, NSexif, "PixelYDimension", convInteger},
+	{tiff.ExifSpace, RelatedSoundFile, tiff.ASCII, NSexif, "RelatedSoundFile", convText},
+	{tiff.ExifSpace, FlashEnergy, tiff.RATIONAL, NSexif, "FlashEnergy", convRational},
+	{tiff.ExifSpace, FocalPlaneXResolution, tiff.RATIONAL, NSexif, "FocalPlaneXResolution", convRational},
+	{tiff.ExifSpace, FocalPlaneYResolution, tiff.RATIONAL, NSexif, "FocalPlaneYResolution", convRational},
+	{tiff.ExifSpace, FocalPlaneResolutionUnit, tiff.SHORT, NSexif, "FocalPlaneResolutionUnit", convInteger},
+	{tiff.ExifSpace, SubjectLocation, tiff.SHORT, NSexif, "SubjectLocation", convIntegerSeq},
+	{tiff.ExifSpace, ExposureIndex, tiff.RATIONAL, NSexif, "ExposureIndex", convRational},
+	{tiff.ExifSpace, SensingMethod, tiff.SHORT, NSexif, "SensingMethod", convInteger},
+	{tiff.ExifSpace, FileSource, tiff.UNDEFINED, NSexif, "FileSource", convUndefInt},
+	{tiff.ExifSpace, SceneType, tiff.UNDEFINED, NSexif, "SceneType", convUndefInt},
+	{tiff.ExifSpace, CustomRendered, tiff.SHORT, NSexif, "CustomRendered", convInteger},
+	{tiff.ExifSpace, ExposureMode, tiff.SHORT, NSexif, "ExposureMode", convInteger},
+	{tiff.ExifSpace, WhiteBalance, tiff.SHORT, NSexif, "WhiteBalance", convInteger},
+	{tiff.ExifSpace, DigitalZoomRatio, tiff.RATIONAL, NSexif, "DigitalZoomRatio", convRational},
+	{tiff.ExifSpace, FocalLengthIn35mmFilm, tiff.SHORT, NSexif, "FocalLengthIn35mmFilm", convInteger},
+	{tiff.ExifSpace, SceneCaptureType, tiff.SHORT, NSexif, "SceneCaptureType", convInteger},
+	{tiff.ExifSpace, GainControl, tiff.SHORT, NSexif, "GainControl", convInteger},
+	{tiff.ExifSpace, Contrast, tiff.SHORT, NSexif, "Contrast", convInteger},
+	{tiff.ExifSpace, Saturation, tiff.SHORT, NSexif, "Saturation", convInteger},
+	{tiff.ExifSpace, Sharpness, tiff.SHORT, NSexif, "Sharpness", convInteger},
+	{tiff.ExifSpace, SubjectDistanceRange, tiff.SHORT, NSexif, "SubjectDistanceRange", convInteger},
+	{tiff.ExifSpace, ImageUniqueID, tiff.ASCII, NSexif, "ImageUniqueID", convText},
+	{tiff.ExifSpace, CameraOwnerName, tiff.ASCII, NSexifEX, "CameraOwnerName", convText},
+	{tiff.ExifSpace, BodySerialNumber, tiff.ASCII, NSexifEX, "BodySerialNumber", convText},
+	{tiff.ExifSpace, LensSpecification, tiff.RATIONAL, NSexifEX, "LensSpecification", convRationalSeq},
+	{tiff.ExifSpace, LensMake, tiff.ASCII, NSexifEX, "LensMake", convText},
+	{tiff.ExifSpace, LensModel, tiff.ASCII, NSexifEX, "LensModel", convText},
+	{tiff.ExifSpace, LensSerialNumber, tiff.ASCII, NSexifEX, "LensSerialNumber", convText},
+	{tiff.ExifSpace, Gamma, tiff.RATIONAL, NSexifEX, "Gamma", convRational},
+
+	{tiff.GPSSpace, GPSVersionID, tiff.BYTE, NSexif, "GPSVersionID", convGPSVersion},
+	{tiff.GPSSpace, GPSLatitude, tiff.RATIONAL, NSexif, "GPSLatitude", convGPSCoord},
+	{tiff.GPSSpace, GPSLongitude, tiff.RATIONAL, NSexif, "GPSLongitude", convGPSCoord},
+	{tiff.GPSSpace, GPSAltitudeRef, tiff.BYTE, NSexif, "GPSAltitudeRef", convInteger},
+	{tiff.GPSSpace, GPSAltitude, tiff.RATIONAL, NSexif, "GPSAltitude", convRational},
+	{tiff.GPSSpace, GPSTimeStamp, tiff.RATIONAL, NSexif, "GPSTimeStamp", convGPSTime},
+	{tiff.GPSSpace, GPSSatellites, tiff.ASCII, NSexif, "GPSSatellites", convText},
+	{tiff.GPSSpace, GPSStatus, tiff.ASCII, NSexif, "GPSStatus", convText},
+	{tiff.GPSSpace, GPSMeasureMode, tiff.ASCII, NSexif, "GPSMeasureMode", convText},
+	{tiff.GPSSpace, GPSDOP, tiff.RATIONAL, NSexif, "GPSDOP", convRational},
+	{tiff.GPSSpace, GPSSpeedRef, tiff.ASCII, NSexif, "GPSSpeedRef", convText},
+	{tiff.GPSSpace, GPSSpeed, tiff.RATIONAL, NSexif, "GPSSpeed", convRational},
+	{tiff.GPSSpace, GPSTrackRef, tiff.ASCII, NSexif, "GPSTrackRef", convText},
+	{tiff.GPSSpace, GPSTrack, tiff.RATIONAL, NSexif, "GPSTrack", convRational},
+	{tiff.GPSSpace, GPSImgDirectionRef, tiff.ASCII, NSexif, "GPSImgDirectionRef", convText},
+	{tiff.GPSSpace, GPSImgDirection, tiff.RATIONAL, NSexif, "GPSImgDirection", convRational},
+	{tiff.GPSSpace, GPSMapDatum, tiff.ASCII, NSexif, "GPSMapDatum", convText},
+	{tiff.GPSSpace, GPSDestLatitude, tiff.RATIONAL, NSexif, "GPSDestLatitude", convGPSCoord},
+	{tiff.GPSSpace, GPSDestLongitude, tiff.RATIONAL, NSexif, "GPSDestLongitude", convGPSCoord},
+	{tiff.GPSSpace, GPSDestBearingRef, tiff.ASCII, NSexif, "GPSDestBearingRef", convText},
+	{tiff.GPSSpace, GPSDestBearing, tiff.RATIONAL, NSexif, "GPSDestBearing", convRational},
+	{tiff.GPSSpace, GPSDestDistanceRef, tiff.ASCII, NSexif, "GPSDestDistanceRef", convText},
+	{tiff.GPSSpace, GPSDestDistance, tiff.RATIONAL, NSexif, "GPSDestDistance", convRational},
+	{tiff.GPSSpace, GPSProcessingMethod, tiff.UNDEFINED, NSexif, "GPSProcessingMethod", convComment},
+	{tiff.GPSSpace, GPSAreaInformation, tiff.UNDEFINED, NSexif, "GPSAreaInformation", convComment},
+	{tiff.GPSSpace, GPSDifferential, tiff.SHORT, NSexif, "GPSDifferential", convInteger},
+	{tiff.GPSSpace, GPSHPositioningError, tiff.RATIONAL, NSexifEX, "GPSHPositioningError", convRational},
+}
+
+// Rating tag in IFD0, written by Microsoft Windows. It's not part of
+// the Exif standard.
+const Rating = 0x4746
+
+// Return the IFD for a tag space in an Exif tree, or nil if not present.
+func exifSpaceNode(exif *Exif, space tiff.TagSpace) *tiff.IFDNode {
+	switch space {
+	case tiff.TIFFSpace:
+		return exif.TIFF
+	case tiff.ExifSpace:
+		return exif.Exif
+	case tiff.GPSSpace:
+		return exif.GPS
+	case tiff.InteropSpace:
+		return exif.Interop
+	}
+	if exif.MakerNote != nil {
+		return findSpaceNode(exif.MakerNote, space)
+	}
+	return nil
+}
+
+// Return the first node in a tree with a given tag space, or nil if
+// not found.
+func findSpaceNode(node *tiff.IFDNode, space tiff.TagSpace) *tiff.IFDNode {
+	if node.GetSpace() == space {
+		return node
+	}
+	for _, sub := range node.SubIFDs {
+		if found := findSpaceNode(sub.Node, space); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// Return a field from an IFD, or nil if not found.
+func findField(node *tiff.IFDNode, tag tiff.Tag) *tiff.Field {
+	if node == nil {
+		return nil
+	}
+	if fields := node.FindFields([]tiff.Tag{tag}); len(fields) > 0 {
+		return fields[0]
+	}
+	return nil
+}
+
+// Add a field to an IFD, replacing any field with the same tag.
+func setField(node *tiff.IFDNode, field tiff.Field) {
+	node.DeleteFields([]tiff.Tag{field.Tag})
+	node.AddFields([]tiff.Field{field})
+}
+
+// Create a GPS IFD and add it to a TIFF tree.
+func addGPSIFD(exif *Exif) {
+	gpsNode := tiff.NewIFDNode(tiff.GPSSpace)
+	gpsNode.Order = exif.TIFF.Order
+	gpsNode.AddFields([]tiff.Field{{Tag: GPSVersionID, Type: tiff.BYTE, Count: 4, Data: []byte{2, 3, 0, 0}}})
+	// Data will be set to the right offset when the tree is
+	// serialized.
+	exif.TIFF.AddFields([]tiff.Field{{Tag: tiff.GPSIFD, Type: tiff.LONG, Count: 1, Data: make([]byte, 4)}})
+	exif.TIFF.SubIFDs = append(exif.TIFF.SubIFDs, tiff.SubIFD{Tag: tiff.GPSIFD, Node: gpsNode})
+	exif.GPS = gpsNode
+}
+
+// Return the IFD for a tag space in an Exif tree, creating an Exif or
+// GPS IFD if required.
+func makeSpaceNode(exif *Exif, space tiff.TagSpace) *tiff.IFDNode {
+	if node := exifSpaceNode(exif, space); node != nil {
+		return node
+	}
+	switch space {
+	case tiff.ExifSpace:
+		addExifIFD(exif)
+	case tiff.GPSSpace:
+		addGPSIFD(exif)
+	}
+	return exifSpaceNode(exif, space)
+}
+
+// Return a field's rational value as text.
+func rationalText(field *tiff.Field, i uint32, order binary.ByteOrder) string {
+	n, d := field.AnyRational(i, order)
+	return fmt.Sprintf("%d/%d", n, d)
+}
+
+// Return a field's rational value as a float, or NaN if the
+// denominator is zero.
+func rationalFloat(field *tiff.Field, i uint32, order binary.ByteOrder) float64 {
+	n, d := field.AnyRational(i, order)
+	if d == 0 {
+		return math.NaN()
+	}
+	return float64(n) / float64(d)
+}
+
+// Character codes at the start of UserComment and similar fields.
+var (
+	commentASCII     = []byte("ASCII\x00\x00\x00")
+	commentUnicode   = []byte("UNICODE\x00")
+	commentUndefined = make([]byte, 8)
+)
+
+// Decode a field with an 8 byte character code prefix.
+func commentText(field *tiff.Field, order binary.ByteOrder) string {
+	data := field.Data
+	if len(data) < 8 {
+		return ""
+	}
+	code, text := data[:8], data[8:]
+	if string(code) == string(commentUnicode) {
+		u := make([]uint16, len(text)/2)
+		for i := range u {
+			u[i] = order.Uint16(text[i*2:])
+		}
+		return strings.TrimRight(string(utf16.Decode(u)), "\x00 ")
+	}
+	return strings.TrimRight(string(text), "\x00 ")
+}
+
+// Format an Exif date, "YYYY:MM:DD HH:MM:SS", as an ISO 8601 date,
+// adding subseconds and a time zone offset if available. Returns ""
+// if the date is invalid or blank.
+func exifDateToISO(date, subsec, offset string) string {
+	t, err := time.Parse("2006:01:02 15:04:05", strings.TrimSpace(date))
+	if err != nil {
+		return ""
+	}
+	iso := t.Format("2006-01-02T15:04:05")
+	if subsec = strings.TrimSpace(subsec); subsec != "" {
+		if _, err := strconv.ParseUint(subsec, 10, 64); err == nil {
+			iso += "." + subsec
+		}
+	}
+	if offset = strings.TrimSpace(offset); len(offset) == 6 && (offset[0] == '+' || offset[0] == '-') {
+		iso += offset
+	}
+	return iso
+}
+
+// Parse an ISO 8601 date as used in XMP, which may omit the seconds
+// or time, returning the Exif date, subseconds and time zone offset.
+func isoDateToExif(iso string) (date, subsec, offset string, err error) {
+	iso = strings.TrimSpace(iso)
+	var t time.Time
+	for _, layout := range []string{"2006-01-02T15:04:05.999999999Z07:00", "2006-01-02T15:04:05.999999999", "2006-01-02T15:04Z07:00", "2006-01-02T15:04", "2006-01-02", "2006-01", "2006"} {
+		if t, err = time.Parse(layout, iso); err == nil {
+			if strings.HasSuffix(layout, "Z07:00") {
+				offset = t.Format("-07:00")
+			}
+			break
+		}
+	}
+	if err != nil {
+		return "", "", "", fmt.Errorf("Invalid XMP date %q", iso)
+	}
+	if dot := strings.IndexByte(iso, '.'); dot >= 0 {
+		end := dot + 1
+		for end < len(iso) && iso[end] >= '0' && iso[end] <= '9' {
+			end++
+		}
+		subsec = iso[dot+1 : end]
+	}
+	return t.Format("2006:01:02 15:04:05"), subsec, offset, nil
+}
+
+// Format GPS coordinates from degrees, minutes and seconds rationals
+// and a reference, as XMP "DDD,MM.mmk" text.
+func gpsCoordText(field *tiff.Field, ref string, order binary.ByteOrder) string {
+	if field.Count < 3 || ref == "" {
+		return ""
+	}
+	total := rationalFloat(field, 0, order) + rationalFloat(field, 1, order)/60 + rationalFloat(field, 2, order)/3600
+	if math.IsNaN(total) {
+		return ""
+	}
+	deg := math.Floor(total)
+	min := math.Floor((total-deg)*60*1e6+0.5) / 1e6
+	return fmt.Sprintf("%d,%s%s", int(deg), strconv.FormatFloat(min, 'f', -1, 64), ref[:1])
+}
+
+// Parse XMP GPS coordinates, "DDD,MM,SSk" or "DDD,MM.mmk", returning
+// degrees as a positive number and the reference letter.
+func parseGPSCoord(text string) (float64, string, error) {
+	text = strings.TrimSpace(text)
+	if len(text) < 2 {
+		return 0, "", fmt.Errorf("Invalid XMP GPS coordinate %q", text)
+	}
+	ref := strings.ToUpper(text[len(text)-1:])
+	if !strings.Contains("NSEW", ref) {
+		return 0, "", fmt.Errorf("Invalid XMP GPS coordinate %q", text)
+	}
+	parts := strings.Split(text[:len(text)-1], ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, "", fmt.Errorf("Invalid XMP GPS coordinate %q", text)
+	}
+	total := 0.0
+	for i, part := range parts {
+		val, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, "", fmt.Errorf("Invalid XMP GPS coordinate %q", text)
+		}
+		total += val / math.Pow(60, float64(i))
+	}
+	return total, ref, nil
+}
+
+// Convert an Exif field to an XMP property, or return false if the
+// field isn't present or can't be converted.
+func exifToXMPProperty(exif *Exif, m xmpMapping) (XMPProperty, bool) {
+	node := exifSpaceNode(exif, m.space)
+	field := findField(node, m.tag)
+	if field == nil || field.Count == 0 {
+		return XMPProperty{}, false
+	}
+	// Fields with types that can't be converted are ignored.
+	switch m.conv {
+	case convInteger, convIntegerSeq, convFlash:
+		if !field.Type.IsIntegral() {
+			return XMPProperty{}, false
+		}
+	case convRational, convRationalSeq, convGPSCoord, convGPSTime:
+		if !field.Type.IsRational() {
+			return XMPProperty{}, false
+		}
+	}
+	order := node.Order
+	prop := XMPProperty{NS: m.ns, Name: m.name}
+	switch m.conv {
+	case convText:
+		prop.Value = strings.TrimRight(field.ASCII(), " ")
+		if prop.Value == "" {
+			return prop, false
+		}
+	case convInteger:
+		prop.Value = strconv.FormatInt(field.AnyInteger(0, order), 10)
+	case convIntegerSeq:
+		prop.Kind = XMPSeq
+		for i := uint32(0); i < field.Count; i++ {
+			prop.Items = append(prop.Items, XMPProperty{Value: strconv.FormatInt(field.AnyInteger(i, order), 10)})
+		}
+	case convUndefInt:
+		prop.Value = strconv.Itoa(int(field.Data[0]))
+	case convRational:
+		prop.Value = rationalText(field, 0, order)
+	case convRationalSeq:
+		prop.Kind = XMPSeq
+		for i := uint32(0); i < field.Count; i++ {
+			prop.Items = append(prop.Items, XMPProperty{Value: rationalText(field, i, order)})
+		}
+	case convVersion:
+		prop.Value = string(field.Data)
+	case convLangAlt:
+		text := strings.TrimRight(field.ASCII(), " ")
+		if text == "" {
+			return prop, false
+		}
+		prop = XMPLangAlt(m.ns, m.name, text)
+	case convCreator:
+		var names []string
+		for _, name := range strings.Split(field.ASCII(), ";") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return prop, false
+		}
+		prop = XMPArray(m.ns, m.name, XMPSeq, names)
+	case convComment:
+		text := commentText(field, order)
+		if text == "" {
+			return prop, false
+		}
+		if m.tag == UserComment {
+			prop = XMPLangAlt(m.ns, m.name, text)
+		} else {
+			prop.Value = text
+		}
+	case convDate:
+		aux := dateAuxTags[m.tag]
+		var subsec, offset string
+		if f := findField(exif.Exif, aux[0]); f != nil {
+			subsec = f.ASCII()
+		}
+		if f := findField(exif.Exif, aux[1]); f != nil {
+			offset = f.ASCII()
+		}
+		prop.Value = exifDateToISO(field.ASCII(), subsec, offset)
+		if prop.Value == "" {
+			return prop, false
+		}
+	case convFlash:
+		val := field.AnyInteger(0, order)
+		boolText := func(b bool) string {
+			if b {
+				return "True"
+			}
+			return "False"
+		}
+		prop.Kind = XMPStruct
+		prop.Items = []XMPProperty{
+			XMPText(m.ns, "Fired", boolText(val&1 != 0)),
+			XMPText(m.ns, "Return", strconv.Itoa(int(val>>1&3))),
+			XMPText(m.ns, "Mode", strconv.Itoa(int(val>>3&3))),
+			XMPText(m.ns, "Function", boolText(val&0x20 != 0)),
+			XMPText(m.ns, "RedEyeMode", boolText(val&0x40 != 0)),
+		}
+	case convGPSVersion:
+		if field.Count < 4 {
+			return prop, false
+		}
+		prop.Value = fmt.Sprintf("%d.%d.%d.%d", field.Data[0], field.Data[1], field.Data[2], field.Data[3])
+	case convGPSCoord:
+		var ref string
+		if f := findField(node, m.tag-1); f != nil {
+			ref = f.ASCII()
+		}
+		prop.Value = gpsCoordText(field, ref, order)
+		if prop.Value == "" {
+			return prop, false
+		}
+	case convGPSTime:
+		date := findField(node, GPSDateStamp)
+		if date == nil || field.Count < 3 {
+			return prop, false
+		}
+		t, err := time.Parse("2006:01:02", strings.TrimSpace(date.ASCII()))
+		if err != nil {
+			return prop, false
+		}
+		secs := rationalFloat(field, 0, order)*3600 + rationalFloat(field, 1, order)*60 + rationalFloat(field, 2, order)
+		if math.IsNaN(secs) {
+			return prop, false
+		}
+		t = t.Add(time.Duration(secs * float64(time.Second)))
+		prop.Value = t.Format("2006-01-02T15:04:05.999Z")
+	}
+	return prop, true
+}
+
+// Add the XMP properties corresponding to the fields in an Exif tree
+// to XMP metadata, replacing any existing properties with the same
+// names.
+func ExifToXMP(exif Exif, meta *XMPMeta) {
+	for _, m := range xmpMappings {
+		if prop, ok := exifToXMPProperty(&exif, m); ok {
+			meta.Set(prop)
+		}
+	}
+}
+
+// Maker note fields giving the camera serial number and the lens,
+// mapped to the properties in the aux namespace that are used by
+// Adobe software. These are only converted from Exif to XMP.
+var makerNoteXMPMappings = []xmpMapping{
+	{tiff.Canon1Space, Canon1SerialNumber, tiff.LONG, NSaux, "SerialNumber", convInteger},
+	{tiff.Canon1Space, Canon1LensModel, tiff.ASCII, NSaux, "Lens", convText},
+	{tiff.Nikon2Space, Nikon2SerialNumber, tiff.ASCII, NSaux, "SerialNumber", convText},
+	{tiff.Olympus1Space, Olympus1SerialNumber, tiff.ASCII, NSaux, "SerialNumber", convText},
+	{tiff.Olympus1EquipmentSpace, Olympus1EqSerialNumber, tiff.ASCII, NSaux, "SerialNumber", convText},
+	{tiff.Olympus1EquipmentSpace, Olympus1EqLensModel, tiff.ASCII, NSaux, "Lens", convText},
+	{tiff.Olympus1EquipmentSpace, Olympus1EqLensSerialNumber, tiff.ASCII, NSaux, "LensSerialNumber", convText},
+	{tiff.Panasonic1Space, Panasonic1LensType, tiff.ASCII, NSaux, "Lens", convText},
+	{tiff.Panasonic1Space, Panasonic1LensSerialNumber, tiff.ASCII, NSaux, "LensSerialNumber", convText},
+}
+
+// Add aux:SerialNumber, aux:Lens and aux:LensSerialNumber properties
+// to XMP metadata from fields in the maker note, for cameras that
+// don't use the corresponding Exif fields. Existing properties are
+// replaced. Fields with unexpected types are ignored.
+func MakerNoteToXMP(exif Exif, meta *XMPMeta) {
+	if exif.MakerNote == nil {
+		return
+	}
+	for _, m := range makerNoteXMPMappings {
+		node := exifSpaceNode(&exif, m.space)
+		if field := findField(node, m.tag); field == nil || field.Type != m.typ {
+			continue
+		}
+		if prop, ok := exifToXMPProperty(&exif, m); ok {
+			meta.Set(prop)
+		}
+	}
+}
+
+// Parse a rational from XMP text, which is normally "n/d" but may be a
+// decimal number.
+func parseRational(text string) (int64, int64, error) {
+	text = strings.TrimSpace(text)
+	if slash := strings.IndexByte(text, '/'); slash >= 0 {
+		n, err1 := strconv.ParseInt(text[:slash], 10, 64)
+		d, err2 := strconv.ParseInt(text[slash+1:], 10, 64)
+		if err1 != nil || err2 != nil {
+			return 0, 0, fmt.Errorf("Invalid XMP rational %q", text)
+		}
+		return n, d, nil
+	}
+	val, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid XMP rational %q", text)
+	}
+	if val == math.Floor(val) {
+		return int64(val), 1, nil
+	}
+	return int64(math.Floor(val*10000 + 0.5)), 10000, nil
+}
+
+// Make a field of rational values, which must be in range for the
+// type.
+func rationalsField(tag tiff.Tag, typ tiff.Type, vals [][2]int64, order binary.ByteOrder) tiff.Field {
+	field := tiff.Field{Tag: tag, Type: typ, Count: uint32(len(vals)), Data: make([]byte, typ.Size()*uint32(len(vals)))}
+	for i, v := range vals {
+		// tiff66's PutAnyRational can't be used, it always panics.
+		if typ == tiff.SRATIONAL {
+			field.PutSRational(int32(v[0]), int32(v[1]), uint32(i), order)
+		} else {
+			field.PutRational(uint32(v[0]), uint32(v[1]), uint32(i), order)
+		}
+	}
+	return field
+}
+
+// Make a field of integer values.
+func integersField(tag tiff.Tag, typ tiff.Type, vals []int64, order binary.ByteOrder) tiff.Field {
+	field := tiff.Field{Tag: tag, Type: typ, Count: uint32(len(vals)), Data: make([]byte, typ.Size()*uint32(len(vals)))}
+	for i, v := range vals {
+		field.PutAnyInteger(v, uint32(i), order)
+	}
+	return field
+}
+
+// Convert an XMP property to Exif fields, which are added to the
+// tree.
+func xmpToExifFields(prop XMPProperty, exif *Exif, m xmpMapping) error {
+	order := exif.TIFF.Order
+	var fields []tiff.Field
+	switch m.conv {
+	case convText, convLangAlt:
+		fields = append(fields, asciiField(m.tag, []byte(prop.Text())))
+	case convCreator:
+		fields = append(fields, asciiField(m.tag, []byte(strings.Join(prop.Values(), "; "))))
+	case convInteger, convIntegerSeq, convUndefInt:
+		values := prop.Values()
+		if m.conv != convIntegerSeq && len(values) > 1 {
+			values = values[:1]
+		}
+		var ints []int64
+		for _, v := range values {
+			i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid XMP integer %q for %s", v, m.name)
+			}
+			ints = append(ints, i)
+		}
+		if len(ints) == 0 {
+			return nil
+		}
+		if m.conv == convUndefInt {
+			fields = append(fields, tiff.Field{Tag: m.tag, Type: tiff.UNDEFINED, Count: 1, Data: []byte{byte(ints[0])}})
+		} else {
+			fields = append(fields, integersField(m.tag, m.typ, ints, order))
+		}
+	case convRational, convRationalSeq:
+		var vals [][2]int64
+		for _, v := range prop.Values() {
+			n, d, err := parseRational(v)
+			if err != nil {
+				return err
+			}
+			vals = append(vals, [2]int64{n, d})
+		}
+		if len(vals) == 0 {
+			return nil
+		}
+		fields = append(fields, rationalsField(m.tag, m.typ, vals, order))
+	case convVersion:
+		fields = append(fields, tiff.Field{Tag: m.tag, Type: tiff.UNDEFINED, Count: uint32(len(prop.Value)), Data: []byte(prop.Value)})
+	case convComment:
+		text := prop.Text()
+		data := append([]byte{}, commentASCII...)
+		for _, r := range text {
+			if r >= 0x80 {
+				data = append([]byte{}, commentUnicode...)
+				for _, u := range utf16.Encode([]rune(text)) {
+					b := make([]byte, 2)
+					order.PutUint16(b, u)
+					data = append(data, b...)
+				}
+				break
+			}
+		}
+		if string(data[:8]) == string(commentASCII) {
+			data = append(data, text...)
+		}
+		fields = append(fields, tiff.Field{Tag: m.tag, Type: tiff.UNDEFINED, Count: uint32(len(data)), Data: data})
+	case convDate:
+		date, subsec, offset, err := isoDateToExif(prop.Value)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, asciiField(m.tag, []byte(date)))
+		aux := dateAuxTags[m.tag]
+		if exif.Exif != nil {
+			exif.Exif.DeleteFields(aux[:])
+		}
+		if subsec != "" {
+			setField(makeSpaceNode(exif, tiff.ExifSpace), asciiField(aux[0], []byte(subsec)))
+		}
+		if offset != "" {
+			setField(makeSpaceNode(exif, tiff.ExifSpace), asciiField(aux[1], []byte(offset)))
+		}
+	case convFlash:
+		flag := func(name string, bit int64) int64 {
+			if field := prop.Field(m.ns, name); field != nil && strings.EqualFold(field.Value, "True") {
+				return bit
+			}
+			return 0
+		}
+		number := func(name string, shift uint) int64 {
+			if field := prop.Field(m.ns, name); field != nil {
+				n, _ := strconv.ParseInt(field.Value, 10, 64)
+				return (n & 3) << shift
+			}
+			return 0
+		}
+		val := flag("Fired", 1) | number("Return", 1) | number("Mode", 3) | flag("Function", 0x20) | flag("RedEyeMode", 0x40)
+		fields = append(fields, integerField(m.tag, tiff.SHORT, val, order))
+	case convGPSVersion:
+		var data []byte
+		for _, part := range strings.Split(prop.Value, ".") {
+			n, err := strconv.ParseUint(part, 10, 8)
+			if err != nil {
+				return fmt.Errorf("Invalid XMP GPS version %q", prop.Value)
+			}
+			data = append(data, byte(n))
+		}
+		if len(data) != 4 {
+			return fmt.Errorf("Invalid XMP GPS version %q", prop.Value)
+		}
+		fields = append(fields, tiff.Field{Tag: m.tag, Type: tiff.BYTE, Count: 4, Data: data})
+	case convGPSCoord:
+		deg, ref, err := parseGPSCoord(prop.Value)
+		if err != nil {
+			return err
+		}
+		d := math.Floor(deg)
+		min := math.Floor((deg - d) * 60)
+		sec := int64(math.Floor(((deg-d)*60-min)*60*1000000 + 0.5))
+		fields = append(fields, asciiField(m.tag-1, []byte(ref)), rationalsField(m.tag, tiff.RATIONAL, [][2]int64{{int64(d), 1}, {int64(min), 1}, {sec, 1000000}}, order))
+	case convGPSTime:
+		date, subsec, offset, err := isoDateToExif(prop.Value)
+		if err != nil {
+			return err
+		}
+		t, _ := time.Parse("2006:01:02 15:04:05", date)
+		if offset != "" {
+			// Convert to UTC.
+			zone, _ := time.Parse("-07:00", offset)
+			_, secs := zone.Zone()
+			t = t.Add(-time.Duration(secs) * time.Second)
+		}
+		micros := int64(0)
+		if subsec != "" {
+			frac, _ := strconv.ParseFloat("0."+subsec, 64)
+			micros = int64(frac*1000000 + 0.5)
+		}
+		fields = append(fields, asciiField(GPSDateStamp, []byte(t.Format("2006:01:02"))), rationalsField(m.tag, tiff.RATIONAL, [][2]int64{{int64(t.Hour()), 1}, {int64(t.Minute()), 1}, {int64(t.Second())*1000000 + micros, 1000000}}, order))
+	}
+	if len(fields) > 0 {
+		node := makeSpaceNode(exif, m.space)
+		for _, field := range fields {
+			setField(node, field)
+		}
+	}
+	return nil
+}
+
+// Set the fields in an Exif tree that correspond to properties in XMP
+// metadata, creating an Exif or GPS IFD if required. Fields without
+// a corresponding property are left unchanged. Returns a multierror
+// structure if any properties couldn't be converted; the others will
+// still be set.
+func XMPToExif(meta *XMPMeta, exif *Exif) error {
+	var err error
+	done := make(map[tiff.TagSpace]map[tiff.Tag]bool)
+	for _, m := range xmpMappings {
+		prop := meta.Get(m.ns, m.name)
+		if prop == nil || done[m.space][m.tag] {
+			continue
+		}
+		if done[m.space] == nil {
+			done[m.space] = make(map[tiff.Tag]bool)
+		}
+		done[m.space][m.tag] = true
+		if propErr := xmpToExifFields(*prop, exif, m); propErr != nil {
+			err = multierror.Append(err, propErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package exif44
+
+import (
+	"encoding/binary"
+	"testing"
+
+	tiff "github.com/garyhouston/tiff66"
+)
+
+func TestExifToXMP(t *testing.T) {
+	order := binary.BigEndian
+	tests := []struct {
+		name  string
+		field tiff.Field
+		ns    string
+		prop  string
+		value string // Expected text, or "" if the property isn't set.
+	}{
+		{"ISO", integersField(PhotographicSensitivity, tiff.SHORT, []int64{200}, order), NSexifEX, "PhotographicSensitivity", "200"},
+		{"ISO seq", integersField(PhotographicSensitivity, tiff.SHORT, []int64{200}, order), NSexif, "ISOSpeedRatings", "200"},
+		{"ISO as ASCII", testASCII(PhotographicSensitivity, "200"), NSexifEX, "PhotographicSensitivity", ""},
+		{"ISO seq as ASCII", testASCII(PhotographicSensitivity, "200"), NSexif, "ISOSpeedRatings", ""},
+		{"exposure", rationalsField(ExposureTime, tiff.RATIONAL, [][2]int64{{1, 250}}, order), NSexif, "ExposureTime", "1/250"},
+		{"exposure as LONG", integersField(ExposureTime, tiff.LONG, []int64{250}, order), NSexif, "ExposureTime", ""},
+		{"flash as rational", rationalsField(Flash, tiff.RATIONAL, [][2]int64{{1, 1}}, order), NSexif, "Flash", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var meta XMPMeta
+			ExifToXMP(*testExif("Acme", test.field), &meta)
+			prop := meta.Get(test.ns, test.prop)
+			switch {
+			case test.value == "" && prop != nil:
+				t.Errorf("unexpected property %v", *prop)
+			case test.value != "" && (prop == nil || prop.Text() != test.value):
+				t.Errorf("property %v, expected %q", prop, test.value)
+			}
+		})
+	}
+}
+
+func TestExifToXMPGPS(t *testing.T) {
+	order := binary.BigEndian
+	tests := []struct {
+		name  string
+		field tiff.Field
+		value string
+	}{
+		{"rational", rationalsField(GPSLatitude, tiff.RATIONAL, [][2]int64{{51, 1}, {30, 1}, {0, 1}}, order), "51,30N"},
+		{"SHORT", integersField(GPSLatitude, tiff.SHORT, []int64{51, 30, 0}, order), ""},
+		{"zero denominator", rationalsField(GPSLatitude, tiff.RATIONAL, [][2]int64{{51, 0}, {30, 1}, {0, 1}}, order), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exif := testExif("Acme")
+			gps := makeSpaceNode(exif, tiff.GPSSpace)
+			gps.AddFields([]tiff.Field{testASCII(GPSLatitudeRef, "N"), test.field})
+			var meta XMPMeta
+			ExifToXMP(*exif, &meta)
+			prop := meta.Get(NSexif, "GPSLatitude")
+			switch {
+			case test.value == "" && prop != nil:
+				t.Errorf("unexpected property %v", *prop)
+			case test.value != "" && (prop == nil || prop.Value != test.value):
+				t.Errorf("property %v, expected %q", prop, test.value)
+			}
+		})
+	}
+}
+
+func TestMakerNoteToXMP(t *testing.T) {
+	canon := func(entries ...testEntry) []byte {
+		return testMakerNoteTIFF(t, "Canon", func(pos uint32) []byte {
+			return testRawIFD(pos, entries)
+		})
+	}
+	lens := append([]byte("EF50mm f/1.8 STM"), 0)
+	tests := []struct {
+		name   string
+		data   []byte
+		serial string // Expected aux:SerialNumber, or "".
+		lens   string // Expected aux:Lens, or "".
+	}{
+		{"Canon", canon(testEntry{Canon1SerialNumber, tiff.LONG, 1, []byte{0, 0, 0x30, 0x39}}, testEntry{Canon1LensModel, tiff.ASCII, uint32(len(lens)), lens}), "12345", "EF50mm f/1.8 STM"},
+		{"serial as ASCII", canon(testEntry{Canon1SerialNumber, tiff.ASCII, 4, []byte("123\000")}), "", ""},
+		{"lens as SHORT", canon(testEntry{Canon1LensModel, tiff.SHORT, 1, []byte{0, 1}}), "", ""},
+		{"no maker note", testTIFF(t, testExif("Canon")), "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exif, err := GetExifTree(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var meta XMPMeta
+			MakerNoteToXMP(*exif, &meta)
+			for _, p := range []struct{ name, value string }{{"SerialNumber", test.serial}, {"Lens", test.lens}} {
+				prop := meta.Get(NSaux, p.name)
+				switch {
+				case p.value == "" && prop != nil:
+					t.Errorf("unexpected property %v", *prop)
+				case p.value != "" && (prop == nil || prop.Value != p.value):
+					t.Errorf("property %v, expected %q", prop, p.value)
+				}
+			}
+		})
+	}
+}
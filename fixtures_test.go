@@ -0,0 +1,148 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// Small fixtures shared by the tests, built in memory.
+
+// Return a JPEG image of the given size.
+func testJPEG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Return an ASCII field.
+func testASCII(tag tiff.Tag, s string) tiff.Field {
+	data := append([]byte(s), 0)
+	return tiff.Field{Tag: tag, Type: tiff.ASCII, Count: uint32(len(data)), Data: data}
+}
+
+// Return a field with a single SHORT value.
+func testShort(tag tiff.Tag, val uint16, order binary.ByteOrder) tiff.Field {
+	field := tiff.Field{Tag: tag, Type: tiff.SHORT, Count: 1, Data: make([]byte, 2)}
+	order.PutUint16(field.Data, val)
+	return field
+}
+
+// Return a big-endian Exif tree with a Make field in IFD0 and the given
+// fields in the Exif IFD.
+func testExif(make string, fields ...tiff.Field) *Exif {
+	root := tiff.NewIFDNode(tiff.TIFFSpace)
+	root.Order = binary.BigEndian
+	root.AddFields([]tiff.Field{testASCII(tiff.Make, make)})
+	exifNode := tiff.NewIFDNode(tiff.ExifSpace)
+	exifNode.Order = binary.BigEndian
+	exifNode.AddFields(append([]tiff.Field{{Tag: ExifVersion, Type: tiff.UNDEFINED, Count: 4, Data: []byte("0230")}}, fields...))
+	root.AddFields([]tiff.Field{longField(tiff.ExifIFD, 0, root.Order)})
+	root.SubIFDs = append(root.SubIFDs, tiff.SubIFD{Tag: tiff.ExifIFD, Node: exifNode})
+	return makeExif(root)
+}
+
+// Return an Exif tree with an undecoded maker note.
+func testMakerNoteExif(make string, makerNote []byte) *Exif {
+	return testExif(make, tiff.Field{Tag: MakerNote, Type: tiff.UNDEFINED, Count: uint32(len(makerNote)), Data: makerNote})
+}
+
+// Serialize an Exif tree as TIFF data.
+func testTIFF(t *testing.T, exif *Exif) []byte {
+	buf := make([]byte, exif.TreeSize())
+	if _, err := exif.Put(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// Return a JPEG file with an APP1 Exif segment for each TIFF buffer,
+// followed by the image data and the trailer.
+func testJPEGFile(t *testing.T, tiffData [][]byte, trailer []byte) []byte {
+	image := testJPEG(t, 16, 8)
+	out := []byte{0xFF, 0xD8}
+	for _, data := range tiffData {
+		seg := make([]byte, HeaderSize+len(data))
+		PutHeader(seg)
+		copy(seg[HeaderSize:], data)
+		out = append(out, 0xFF, 0xE1, 0, 0)
+		binary.BigEndian.PutUint16(out[len(out)-2:], uint16(len(seg)+2))
+		out = append(out, seg...)
+	}
+	out = append(out, image[2:]...)
+	return append(out, trailer...)
+}
+
+// Return the TIFF data of the first Exif segment of a JPEG file,
+// extending to the end of the file.
+func testJPEGTIFF(t *testing.T, file []byte) []byte {
+	pos, err := jpegTIFFPos(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file[pos:]
+}
+
+// ReadWrite a file in memory.
+func testReadWrite(t *testing.T, file []byte, control ReadWriteControl) ([]byte, error) {
+	var out WriteBuffer
+	err := ReadWrite(bytes.NewReader(file), &out, control)
+	return out.Bytes(), err
+}
+
+// Exif callback that calls a function on each tree.
+type testExifFunc func(*Exif)
+
+func (f testExifFunc) ReadWriteExif(format FileFormat, imageIdx uint32, exif *Exif, err error) error {
+	f(exif)
+	return nil
+}
+
+// Insert a segment after the SOI marker of a JPEG file.
+func testInsertSegment(file []byte, marker jseg.Marker, data []byte) []byte {
+	seg := []byte{0xFF, byte(marker), 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(data)+2))
+	seg = append(seg, data...)
+	return append(append(append([]byte{}, file[:2]...), seg...), file[2:]...)
+}
+
+// Return the segments of the first image in a JPEG file that precede
+// the SOS marker.
+func testSegments(t *testing.T, file []byte) []jseg.Segment {
+	scanner, err := jseg.NewScanner(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segments []jseg.Segment
+	for {
+		marker, buf, err := scanner.Scan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if marker == jseg.SOS || marker == jseg.EOI {
+			return segments
+		}
+		segments = append(segments, jseg.Segment{Marker: marker, Data: append([]byte{}, buf...)})
+	}
+}
+
+// ExifRequired callback that requests Exif data for all images.
+type testExifRequired struct{}
+
+func (testExifRequired) ExifRequired(format FileFormat, imageIdx uint32) bool {
+	return true
+}
+
+// Trailer callback that calls a function on the trailer.
+type testTrailerFunc func([]byte) []byte
+
+func (f testTrailerFunc) ReadWriteTrailer(format FileFormat, trailer []byte) ([]byte, error) {
+	return f(trailer), nil
+}
@@ -0,0 +1,343 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	tiff "github.com/garyhouston/tiff66"
+	"github.com/hashicorp/go-multierror"
+	"strings"
+	"unicode/utf16"
+)
+
+// Support for ICC color profiles in JPEG files. A profile is stored
+// in one or more APP2 segments, each with a header giving its
+// sequence number and the total number of segments. All values in
+// the profile are big endian.
+
+// Header at the start of an APP2 segment containing part of an ICC
+// profile. It's followed by the sequence number (starting at 1) and
+// the number of segments, one byte each.
+var iccHeader = []byte("ICC_PROFILE\x00")
+
+// Size of the ICC segment header, up to the start of the data.
+var iccSegmentHeaderSize = len(iccHeader) + 2
+
+// Size of the fixed header at the start of an ICC profile.
+const ICCHeaderSize = 128
+
+// Check if an APP2 segment contains part of an ICC profile.
+func IsICCSegment(buf []byte) bool {
+	return bytes.HasPrefix(buf, iccHeader) && len(buf) >= iccSegmentHeaderSize
+}
+
+// An ICC profile.
+type ICCProfile struct {
+	Data []byte // The complete profile, or nil if not present.
+}
+
+// Decoded ICC profile header.
+type ICCHeader struct {
+	Size            uint32
+	CMM             string // Preferred color management module.
+	Version         uint32 // E.g., 0x02100000 for version 2.1.
+	DeviceClass     string // E.g., "mntr" for monitor profiles.
+	ColorSpace      string // Data color space, e.g., "RGB ".
+	PCS             string // Profile connection space, "XYZ " or "Lab ".
+	Platform        string
+	RenderingIntent uint32
+	Creator         string
+}
+
+// Decode the header of an ICC profile.
+func (profile ICCProfile) Header() (*ICCHeader, error) {
+	buf := profile.Data
+	if len(buf) < ICCHeaderSize {
+		return nil, errors.New("ICC profile is truncated")
+	}
+	if string(buf[36:40]) != "acsp" {
+		return nil, errors.New("Invalid ICC profile signature")
+	}
+	order := binary.BigEndian
+	var header ICCHeader
+	header.Size = order.Uint32(buf)
+	header.CMM = string(buf[4:8])
+	header.Version = order.Uint32(buf[8:])
+	header.DeviceClass = string(buf[12:16])
+	header.ColorSpace = string(buf[16:20])
+	header.PCS = string(buf[20:24])
+	header.Platform = string(buf[40:44])
+	header.RenderingIntent = order.Uint32(buf[64:])
+	header.Creator = string(buf[80:84])
+	return &header, nil
+}
+
+// Return the data for a tag in an ICC profile, or nil if not found.
+func (profile ICCProfile) Tag(sig string) ([]byte, error) {
+	buf := profile.Data
+	bufsize := uint32(len(buf))
+	if bufsize < ICCHeaderSize+4 {
+		return nil, errors.New("ICC profile is truncated")
+	}
+	order := binary.BigEndian
+	count := order.Uint32(buf[ICCHeaderSize:])
+	pos := uint32(ICCHeaderSize + 4)
+	for i := uint32(0); i < count; i++ {
+		if pos+12 > bufsize {
+			return nil, errors.New("ICC tag table extends past end of profile")
+		}
+		if string(buf[pos:pos+4]) == sig {
+			offset := order.Uint32(buf[pos+4:])
+			size := order.Uint32(buf[pos+8:])
+			if offset+size < offset || offset+size > bufsize {
+				return nil, fmt.Errorf("ICC tag %s extends past end of profile", sig)
+			}
+			return buf[offset : offset+size], nil
+		}
+		pos += 12
+	}
+	return nil, nil
+}
+
+// Return the profile description from the 'desc' tag, which may be
+// a textDescriptionType (version 2) or multiLocalizedUnicodeType
+// (version 4). For the latter, the first record is used.
+func (profile ICCProfile) Description() (string, error) {
+	desc, err := profile.Tag("desc")
+	if err != nil || desc == nil {
+		return "", err
+	}
+	order := binary.BigEndian
+	size := uint32(len(desc))
+	if size < 12 {
+		return "", errors.New("ICC description is truncated")
+	}
+	switch string(desc[0:4]) {
+	case "desc":
+		count := order.Uint32(desc[8:])
+		if 12+count < count || 12+count > size {
+			return "", errors.New("ICC description is truncated")
+		}
+		return paddedString(desc[12 : 12+count]), nil
+	case "mluc":
+		if size < 28 || order.Uint32(desc[8:]) == 0 {
+			return "", errors.New("ICC description is truncated")
+		}
+		length := order.Uint32(desc[20:])
+		offset := order.Uint32(desc[24:])
+		if offset+length < offset || offset+length > size {
+			return "", errors.New("ICC description extends past end of tag")
+		}
+		text := make([]uint16, length/2)
+		for i := range text {
+			text[i] = order.Uint16(desc[offset+uint32(i)*2:])
+		}
+		return string(utf16.Decode(text)), nil
+	}
+	return "", fmt.Errorf("Unknown ICC description type %q", desc[0:4])
+}
+
+// Check if the profile is an sRGB profile, judging by its description.
+func (profile ICCProfile) IsSRGB() bool {
+	desc, _ := profile.Description()
+	return strings.HasPrefix(desc, "sRGB")
+}
+
+// Check if the profile is an Adobe RGB (1998) profile, or compatible
+// with it, judging by its description.
+func (profile ICCProfile) IsAdobeRGB() bool {
+	desc, _ := profile.Description()
+	return strings.Contains(desc, "Adobe RGB")
+}
+
+// Return the ColorSpace field from the Exif IFD, and the
+// InteroperabilityIndex field from the Interoperability IFD, as found
+// in an Exif tree. 'colorSpace' is zero and 'interop' is empty if not
+// found.
+func ExifColorSpace(exif Exif) (colorSpace uint16, interop string) {
+	if exif.Exif != nil {
+		if fields := exif.Exif.FindFields([]tiff.Tag{ColorSpace}); len(fields) > 0 && fields[0].Count > 0 && fields[0].Type.IsIntegral() {
+			colorSpace = uint16(fields[0].AnyInteger(0, exif.Exif.Order))
+		}
+	}
+	if exif.Interop != nil {
+		if fields := exif.Interop.FindFields([]tiff.Tag{InteroperabilityIndex}); len(fields) > 0 {
+			interop = fields[0].ASCII()
+		}
+	}
+	return colorSpace, interop
+}
+
+// Values of the Exif ColorSpace field.
+const (
+	ColorSpaceSRGB         = 1
+	ColorSpaceUncalibrated = 0xFFFF
+)
+
+// Check if an image is in the Adobe RGB color space, either with an
+// Adobe RGB profile or, if there's no profile, as indicated by the
+// DCF option file convention of an uncalibrated ColorSpace and an
+// InteroperabilityIndex of "R03". 'profile' may be nil.
+func IsAdobeRGB(exif Exif, profile *ICCProfile) bool {
+	if profile != nil && profile.Data != nil {
+		return profile.IsAdobeRGB()
+	}
+	colorSpace, interop := ExifColorSpace(exif)
+	return colorSpace == ColorSpaceUncalibrated && interop == "R03"
+}
+
+// Check that the Exif ColorSpace and InteroperabilityIndex fields are
+// consistent with an ICC profile: an sRGB profile requires an sRGB
+// ColorSpace and an "R98" index, an Adobe RGB profile requires an
+// uncalibrated ColorSpace and an "R03" index, and other profiles
+// require an uncalibrated ColorSpace. Missing fields aren't
+// considered errors. A multierror structure may be returned.
+func CheckICCColorSpace(exif Exif, profile ICCProfile) error {
+	var err error
+	if profile.Data == nil {
+		return nil
+	}
+	if _, headerErr := profile.Header(); headerErr != nil {
+		return headerErr
+	}
+	colorSpace, interop := ExifColorSpace(exif)
+	var wantColorSpace uint16 = ColorSpaceUncalibrated
+	var wantInterop string
+	if profile.IsSRGB() {
+		wantColorSpace, wantInterop = ColorSpaceSRGB, "R98"
+	} else if profile.IsAdobeRGB() {
+		wantInterop = "R03"
+	}
+	if colorSpace != 0 && colorSpace != wantColorSpace {
+		err = multierror.Append(err, fmt.Errorf("Exif ColorSpace is 0x%X, but ICC profile requires 0x%X", colorSpace, wantColorSpace))
+	}
+	if interop != "" && wantInterop != "" && interop != wantInterop {
+		err = multierror.Append(err, fmt.Errorf("InteroperabilityIndex is %s, but ICC profile requires %s", interop, wantInterop))
+	}
+	return err
+}
+
+// Return the APP2 segment data for an ICC profile.
+func makeICCSegments(profile ICCProfile) ([][]byte, error) {
+	if profile.Data == nil {
+		return nil, nil
+	}
+	chunkSize := maxSegmentData - iccSegmentHeaderSize
+	count := (len(profile.Data) + chunkSize - 1) / chunkSize
+	if count > 255 {
+		return nil, errors.New("ICC profile is too large for JPEG segments")
+	}
+	segments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(profile.Data) {
+			end = len(profile.Data)
+		}
+		buf := make([]byte, iccSegmentHeaderSize+end-i*chunkSize)
+		copy(buf, iccHeader)
+		buf[len(iccHeader)] = byte(i + 1)
+		buf[len(iccHeader)+1] = byte(count)
+		copy(buf[iccSegmentHeaderSize:], profile.Data[i*chunkSize:end])
+		segments = append(segments, buf)
+	}
+	return segments, nil
+}
+
+// Collects the ICC segments in a JPEG image.
+type iccCollector struct {
+	found    bool
+	chunks   map[uint8][]byte
+	count    uint8
+	segments [][]byte // The original segments.
+	err      error
+}
+
+// Add an APP2 segment to the collection if it contains part of an ICC
+// profile. Returns true if it did.
+func (c *iccCollector) add(buf []byte) bool {
+	if !IsICCSegment(buf) {
+		return false
+	}
+	c.found = true
+	c.segments = append(c.segments, append([]byte{}, buf...))
+	seq := buf[len(iccHeader)]
+	count := buf[len(iccHeader)+1]
+	if c.chunks == nil {
+		c.chunks = make(map[uint8][]byte)
+		c.count = count
+	}
+	if count != c.count || seq == 0 || seq > count {
+		c.err = multierror.Append(c.err, fmt.Errorf("Invalid ICC segment number %d of %d", seq, count))
+		return true
+	}
+	if _, dup := c.chunks[seq]; dup {
+		c.err = multierror.Append(c.err, fmt.Errorf("Duplicate ICC segment number %d", seq))
+		return true
+	}
+	c.chunks[seq] = append([]byte{}, buf[iccSegmentHeaderSize:]...)
+	return true
+}
+
+// Return the reassembled ICC profile. If any segments are missing,
+// the profile is returned empty.
+func (c *iccCollector) result() (ICCProfile, error) {
+	var profile ICCProfile
+	if !c.found {
+		return profile, nil
+	}
+	err := c.err
+	var data []byte
+	for seq := uint8(1); seq <= c.count; seq++ {
+		chunk, found := c.chunks[seq]
+		if !found {
+			return profile, multierror.Append(err, fmt.Errorf("ICC segment %d of %d is missing", seq, c.count))
+		}
+		data = append(data, chunk...)
+	}
+	profile.Data = data
+	if _, headerErr := profile.Header(); headerErr != nil {
+		err = multierror.Append(err, headerErr)
+	}
+	return profile, err
+}
+
+// Return the original ICC segments if the profile couldn't be
+// reassembled, or nil.
+func (c *iccCollector) incompleteSegments() [][]byte {
+	if c.count == 0 {
+		return c.segments
+	}
+	for seq := uint8(1); seq <= c.count; seq++ {
+		if _, found := c.chunks[seq]; !found {
+			return c.segments
+		}
+	}
+	return nil
+}
+
+type ReadICC interface {
+	// Callback for processing an ICC profile, read-only. For JPEG
+	// files, it will be called once for each image that contains
+	// ICC segments, after all metadata segments of the image have
+	// been read, with the segments reassembled. Any errors from
+	// reassembling the profile will be available in err, which may
+	// be a multierror structure. Returning a non-nil error will
+	// terminate processing.
+	ReadICC(format FileFormat, imageIdx uint32, profile ICCProfile, err error) error
+}
+
+type ReadWriteICC interface {
+	// Callback for processing an ICC profile, read-write. For JPEG
+	// files, it will be called once for each image, with an empty
+	// profile if the image has none. Setting Data to nil will
+	// remove the profile, except that if any segments are missing,
+	// the profile is empty and the original segments are retained
+	// unless Data is set. The profile will be written where the
+	// first ICC segment was found, or otherwise after any APP0 and
+	// APP1 segments, split into segments as required. Any errors
+	// from reassembling the profile will be available in err,
+	// which may be a multierror structure. Returning a non-nil
+	// error will terminate processing.
+	ReadWriteICC(format FileFormat, imageIdx uint32, profile *ICCProfile, err error) error
+}
@@ -0,0 +1,144 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// Return a minimal ICC profile with no tags.
+func testICCProfile() []byte {
+	profile := make([]byte, ICCHeaderSize+4)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	copy(profile[12:], "mntrRGB XYZ ")
+	copy(profile[36:], "acsp")
+	return profile
+}
+
+// Return an ICC segment with the given sequence number and count.
+func testICCSegment(seq, count uint8, data []byte) []byte {
+	return append(append(append([]byte{}, iccHeader...), seq, count), data...)
+}
+
+func TestICCCollector(t *testing.T) {
+	profile := testICCProfile()
+	first, second := profile[:100], profile[100:]
+	tests := []struct {
+		name     string
+		segments [][]byte
+		size     int // Size of the reassembled profile.
+		fail     bool
+		retain   bool // Original segments retained.
+	}{
+		{"single", [][]byte{testICCSegment(1, 1, profile)}, len(profile), false, false},
+		{"split", [][]byte{testICCSegment(1, 2, first), testICCSegment(2, 2, second)}, len(profile), false, false},
+		{"reversed", [][]byte{testICCSegment(2, 2, second), testICCSegment(1, 2, first)}, len(profile), false, false},
+		{"duplicate", [][]byte{testICCSegment(1, 2, first), testICCSegment(1, 2, first), testICCSegment(2, 2, second)}, len(profile), true, false},
+		{"missing", [][]byte{testICCSegment(1, 2, first)}, 0, true, true},
+		{"zero count", [][]byte{testICCSegment(1, 0, profile)}, 0, true, true},
+		{"bad sequence", [][]byte{testICCSegment(3, 2, first), testICCSegment(2, 2, second)}, 0, true, true},
+		{"truncated", [][]byte{testICCSegment(1, 1, first)}, len(first), true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var c iccCollector
+			for _, seg := range test.segments {
+				if !c.add(seg) {
+					t.Fatal("ICC segment not accepted")
+				}
+			}
+			result, err := c.result()
+			if (err != nil) != test.fail {
+				t.Errorf("error %v", err)
+			}
+			if len(result.Data) != test.size {
+				t.Errorf("profile of %d bytes, expected %d", len(result.Data), test.size)
+			}
+			if retained := c.incompleteSegments() != nil; retained != test.retain {
+				t.Errorf("segments retained: %v", retained)
+			}
+		})
+	}
+	var c iccCollector
+	if c.add([]byte("ICC_PROFILE\x00\x01")) || c.add([]byte("XMP")) {
+		t.Error("invalid segment accepted")
+	}
+}
+
+// ICC callback that calls a function on the profile.
+type testICCFunc func(*ICCProfile)
+
+func (f testICCFunc) ReadWriteICC(format FileFormat, imageIdx uint32, profile *ICCProfile, err error) error {
+	f(profile)
+	return nil
+}
+
+func TestReadWriteICC(t *testing.T) {
+	profile := testICCProfile()
+	plain := testJPEGFile(t, nil, nil)
+	complete := testInsertSegment(plain, jseg.APP0+2, testICCSegment(1, 1, profile))
+	incomplete := testInsertSegment(plain, jseg.APP0+2, testICCSegment(1, 2, profile[:100]))
+	keep := testICCFunc(func(*ICCProfile) {})
+	remove := testICCFunc(func(p *ICCProfile) { p.Data = nil })
+	replace := testICCFunc(func(p *ICCProfile) { p.Data = profile })
+	tests := []struct {
+		name     string
+		file     []byte
+		callback ReadWriteICC
+		expected [][]byte // Expected APP2 segments.
+	}{
+		{"complete", complete, keep, [][]byte{testICCSegment(1, 1, profile)}},
+		{"removed", complete, remove, nil},
+		{"incomplete", incomplete, keep, [][]byte{testICCSegment(1, 2, profile[:100])}},
+		{"incomplete removed", incomplete, remove, [][]byte{testICCSegment(1, 2, profile[:100])}},
+		{"incomplete replaced", incomplete, replace, [][]byte{testICCSegment(1, 1, profile)}},
+		{"created", plain, replace, [][]byte{testICCSegment(1, 1, profile)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := testReadWrite(t, test.file, ReadWriteControl{ReadWriteICC: test.callback})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var segments [][]byte
+			for _, seg := range testSegments(t, out) {
+				if seg.Marker == jseg.APP0+2 {
+					segments = append(segments, seg.Data)
+				}
+			}
+			if len(segments) != len(test.expected) {
+				t.Fatalf("%d APP2 segments, expected %d", len(segments), len(test.expected))
+			}
+			for i := range segments {
+				if !bytes.Equal(segments[i], test.expected[i]) {
+					t.Errorf("APP2 segment %d differs", i)
+				}
+			}
+		})
+	}
+}
+
+func TestExifColorSpace(t *testing.T) {
+	order := binary.BigEndian
+	tests := []struct {
+		name  string
+		field tiff.Field
+		value uint16
+	}{
+		{"sRGB", testShort(ColorSpace, ColorSpaceSRGB, order), ColorSpaceSRGB},
+		{"uncalibrated", testShort(ColorSpace, ColorSpaceUncalibrated, order), ColorSpaceUncalibrated},
+		{"ASCII", testASCII(ColorSpace, "1"), 0},
+		{"empty", tiff.Field{Tag: ColorSpace, Type: tiff.SHORT}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			colorSpace, _ := ExifColorSpace(*testExif("Acme", test.field))
+			if colorSpace != test.value {
+				t.Errorf("ColorSpace 0x%X, expected 0x%X", colorSpace, test.value)
+			}
+		})
+	}
+}
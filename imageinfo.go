@@ -0,0 +1,154 @@
+package exif44
+
+import (
+	"encoding/binary"
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+	"io"
+)
+
+// Description of an image in a file, which allows callbacks to tell
+// primary images from thumbnails, previews and other views, since
+// image indexes are numbered differently in different formats.
+type ImageInfo struct {
+	Format         FileFormat
+	ImageIdx       uint32
+	Width          uint32  // From the JPEG frame header or TIFF ImageWidth, or 0 if unknown.
+	Height         uint32  // From the JPEG frame header or TIFF ImageLength, or 0 if unknown.
+	MPF            bool    // True if the image is in a Multi-Picture Format file.
+	MPEntry        MPEntry // The image's entry from the MP Index IFD, if MPF is true.
+	NewSubfileType uint32  // TIFF NewSubfileType, or 0.
+	PageNumber     uint16  // TIFF PageNumber, from 0, or 0 if not present.
+	PageCount      uint16  // TIFF total number of pages, or 0 if unknown.
+}
+
+// Bits in the TIFF NewSubfileType field.
+const (
+	SubfileReducedResolution = 1
+	SubfilePage              = 2
+	SubfileMask              = 4
+)
+
+// Check if an image is a reduced-resolution version of another, such
+// as a TIFF thumbnail or an MPF large thumbnail. This doesn't apply
+// to the IFD1 thumbnail in the Exif data of a JPEG image, which is
+// part of the image's Exif tree.
+func (info ImageInfo) Thumbnail() bool {
+	if info.MPF {
+		mpType := info.MPEntry.Type()
+		return mpType == MPTypeLargeThumbnailVGA || mpType == MPTypeLargeThumbnailFullHD
+	}
+	return info.NewSubfileType&SubfileReducedResolution != 0
+}
+
+// Check if an image is a primary image: the baseline primary or
+// representative image of an MPF file, or otherwise a full-resolution
+// image that's not a transparency mask.
+func (info ImageInfo) Primary() bool {
+	if info.MPF {
+		return info.MPEntry.Type() == MPTypeBaselinePrimary || info.MPEntry.Attribute&MPRepresentative != 0
+	}
+	return info.NewSubfileType&(SubfileReducedResolution|SubfileMask) == 0
+}
+
+// Return the description of an image in a TIFF tree.
+func tiffImageInfo(format FileFormat, imageIdx uint32, node *tiff.IFDNode) ImageInfo {
+	info := ImageInfo{Format: format, ImageIdx: imageIdx}
+	fields := node.FindFields([]tiff.Tag{tiff.NewSubfileType, tiff.ImageWidth, tiff.ImageLength, tiff.PageNumber})
+	for _, field := range fields {
+		if field.Count == 0 || !field.Type.IsIntegral() {
+			continue
+		}
+		switch field.Tag {
+		case tiff.NewSubfileType:
+			info.NewSubfileType = uint32(field.AnyInteger(0, node.Order))
+		case tiff.ImageWidth:
+			info.Width = uint32(field.AnyInteger(0, node.Order))
+		case tiff.ImageLength:
+			info.Height = uint32(field.AnyInteger(0, node.Order))
+		case tiff.PageNumber:
+			if field.Count >= 2 {
+				info.PageNumber = uint16(field.AnyInteger(0, node.Order))
+				info.PageCount = uint16(field.AnyInteger(1, node.Order))
+			}
+		}
+	}
+	return info
+}
+
+// Check if a marker is a start of frame marker, which is one of the
+// SOFn markers other than DHT, JPG and DAC.
+func isSOF(marker jseg.Marker) bool {
+	return marker >= jseg.SOF0 && marker <= jseg.SOF15 && marker != jseg.DHT && marker != jseg.JPG && marker != jseg.DAC
+}
+
+// Return the description of an image in a JPEG stream, by scanning
+// its metadata segments. For the first image, any MP entries are
+// decoded from its MPF segment and returned; for other images, they
+// must be supplied. The reader's position is unchanged.
+func jpegImageInfo(format FileFormat, imageIdx uint32, reader io.ReadSeeker, entries []MPEntry) (ImageInfo, []MPEntry, error) {
+	info := ImageInfo{Format: format, ImageIdx: imageIdx}
+	readerSave, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return info, nil, err
+	}
+	scanner, err := jseg.NewScanner(reader)
+	if err != nil {
+		return info, nil, err
+	}
+	for {
+		marker, buf, err := scanner.Scan()
+		if err != nil {
+			return info, nil, err
+		}
+		if marker == jseg.SOS || marker == jseg.EOI {
+			// No more metadata expected.
+			break
+		}
+		if isSOF(marker) && len(buf) >= 5 {
+			info.Height = uint32(binary.BigEndian.Uint16(buf[1:]))
+			info.Width = uint32(binary.BigEndian.Uint16(buf[3:]))
+		}
+		if marker == jseg.APP0+2 && imageIdx == 0 && isMPFSegment(buf) {
+			// Errors in the MPF segment are reported
+			// elsewhere.
+			if mpf, err := getMPF(0, append([]byte{}, buf...)); err == nil {
+				entries, _ = mpf.Entries()
+			}
+		}
+	}
+	if imageIdx < uint32(len(entries)) {
+		info.MPF = true
+		info.MPEntry = entries[imageIdx]
+	}
+	// Reset the file position.
+	if _, err = reader.Seek(readerSave, io.SeekStart); err != nil {
+		return info, nil, err
+	}
+	return info, entries, nil
+}
+
+// Pass the description of an image in a JPEG stream to a callback,
+// returning the MP entries as per jpegImageInfo.
+func readJPEGImageInfo(format FileFormat, imageIdx uint32, reader io.ReadSeeker, entries []MPEntry, callback ReadImageInfo) ([]MPEntry, error) {
+	if callback == nil {
+		return nil, nil
+	}
+	info, entries, err := jpegImageInfo(format, imageIdx, reader, entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, callback.ReadImageInfo(info)
+}
+
+type ReadImageInfo interface {
+	// Callback for receiving the description of an image. It's
+	// called for each image in a file, before any other callbacks
+	// for the image, so that a handler can record whether
+	// subsequent callbacks with the same image index apply to a
+	// primary image, a thumbnail or another view. When reading
+	// TIFF files, it's only called if there's also an Exif
+	// callback. Returning a non-nil error will terminate
+	// processing.
+	ReadImageInfo(info ImageInfo) error
+}
@@ -0,0 +1,69 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// Return big-endian TIFF data with a full-resolution image in IFD0
+// and a reduced-resolution image in IFD1, without image data.
+func testSubfileTIFF() []byte {
+	order := binary.BigEndian
+	ifd := func(base uint32, subfile, width, height uint16) []byte {
+		return testRawIFD(base, []testEntry{
+			{tiff.NewSubfileType, tiff.LONG, 1, []byte{0, 0, 0, byte(subfile)}},
+			{tiff.ImageWidth, tiff.SHORT, 1, []byte{byte(width >> 8), byte(width)}},
+			{tiff.ImageLength, tiff.SHORT, 1, []byte{byte(height >> 8), byte(height)}},
+		})
+	}
+	ifd0 := ifd(8, 0, 640, 480)
+	ifd1Pos := uint32(8 + len(ifd0))
+	order.PutUint32(ifd0[tiff.TableSize(3)-4:], ifd1Pos)
+	buf := []byte("MM\000\052\000\000\000\010")
+	return append(append(buf, ifd0...), ifd(ifd1Pos, SubfileReducedResolution, 160, 120)...)
+}
+
+func TestReadImageInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    []byte
+		infos   []ImageInfo // Expected descriptions, ignoring MP entries.
+		primary []bool
+	}{
+		{"JPEG", testJPEGFile(t, [][]byte{testTIFF(t, testExif("Acme"))}, nil), []ImageInfo{{Format: FileJPEG, Width: 16, Height: 8}}, []bool{true}},
+		{"MPF", testMPF(t), []ImageInfo{
+			{Format: FileJPEG, Width: 16, Height: 8, MPF: true},
+			{Format: FileJPEG, ImageIdx: 1, Width: 8, Height: 8, MPF: true},
+		}, []bool{true, false}},
+		{"TIFF", testSubfileTIFF(), []ImageInfo{
+			{Format: FileTIFF, Width: 640, Height: 480},
+			{Format: FileTIFF, ImageIdx: 1, Width: 160, Height: 120, NewSubfileType: SubfileReducedResolution},
+		}, []bool{true, false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var infos testImageInfoRecorder
+			control := ReadControl{ReadImageInfo: &infos, ReadExif: testReadExifFunc(func(Exif, error) {})}
+			if err := Read(bytes.NewReader(test.file), control); err != nil {
+				t.Fatal(err)
+			}
+			if len(infos) != len(test.infos) {
+				t.Fatalf("image info %+v", infos)
+			}
+			for i, info := range infos {
+				entry := info.MPEntry
+				info.MPEntry = MPEntry{}
+				if info != test.infos[i] {
+					t.Errorf("image %d: info %+v", i, info)
+				}
+				info.MPEntry = entry
+				if info.Primary() != test.primary[i] || info.Thumbnail() == test.primary[i] {
+					t.Errorf("image %d: primary %v, thumbnail %v", i, info.Primary(), info.Thumbnail())
+				}
+			}
+		})
+	}
+}
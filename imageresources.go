@@ -0,0 +1,169 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+)
+
+// Photoshop image resource blocks, as found in the image resources
+// section of PSD files and in JPEG APP13 "Photoshop 3.0"
+// segments. All values are big endian.
+
+// Some of the image resource IDs. Names are from ExifTool 10.63,
+// Photoshop tags.
+const (
+	ImageResourceIPTC       = 0x0404 // IPTC-IIM datasets.
+	ImageResourceThumbnail  = 0x040C
+	ImageResourceICCProfile = 0x040F
+	ImageResourceExif       = 0x0422 // TIFF-format Exif data, without Exif header.
+	ImageResourceExif2      = 0x0423
+	ImageResourceXMP        = 0x0424
+	ImageResourceIPTCDigest = 0x0425 // MD5 digest of the IPTC resource.
+)
+
+// Mapping from image resource IDs to strings.
+var ImageResourceNames = map[uint16]string{
+	ImageResourceIPTC:       "IPTCData",
+	ImageResourceThumbnail:  "PhotoshopThumbnail",
+	ImageResourceICCProfile: "ICC_Profile",
+	ImageResourceExif:       "EXIFInfo",
+	ImageResourceExif2:      "ExifInfo2",
+	ImageResourceXMP:        "XMP",
+	ImageResourceIPTCDigest: "IPTCDigest",
+}
+
+// Signatures that may start an image resource block. "8BIM" is by far
+// the most common.
+var imageResourceSignatures = [][]byte{
+	[]byte("8BIM"), []byte("MeSa"), []byte("AgHg"), []byte("PHUT"), []byte("DCSR"),
+}
+
+// An image resource block.
+type ImageResource struct {
+	Signature []byte // Usually "8BIM".
+	ID        uint16
+	Name      string // Usually empty.
+	Data      []byte // Resource data, which points into the original buffer.
+}
+
+// Return the serialized size of an image resource block. The name is
+// stored as a Pascal string, and the name and data are padded to even
+// lengths.
+func (res ImageResource) Size() uint32 {
+	nameLen := uint32(len(res.Name)) + 1
+	dataLen := uint32(len(res.Data))
+	return 4 + 2 + nameLen + nameLen%2 + 4 + dataLen + dataLen%2
+}
+
+// Decode a sequence of image resource blocks, which should occupy all
+// of 'buf'. Resources will be read if possible even if errors occur,
+// and a multierror structure may be returned.
+func GetImageResources(buf []byte) ([]ImageResource, error) {
+	order := binary.BigEndian
+	var resources []ImageResource
+	var err error
+	bufsize := uint32(len(buf))
+	pos := uint32(0)
+	for pos < bufsize {
+		if pos+7 > bufsize {
+			return resources, multierror.Append(err, fmt.Errorf("Image resource at %d is truncated", pos))
+		}
+		var res ImageResource
+		for _, sig := range imageResourceSignatures {
+			if bytes.HasPrefix(buf[pos:], sig) {
+				res.Signature = buf[pos : pos+4]
+			}
+		}
+		if res.Signature == nil {
+			return resources, multierror.Append(err, fmt.Errorf("Invalid image resource signature at %d", pos))
+		}
+		res.ID = order.Uint16(buf[pos+4:])
+		pos += 6
+		nameLen := uint32(buf[pos]) + 1
+		if pos+nameLen+nameLen%2+4 > bufsize {
+			return resources, multierror.Append(err, fmt.Errorf("Image resource 0x%04X is truncated", res.ID))
+		}
+		res.Name = string(buf[pos+1 : pos+nameLen])
+		pos += nameLen + nameLen%2
+		dataLen := order.Uint32(buf[pos:])
+		pos += 4
+		if pos+dataLen < pos || pos+dataLen > bufsize {
+			return resources, multierror.Append(err, fmt.Errorf("Data for image resource 0x%04X extends past end of input", res.ID))
+		}
+		res.Data = buf[pos : pos+dataLen]
+		pos += dataLen + dataLen%2
+		resources = append(resources, res)
+	}
+	return resources, err
+}
+
+// Return the serialized size of a sequence of image resource blocks.
+func ImageResourcesSize(resources []ImageResource) uint32 {
+	size := uint32(0)
+	for _, res := range resources {
+		size += res.Size()
+	}
+	return size
+}
+
+// Serialize image resource blocks into a newly allocated slice.
+func MakeImageResources(resources []ImageResource) ([]byte, error) {
+	order := binary.BigEndian
+	buf := make([]byte, ImageResourcesSize(resources))
+	pos := uint32(0)
+	for _, res := range resources {
+		if len(res.Signature) != 4 {
+			return nil, errors.New("Image resource signature must have 4 bytes")
+		}
+		if len(res.Name) > 255 {
+			return nil, errors.New("Image resource name is too long")
+		}
+		copy(buf[pos:], res.Signature)
+		order.PutUint16(buf[pos+4:], res.ID)
+		pos += 6
+		nameLen := uint32(len(res.Name)) + 1
+		buf[pos] = byte(len(res.Name))
+		copy(buf[pos+1:], res.Name)
+		pos += nameLen + nameLen%2
+		dataLen := uint32(len(res.Data))
+		order.PutUint32(buf[pos:], dataLen)
+		pos += 4
+		copy(buf[pos:], res.Data)
+		pos += dataLen + dataLen%2
+	}
+	return buf, nil
+}
+
+// Return the index of the first resource with the given ID, or -1 if
+// not found.
+func FindImageResource(resources []ImageResource, id uint16) int {
+	for i := range resources {
+		if resources[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Replace the data of the first resource with the given ID, or append
+// a new "8BIM" resource if not found. If data is nil, any resources
+// with the ID are deleted instead. Returns the modified slice.
+func SetImageResource(resources []ImageResource, id uint16, data []byte) []ImageResource {
+	if data == nil {
+		out := resources[:0]
+		for _, res := range resources {
+			if res.ID != id {
+				out = append(out, res)
+			}
+		}
+		return out
+	}
+	if i := FindImageResource(resources, id); i >= 0 {
+		resources[i].Data = data
+		return resources
+	}
+	return append(resources, ImageResource{Signature: []byte("8BIM"), ID: id, Data: data})
+}
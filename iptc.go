@@ -0,0 +1,435 @@
+package exif44
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+)
+
+// Support for IPTC-IIM, as stored in the IPTC image resource of a
+// JPEG APP13 "Photoshop 3.0" segment. The image resources may be
+// split over multiple APP13 segments if they are too large for one.
+// The IIM data is a sequence of datasets, each identified by a record
+// number and a dataset number. Dataset names are from ExifTool 10.63,
+// IPTC tags.
+
+// Header at the start of an APP13 segment containing image resources.
+var photoshopHeader = []byte("Photoshop 3.0\x00")
+
+// Check if an APP13 segment contains Photoshop image resources.
+func IsPhotoshopSegment(buf []byte) bool {
+	return bytes.HasPrefix(buf, photoshopHeader)
+}
+
+// IPTCTag identifies an IIM dataset, with the record number in the
+// high byte and the dataset number in the low byte.
+type IPTCTag uint16
+
+// Return the record number of a dataset tag.
+func (tag IPTCTag) Record() uint8 {
+	return uint8(tag >> 8)
+}
+
+// Some of the IIM datasets in the envelope (1) and application (2)
+// records.
+const (
+	IPTCEnvelopeRecordVersion         = 0x0100
+	IPTCCodedCharacterSet             = 0x015A
+	IPTCApplicationRecordVersion      = 0x0200
+	IPTCObjectName                    = 0x0205
+	IPTCEditStatus                    = 0x0207
+	IPTCUrgency                       = 0x020A
+	IPTCCategory                      = 0x020F
+	IPTCSupplementalCategories        = 0x0214
+	IPTCKeywords                      = 0x0219
+	IPTCSpecialInstructions           = 0x0228
+	IPTCDateCreated                   = 0x0237
+	IPTCTimeCreated                   = 0x023C
+	IPTCOriginatingProgram            = 0x0241
+	IPTCProgramVersion                = 0x0246
+	IPTCByline                        = 0x0250
+	IPTCBylineTitle                   = 0x0255
+	IPTCCity                          = 0x025A
+	IPTCSubLocation                   = 0x025C
+	IPTCProvinceState                 = 0x025F
+	IPTCCountryCode                   = 0x0264
+	IPTCCountryName                   = 0x0265
+	IPTCOriginalTransmissionReference = 0x0267
+	IPTCHeadline                      = 0x0269
+	IPTCCredit                        = 0x026E
+	IPTCSource                        = 0x0273
+	IPTCCopyrightNotice               = 0x0274
+	IPTCContact                       = 0x0276
+	IPTCCaptionAbstract               = 0x0278
+	IPTCWriterEditor                  = 0x027A
+)
+
+// Mapping from IIM dataset tags to strings.
+var IPTCTagNames = map[IPTCTag]string{
+	IPTCEnvelopeRecordVersion:         "EnvelopeRecordVersion",
+	IPTCCodedCharacterSet:             "CodedCharacterSet",
+	IPTCApplicationRecordVersion:      "ApplicationRecordVersion",
+	IPTCObjectName:                    "ObjectName",
+	IPTCEditStatus:                    "EditStatus",
+	IPTCUrgency:                       "Urgency",
+	IPTCCategory:                      "Category",
+	IPTCSupplementalCategories:        "SupplementalCategories",
+	IPTCKeywords:                      "Keywords",
+	IPTCSpecialInstructions:           "SpecialInstructions",
+	IPTCDateCreated:                   "DateCreated",
+	IPTCTimeCreated:                   "TimeCreated",
+	IPTCOriginatingProgram:            "OriginatingProgram",
+	IPTCProgramVersion:                "ProgramVersion",
+	IPTCByline:                        "By-line",
+	IPTCBylineTitle:                   "By-lineTitle",
+	IPTCCity:                          "City",
+	IPTCSubLocation:                   "Sub-location",
+	IPTCProvinceState:                 "Province-State",
+	IPTCCountryCode:                   "Country-PrimaryLocationCode",
+	IPTCCountryName:                   "Country-PrimaryLocationName",
+	IPTCOriginalTransmissionReference: "OriginalTransmissionReference",
+	IPTCHeadline:                      "Headline",
+	IPTCCredit:                        "Credit",
+	IPTCSource:                        "Source",
+	IPTCCopyrightNotice:               "CopyrightNotice",
+	IPTCContact:                       "Contact",
+	IPTCCaptionAbstract:               "Caption-Abstract",
+	IPTCWriterEditor:                  "Writer-Editor",
+}
+
+// Value of the CodedCharacterSet dataset that indicates UTF-8.
+var iptcUTF8 = []byte("\x1B%G")
+
+// An IIM dataset.
+type IPTCDataset struct {
+	Tag  IPTCTag
+	Data []byte
+}
+
+// Decode a sequence of IIM datasets. Datasets will be read if
+// possible even if errors occur, and a multierror structure may be
+// returned.
+func GetIPTCDatasets(buf []byte) ([]IPTCDataset, error) {
+	var datasets []IPTCDataset
+	var err error
+	bufsize := uint32(len(buf))
+	pos := uint32(0)
+	for pos < bufsize {
+		if buf[pos] != 0x1C {
+			// Some writers pad the resource with zeros.
+			if bytes.Count(buf[pos:], []byte{0}) == int(bufsize-pos) {
+				break
+			}
+			return datasets, multierror.Append(err, fmt.Errorf("Invalid IIM tag marker at %d", pos))
+		}
+		if pos+5 > bufsize {
+			return datasets, multierror.Append(err, fmt.Errorf("IIM dataset at %d is truncated", pos))
+		}
+		tag := IPTCTag(binary.BigEndian.Uint16(buf[pos+1:]))
+		size := uint32(binary.BigEndian.Uint16(buf[pos+3:]))
+		pos += 5
+		if size&0x8000 != 0 {
+			// Extended dataset, with the size of the length
+			// field in the low bits.
+			lenSize := size & 0x7FFF
+			if lenSize > 4 || pos+lenSize > bufsize {
+				return datasets, multierror.Append(err, fmt.Errorf("Invalid length for IIM dataset %d:%d", tag.Record(), uint8(tag)))
+			}
+			size = 0
+			for i := uint32(0); i < lenSize; i++ {
+				size = size<<8 | uint32(buf[pos+i])
+			}
+			pos += lenSize
+		}
+		if pos+size < pos || pos+size > bufsize {
+			return datasets, multierror.Append(err, fmt.Errorf("Data for IIM dataset %d:%d extends past end of input", tag.Record(), uint8(tag)))
+		}
+		datasets = append(datasets, IPTCDataset{Tag: tag, Data: buf[pos : pos+size]})
+		pos += size
+	}
+	return datasets, err
+}
+
+// Serialize IIM datasets into a newly allocated slice.
+func MakeIPTCDatasets(datasets []IPTCDataset) []byte {
+	var buf bytes.Buffer
+	for _, ds := range datasets {
+		header := make([]byte, 5)
+		header[0] = 0x1C
+		binary.BigEndian.PutUint16(header[1:], uint16(ds.Tag))
+		if len(ds.Data) < 0x8000 {
+			binary.BigEndian.PutUint16(header[3:], uint16(len(ds.Data)))
+			buf.Write(header)
+		} else {
+			binary.BigEndian.PutUint16(header[3:], 0x8004)
+			buf.Write(header)
+			binary.Write(&buf, binary.BigEndian, uint32(len(ds.Data)))
+		}
+		buf.Write(ds.Data)
+	}
+	return buf.Bytes()
+}
+
+// IPTC data from a JPEG image.
+type IPTC struct {
+	// All image resources from the APP13 segments, including the
+	// IPTC resource itself. Other resources are written
+	// unchanged; the IPTC resource and its digest are replaced if
+	// the datasets are modified.
+	Resources []ImageResource
+	Datasets  []IPTCDataset // Datasets decoded from the IPTC resource.
+}
+
+// Check if the text datasets are encoded in UTF-8, according to the
+// CodedCharacterSet dataset. Otherwise they are in an unspecified
+// character set, often Latin-1.
+func (iptc IPTC) IsUTF8() bool {
+	for _, ds := range iptc.Datasets {
+		if ds.Tag == IPTCCodedCharacterSet {
+			return bytes.Equal(ds.Data, iptcUTF8)
+		}
+	}
+	return false
+}
+
+// Return the values of all datasets with the given tag.
+func (iptc IPTC) Strings(tag IPTCTag) []string {
+	var values []string
+	for _, ds := range iptc.Datasets {
+		if ds.Tag == tag {
+			values = append(values, string(ds.Data))
+		}
+	}
+	return values
+}
+
+// Return the value of the first dataset with the given tag, or "" if
+// not found.
+func (iptc IPTC) Value(tag IPTCTag) string {
+	for _, ds := range iptc.Datasets {
+		if ds.Tag == tag {
+			return string(ds.Data)
+		}
+	}
+	return ""
+}
+
+// Delete all datasets with the given tag.
+func (iptc *IPTC) Delete(tag IPTCTag) {
+	out := iptc.Datasets[:0]
+	for _, ds := range iptc.Datasets {
+		if ds.Tag != tag {
+			out = append(out, ds)
+		}
+	}
+	iptc.Datasets = out
+}
+
+// Insert a dataset after any datasets with the same or lower tag
+// number.
+func (iptc *IPTC) insert(ds IPTCDataset) {
+	pos := 0
+	for i, existing := range iptc.Datasets {
+		if existing.Tag <= ds.Tag {
+			pos = i + 1
+		}
+	}
+	iptc.Datasets = append(iptc.Datasets, IPTCDataset{})
+	copy(iptc.Datasets[pos+1:], iptc.Datasets[pos:])
+	iptc.Datasets[pos] = ds
+}
+
+// Replace all datasets with the given tag by new datasets with the
+// given values. The record version datasets and, if any value isn't
+// ASCII, a CodedCharacterSet dataset indicating UTF-8 will be added
+// if required.
+func (iptc *IPTC) Set(tag IPTCTag, values []string) {
+	iptc.Delete(tag)
+	if len(values) == 0 {
+		return
+	}
+	version := IPTCTag(tag.Record()) << 8
+	if version == IPTCEnvelopeRecordVersion || version == IPTCApplicationRecordVersion {
+		if iptc.Value(version) == "" {
+			iptc.insert(IPTCDataset{Tag: version, Data: []byte{0, 4}})
+		}
+	}
+	for _, v := range values {
+		for _, c := range []byte(v) {
+			if c >= 0x80 && iptc.Value(IPTCCodedCharacterSet) == "" {
+				if iptc.Value(IPTCEnvelopeRecordVersion) == "" {
+					iptc.insert(IPTCDataset{Tag: IPTCEnvelopeRecordVersion, Data: []byte{0, 4}})
+				}
+				iptc.insert(IPTCDataset{Tag: IPTCCodedCharacterSet, Data: iptcUTF8})
+			}
+		}
+		iptc.insert(IPTCDataset{Tag: tag, Data: []byte(v)})
+	}
+}
+
+// Decode the image resources from the concatenated data of APP13
+// segments, without the segment headers. Also returns a copy of the
+// decoded datasets, for detecting changes.
+func getIPTC(buf []byte) (IPTC, []IPTCDataset, error) {
+	var iptc IPTC
+	resources, err := GetImageResources(buf)
+	iptc.Resources = resources
+	if i := FindImageResource(resources, ImageResourceIPTC); i >= 0 {
+		datasets, iimErr := GetIPTCDatasets(resources[i].Data)
+		if iimErr != nil {
+			err = multierror.Append(err, iimErr)
+		}
+		iptc.Datasets = datasets
+	}
+	return iptc, copyIPTCDatasets(iptc.Datasets), err
+}
+
+// Return a copy of IIM datasets, including their data.
+func copyIPTCDatasets(datasets []IPTCDataset) []IPTCDataset {
+	if datasets == nil {
+		return nil
+	}
+	out := make([]IPTCDataset, len(datasets))
+	for i, ds := range datasets {
+		out[i] = IPTCDataset{Tag: ds.Tag, Data: append([]byte{}, ds.Data...)}
+	}
+	return out
+}
+
+// Check if two sequences of IIM datasets are the same.
+func sameIPTCDatasets(a, b []IPTCDataset) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Tag != b[i].Tag || !bytes.Equal(a[i].Data, b[i].Data) {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the APP13 segment data for IPTC. 'oldDatasets' are the
+// datasets originally decoded; if the datasets have changed, the IPTC
+// resource and its digest are updated. Otherwise the original IPTC
+// resource is retained, including any data that couldn't be decoded.
+func makeIPTCSegments(iptc IPTC, oldDatasets []IPTCDataset) ([][]byte, error) {
+	resources := append([]ImageResource{}, iptc.Resources...)
+	if !sameIPTCDatasets(iptc.Datasets, oldDatasets) {
+		var iim []byte
+		if len(iptc.Datasets) > 0 {
+			iim = MakeIPTCDatasets(iptc.Datasets)
+		}
+		resources = SetImageResource(resources, ImageResourceIPTC, iim)
+		var digest []byte
+		if iim != nil {
+			sum := md5.Sum(iim)
+			digest = sum[:]
+		}
+		resources = SetImageResource(resources, ImageResourceIPTCDigest, digest)
+	}
+	if len(resources) == 0 {
+		return nil, nil
+	}
+	buf, err := MakeImageResources(resources)
+	if err != nil {
+		return nil, err
+	}
+	var segments [][]byte
+	chunkSize := maxSegmentData - len(photoshopHeader)
+	for len(buf) > 0 {
+		n := chunkSize
+		if n > len(buf) {
+			n = len(buf)
+		}
+		segments = append(segments, append(append([]byte{}, photoshopHeader...), buf[:n]...))
+		buf = buf[n:]
+	}
+	return segments, nil
+}
+
+// Collects the APP13 image resource segments in a JPEG image.
+type iptcCollector struct {
+	found    bool
+	data     []byte
+	segments [][]byte // The original segments.
+}
+
+// Add an APP13 segment to the collection if it contains image
+// resources. Returns true if it did.
+func (c *iptcCollector) add(buf []byte) bool {
+	if !IsPhotoshopSegment(buf) {
+		return false
+	}
+	c.found = true
+	c.data = append(c.data, buf[len(photoshopHeader):]...)
+	c.segments = append(c.segments, append([]byte{}, buf...))
+	return true
+}
+
+// Return the collected IPTC data and a copy of the original datasets.
+func (c *iptcCollector) result() (IPTC, []IPTCDataset, error) {
+	if !c.found {
+		return IPTC{}, nil, nil
+	}
+	return getIPTC(c.data)
+}
+
+// Return the original segments if the image resources couldn't be
+// decoded, or nil.
+func (c *iptcCollector) undecodedSegments() [][]byte {
+	if _, err := GetImageResources(c.data); err != nil {
+		return c.segments
+	}
+	return nil
+}
+
+// Check that an IPTC digest resource, if present, matches the IPTC
+// resource.
+func CheckIPTCDigest(resources []ImageResource) error {
+	i := FindImageResource(resources, ImageResourceIPTCDigest)
+	if i < 0 {
+		return nil
+	}
+	var iim []byte
+	if j := FindImageResource(resources, ImageResourceIPTC); j >= 0 {
+		iim = resources[j].Data
+	}
+	sum := md5.Sum(iim)
+	if !bytes.Equal(resources[i].Data, sum[:]) {
+		return errors.New("IPTC digest doesn't match IPTC data")
+	}
+	return nil
+}
+
+type ReadIPTC interface {
+	// Callback for processing IPTC data, read-only. For JPEG
+	// files, it will be called once for each image that contains
+	// Photoshop APP13 segments, after all metadata segments of
+	// the image have been read. For PSD files, it will be called
+	// once if the image resources contain IPTC data. Any errors
+	// from decoding the image resources or datasets will be
+	// available in err, which may be a multierror structure.
+	// Returning a non-nil error will terminate processing.
+	ReadIPTC(format FileFormat, imageIdx uint32, iptc IPTC, err error) error
+}
+
+type ReadWriteIPTC interface {
+	// Callback for processing IPTC data, read-write. For JPEG
+	// files, it will be called once for each image, with an
+	// empty IPTC structure if the image has no Photoshop APP13
+	// segments. The image resources will be written where the
+	// first APP13 segment was found, or otherwise after any APP0
+	// and APP1 segments. If the datasets are modified, the IPTC
+	// digest resource is updated; deleting all the resources
+	// removes the APP13 segments. If the image resources can't be
+	// decoded, the original segments are written unchanged, since
+	// resources would otherwise be lost. Any errors from decoding
+	// the image resources or datasets will be available in err,
+	// which may be a multierror structure. Returning a non-nil
+	// error will terminate processing.
+	ReadWriteIPTC(format FileFormat, imageIdx uint32, iptc *IPTC, err error) error
+}
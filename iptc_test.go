@@ -0,0 +1,129 @@
+package exif44
+
+import (
+	"bytes"
+	"testing"
+
+	jseg "github.com/garyhouston/jpegsegs"
+)
+
+// Return an APP13 segment with an IPTC resource containing the given
+// datasets, and a resolution info resource.
+func testIPTCSegment(t *testing.T, datasets []IPTCDataset) []byte {
+	return testIIMSegment(t, MakeIPTCDatasets(datasets))
+}
+
+// Return an APP13 segment with an IPTC resource containing the given
+// IIM data, and a resolution info resource.
+func testIIMSegment(t *testing.T, iim []byte) []byte {
+	resources := []ImageResource{
+		{Signature: []byte("8BIM"), ID: ImageResourceIPTC, Data: iim},
+		{Signature: []byte("8BIM"), ID: 0x03ED, Data: make([]byte, 16)},
+	}
+	buf, err := MakeImageResources(resources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(append([]byte{}, photoshopHeader...), buf...)
+}
+
+func TestGetIPTCDatasets(t *testing.T) {
+	long := bytes.Repeat([]byte("k"), 0x9000)
+	valid := MakeIPTCDatasets([]IPTCDataset{{IPTCObjectName, []byte("name")}, {IPTCKeywords, long}})
+	tests := []struct {
+		name     string
+		buf      []byte
+		datasets int
+		fail     bool
+	}{
+		{"valid", valid, 2, false},
+		{"zero padding", append(append([]byte{}, valid...), 0, 0, 0), 2, false},
+		{"bad marker", append(append([]byte{}, valid...), 0x1D, 0, 0), 2, true},
+		{"truncated header", append(append([]byte{}, valid...), 0x1C, 2), 2, true},
+		{"truncated data", valid[:len(valid)-1], 1, true},
+		{"bad extended length", []byte{0x1C, 2, 0x19, 0x80, 0x05, 0, 0, 0, 0, 1}, 0, true},
+		{"empty", nil, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			datasets, err := GetIPTCDatasets(test.buf)
+			if (err != nil) != test.fail {
+				t.Errorf("error %v", err)
+			}
+			if len(datasets) != test.datasets {
+				t.Errorf("%d datasets, expected %d", len(datasets), test.datasets)
+			}
+		})
+	}
+}
+
+// IPTC callback that calls a function on the IPTC data.
+type testIPTCFunc func(*IPTC)
+
+func (f testIPTCFunc) ReadWriteIPTC(format FileFormat, imageIdx uint32, iptc *IPTC, err error) error {
+	f(iptc)
+	return nil
+}
+
+func (f testIPTCFunc) ReadIPTC(format FileFormat, imageIdx uint32, iptc IPTC, err error) error {
+	f(&iptc)
+	return nil
+}
+
+func TestReadWriteIPTC(t *testing.T) {
+	datasets := []IPTCDataset{{IPTCApplicationRecordVersion, []byte{0, 4}}, {IPTCObjectName, []byte("name")}}
+	valid := testIPTCSegment(t, datasets)
+	// A resource whose length extends past the end of the data.
+	truncated := valid[:len(valid)-4]
+	plain := testJPEGFile(t, nil, nil)
+	// IIM data that isn't reproduced by serializing its datasets.
+	padded := testIIMSegment(t, append(MakeIPTCDatasets(datasets), 0, 0, 0))
+	invalid := testIIMSegment(t, append(MakeIPTCDatasets(datasets), "junk"...))
+	setKeyword := testIPTCFunc(func(iptc *IPTC) { iptc.Set(IPTCKeywords, []string{"keyword"}) })
+	unchanged := testIPTCFunc(func(iptc *IPTC) {})
+	tests := []struct {
+		name     string
+		file     []byte
+		callback ReadWriteIPTC
+		original []byte // Expected unchanged APP13 segment, or nil.
+	}{
+		{"valid", testInsertSegment(plain, jseg.APP0+13, valid), setKeyword, nil},
+		{"created", plain, setKeyword, nil},
+		{"undecodable", testInsertSegment(plain, jseg.APP0+13, truncated), setKeyword, truncated},
+		{"padded", testInsertSegment(plain, jseg.APP0+13, padded), unchanged, padded},
+		{"invalid dataset", testInsertSegment(plain, jseg.APP0+13, invalid), unchanged, invalid},
+		{"invalid dataset modified", testInsertSegment(plain, jseg.APP0+13, invalid), setKeyword, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := testReadWrite(t, test.file, ReadWriteControl{ReadWriteIPTC: test.callback})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var c iptcCollector
+			for _, seg := range testSegments(t, out) {
+				if seg.Marker == jseg.APP0+13 {
+					c.add(seg.Data)
+				}
+			}
+			if test.original != nil {
+				if len(c.segments) != 1 || !bytes.Equal(c.segments[0], test.original) {
+					t.Error("APP13 segment changed")
+				}
+				return
+			}
+			iptc, _, err := c.result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if iptc.Value(IPTCKeywords) != "keyword" {
+				t.Errorf("keywords %q", iptc.Strings(IPTCKeywords))
+			}
+			if FindImageResource(iptc.Resources, ImageResourceIPTCDigest) < 0 {
+				t.Error("IPTC digest not written")
+			} else if err := CheckIPTCDigest(iptc.Resources); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	tiff "github.com/garyhouston/tiff66"
+	"github.com/hashicorp/go-multierror"
+	"math"
+)
+
+// Support for the JFIF APP0 segment, which gives the JFIF version
+// and pixel density and may contain an uncompressed thumbnail, and
+// for JFXX extension segments, which contain thumbnails in other
+// formats. All values are big endian.
+
+var jfifHeader = []byte("JFIF\x00")
+var jfxxHeader = []byte("JFXX\x00")
+
+// Size of a JFIF segment without a thumbnail.
+const jfifSegmentSize = 14
+
+// Size of the palette in a JFXX palette thumbnail.
+const jfxxPaletteSize = 768
+
+// Check if an APP0 segment is a JFIF segment.
+func IsJFIFSegment(buf []byte) bool {
+	return bytes.HasPrefix(buf, jfifHeader)
+}
+
+// Check if an APP0 segment is a JFXX extension segment.
+func IsJFXXSegment(buf []byte) bool {
+	return bytes.HasPrefix(buf, jfxxHeader)
+}
+
+// Check if an APP0 segment is either a JFIF or JFXX segment.
+func isAnyJFIFSegment(buf []byte) bool {
+	return IsJFIFSegment(buf) || IsJFXXSegment(buf)
+}
+
+// Values of the JFIF density units.
+const (
+	JFIFUnitsNone = 0 // Density gives the pixel aspect ratio only.
+	JFIFUnitsInch = 1
+	JFIFUnitsCm   = 2
+)
+
+// Thumbnail formats in JFXX segments.
+const (
+	JFXXThumbnailJPEG    = 0x10
+	JFXXThumbnailPalette = 0x11 // One byte per pixel, indexing an RGB palette.
+	JFXXThumbnailRGB     = 0x13 // Three bytes per pixel.
+)
+
+// A thumbnail from a JFXX segment.
+type JFXXThumbnail struct {
+	Format uint8
+	Width  uint8 // Zero for JPEG thumbnails.
+	Height uint8 // Zero for JPEG thumbnails.
+	// A JPEG stream, the palette followed by the pixel indices, or
+	// the RGB pixels.
+	Data []byte
+}
+
+// Decoded JFIF and JFXX segments of a JPEG image.
+type JFIF struct {
+	Version     uint16 // E.g., 0x0102 for version 1.02, or 0 if not present.
+	Units       uint8
+	XDensity    uint16
+	YDensity    uint16
+	ThumbWidth  uint8
+	ThumbHeight uint8
+	Thumbnail   []byte          // RGB pixels of the JFIF thumbnail, if any.
+	Extensions  []JFXXThumbnail // Thumbnails from JFXX segments.
+}
+
+// Decode a JFIF segment.
+func ParseJFIF(buf []byte) (JFIF, error) {
+	var jfif JFIF
+	if !IsJFIFSegment(buf) {
+		return jfif, errors.New("Not a JFIF segment")
+	}
+	if len(buf) < jfifSegmentSize {
+		return jfif, errors.New("JFIF segment is truncated")
+	}
+	order := binary.BigEndian
+	jfif.Version = order.Uint16(buf[5:])
+	jfif.Units = buf[7]
+	jfif.XDensity = order.Uint16(buf[8:])
+	jfif.YDensity = order.Uint16(buf[10:])
+	jfif.ThumbWidth = buf[12]
+	jfif.ThumbHeight = buf[13]
+	size := 3 * int(jfif.ThumbWidth) * int(jfif.ThumbHeight)
+	if len(buf) < jfifSegmentSize+size {
+		jfif.ThumbWidth, jfif.ThumbHeight = 0, 0
+		return jfif, errors.New("JFIF thumbnail is truncated")
+	}
+	if size > 0 {
+		jfif.Thumbnail = append([]byte{}, buf[jfifSegmentSize:jfifSegmentSize+size]...)
+	}
+	return jfif, nil
+}
+
+// Decode a JFXX segment.
+func ParseJFXX(buf []byte) (JFXXThumbnail, error) {
+	var thumb JFXXThumbnail
+	if !IsJFXXSegment(buf) || len(buf) < len(jfxxHeader)+1 {
+		return thumb, errors.New("Not a JFXX segment")
+	}
+	pos := len(jfxxHeader)
+	thumb.Format = buf[pos]
+	pos++
+	var size int
+	switch thumb.Format {
+	case JFXXThumbnailJPEG:
+		thumb.Data = append([]byte{}, buf[pos:]...)
+		return thumb, nil
+	case JFXXThumbnailPalette, JFXXThumbnailRGB:
+		if len(buf) < pos+2 {
+			return thumb, errors.New("JFXX segment is truncated")
+		}
+		thumb.Width, thumb.Height = buf[pos], buf[pos+1]
+		pos += 2
+		size = int(thumb.Width) * int(thumb.Height)
+		if thumb.Format == JFXXThumbnailPalette {
+			size += jfxxPaletteSize
+		} else {
+			size *= 3
+		}
+	default:
+		return thumb, fmt.Errorf("Unknown JFXX thumbnail format 0x%X", thumb.Format)
+	}
+	if len(buf) < pos+size {
+		return thumb, errors.New("JFXX thumbnail is truncated")
+	}
+	thumb.Data = append([]byte{}, buf[pos:pos+size]...)
+	return thumb, nil
+}
+
+// Return the horizontal and vertical pixel density in dots per inch.
+// 'ok' is false if the density only gives the aspect ratio.
+func (jfif JFIF) DPI() (x, y float64, ok bool) {
+	if jfif.XDensity == 0 || jfif.YDensity == 0 {
+		return 0, 0, false
+	}
+	switch jfif.Units {
+	case JFIFUnitsInch:
+		return float64(jfif.XDensity), float64(jfif.YDensity), true
+	case JFIFUnitsCm:
+		return float64(jfif.XDensity) * 2.54, float64(jfif.YDensity) * 2.54, true
+	}
+	return 0, 0, false
+}
+
+// Values of the Exif ResolutionUnit field.
+const (
+	ResolutionUnitNone = 1
+	ResolutionUnitInch = 2
+	ResolutionUnitCm   = 3
+)
+
+// Return the horizontal and vertical resolution in dots per inch from
+// the XResolution, YResolution and ResolutionUnit fields in IFD0 of
+// an Exif tree. ResolutionUnit defaults to inches if missing or
+// invalid. 'ok' is false if the resolution is missing or has no unit.
+func ExifDPI(exif Exif) (x, y float64, ok bool) {
+	if exif.TIFF == nil {
+		return 0, 0, false
+	}
+	node := exif.TIFF
+	fields := node.FindFields([]tiff.Tag{tiff.XResolution, tiff.YResolution, tiff.ResolutionUnit})
+	unit := int64(ResolutionUnitInch)
+	var xres, yres float64
+	for _, field := range fields {
+		if field.Count == 0 {
+			continue
+		}
+		switch field.Tag {
+		case tiff.XResolution, tiff.YResolution:
+			if field.Type != tiff.RATIONAL {
+				continue
+			}
+			n, d := field.Rational(0, node.Order)
+			if d == 0 {
+				continue
+			}
+			if field.Tag == tiff.XResolution {
+				xres = float64(n) / float64(d)
+			} else {
+				yres = float64(n) / float64(d)
+			}
+		case tiff.ResolutionUnit:
+			if field.Type.IsIntegral() {
+				unit = field.AnyInteger(0, node.Order)
+			}
+		}
+	}
+	if xres == 0 || yres == 0 {
+		return 0, 0, false
+	}
+	switch unit {
+	case ResolutionUnitInch:
+		return xres, yres, true
+	case ResolutionUnitCm:
+		return xres * 2.54, yres * 2.54, true
+	}
+	return 0, 0, false
+}
+
+// Check that the JFIF density is consistent with the Exif resolution.
+// Missing values aren't considered errors. A multierror structure may
+// be returned.
+func CheckJFIFResolution(exif Exif, jfif JFIF) error {
+	jx, jy, jok := jfif.DPI()
+	ex, ey, eok := ExifDPI(exif)
+	if !jok || !eok {
+		return nil
+	}
+	var err error
+	// Allow for rounding of the integer JFIF density.
+	if math.Abs(jx-ex) > 0.5 {
+		err = multierror.Append(err, fmt.Errorf("JFIF X density is %g dpi, but Exif XResolution is %g dpi", jx, ex))
+	}
+	if math.Abs(jy-ey) > 0.5 {
+		err = multierror.Append(err, fmt.Errorf("JFIF Y density is %g dpi, but Exif YResolution is %g dpi", jy, ey))
+	}
+	return err
+}
+
+// Set the JFIF density from the Exif resolution. Returns false,
+// leaving the JFIF unchanged, if the Exif resolution is missing.
+func SetJFIFResolution(jfif *JFIF, exif Exif) bool {
+	x, y, ok := ExifDPI(exif)
+	if !ok || x > math.MaxUint16 || y > math.MaxUint16 {
+		return false
+	}
+	jfif.Units = JFIFUnitsInch
+	jfif.XDensity = uint16(math.Floor(x + 0.5))
+	jfif.YDensity = uint16(math.Floor(y + 0.5))
+	return true
+}
+
+// Set the XResolution, YResolution and ResolutionUnit fields in IFD0
+// of an Exif tree from the JFIF density. Returns false, leaving the
+// tree unchanged, if the JFIF density only gives the aspect ratio.
+func SetExifResolution(exif *Exif, jfif JFIF) bool {
+	if exif.TIFF == nil || jfif.XDensity == 0 || jfif.YDensity == 0 {
+		return false
+	}
+	var unit uint16
+	switch jfif.Units {
+	case JFIFUnitsInch:
+		unit = ResolutionUnitInch
+	case JFIFUnitsCm:
+		unit = ResolutionUnitCm
+	default:
+		return false
+	}
+	node := exif.TIFF
+	xres := tiff.Field{Tag: tiff.XResolution, Type: tiff.RATIONAL, Count: 1, Data: make([]byte, 8)}
+	xres.PutRational(uint32(jfif.XDensity), 1, 0, node.Order)
+	yres := tiff.Field{Tag: tiff.YResolution, Type: tiff.RATIONAL, Count: 1, Data: make([]byte, 8)}
+	yres.PutRational(uint32(jfif.YDensity), 1, 0, node.Order)
+	units := tiff.Field{Tag: tiff.ResolutionUnit, Type: tiff.SHORT, Count: 1, Data: make([]byte, 2)}
+	units.PutShort(unit, 0, node.Order)
+	node.DeleteFields([]tiff.Tag{tiff.XResolution, tiff.YResolution, tiff.ResolutionUnit})
+	node.AddFields([]tiff.Field{xres, yres, units})
+	return true
+}
+
+// Collector for the JFIF and JFXX segments in a JPEG image.
+type jfifCollector struct {
+	found bool
+	jfif  JFIF
+	err   error
+}
+
+// Add an APP0 segment to the collection if it's a JFIF or JFXX
+// segment. Returns true if it was.
+func (c *jfifCollector) add(buf []byte) bool {
+	switch {
+	case IsJFIFSegment(buf):
+		if c.jfif.Version != 0 {
+			c.err = multierror.Append(c.err, errors.New("Duplicate JFIF segment"))
+			return true
+		}
+		c.found = true
+		jfif, err := ParseJFIF(buf)
+		if err != nil {
+			c.err = multierror.Append(c.err, err)
+		}
+		jfif.Extensions = c.jfif.Extensions
+		c.jfif = jfif
+	case IsJFXXSegment(buf):
+		c.found = true
+		thumb, err := ParseJFXX(buf)
+		if err != nil {
+			c.err = multierror.Append(c.err, err)
+			return true
+		}
+		c.jfif.Extensions = append(c.jfif.Extensions, thumb)
+	default:
+		return false
+	}
+	return true
+}
+
+// Return the decoded JFIF segments.
+func (c *jfifCollector) result() (JFIF, error) {
+	err := c.err
+	if c.found && c.jfif.Version == 0 {
+		err = multierror.Append(err, errors.New("JFXX segment without JFIF segment"))
+	}
+	return c.jfif, err
+}
+
+// Return the APP0 segment data for JFIF and JFXX segments. No
+// segments are returned if Version is zero.
+func makeJFIFSegments(jfif JFIF) ([][]byte, error) {
+	if jfif.Version == 0 {
+		return nil, nil
+	}
+	order := binary.BigEndian
+	thumbSize := 3 * int(jfif.ThumbWidth) * int(jfif.ThumbHeight)
+	if len(jfif.Thumbnail) != thumbSize {
+		return nil, errors.New("JFIF thumbnail size doesn't match its dimensions")
+	}
+	if jfifSegmentSize+thumbSize > maxSegmentData {
+		return nil, errors.New("JFIF thumbnail is too large for a JPEG segment")
+	}
+	buf := make([]byte, jfifSegmentSize+thumbSize)
+	copy(buf, jfifHeader)
+	order.PutUint16(buf[5:], jfif.Version)
+	buf[7] = jfif.Units
+	order.PutUint16(buf[8:], jfif.XDensity)
+	order.PutUint16(buf[10:], jfif.YDensity)
+	buf[12] = jfif.ThumbWidth
+	buf[13] = jfif.ThumbHeight
+	copy(buf[jfifSegmentSize:], jfif.Thumbnail)
+	segments := [][]byte{buf}
+	for _, thumb := range jfif.Extensions {
+		header := []byte{thumb.Format}
+		if thumb.Format != JFXXThumbnailJPEG {
+			header = append(header, thumb.Width, thumb.Height)
+		}
+		size := len(jfxxHeader) + len(header) + len(thumb.Data)
+		if size > maxSegmentData {
+			return nil, errors.New("JFXX thumbnail is too large for a JPEG segment")
+		}
+		buf := make([]byte, 0, size)
+		buf = append(buf, jfxxHeader...)
+		buf = append(buf, header...)
+		buf = append(buf, thumb.Data...)
+		segments = append(segments, buf)
+	}
+	return segments, nil
+}
+
+type ReadJFIF interface {
+	// Callback for processing JFIF data, read-only. For JPEG
+	// files, it will be called once for each image that contains
+	// JFIF or JFXX segments, after all metadata segments of the
+	// image have been read. Any errors from decoding the segments
+	// will be available in err, which may be a multierror
+	// structure. Returning a non-nil error will terminate
+	// processing.
+	ReadJFIF(format FileFormat, imageIdx uint32, jfif JFIF, err error) error
+}
+
+type ReadWriteJFIF interface {
+	// Callback for processing JFIF data, read-write. For JPEG
+	// files, it will be called once for each image, with a zero
+	// Version if the image has no JFIF segment. Setting Version
+	// to zero will remove the JFIF and JFXX segments. The segments
+	// will be written where the first was found, or otherwise at
+	// the start of the image. It's called before the Exif
+	// callback for the same image, which can use SetExifResolution
+	// to make the Exif resolution consistent. Any errors from
+	// decoding the segments will be available in err, which may
+	// be a multierror structure. Returning a non-nil error will
+	// terminate processing.
+	ReadWriteJFIF(format FileFormat, imageIdx uint32, jfif *JFIF, err error) error
+}
@@ -0,0 +1,158 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// A JFIF segment for version 1.02, 72 dpi, without a thumbnail.
+var testJFIFSegment = []byte("JFIF\x00\x01\x02\x01\x00\x48\x00\x48\x00\x00")
+
+func TestParseJFIF(t *testing.T) {
+	tests := []struct {
+		name  string
+		buf   []byte
+		fail  bool
+		thumb int
+	}{
+		{"plain", testJFIFSegment, false, 0},
+		{"thumbnail", append([]byte("JFIF\x00\x01\x02\x01\x00\x48\x00\x48\x02\x01"), make([]byte, 6)...), false, 6},
+		{"truncated", testJFIFSegment[:10], true, 0},
+		{"truncated thumbnail", []byte("JFIF\x00\x01\x02\x01\x00\x48\x00\x48\x02\x01\x00"), true, 0},
+		{"not JFIF", []byte("JFXX\x00\x10"), true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			jfif, err := ParseJFIF(test.buf)
+			if (err != nil) != test.fail {
+				t.Errorf("error %v", err)
+			}
+			if len(jfif.Thumbnail) != test.thumb || 3*int(jfif.ThumbWidth)*int(jfif.ThumbHeight) != test.thumb {
+				t.Errorf("thumbnail of %d bytes, %dx%d", len(jfif.Thumbnail), jfif.ThumbWidth, jfif.ThumbHeight)
+			}
+		})
+	}
+}
+
+func TestParseJFXX(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+		fail bool
+		size int
+	}{
+		{"JPEG", []byte("JFXX\x00\x10\xFF\xD8\xFF\xD9"), false, 4},
+		{"RGB", append([]byte("JFXX\x00\x13\x01\x02"), make([]byte, 6)...), false, 6},
+		{"palette", append([]byte("JFXX\x00\x11\x01\x01"), make([]byte, jfxxPaletteSize+1)...), false, jfxxPaletteSize + 1},
+		{"truncated RGB", append([]byte("JFXX\x00\x13\x01\x02"), make([]byte, 5)...), true, 0},
+		{"no dimensions", []byte("JFXX\x00\x13\x01"), true, 0},
+		{"no format", []byte("JFXX\x00"), true, 0},
+		{"unknown format", []byte("JFXX\x00\x12"), true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			thumb, err := ParseJFXX(test.buf)
+			if (err != nil) != test.fail {
+				t.Errorf("error %v", err)
+			}
+			if len(thumb.Data) != test.size {
+				t.Errorf("thumbnail of %d bytes, expected %d", len(thumb.Data), test.size)
+			}
+		})
+	}
+}
+
+func TestExifDPI(t *testing.T) {
+	order := binary.BigEndian
+	res := func(tag tiff.Tag, n int64) tiff.Field {
+		return rationalsField(tag, tiff.RATIONAL, [][2]int64{{n, 1}}, order)
+	}
+	tests := []struct {
+		name   string
+		fields []tiff.Field
+		dpi    float64
+		ok     bool
+	}{
+		{"default unit", []tiff.Field{res(tiff.XResolution, 300), res(tiff.YResolution, 300)}, 300, true},
+		{"cm", []tiff.Field{res(tiff.XResolution, 100), res(tiff.YResolution, 100), testShort(tiff.ResolutionUnit, ResolutionUnitCm, order)}, 254, true},
+		{"no unit", []tiff.Field{res(tiff.XResolution, 1), res(tiff.YResolution, 1), testShort(tiff.ResolutionUnit, ResolutionUnitNone, order)}, 0, false},
+		{"ASCII unit", []tiff.Field{res(tiff.XResolution, 300), res(tiff.YResolution, 300), testASCII(tiff.ResolutionUnit, "cm")}, 300, true},
+		{"empty unit", []tiff.Field{res(tiff.XResolution, 300), res(tiff.YResolution, 300), {Tag: tiff.ResolutionUnit, Type: tiff.SHORT}}, 300, true},
+		{"LONG resolution", []tiff.Field{integersField(tiff.XResolution, tiff.LONG, []int64{300}, order), res(tiff.YResolution, 300)}, 0, false},
+		{"zero denominator", []tiff.Field{rationalsField(tiff.XResolution, tiff.RATIONAL, [][2]int64{{300, 0}}, order), res(tiff.YResolution, 300)}, 0, false},
+		{"missing", nil, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exif := testExif("Acme")
+			exif.TIFF.AddFields(test.fields)
+			x, y, ok := ExifDPI(*exif)
+			if ok != test.ok || x != test.dpi || y != test.dpi {
+				t.Errorf("got %g x %g, %v", x, y, ok)
+			}
+		})
+	}
+}
+
+// JFIF callback that calls a function on the JFIF data.
+type testJFIFFunc func(*JFIF)
+
+func (f testJFIFFunc) ReadWriteJFIF(format FileFormat, imageIdx uint32, jfif *JFIF, err error) error {
+	f(jfif)
+	return nil
+}
+
+func TestCreateExifAfterJFIF(t *testing.T) {
+	plain := testJPEGFile(t, nil, nil)
+	withJFIF := testInsertSegment(plain, jseg.APP0, testJFIFSegment)
+	newJFIF := testJFIFFunc(func(jfif *JFIF) {
+		if jfif.Version == 0 {
+			*jfif, _ = ParseJFIF(testJFIFSegment)
+		}
+	})
+	tests := []struct {
+		name    string
+		file    []byte
+		jfif    ReadWriteJFIF
+		drop    bool
+		markers []jseg.Marker // Expected markers up to the first that isn't APP0 or APP1.
+	}{
+		{"no JFIF", plain, nil, false, []jseg.Marker{jseg.APP0 + 1}},
+		{"JFIF copied", withJFIF, nil, false, []jseg.Marker{jseg.APP0, jseg.APP0 + 1}},
+		{"JFIF rewritten", withJFIF, newJFIF, false, []jseg.Marker{jseg.APP0, jseg.APP0 + 1}},
+		{"JFIF created", plain, newJFIF, false, []jseg.Marker{jseg.APP0, jseg.APP0 + 1}},
+		{"JFIF dropped", withJFIF, newJFIF, true, []jseg.Marker{jseg.APP0 + 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			control := ReadWriteControl{
+				ReadWriteExif: testExifFunc(func(*Exif) {}),
+				ExifRequired:  testExifRequired{},
+				ReadWriteJFIF: test.jfif,
+				DropJFIF:      test.drop,
+			}
+			out, err := testReadWrite(t, test.file, control)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var markers []jseg.Marker
+			for _, seg := range testSegments(t, out) {
+				if seg.Marker != jseg.APP0 && seg.Marker != jseg.APP0+1 {
+					break
+				}
+				markers = append(markers, seg.Marker)
+				if seg.Marker == jseg.APP0 && !bytes.Equal(seg.Data, testJFIFSegment) {
+					t.Errorf("APP0 segment %q", seg.Data)
+				}
+			}
+			if fmt.Sprint(markers) != fmt.Sprint(test.markers) {
+				t.Errorf("markers %v, expected %v", markers, test.markers)
+			}
+		})
+	}
+}
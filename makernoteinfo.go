@@ -0,0 +1,249 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	tiff "github.com/garyhouston/tiff66"
+	"strings"
+)
+
+// Identification of maker notes, including those that tiff66 doesn't
+// decode, so that applications can report why a file can't be
+// rewritten. Maker notes are identified from the signature at their
+// start, or failing that, from the Make field in IFD0. Signatures and
+// offset bases are as per ExifTool lib/Image/ExifTool/MakerNotes.pm.
+
+// Base from which the offsets in a maker note are measured.
+type MakerNoteBase uint8
+
+const (
+	MakerNoteBaseUnknown       MakerNoteBase = iota // Not known.
+	MakerNoteBaseNone                               // Not an IFD, and no offsets are known.
+	MakerNoteBaseTIFF                               // TIFF header of the Exif data.
+	MakerNoteBaseMakerNote                          // Start of the maker note.
+	MakerNoteBaseMakerNoteTIFF                      // TIFF header in the maker note, as in Nikon2 maker notes.
+)
+
+// Mapping from maker note offset bases to strings.
+var MakerNoteBaseNames = map[MakerNoteBase]string{
+	MakerNoteBaseUnknown:       "unknown",
+	MakerNoteBaseNone:          "none",
+	MakerNoteBaseTIFF:          "TIFF header",
+	MakerNoteBaseMakerNote:     "maker note",
+	MakerNoteBaseMakerNoteTIFF: "maker note TIFF header",
+}
+
+// Description of the maker note in an Exif tree.
+type MakerNoteInfo struct {
+	Vendor      string           // Manufacturer, e.g., "Pentax", or the Make field if not identified.
+	Format      string           // The maker note signature or tiff66 space name, or "" if not identified.
+	Space       tiff.TagSpace    // The tiff66 space if decoded, or 0.
+	IFD         bool             // True if the maker note contains an IFD.
+	Base        MakerNoteBase    // Base of the offsets in the maker note.
+	Order       binary.ByteOrder // Byte order of the IFD, or nil if unknown.
+	Relocatable bool             // True if the maker note remains valid when moved: it's decoded, or its offsets don't depend on its position.
+	Writable    bool             // True if ReadWrite accepts it with the default UnknownMakerNote policy; see Problem.
+	Problem     string           // Why the maker note isn't writable, or "".
+}
+
+// Signature of a maker note that isn't decoded by tiff66.
+type makerNoteSignature struct {
+	prefix   string
+	vendor   string
+	ifdPos   int // Position of the IFD, or -1 if not an IFD.
+	orderPos int // Position of an "II" or "MM" byte order mark, or -1.
+	base     MakerNoteBase
+}
+
+var makerNoteSignatures = []makerNoteSignature{
+	{"Apple iOS\000", "Apple", 14, 12, MakerNoteBaseMakerNote},
+	{"AOC\000", "Pentax", 6, 4, MakerNoteBaseUnknown},
+	{"PENTAX \000", "Pentax", 10, 8, MakerNoteBaseMakerNote},
+	{"RICOH\000II", "Ricoh", 8, 6, MakerNoteBaseMakerNote},
+	{"RICOH\000MM", "Ricoh", 8, 6, MakerNoteBaseMakerNote},
+	{"Ricoh", "Ricoh", 8, -1, MakerNoteBaseUnknown},
+	{"RICOH", "Ricoh", 8, -1, MakerNoteBaseUnknown},
+	{"QVC\000", "Casio", 6, -1, MakerNoteBaseTIFF},
+	{"DCI\000", "Casio", 6, -1, MakerNoteBaseTIFF},
+	{"SIGMA\000\000\000", "Sigma", 10, -1, MakerNoteBaseTIFF},
+	{"FOVEON\000\000", "Sigma", 10, -1, MakerNoteBaseTIFF},
+	{"SANYO\000", "Sanyo", 8, -1, MakerNoteBaseTIFF},
+	{"OM SYSTEM\000", "OM Digital Solutions", 16, 12, MakerNoteBaseMakerNote},
+	{"LEICA CAMERA AG\000", "Leica", 18, -1, MakerNoteBaseUnknown},
+	{"LEICA\000", "Leica", 8, -1, MakerNoteBaseUnknown},
+	{"KYOCERA", "Kyocera", 22, -1, MakerNoteBaseUnknown},
+	{"STMN", "Samsung", -1, -1, MakerNoteBaseMakerNote},
+	{"KDK", "Kodak", -1, -1, MakerNoteBaseNone},
+	{"MLY0", "Minolta", -1, -1, MakerNoteBaseNone},
+	{"KC", "Minolta", -1, -1, MakerNoteBaseNone},
+}
+
+// Vendors identified by the Make field, for maker notes without a
+// signature, which are usually an IFD at the start of the maker note.
+var makerNoteMakes = []struct {
+	prefix string // Lower case.
+	vendor string
+}{
+	{"asahi", "Pentax"},
+	{"casio", "Casio"},
+	{"dji", "DJI"},
+	{"eastman kodak", "Kodak"},
+	{"kodak", "Kodak"},
+	{"konica minolta", "Minolta"},
+	{"minolta", "Minolta"},
+	{"nintendo", "Nintendo"},
+	{"pentax", "Pentax"},
+	{"ricoh", "Ricoh"},
+	{"samsung", "Samsung"},
+	{"sigma", "Sigma"},
+}
+
+// Vendors of the maker notes decoded by tiff66.
+var makerNoteSpaceVendors = map[tiff.TagSpace]string{
+	tiff.Canon1Space:     "Canon",
+	tiff.Fujifilm1Space:  "Fujifilm",
+	tiff.Nikon1Space:     "Nikon",
+	tiff.Nikon2Space:     "Nikon",
+	tiff.Olympus1Space:   "Olympus",
+	tiff.Panasonic1Space: "Panasonic",
+	tiff.Sony1Space:      "Sony",
+}
+
+// Guess the byte order of an IFD from its entry count, which is
+// usually small.
+func guessIFDOrder(buf []byte) binary.ByteOrder {
+	if binary.LittleEndian.Uint16(buf) < binary.BigEndian.Uint16(buf) {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// Check if data at the start of a maker note looks like an IFD: a
+// plausible number of entries with valid types, which fit in the
+// maker note.
+func isPlausibleIFD(buf []byte, order binary.ByteOrder) bool {
+	if len(buf) < 2 {
+		return false
+	}
+	entries := order.Uint16(buf)
+	if entries == 0 || entries > 512 || tiff.TableSize(entries) > uint32(len(buf))+4 {
+		return false
+	}
+	for i := uint32(0); i < uint32(entries); i++ {
+		fieldType := tiff.Type(order.Uint16(buf[2+i*tiff.TableEntrySize+2:]))
+		if fieldType.Size() == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the base of the offsets in a maker note decoded by tiff66.
+func decodedMakerNoteBase(space tiff.TagSpace, data []byte) MakerNoteBase {
+	switch space {
+	case tiff.Fujifilm1Space:
+		return MakerNoteBaseMakerNote
+	case tiff.Nikon2Space:
+		if bytes.HasPrefix(data, []byte("Nikon\000")) {
+			return MakerNoteBaseMakerNoteTIFF
+		}
+	case tiff.Olympus1Space:
+		if bytes.HasPrefix(data, []byte("OLYMPUS\000")) {
+			return MakerNoteBaseMakerNote
+		}
+	}
+	return MakerNoteBaseTIFF
+}
+
+// Identify the maker note in an Exif tree, returning false if there
+// isn't one.
+func (exif Exif) IdentifyMakerNote() (MakerNoteInfo, bool) {
+	var info MakerNoteInfo
+	if exif.Exif == nil {
+		return info, false
+	}
+	field := findField(exif.Exif, MakerNote)
+	if field == nil {
+		return info, false
+	}
+	data := field.Data
+	if exif.MakerNote != nil {
+		space := exif.MakerNote.GetSpace()
+		info.Vendor = makerNoteSpaceVendors[space]
+		info.Format = space.Name()
+		info.Space = space
+		info.IFD = true
+		info.Base = decodedMakerNoteBase(space, data)
+		info.Order = exif.MakerNote.Order
+		// The pointer to a Minolta maker note isn't updated.
+		info.Relocatable = !sonyMinoltaPointer(exif)
+	} else {
+		identifyUndecoded(&info, exif, data)
+	}
+	// Previews stored outside the Exif data are relocated by
+	// ReadWrite in the first image of a JPEG file.
+	err := exif.CheckMakerNote()
+	if err == nil {
+		err = exif.makerNoteComplexities(true)
+	}
+	if err != nil {
+		info.Problem = err.Error()
+	} else {
+		info.Writable = true
+	}
+	return info, true
+}
+
+// Identify a maker note that isn't decoded by tiff66, from its
+// signature or the Make field.
+func identifyUndecoded(info *MakerNoteInfo, exif Exif, data []byte) {
+	ifdPos := -1
+	for _, sig := range makerNoteSignatures {
+		if !bytes.HasPrefix(data, []byte(sig.prefix)) {
+			continue
+		}
+		info.Vendor = sig.vendor
+		info.Format = strings.TrimSpace(strings.Replace(sig.prefix, "\000", " ", -1))
+		info.Base = sig.base
+		ifdPos = sig.ifdPos
+		if sig.orderPos >= 0 && len(data) >= sig.orderPos+2 {
+			switch string(data[sig.orderPos : sig.orderPos+2]) {
+			case "II":
+				info.Order = binary.LittleEndian
+			case "MM":
+				info.Order = binary.BigEndian
+			}
+		}
+		break
+	}
+	if info.Vendor == "" {
+		cameraMake := ""
+		if field := findField(exif.TIFF, tiff.Make); field != nil && field.Type == tiff.ASCII {
+			cameraMake = strings.TrimSpace(field.ASCII())
+		}
+		info.Vendor = cameraMake
+		lcMake := strings.ToLower(cameraMake)
+		for _, m := range makerNoteMakes {
+			if strings.HasPrefix(lcMake, m.prefix) {
+				info.Vendor = m.vendor
+				break
+			}
+		}
+		// Without a signature, an IFD at the start of the maker
+		// note has offsets relative to the TIFF header.
+		if len(data) >= 2 && isPlausibleIFD(data, guessIFDOrder(data)) {
+			ifdPos = 0
+			info.Base = MakerNoteBaseTIFF
+		}
+	}
+	if ifdPos >= 0 && len(data) >= ifdPos+2 {
+		info.IFD = true
+		if info.Order == nil {
+			info.Order = guessIFDOrder(data[ifdPos:])
+		}
+	}
+	if allZero(data) {
+		info.Base = MakerNoteBaseNone
+	}
+	info.Relocatable = info.Base == MakerNoteBaseNone || info.Base == MakerNoteBaseMakerNote || info.Base == MakerNoteBaseMakerNoteTIFF
+}
@@ -0,0 +1,70 @@
+package exif44
+
+import (
+	"encoding/binary"
+	"testing"
+
+	tiff "github.com/garyhouston/tiff66"
+)
+
+func TestIdentifyMakerNote(t *testing.T) {
+	ifd := testRawIFD(0, []testEntry{{0x0001, tiff.SHORT, 1, []byte{0, 1}}})
+	sony := func(minolta uint32) []byte {
+		return testMakerNoteTIFF(t, "SONY", func(pos uint32) []byte {
+			value := make([]byte, 4)
+			binary.BigEndian.PutUint32(value, minolta)
+			return append([]byte("SONY DSC \000\000\000"), testRawIFD(pos+sony1LabelSize, []testEntry{
+				{0xB000, tiff.BYTE, 4, []byte{2, 0, 0, 0}},
+				{Sony1MinoltaMakerNote, tiff.LONG, 1, value},
+			})...)
+		})
+	}
+	undecoded := func(make string, note []byte) []byte {
+		return testTIFF(t, testMakerNoteExif(make, note))
+	}
+	tests := []struct {
+		name        string
+		data        []byte
+		vendor      string
+		base        MakerNoteBase
+		order       binary.ByteOrder
+		decoded     bool
+		relocatable bool
+		writable    bool
+	}{
+		{"Pentax AOC", undecoded("PENTAX", append([]byte("AOC\000MM"), ifd...)), "Pentax", MakerNoteBaseUnknown, binary.BigEndian, false, false, false},
+		{"Pentax", undecoded("PENTAX", append([]byte("PENTAX \000MM"), ifd...)), "Pentax", MakerNoteBaseMakerNote, binary.BigEndian, false, true, false},
+		{"Casio", undecoded("CASIO", append([]byte("QVC\000\000\000"), ifd...)), "Casio", MakerNoteBaseTIFF, binary.BigEndian, false, false, false},
+		{"Kodak", undecoded("KODAK", []byte("KDK INFO\000\000\000\000")), "Kodak", MakerNoteBaseNone, nil, false, true, false},
+		{"zeros", undecoded("Acme", make([]byte, 16)), "Acme", MakerNoteBaseNone, nil, false, true, true},
+		{"IFD by make", undecoded("Nintendo", ifd), "Nintendo", MakerNoteBaseTIFF, binary.BigEndian, false, false, false},
+		{"unidentified", undecoded("Acme", []byte("ACME\000\001\002\003")), "Acme", MakerNoteBaseUnknown, nil, false, false, false},
+		{"Sony", sony(0), "Sony", MakerNoteBaseTIFF, binary.BigEndian, true, true, true},
+		{"Sony with Minolta", sony(1000), "Sony", MakerNoteBaseTIFF, binary.BigEndian, true, false, false},
+		{"Canon", testCanonTIFF(t), "Canon", MakerNoteBaseTIFF, binary.BigEndian, true, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exif, err := GetExifTree(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, found := exif.IdentifyMakerNote()
+			if !found {
+				t.Fatal("maker note not found")
+			}
+			if info.Vendor != test.vendor || info.Base != test.base || info.Order != test.order {
+				t.Errorf("vendor %q, base %s, order %v", info.Vendor, MakerNoteBaseNames[info.Base], info.Order)
+			}
+			if (info.Space != 0) != test.decoded || info.Relocatable != test.relocatable || info.Writable != test.writable {
+				t.Errorf("space %v, relocatable %v, writable %v", info.Space, info.Relocatable, info.Writable)
+			}
+			if info.Writable != (info.Problem == "") {
+				t.Errorf("problem %q", info.Problem)
+			}
+		})
+	}
+	if _, found := testExif("Acme").IdentifyMakerNote(); found {
+		t.Error("maker note found in tree without one")
+	}
+}
@@ -0,0 +1,255 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Support for rewriting JPEG files with maker note previews that are
+// stored outside the Exif segment, after the end of the JPEG image or
+// in a following image of an MPF file. These previews are located by
+// an offset from the TIFF header of the Exif segment, which changes
+// when the Exif data is rewritten. ReadWrite carries the preview
+// through to the output and updates the offset.
+
+// A maker note format whose preview image may be stored outside the
+// Exif data.
+type previewLocator struct {
+	// Return the length and offset from the TIFF header of the
+	// preview, or false if there's none.
+	find func(exif Exif) (uint32, uint32, bool)
+	// Return the positions of the preview length and offset in
+	// TIFF data, given the position of the maker note, or false
+	// if not found.
+	fields func(tiffData []byte, order binary.ByteOrder, makerPos uint32) (uint32, uint32, bool)
+}
+
+// Maker note formats with previews outside the Exif data.
+var previewLocators = []previewLocator{
+	{canonOutsidePreview, canonPreviewFields},
+	{sonyOutsidePreview, sonyPreviewFields},
+}
+
+// Return the length and offset from the TIFF header of a maker note
+// preview stored outside the Exif data, or false if there's none.
+func outsidePreview(exif Exif) (uint32, uint32, bool) {
+	for _, locator := range previewLocators {
+		if length, offset, found := locator.find(exif); found {
+			return length, offset, true
+		}
+	}
+	return 0, 0, false
+}
+
+// A maker note preview being carried from the input to the output of
+// ReadWrite, for the first image of a JPEG file.
+type makerPreview struct {
+	inPos    int64            // Position of the preview in the input.
+	data     []byte           // The preview image, or nil if there's none.
+	order    binary.ByteOrder // Byte order of the maker note.
+	countPos uint32           // Position of the preview length in the new TIFF data, or 0.
+	fieldPos uint32           // Position of the preview offset in the new TIFF data, or 0 if removed.
+	sizes    []int            // Size of the TIFF data in each new Exif segment.
+	outTIFF  []int64          // Output positions of the TIFF data in the new Exif segments, as they're written.
+}
+
+// Read the preview image located by the Exif data of the first image,
+// whose TIFF header is at 'tiffPos' in the input. The reader's
+// position is unchanged.
+func (p *makerPreview) read(reader io.ReadSeeker, tiffPos int64, tiffData []byte) error {
+	// Errors in the Exif data are reported by the Exif callback.
+	exif, _ := GetExifTree(tiffData)
+	length, offset, found := outsidePreview(*exif)
+	if !found || length == 0 {
+		return nil
+	}
+	readerSave, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	p.inPos = tiffPos + int64(offset)
+	if p.inPos+int64(length) > size {
+		return errors.New("Maker note preview image extends past end of file")
+	}
+	if _, err := reader.Seek(p.inPos, io.SeekStart); err != nil {
+		return err
+	}
+	p.data = make([]byte, length)
+	if _, err := io.ReadFull(reader, p.data); err != nil {
+		return errors.New("Maker note preview image extends past end of file")
+	}
+	// Reset the file position.
+	_, err = reader.Seek(readerSave, io.SeekStart)
+	return err
+}
+
+// Record the position of the preview offset in the new Exif segments
+// of the first image, if the callback didn't remove it. The positions
+// are in the TIFF data reassembled from the segments.
+func (p *makerPreview) setSegments(segments [][]byte) {
+	p.countPos, p.fieldPos, p.sizes = 0, 0, nil
+	if p.data == nil {
+		return
+	}
+	var tiffData []byte
+	for _, segment := range segments {
+		tiffData = append(tiffData, segment[HeaderSize:]...)
+		p.sizes = append(p.sizes, len(segment)-HeaderSize)
+	}
+	exif, err := GetExifTree(tiffData)
+	if err != nil || exif.MakerNote == nil {
+		return
+	}
+	makerPos, found := makerNotePos(*exif, tiffData)
+	if !found {
+		return
+	}
+	p.order = exif.MakerNote.Order
+	for _, locator := range previewLocators {
+		if _, _, found := locator.find(*exif); found {
+			if countPos, fieldPos, found := locator.fields(tiffData, p.order, makerPos); found {
+				p.countPos, p.fieldPos = countPos, fieldPos
+			}
+			return
+		}
+	}
+}
+
+// Positions of an image of an MPF file in the input and output of
+// ReadWrite.
+type imageExtent struct {
+	inStart, inEnd   int64
+	outStart, outEnd int64
+}
+
+// Return the output position and length of a preview that lies in one
+// of the following images of an MPF file, as written by some Sony
+// cameras. The position is -1 if the preview isn't in an image, or
+// can't be located after the image was rewritten.
+func (p *makerPreview) inImage(images []imageExtent) (int64, int64) {
+	length := int64(len(p.data))
+	for _, image := range images {
+		if p.inPos < image.inStart || p.inPos >= image.inEnd {
+			continue
+		}
+		switch {
+		case p.inPos == image.inStart && length == image.inEnd-image.inStart:
+			// The preview is the image.
+			return image.outStart, image.outEnd - image.outStart
+		case image.outEnd-image.outStart == image.inEnd-image.inStart:
+			return image.outStart + p.inPos - image.inStart, length
+		}
+		return -1, length
+	}
+	return -1, length
+}
+
+// Locate the preview in the output following the first image, and
+// update its offset and length in the Exif segment. 'images' are the
+// following images of an MPF file. 'inEnd' and 'outEnd' are the
+// positions of the trailer in the input and output, and 'trailer' is
+// the output trailer, or nil if the input trailer was copied
+// unchanged. If the preview isn't in an image or the trailer, it's
+// appended to the output.
+func (p *makerPreview) relocate(writer io.WriteSeeker, images []imageExtent, inEnd, outEnd int64, trailer []byte) error {
+	if p.data == nil || p.fieldPos == 0 || len(p.outTIFF) == 0 || len(p.outTIFF) != len(p.sizes) {
+		return nil
+	}
+	outTIFF := p.outTIFF[0]
+	outPos, length := p.inImage(images)
+	if outPos < 0 {
+		if trailer == nil {
+			if p.inPos >= inEnd {
+				outPos = outEnd + p.inPos - inEnd
+			}
+		} else if i := bytes.Index(trailer, p.data); i >= 0 {
+			outPos = outEnd + int64(i)
+		}
+	}
+	end, err := writer.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if outPos < 0 {
+		outPos = end
+		if _, err := writer.Write(p.data); err != nil {
+			return err
+		}
+	}
+	if outPos-outTIFF > 0xFFFFFFFF || length > 0xFFFFFFFF {
+		return errors.New("Maker note preview image offset too large")
+	}
+	if p.countPos != 0 {
+		if err := p.put(writer, p.countPos, uint32(length)); err != nil {
+			return err
+		}
+	}
+	if err := p.put(writer, p.fieldPos, uint32(outPos-outTIFF)); err != nil {
+		return err
+	}
+	_, err = writer.Seek(0, io.SeekEnd)
+	return err
+}
+
+// Record the output position of the TIFF data in an Exif segment
+// that's about to be written, if it's one of the new segments.
+func (p *makerPreview) writeSegment(writer io.WriteSeeker) error {
+	if len(p.outTIFF) >= len(p.sizes) {
+		return nil
+	}
+	pos, err := writer.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	// The TIFF data follows the marker, length and Exif header.
+	p.outTIFF = append(p.outTIFF, pos+4+HeaderSize)
+	return nil
+}
+
+// Write a value at a position in the new TIFF data, which may be split
+// over several Exif segments.
+func (p *makerPreview) put(writer io.WriteSeeker, pos uint32, val uint32) error {
+	buf := make([]byte, 4)
+	p.order.PutUint32(buf, val)
+	for i, size := range p.sizes {
+		if len(buf) == 0 {
+			break
+		}
+		if pos >= uint32(size) {
+			pos -= uint32(size)
+			continue
+		}
+		n := uint32(size) - pos
+		if n > uint32(len(buf)) {
+			n = uint32(len(buf))
+		}
+		if _, err := writer.Seek(p.outTIFF[i]+int64(pos), io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := writer.Write(buf[:n]); err != nil {
+			return err
+		}
+		buf, pos = buf[n:], 0
+	}
+	return nil
+}
+
+// Check that the maker note in the TIFF data of a duplicate Exif
+// segment, which is written instead of the first, has no preview
+// outside the Exif data, since it can't be relocated.
+func checkDuplicatePreview(tiffData []byte) error {
+	exif, _ := GetExifTree(tiffData)
+	if exif == nil || exif.TIFF == nil {
+		return nil
+	}
+	if _, _, found := outsidePreview(*exif); found {
+		return errors.New("Can't relocate the maker note preview of a duplicate Exif segment")
+	}
+	return nil
+}
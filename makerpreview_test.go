@@ -0,0 +1,268 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// An IFD entry for testRawIFD.
+type testEntry struct {
+	tag   tiff.Tag
+	typ   tiff.Type
+	count uint32
+	data  []byte
+}
+
+// Return a big-endian IFD with no next IFD, for a position 'base'
+// from the TIFF header, with out-of-line data following the table.
+func testRawIFD(base uint32, entries []testEntry) []byte {
+	order := binary.BigEndian
+	buf := make([]byte, tiff.TableSize(uint16(len(entries))))
+	order.PutUint16(buf, uint16(len(entries)))
+	for i, e := range entries {
+		entry := buf[2+i*tiff.TableEntrySize:]
+		order.PutUint16(entry, uint16(e.tag))
+		order.PutUint16(entry[2:], uint16(e.typ))
+		order.PutUint32(entry[4:], e.count)
+		if len(e.data) <= 4 {
+			copy(entry[8:], e.data)
+			continue
+		}
+		order.PutUint32(entry[8:], base+uint32(len(buf)))
+		buf = append(buf, e.data...)
+	}
+	return buf
+}
+
+// Return TIFF data with a maker note made by a function of its
+// position.
+func testMakerNoteTIFF(t *testing.T, make string, note func(pos uint32) []byte) []byte {
+	data := testTIFF(t, testMakerNoteExif(make, note(0)))
+	exif, _ := GetExifTree(data)
+	pos, _ := makerNotePos(*exif, data)
+	return testTIFF(t, testMakerNoteExif(make, note(pos)))
+}
+
+// Return TIFF data with a Sony maker note with a dummy preview image
+// in the Exif data, to be replaced by testSetPreview.
+func testSonyTIFF(t *testing.T) []byte {
+	return testMakerNoteTIFF(t, "SONY", func(pos uint32) []byte {
+		return append([]byte("SONY DSC \000\000\000"), testRawIFD(pos+sony1LabelSize, []testEntry{
+			{Sony1PreviewImage, tiff.UNDEFINED, 8, []byte{0xFF, 0xD8, 0xFF, 0xD9, 0, 0, 0, 0}},
+			{0xB000, tiff.BYTE, 4, []byte{2, 0, 0, 0}},
+		})...)
+	})
+}
+
+// Return the positions of the first Exif segment's TIFF header in a
+// JPEG file, and of the maker note preview length and offset relative
+// to the TIFF header.
+func testPreviewFields(t *testing.T, file []byte) (uint32, uint32, uint32) {
+	tiffPos, err := jpegTIFFPos(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seg := range testSegments(t, file) {
+		if seg.Marker != jseg.APP0+1 || !isExifSegment(seg.Data) {
+			continue
+		}
+		data := seg.Data[HeaderSize:]
+		exif, _ := GetExifTree(data)
+		makerPos, _ := makerNotePos(*exif, data)
+		order := binary.BigEndian
+		if exif.MakerNote.GetSpace() == tiff.Canon1Space {
+			if pos, found := fieldDataPos(data, order, makerPos, Canon1PreviewImageInfo); found {
+				return tiffPos, pos + canonPreviewLengthIdx*4, pos + canonPreviewStartIdx*4
+			}
+		} else if pos, found := fieldEntryPos(data, order, makerPos+sony1LabelSize, Sony1PreviewImage); found {
+			return tiffPos, pos + 4, pos + 8
+		}
+		t.Fatal("maker note preview field not found")
+	}
+	t.Fatal("Exif segment not found")
+	return 0, 0, 0
+}
+
+// Set the maker note preview of a JPEG file to the given file
+// position and length.
+func testSetPreview(t *testing.T, file []byte, pos, length uint32) {
+	tiffPos, countPos, fieldPos := testPreviewFields(t, file)
+	binary.BigEndian.PutUint32(file[tiffPos+countPos:], length)
+	binary.BigEndian.PutUint32(file[tiffPos+fieldPos:], pos-tiffPos)
+}
+
+// Return the maker note preview of a JPEG file, and its position.
+func testGetPreview(t *testing.T, file []byte) ([]byte, uint32) {
+	tiffPos, countPos, fieldPos := testPreviewFields(t, file)
+	length := binary.BigEndian.Uint32(file[tiffPos+countPos:])
+	pos := tiffPos + binary.BigEndian.Uint32(file[tiffPos+fieldPos:])
+	if pos+length > uint32(len(file)) {
+		t.Fatalf("preview at %d of length %d extends past end of file", pos, length)
+	}
+	return file[pos : pos+length], pos
+}
+
+func TestMakerPreview(t *testing.T) {
+	preview := testInsertSegment(testJPEG(t, 32, 24), jseg.COM, []byte("preview"))
+	tests := []struct {
+		name    string
+		tiff    func(*testing.T) []byte
+		mpf     bool // Preview is the second image of an MPF file.
+		trailer ReadWriteTrailer
+	}{
+		{"Sony trailer", testSonyTIFF, false, nil},
+		{"Sony trailer callback", testSonyTIFF, false, testTrailerFunc(func(b []byte) []byte { return append([]byte("prefix"), b...) })},
+		{"Sony trailer removed", testSonyTIFF, false, testTrailerFunc(func([]byte) []byte { return nil })},
+		{"Sony MPF", testSonyTIFF, true, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var in []byte
+			if test.mpf {
+				var out WriteBuffer
+				images := []MPFImage{
+					{Entry: MPEntry{Attribute: MPTypeBaselinePrimary | MPRepresentative}, Data: testJPEGFile(t, [][]byte{test.tiff(t)}, nil)},
+					{Entry: MPEntry{Attribute: MPTypeLargeThumbnailVGA}, Data: preview},
+				}
+				if err := JoinMPF(&out, images); err != nil {
+					t.Fatal(err)
+				}
+				in = out.Bytes()
+				_, index, err := readMPFIndex(bytes.NewReader(in))
+				if err != nil {
+					t.Fatal(err)
+				}
+				testSetPreview(t, in, index.ImageOffsets[1], index.ImageLengths[1])
+			} else {
+				in = testJPEGFile(t, [][]byte{test.tiff(t)}, preview)
+				testSetPreview(t, in, uint32(len(in)-len(preview)), uint32(len(preview)))
+			}
+			control := ReadWriteControl{ReadWriteExif: testGrowExif, ReadWriteTrailer: test.trailer}
+			out, err := testReadWrite(t, in, control)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, pos := testGetPreview(t, out)
+			if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) || bytes.Index(data, []byte("preview")) < 0 {
+				t.Errorf("preview at %d not found", pos)
+			}
+			if count := bytes.Count(out, []byte("preview")); count != 1 {
+				t.Errorf("%d copies of the preview", count)
+			}
+			if test.mpf {
+				_, index, err := readMPFIndex(bytes.NewReader(out))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if index.ImageOffsets[1] != pos || index.ImageLengths[1] != uint32(len(data)) {
+					t.Errorf("preview at %d of length %d, second image at %d of length %d", pos, len(data), index.ImageOffsets[1], index.ImageLengths[1])
+				}
+			}
+		})
+	}
+}
+
+func TestMakerPreviewMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		pos    uint32
+		length uint32
+	}{
+		{"huge length", 100, 0xFFFFFF00},
+		{"past end", 0xFFFFFF00, 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := testJPEGFile(t, [][]byte{testSonyTIFF(t)}, nil)
+			testSetPreview(t, in, test.pos, test.length)
+			if _, err := testReadWrite(t, in, ReadWriteControl{ReadWriteExif: testGrowExif}); err == nil {
+				t.Error("missing preview not reported")
+			}
+		})
+	}
+}
+
+func TestMakerPreviewSegments(t *testing.T) {
+	preview := testInsertSegment(testJPEG(t, 32, 24), jseg.COM, []byte("preview"))
+	plain := testTIFF(t, testExif("Acme"))
+	comment := bytes.Repeat([]byte("c"), 70000)
+	addComment := testExifFunc(func(exif *Exif) {
+		exif.TIFF.AddFields([]tiff.Field{{Tag: tiff.ImageDescription, Type: tiff.ASCII, Count: uint32(len(comment)), Data: comment}})
+	})
+	tests := []struct {
+		name    string
+		tiff    func(*testing.T) []byte
+		first   bool // Maker note in the first of two Exif segments, otherwise only one.
+		second  bool // Maker note in the second of two Exif segments.
+		control ReadWriteControl
+		fail    bool // Preview can't be relocated.
+		found   bool // Preview found in the output.
+	}{
+		{"Canon multi-segment", testCanonTIFF, false, false, ReadWriteControl{ReadWriteExif: addComment, ExifOverflow: ExifOverflowPolicy{MultiSegment: true}}, false, true},
+		{"Sony multi-segment", testSonyTIFF, false, false, ReadWriteControl{ReadWriteExif: addComment, ExifOverflow: ExifOverflowPolicy{MultiSegment: true}}, false, true},
+		{"keep first", testCanonTIFF, true, false, ReadWriteControl{DuplicateExif: DuplicateExifKeepFirst}, false, true},
+		{"keep last", testCanonTIFF, false, true, ReadWriteControl{DuplicateExif: DuplicateExifKeepLast}, true, false},
+		{"merge", testCanonTIFF, false, true, ReadWriteControl{DuplicateExif: DuplicateExifMerge}, true, false},
+		{"keep last without preview", testCanonTIFF, true, false, ReadWriteControl{DuplicateExif: DuplicateExifKeepLast}, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			segments := [][]byte{test.tiff(t)}
+			switch {
+			case test.first:
+				segments = append(segments, plain)
+			case test.second:
+				segments = append([][]byte{plain}, segments...)
+			}
+			in := testJPEGFile(t, segments, preview)
+			// Set the preview in the segment with the maker note.
+			if test.second {
+				tiffPos, countPos, fieldPos := testPreviewFields(t, testJPEGFile(t, segments[1:], nil))
+				offset := uint32(HeaderSize + 4 + len(plain))
+				binary.BigEndian.PutUint32(in[offset+tiffPos+countPos:], uint32(len(preview)))
+				binary.BigEndian.PutUint32(in[offset+tiffPos+fieldPos:], uint32(len(in)-len(preview))-offset-tiffPos)
+			} else {
+				testSetPreview(t, in, uint32(len(in)-len(preview)), uint32(len(preview)))
+			}
+			out, err := testReadWrite(t, in, test.control)
+			if test.fail {
+				if err == nil {
+					t.Error("preview in duplicate Exif segment not reported")
+
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Locate the preview from the reassembled Exif data.
+			tiffPos, err := jpegTIFFPos(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var length, offset uint32
+			callback := testReadExifFunc(func(exif Exif, err error) {
+				if l, o, found := outsidePreview(exif); found {
+					length, offset = l, o
+				}
+			})
+			if err := Read(bytes.NewReader(out), ReadControl{ReadExif: callback}); err != nil {
+				t.Fatal(err)
+			}
+			if !test.found {
+				if length != 0 {
+					t.Error("preview of dropped maker note found")
+				}
+				return
+			}
+			pos := uint64(tiffPos) + uint64(offset)
+			if pos+uint64(length) > uint64(len(out)) || !bytes.Equal(out[pos:pos+uint64(length)], preview) {
+				t.Errorf("preview at %d of length %d not found", pos, length)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Support for Motion Photos, which are JPEG files with an MP4 video in
+// the trailer following the last image. In Google's format, the XMP
+// of the primary image has a Container:Directory property listing the
+// media items in the file with their lengths, the video being the
+// item with the "MotionPhoto" semantic. The items are stored in
+// order, so the video's position is found by counting back from the
+// end of the file. The older "MicroVideo" format instead gives the
+// position of the video from the end of the file in
+// GCamera:MicroVideoOffset. Samsung files store the video in a
+// "MotionPhoto_Data" record of a SEF trailer.
+
+// Format of a Motion Photo.
+type MotionPhotoFormat uint8
+
+const (
+	MotionPhotoNone       MotionPhotoFormat = iota
+	MotionPhotoGoogle                       // XMP Container:Directory.
+	MotionPhotoMicroVideo                   // XMP GCamera:MicroVideoOffset.
+	MotionPhotoSamsung                      // Samsung SEF trailer.
+)
+
+// Mapping from Motion Photo formats to strings.
+var MotionPhotoFormatNames = map[MotionPhotoFormat]string{
+	MotionPhotoNone:       "none",
+	MotionPhotoGoogle:     "Google Motion Photo",
+	MotionPhotoMicroVideo: "Google MicroVideo",
+	MotionPhotoSamsung:    "Samsung Motion Photo",
+}
+
+// Location of the video in a Motion Photo.
+type MotionPhoto struct {
+	Format        MotionPhotoFormat
+	TrailerOffset int64 // Position of the trailer in the file, if known.
+	Offset        int64 // Position of the video in the trailer.
+	Length        int64 // Length of the video.
+}
+
+// Return the video from a trailer.
+func (mp MotionPhoto) Video(trailer []byte) []byte {
+	return trailer[mp.Offset : mp.Offset+mp.Length]
+}
+
+// A record in a Samsung SEF trailer.
+type SEFRecord struct {
+	Type uint16
+	Name string
+	Data []byte
+}
+
+// Samsung SEF trailer, which ends with a directory of records.
+type sefTrailer struct {
+	start       int    // Position of the first record in the trailer.
+	version     uint32 // Version from the directory header.
+	records     []SEFRecord
+	dataOffsets []int // Position of each record's data in the trailer.
+}
+
+// Size of a SEF directory entry.
+const sefEntrySize = 12
+
+// Decode a SEF trailer at the end of a JPEG trailer. Returns nil if
+// there's no SEF trailer.
+func getSEF(trailer []byte) (*sefTrailer, error) {
+	size := len(trailer)
+	if size < 8 || string(trailer[size-4:]) != "SEFT" {
+		return nil, nil
+	}
+	order := binary.LittleEndian
+	dirLength := int(order.Uint32(trailer[size-8:]))
+	dirPos := size - 8 - dirLength
+	if dirLength < 12 || dirPos < 0 || string(trailer[dirPos:dirPos+4]) != "SEFH" {
+		return nil, errors.New("Invalid SEF trailer directory")
+	}
+	sef := &sefTrailer{start: dirPos, version: order.Uint32(trailer[dirPos+4:])}
+	count := int(order.Uint32(trailer[dirPos+8:]))
+	if count > (dirLength-12)/sefEntrySize {
+		return nil, errors.New("SEF trailer directory is truncated")
+	}
+	for i := 0; i < count; i++ {
+		entry := trailer[dirPos+12+i*sefEntrySize:]
+		offset := int(order.Uint32(entry[4:]))
+		length := int(order.Uint32(entry[8:]))
+		pos := dirPos - offset
+		if offset < 0 || pos < 0 || length < 8 || pos+length > dirPos {
+			return nil, fmt.Errorf("SEF record %d is outside the trailer", i)
+		}
+		record := trailer[pos : pos+length]
+		nameLength := int(order.Uint32(record[4:]))
+		if nameLength < 0 || 8+nameLength > length {
+			return nil, fmt.Errorf("SEF record %d has an invalid name length", i)
+		}
+		sef.records = append(sef.records, SEFRecord{
+			Type: order.Uint16(entry[2:]),
+			Name: string(record[8 : 8+nameLength]),
+			Data: record[8+nameLength:],
+		})
+		sef.dataOffsets = append(sef.dataOffsets, pos+8+nameLength)
+		if pos < sef.start {
+			sef.start = pos
+		}
+	}
+	return sef, nil
+}
+
+// Encode a SEF trailer, with the records followed by the directory.
+func (sef sefTrailer) put() []byte {
+	var buf bytes.Buffer
+	order := binary.LittleEndian
+	positions := make([]int, len(sef.records))
+	for i, record := range sef.records {
+		positions[i] = buf.Len()
+		var header [8]byte
+		order.PutUint16(header[2:], record.Type)
+		order.PutUint32(header[4:], uint32(len(record.Name)))
+		buf.Write(header[:])
+		buf.WriteString(record.Name)
+		buf.Write(record.Data)
+	}
+	dirPos := buf.Len()
+	dir := make([]byte, 12+len(sef.records)*sefEntrySize)
+	copy(dir, "SEFH")
+	order.PutUint32(dir[4:], sef.version)
+	order.PutUint32(dir[8:], uint32(len(sef.records)))
+	for i, record := range sef.records {
+		entry := dir[12+i*sefEntrySize:]
+		order.PutUint16(entry[2:], record.Type)
+		order.PutUint32(entry[4:], uint32(dirPos-positions[i]))
+		order.PutUint32(entry[8:], uint32(8+len(record.Name)+len(record.Data)))
+	}
+	buf.Write(dir)
+	var tail [8]byte
+	order.PutUint32(tail[:], uint32(len(dir)))
+	copy(tail[4:], "SEFT")
+	buf.Write(tail[:])
+	return buf.Bytes()
+}
+
+// Name of the SEF record containing a Samsung Motion Photo video.
+const sefMotionPhotoName = "MotionPhoto_Data"
+
+// Return the index of the SEF record with a given name, or -1 if not
+// found.
+func (sef sefTrailer) find(name string) int {
+	for i, record := range sef.records {
+		if record.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Return the SEF records in a JPEG trailer, or nil if there's no SEF
+// trailer.
+func GetSEFRecords(trailer []byte) ([]SEFRecord, error) {
+	sef, err := getSEF(trailer)
+	if sef == nil {
+		return nil, err
+	}
+	return sef.records, nil
+}
+
+// Return the integer value of a simple XMP property, or -1 if not
+// present or invalid.
+func xmpInteger(prop *XMPProperty) int64 {
+	if prop == nil {
+		return -1
+	}
+	val, err := strconv.ParseInt(prop.Value, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return val
+}
+
+// Return the Container:Item structure from an item in a
+// Container:Directory.
+func containerItem(item *XMPProperty) *XMPProperty {
+	if field := item.Field(NSContainer, "Item"); field != nil {
+		return field
+	}
+	return item
+}
+
+// Locate the video in a Google Motion Photo from its
+// Container:Directory, returning its position from the end of the
+// file.
+func containerVideo(directory *XMPProperty) (fromEnd, length int64, err error) {
+	video := -1
+	for i := range directory.Items {
+		item := containerItem(&directory.Items[i])
+		if semantic := item.Field(NSItem, "Semantic"); semantic != nil && semantic.Value == "MotionPhoto" {
+			video = i
+		}
+	}
+	if video < 0 {
+		return 0, 0, nil
+	}
+	for i := video; i < len(directory.Items); i++ {
+		item := containerItem(&directory.Items[i])
+		itemLength := xmpInteger(item.Field(NSItem, "Length"))
+		if itemLength <= 0 {
+			return 0, 0, fmt.Errorf("Container:Directory item %d has no valid length", i)
+		}
+		if i == video {
+			length = itemLength
+		}
+		fromEnd += itemLength
+		if padding := xmpInteger(item.Field(NSItem, "Padding")); padding > 0 {
+			fromEnd += padding
+		}
+	}
+	return fromEnd, length, nil
+}
+
+// Locate the video in a Motion Photo, given the XMP properties of the
+// primary image, which may be nil, and the trailer following the last
+// image. A Samsung SEF record is used if present, otherwise Google's
+// XMP properties. The format is MotionPhotoNone if there's no video.
+// An error is returned if the video is outside the trailer or doesn't
+// start with an MP4 "ftyp" box.
+func FindMotionPhoto(meta *XMPMeta, trailer []byte) (MotionPhoto, error) {
+	var mp MotionPhoto
+	size := int64(len(trailer))
+	sef, err := getSEF(trailer)
+	if err != nil {
+		return mp, err
+	}
+	if sef != nil {
+		if idx := sef.find(sefMotionPhotoName); idx >= 0 {
+			mp.Format = MotionPhotoSamsung
+			mp.Offset = int64(sef.dataOffsets[idx])
+			mp.Length = int64(len(sef.records[idx].Data))
+		}
+	}
+	if mp.Format == MotionPhotoNone && meta != nil {
+		if directory := meta.Get(NSContainer, "Directory"); directory != nil {
+			fromEnd, length, err := containerVideo(directory)
+			if err != nil {
+				return mp, err
+			}
+			if length > 0 {
+				mp.Format = MotionPhotoGoogle
+				mp.Offset = size - fromEnd
+				mp.Length = length
+			}
+		} else if fromEnd := xmpInteger(meta.Get(NSGCamera, "MicroVideoOffset")); fromEnd > 0 {
+			mp.Format = MotionPhotoMicroVideo
+			mp.Offset = size - fromEnd
+			mp.Length = fromEnd
+		}
+	}
+	if mp.Format == MotionPhotoNone {
+		return mp, nil
+	}
+	if mp.Offset < 0 || mp.Offset+mp.Length > size {
+		return mp, fmt.Errorf("%s video extends outside the trailer", MotionPhotoFormatNames[mp.Format])
+	}
+	if mp.Length < 8 || string(trailer[mp.Offset+4:mp.Offset+8]) != "ftyp" {
+		return mp, fmt.Errorf("%s video isn't an MP4 file", MotionPhotoFormatNames[mp.Format])
+	}
+	return mp, nil
+}
+
+// Return a trailer with the Motion Photo video removed. For Samsung
+// files the SEF trailer is rebuilt without its MotionPhoto_Data
+// record, or removed if it has no other records.
+func StripMotionPhoto(mp MotionPhoto, trailer []byte) ([]byte, error) {
+	switch mp.Format {
+	case MotionPhotoNone:
+		return trailer, nil
+	case MotionPhotoSamsung:
+		sef, err := getSEF(trailer)
+		if err != nil {
+			return nil, err
+		}
+		idx := -1
+		if sef != nil {
+			idx = sef.find(sefMotionPhotoName)
+		}
+		if idx < 0 {
+			return nil, errors.New("SEF trailer has no Motion Photo record")
+		}
+		sef.records = append(sef.records[:idx], sef.records[idx+1:]...)
+		stripped := append([]byte{}, trailer[:sef.start]...)
+		if len(sef.records) > 0 {
+			stripped = append(stripped, sef.put()...)
+		}
+		return stripped, nil
+	}
+	stripped := append([]byte{}, trailer[:mp.Offset]...)
+	return append(stripped, trailer[mp.Offset+mp.Length:]...), nil
+}
+
+// Remove the properties describing a Motion Photo video from the XMP
+// of the primary image: the GCamera MotionPhoto and MicroVideo
+// properties, and the video's item in Container:Directory, which is
+// removed entirely if only the primary image remains. Returns true if
+// any properties were changed.
+func StripMotionPhotoXMP(meta *XMPMeta) bool {
+	changed := false
+	for _, name := range []string{"MotionPhoto", "MotionPhotoVersion", "MotionPhotoPresentationTimestampUs", "MicroVideo", "MicroVideoVersion", "MicroVideoOffset", "MicroVideoPresentationTimestampUs"} {
+		if meta.Get(NSGCamera, name) != nil {
+			meta.Delete(NSGCamera, name)
+			changed = true
+		}
+	}
+	if directory := meta.Get(NSContainer, "Directory"); directory != nil {
+		items := directory.Items[:0]
+		for _, item := range directory.Items {
+			if semantic := containerItem(&item).Field(NSItem, "Semantic"); semantic != nil && semantic.Value == "MotionPhoto" {
+				changed = true
+				continue
+			}
+			items = append(items, item)
+		}
+		directory.Items = items
+		if len(items) <= 1 {
+			meta.Delete(NSContainer, "Directory")
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Handlers for ReadMotionPhoto.
+type motionPhotoReader struct {
+	meta    *XMPMeta
+	trailer []byte
+}
+
+func (r *motionPhotoReader) ReadXMP(format FileFormat, imageIdx uint32, xmp XMP, err error) error {
+	if imageIdx == 0 {
+		// Errors in the XMP aren't fatal, provided the
+		// relevant properties can be read.
+		r.meta, _ = xmp.Meta()
+	}
+	return nil
+}
+
+func (r *motionPhotoReader) ReadTrailer(format FileFormat, trailer []byte) error {
+	r.trailer = trailer
+	return nil
+}
+
+// Locate the video in a Motion Photo file, as per FindMotionPhoto.
+// The trailer is also returned.
+func ReadMotionPhoto(reader io.ReadSeeker) (MotionPhoto, []byte, error) {
+	var r motionPhotoReader
+	if err := Read(reader, ReadControl{ReadXMP: &r, ReadTrailer: &r}); err != nil {
+		return MotionPhoto{}, nil, err
+	}
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return MotionPhoto{}, nil, err
+	}
+	mp, err := FindMotionPhoto(r.meta, r.trailer)
+	mp.TrailerOffset = size - int64(len(r.trailer))
+	return mp, r.trailer, err
+}
@@ -0,0 +1,194 @@
+package exif44
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"testing"
+
+	jseg "github.com/garyhouston/jpegsegs"
+)
+
+// Minimal MP4 data, starting with an "ftyp" box.
+var testVideo = []byte("\000\000\000\020ftypisom\000\000\000\000moov")
+
+// Return XMP metadata with a Container:Directory listing items with
+// the given semantics and lengths.
+func testContainerXMP(semantics []string, lengths []int) *XMPMeta {
+	directory := XMPProperty{NS: NSContainer, Name: "Directory", Kind: XMPSeq}
+	for i, semantic := range semantics {
+		item := XMPProperty{NS: NSContainer, Name: "Item", Kind: XMPStruct, Items: []XMPProperty{
+			XMPText(NSItem, "Semantic", semantic),
+			XMPText(NSItem, "Mime", "video/mp4"),
+		}}
+		if lengths[i] >= 0 {
+			item.Items = append(item.Items, XMPText(NSItem, "Length", strconv.Itoa(lengths[i])))
+		}
+		directory.Items = append(directory.Items, XMPProperty{Kind: XMPStruct, Items: []XMPProperty{item}})
+	}
+	var meta XMPMeta
+	meta.Set(XMPText(NSGCamera, "MotionPhoto", "1"))
+	meta.Set(directory)
+	return &meta
+}
+
+// Return a SEF trailer with records of the given names, each holding
+// testVideo.
+func testSEF(names ...string) []byte {
+	sef := sefTrailer{version: 107}
+	for i, name := range names {
+		sef.records = append(sef.records, SEFRecord{Type: uint16(0x0A30 + i), Name: name, Data: testVideo})
+	}
+	return sef.put()
+}
+
+func TestFindMotionPhoto(t *testing.T) {
+	prefix := []byte("other data")
+	video := len(testVideo)
+	google := testContainerXMP([]string{"Primary", "MotionPhoto"}, []int{0, video})
+	var micro XMPMeta
+	micro.Set(XMPText(NSGCamera, "MicroVideoOffset", strconv.Itoa(video)))
+	sef := testSEF("Other", sefMotionPhotoName)
+	// A SEF directory whose record count exceeds its length.
+	truncated := append([]byte{}, sef...)
+	truncated[len(truncated)-8-(12+2*sefEntrySize)+8] = 3
+	// A SEF record before the start of the trailer.
+	outside := append([]byte{}, sef...)
+	outside[len(outside)-8-sefEntrySize+7] = 0x7F
+	tests := []struct {
+		name    string
+		meta    *XMPMeta
+		trailer []byte
+		format  MotionPhotoFormat
+		offset  int
+		fail    bool
+	}{
+		{"none", nil, prefix, MotionPhotoNone, 0, false},
+		{"Google", google, append(append([]byte{}, prefix...), testVideo...), MotionPhotoGoogle, len(prefix), false},
+		{"MicroVideo", &micro, append(append([]byte{}, prefix...), testVideo...), MotionPhotoMicroVideo, len(prefix), false},
+		{"Samsung", nil, append(append([]byte{}, prefix...), sef...), MotionPhotoSamsung, len(prefix) + 8 + len("Other") + video + 8 + len(sefMotionPhotoName), false},
+		{"Samsung without video", nil, testSEF("Other"), MotionPhotoNone, 0, false},
+		{"Google past start", google, testVideo[1:], MotionPhotoGoogle, -1, true},
+		{"Google not MP4", google, append(append([]byte{}, prefix...), bytes.Repeat([]byte("x"), video)...), MotionPhotoGoogle, len(prefix), true},
+		{"Google missing length", testContainerXMP([]string{"Primary", "MotionPhoto"}, []int{0, -1}), testVideo, MotionPhotoNone, 0, true},
+		{"SEF truncated", nil, truncated, MotionPhotoNone, 0, true},
+		{"SEF record outside", nil, outside, MotionPhotoNone, 0, true},
+		{"SEF short", nil, []byte("\000\000\000\000SEFT"), MotionPhotoNone, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mp, err := FindMotionPhoto(test.meta, test.trailer)
+			if (err != nil) != test.fail {
+				t.Errorf("error %v", err)
+			}
+			if mp.Format != test.format {
+				t.Errorf("format %s", MotionPhotoFormatNames[mp.Format])
+			}
+			if mp.Format == MotionPhotoNone {
+				return
+			}
+			if mp.Offset != int64(test.offset) {
+				t.Errorf("video at %d, expected %d", mp.Offset, test.offset)
+			}
+			if err == nil && !bytes.Equal(mp.Video(test.trailer), testVideo) {
+				t.Errorf("video %q", mp.Video(test.trailer))
+			}
+		})
+	}
+}
+
+func TestStripMotionPhoto(t *testing.T) {
+	prefix := []byte("other data")
+	google := testContainerXMP([]string{"Primary", "MotionPhoto"}, []int{0, len(testVideo)})
+	tests := []struct {
+		name    string
+		meta    *XMPMeta
+		trailer []byte
+		records []string // Expected SEF records after stripping.
+	}{
+		{"none", nil, prefix, nil},
+		{"Google", google, append(append([]byte{}, prefix...), testVideo...), nil},
+		{"Samsung", nil, append(append([]byte{}, prefix...), testSEF(sefMotionPhotoName)...), nil},
+		{"Samsung with other records", nil, append(append([]byte{}, prefix...), testSEF("Other", sefMotionPhotoName, "Another")...), []string{"Other", "Another"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mp, err := FindMotionPhoto(test.meta, test.trailer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stripped, err := StripMotionPhoto(mp, test.trailer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(stripped, prefix) {
+				t.Error("trailer data before the video changed")
+			}
+			records, err := GetSEFRecords(stripped)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, record := range records {
+				names = append(names, record.Name)
+			}
+			if fmt.Sprint(names) != fmt.Sprint(test.records) {
+				t.Errorf("SEF records %q, expected %q", names, test.records)
+			}
+			if test.records == nil && !bytes.Equal(stripped, prefix) {
+				t.Errorf("stripped trailer %q", stripped)
+			}
+			if mp, err := FindMotionPhoto(nil, stripped); err != nil || mp.Format != MotionPhotoNone {
+				t.Errorf("video found after stripping: %s, %v", MotionPhotoFormatNames[mp.Format], err)
+			}
+		})
+	}
+	if _, err := StripMotionPhoto(MotionPhoto{Format: MotionPhotoSamsung}, testSEF("Other")); err == nil {
+		t.Error("missing SEF record not reported")
+	}
+}
+
+func TestStripMotionPhotoXMP(t *testing.T) {
+	var plain XMPMeta
+	plain.Set(XMPText(NSxmp, "Rating", "3"))
+	tests := []struct {
+		name      string
+		meta      *XMPMeta
+		changed   bool
+		directory int // Items remaining in Container:Directory, or -1 if removed.
+	}{
+		{"unrelated", &plain, false, -1},
+		{"Google", testContainerXMP([]string{"Primary", "MotionPhoto"}, []int{0, 10}), true, -1},
+		{"Google with other items", testContainerXMP([]string{"Primary", "GainMap", "MotionPhoto"}, []int{0, 10, 10}), true, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if changed := StripMotionPhotoXMP(test.meta); changed != test.changed {
+				t.Errorf("changed %v", changed)
+			}
+			if test.meta.Get(NSGCamera, "MotionPhoto") != nil {
+				t.Error("GCamera:MotionPhoto not removed")
+			}
+			directory := test.meta.Get(NSContainer, "Directory")
+			if test.directory < 0 && directory != nil || test.directory >= 0 && (directory == nil || len(directory.Items) != test.directory) {
+				t.Errorf("directory %v", directory)
+			}
+		})
+	}
+}
+
+func TestReadMotionPhoto(t *testing.T) {
+	meta := testContainerXMP([]string{"Primary", "MotionPhoto"}, []int{0, len(testVideo)})
+	xmp := append(append([]byte{}, xmpHeader...), meta.Packet(0)...)
+	file := testInsertSegment(testJPEGFile(t, nil, testVideo), jseg.APP0+1, xmp)
+	mp, trailer, err := ReadMotionPhoto(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp.Format != MotionPhotoGoogle || mp.TrailerOffset != int64(len(file)-len(testVideo)) {
+		t.Errorf("format %s, trailer at %d", MotionPhotoFormatNames[mp.Format], mp.TrailerOffset)
+	}
+	if !bytes.Equal(mp.Video(trailer), testVideo) {
+		t.Errorf("video %q", mp.Video(trailer))
+	}
+}
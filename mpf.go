@@ -0,0 +1,182 @@
+package exif44
+
+import (
+	"errors"
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+	"io"
+)
+
+// Support for the Multi-Picture Format (MPF) APP2 segments in JPEG
+// files. The segment in the first image contains an MP Index IFD,
+// which locates all the images in the file, followed by an MP
+// Attribute IFD. The segments in subsequent images contain only an
+// MP Attribute IFD.
+
+// Decoded MPF segment of a JPEG image.
+type MPF struct {
+	// MP Index IFD, only present for the first image. tiff66
+	// doesn't record the space of MP Index nodes, so GetSpace
+	// returns TIFFSpace: use tiff.MPFIndexSpace for tag names.
+	Index     *tiff.IFDNode
+	Attribute *tiff.IFDNode // MP Attribute IFD, or nil.
+}
+
+// Size of each entry in the MP Entry field.
+const mpEntrySize = 16
+
+// Entry for an image in the MP Entry field of the MP Index IFD.
+type MPEntry struct {
+	Attribute  uint32 // Flags, image data format and MP type.
+	Size       uint32
+	Offset     uint32 // Relative to the MPF header, or 0 for the first image.
+	Dependent1 uint16 // Entry number of a dependent image, from 1, or 0.
+	Dependent2 uint16
+}
+
+// Flags in the attribute of an MP entry.
+const (
+	MPDependentParent = 0x80000000
+	MPDependentChild  = 0x40000000
+	MPRepresentative  = 0x20000000
+)
+
+// MP types, in the low 24 bits of the attribute of an MP entry.
+const (
+	MPTypeUndefined            = 0x000000
+	MPTypeLargeThumbnailVGA    = 0x010001
+	MPTypeLargeThumbnailFullHD = 0x010002
+	MPTypePanorama             = 0x020001
+	MPTypeDisparity            = 0x020002
+	MPTypeMultiAngle           = 0x020003
+	MPTypeBaselinePrimary      = 0x030000
+)
+
+// Mapping from MP types to strings.
+var MPTypeNames = map[uint32]string{
+	MPTypeUndefined:            "Undefined",
+	MPTypeLargeThumbnailVGA:    "Large Thumbnail (VGA equivalent)",
+	MPTypeLargeThumbnailFullHD: "Large Thumbnail (Full HD equivalent)",
+	MPTypePanorama:             "Multi-Frame Image (Panorama)",
+	MPTypeDisparity:            "Multi-Frame Image (Disparity)",
+	MPTypeMultiAngle:           "Multi-Frame Image (Multi-Angle)",
+	MPTypeBaselinePrimary:      "Baseline MP Primary Image",
+}
+
+// Return the MP type of an entry.
+func (entry MPEntry) Type() uint32 {
+	return entry.Attribute & 0xFFFFFF
+}
+
+// Decode the MP Entry field of the MP Index IFD.
+func (mpf MPF) Entries() ([]MPEntry, error) {
+	if mpf.Index == nil {
+		return nil, nil
+	}
+	fields := mpf.Index.FindFields([]tiff.Tag{jseg.MPFEntry})
+	if len(fields) == 0 {
+		return nil, errors.New("MP Index IFD has no MP Entry field")
+	}
+	field := fields[0]
+	if len(field.Data)%mpEntrySize != 0 {
+		return nil, errors.New("MP Entry field size isn't a multiple of 16 bytes")
+	}
+	order := mpf.Index.Order
+	entries := make([]MPEntry, len(field.Data)/mpEntrySize)
+	for i := range entries {
+		buf := field.Data[i*mpEntrySize:]
+		entries[i] = MPEntry{
+			Attribute:  order.Uint32(buf),
+			Size:       order.Uint32(buf[4:]),
+			Offset:     order.Uint32(buf[8:]),
+			Dependent1: order.Uint16(buf[12:]),
+			Dependent2: order.Uint16(buf[14:]),
+		}
+	}
+	return entries, nil
+}
+
+// Decode an MPF APP2 segment. 'buf' starts with the MPF header.
+func getMPF(imageIdx uint32, buf []byte) (MPF, error) {
+	var mpf MPF
+	_, next := jseg.GetMPFHeader(buf)
+	if imageIdx == 0 {
+		tree, err := jseg.GetMPFTree(buf[next:], tiff.MPFIndexSpace)
+		if tree != nil {
+			mpf.Index = tree
+			mpf.Attribute = tree.Next
+		}
+		return mpf, err
+	}
+	tree, err := jseg.GetMPFTree(buf[next:], tiff.MPFAttributeSpace)
+	mpf.Attribute = tree
+	return mpf, err
+}
+
+// MPF processor for writing that applies the MPF callback to MPF
+// segments after they have been processed by another processor.
+type mpfEditor struct {
+	processor jseg.MPFProcessor
+	format    FileFormat
+	imageIdx  uint32
+	callback  ReadWriteMPF
+}
+
+func (e *mpfEditor) ProcessAPP2(writer io.WriteSeeker, reader io.ReadSeeker, seg []byte) (bool, []byte, error) {
+	isMPF, seg, err := e.processor.ProcessAPP2(writer, reader, seg)
+	if !isMPF || err != nil {
+		return isMPF, seg, err
+	}
+	// The index rewriter's tree is written again with the final
+	// image positions, so it's edited directly.
+	rewriter, isRewriter := e.processor.(*jseg.MPFIndexRewriter)
+	var mpf MPF
+	if isRewriter {
+		mpf = MPF{Index: rewriter.Tree, Attribute: rewriter.Tree.Next}
+	} else {
+		mpf, err = getMPF(e.imageIdx, append([]byte{}, seg...))
+	}
+	if err = e.callback.ReadWriteMPF(e.format, e.imageIdx, &mpf, err); err != nil {
+		return true, nil, err
+	}
+	tree := mpf.Attribute
+	if mpf.Index != nil {
+		mpf.Index.Next = mpf.Attribute
+		tree = mpf.Index
+	}
+	if isRewriter {
+		if mpf.Index == nil {
+			return true, nil, errors.New("MP Index IFD can't be removed")
+		}
+		rewriter.Tree = mpf.Index
+	}
+	if tree == nil {
+		return true, seg, nil
+	}
+	seg, err = jseg.MakeMPFSegment(tree)
+	return true, seg, err
+}
+
+type ReadMPF interface {
+	// Callback for processing MPF data, read-only. For JPEG
+	// files, it will be called for the MPF segment in each image
+	// that has one, with the MP Index IFD for the first image.
+	// Any errors from decoding the segment will be available in
+	// err, which may be a multierror structure. Returning a
+	// non-nil error will terminate processing.
+	ReadMPF(format FileFormat, imageIdx uint32, mpf MPF, err error) error
+}
+
+type ReadWriteMPF interface {
+	// Callback for processing MPF data, read-write. For JPEG
+	// files, it will be called for the MPF segment in each image
+	// that has one. Fields in the MP Attribute IFD, and in the MP
+	// Index IFD of the first image, can be added, modified or
+	// deleted, but the number of images can't be changed. The
+	// image sizes and offsets in the MP Entry field are set when
+	// the file is written. Any errors from decoding the segment
+	// will be available in err, which may be a multierror
+	// structure. Returning a non-nil error will terminate
+	// processing.
+	ReadWriteMPF(format FileFormat, imageIdx uint32, mpf *MPF, err error) error
+}
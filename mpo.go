@@ -0,0 +1,260 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+	"io"
+)
+
+// Splitting of Multi-Picture Format files, such as MPO files from
+// stereo cameras, into standalone JPEG files, and joining of JPEG
+// files into MPF files.
+
+// An image from an MPF file.
+type MPFImage struct {
+	Entry     MPEntry       // The image's entry from the MP Index IFD.
+	Attribute *tiff.IFDNode // The image's MP Attribute IFD, or nil.
+	Data      []byte        // Standalone JPEG stream.
+}
+
+// Read the MPF segment of the first image in a JPEG file, returning
+// the decoded segment and the index with the absolute image
+// positions. The index is nil if there's no MPF segment.
+func readMPFIndex(reader io.ReadSeeker) (MPF, *jseg.MPFIndex, error) {
+	var mpf MPF
+	scanner, err := jseg.NewScanner(reader)
+	if err != nil {
+		return mpf, nil, err
+	}
+	for {
+		marker, buf, err := scanner.Scan()
+		if err != nil {
+			return mpf, nil, err
+		}
+		if marker == jseg.SOS || marker == jseg.EOI {
+			return mpf, nil, nil
+		}
+		if marker == jseg.APP0+2 {
+			var index jseg.MPFGetIndex
+			isMPF, _, err := index.ProcessAPP2(nil, reader, buf)
+			if err != nil {
+				return mpf, nil, err
+			}
+			if isMPF {
+				mpf, err = getMPF(0, append([]byte{}, buf...))
+				return mpf, index.Index, err
+			}
+		}
+	}
+}
+
+// Segment callback that removes MPF segments, keeping a copy of the
+// first, and optionally inserts a new MPF segment after any APP0 and
+// APP1 segments.
+type replaceMPF struct {
+	found  []byte // Copy of the original MPF segment.
+	insert []byte // New MPF segment, or nil.
+}
+
+func (r *replaceMPF) ReadWriteSegment(format FileFormat, imageIdx uint32, marker jseg.Marker, payload []byte) ([]jseg.Segment, error) {
+	if marker == jseg.APP0+2 && isMPFSegment(payload) {
+		if r.found == nil {
+			r.found = append([]byte{}, payload...)
+		}
+		return nil, nil
+	}
+	segments := []jseg.Segment{{Marker: marker, Data: payload}}
+	if r.insert != nil && afterAPP1(marker, payload) {
+		segments = append([]jseg.Segment{{Marker: jseg.APP0 + 2, Data: r.insert}}, segments...)
+		r.insert = nil
+	}
+	return segments, nil
+}
+
+// Split an MPF file into its images, each as a standalone JPEG stream
+// with its Exif and other metadata, but without its MPF segment. The
+// MP Attribute IFDs are returned separately. 'reader' must be
+// positioned at the start of the file.
+func SplitMPF(reader io.ReadSeeker) ([]MPFImage, error) {
+	mpf, index, err := readMPFIndex(reader)
+	if err != nil {
+		return nil, err
+	}
+	if index == nil {
+		return nil, errors.New("No MPF index found")
+	}
+	entries, err := mpf.Entries()
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != len(index.ImageOffsets) {
+		return nil, errors.New("MPF index and entries don't match")
+	}
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	images := make([]MPFImage, len(entries))
+	for i := range entries {
+		if int64(index.ImageOffsets[i])+int64(index.ImageLengths[i]) > size {
+			return nil, fmt.Errorf("MPF image %d extends past end of file", i+1)
+		}
+		if _, err := reader.Seek(int64(index.ImageOffsets[i]), io.SeekStart); err != nil {
+			return nil, err
+		}
+		data := make([]byte, index.ImageLengths[i])
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, fmt.Errorf("MPF image %d: %v", i+1, err)
+		}
+		var out WriteBuffer
+		var control ReadWriteControl
+		var replace replaceMPF
+		control.ReadWriteSegment = &replace
+		if err := readWriteJPEG(FileJPEG, bytes.NewReader(data), &out, control); err != nil {
+			return nil, fmt.Errorf("MPF image %d: %v", i+1, err)
+		}
+		images[i] = MPFImage{Entry: entries[i], Data: out.Bytes()}
+		if i == 0 {
+			images[i].Attribute = mpf.Attribute
+		} else if replace.found != nil {
+			// Errors in the attribute IFDs of other images
+			// aren't fatal.
+			if imageMPF, err := getMPF(uint32(i), replace.found); err == nil {
+				images[i].Attribute = imageMPF.Attribute
+			}
+		}
+	}
+	return images, nil
+}
+
+// Return a field with a single LONG value.
+func longField(tag tiff.Tag, val uint32, order binary.ByteOrder) tiff.Field {
+	field := tiff.Field{Tag: tag, Type: tiff.LONG, Count: 1, Data: make([]byte, 4)}
+	field.PutLong(val, 0, order)
+	return field
+}
+
+// Check if an MP type is one of the multi-frame types.
+func isMultiFrame(mpType uint32) bool {
+	return mpType&0xFF0000 == 0x020000
+}
+
+// Return a minimal MP Attribute IFD for an image, with the version
+// and, for multi-frame images, the image number and base viewpoint.
+func makeMPFAttribute(entry MPEntry, number uint32, order binary.ByteOrder) *tiff.IFDNode {
+	node := tiff.NewIFDNode(tiff.MPFAttributeSpace)
+	node.Order = order
+	fields := []tiff.Field{{Tag: jseg.MPFVersion, Type: tiff.UNDEFINED, Count: 4, Data: []byte("0100")}}
+	if isMultiFrame(entry.Type()) {
+		fields = append(fields, longField(jseg.MPFIndividualImageNumber, number, order))
+		if entry.Type() == MPTypeDisparity || entry.Type() == MPTypeMultiAngle {
+			fields = append(fields, longField(jseg.MPFBaseViewpointNumber, 1, order))
+		}
+	}
+	node.AddFields(fields)
+	return node
+}
+
+// Return the MP Index IFD for a set of images, with zero sizes and
+// offsets, followed by the MP Attribute IFD of the first image.
+func makeMPFIndex(images []MPFImage, attribute *tiff.IFDNode) *tiff.IFDNode {
+	node := tiff.NewIFDNode(tiff.MPFIndexSpace)
+	node.Order = attribute.Order
+	entries := make([]byte, mpEntrySize*len(images))
+	for i, image := range images {
+		buf := entries[i*mpEntrySize:]
+		node.Order.PutUint32(buf, image.Entry.Attribute)
+		node.Order.PutUint16(buf[12:], image.Entry.Dependent1)
+		node.Order.PutUint16(buf[14:], image.Entry.Dependent2)
+	}
+	node.AddFields([]tiff.Field{
+		{Tag: jseg.MPFVersion, Type: tiff.UNDEFINED, Count: 4, Data: []byte("0100")},
+		longField(jseg.MPFNumberOfImages, uint32(len(images)), node.Order),
+		{Tag: jseg.MPFEntry, Type: tiff.UNDEFINED, Count: uint32(len(entries)), Data: entries},
+	})
+	node.Next = attribute
+	return node
+}
+
+// MPF processor that records the output position of the MPF segment.
+type mpfPosition struct {
+	pos uint32
+}
+
+func (p *mpfPosition) ProcessAPP2(writer io.WriteSeeker, _ io.ReadSeeker, seg []byte) (bool, []byte, error) {
+	isMPF, _ := jseg.GetMPFHeader(seg)
+	if isMPF {
+		pos, err := writer.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return false, nil, err
+		}
+		p.pos = uint32(pos)
+	}
+	return isMPF, seg, nil
+}
+
+// Join JPEG images into an MPF file, written to 'writer' from its
+// start. The first image is the primary image, which gets the MP
+// Index IFD. The MP type, flags and dependent images of each image
+// are taken from its Entry; the size and offset are calculated. Any
+// MPF segments in the images are replaced, and images without an MP
+// Attribute IFD are given a minimal one, numbering the multi-frame
+// images from 1. Data following the end of each image is dropped.
+func JoinMPF(writer io.WriteSeeker, images []MPFImage) error {
+	if len(images) < 2 {
+		return errors.New("An MPF file needs at least two images")
+	}
+	offsets := make([]uint32, len(images))
+	var index *tiff.IFDNode
+	var position mpfPosition
+	number := uint32(0)
+	for i, image := range images {
+		if isMultiFrame(image.Entry.Type()) {
+			number++
+		}
+		attribute := image.Attribute
+		if attribute == nil {
+			var order binary.ByteOrder = binary.BigEndian
+			if i > 0 {
+				order = index.Order
+			}
+			attribute = makeMPFAttribute(image.Entry, number, order)
+		}
+		tree := attribute
+		var processor jseg.MPFProcessor = &jseg.MPFCheck{}
+		if i == 0 {
+			index = makeMPFIndex(images, attribute)
+			tree = index
+			processor = &position
+		}
+		seg, err := jseg.MakeMPFSegment(tree)
+		if err != nil {
+			return err
+		}
+		pos, err := writer.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			offsets[i] = uint32(pos)
+		}
+		var control ReadWriteControl
+		control.ReadWriteSegment = &replaceMPF{insert: seg}
+		if err := readWriteJPEGImage(FileJPEG, uint32(i), bytes.NewReader(image.Data), writer, processor, nil, control); err != nil {
+			return fmt.Errorf("Image %d: %v", i+1, err)
+		}
+	}
+	end, err := writer.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := jseg.RewriteMPF(writer, index, position.pos, offsets, uint32(end)); err != nil {
+		return err
+	}
+	_, err = writer.Seek(end, io.SeekStart)
+	return err
+}
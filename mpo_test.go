@@ -0,0 +1,265 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// Return an MPF file with a primary image and a large thumbnail.
+func testMPF(t *testing.T) []byte {
+	images := []MPFImage{
+		{Entry: MPEntry{Attribute: MPTypeBaselinePrimary | MPRepresentative}, Data: testJPEGFile(t, [][]byte{testTIFF(t, testExif("Acme"))}, nil)},
+		{Entry: MPEntry{Attribute: MPTypeLargeThumbnailVGA}, Data: testJPEG(t, 8, 8)},
+	}
+	var out WriteBuffer
+	if err := JoinMPF(&out, images); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// Set the size of the second image in the MP Entry field of an MPF file.
+func testSetMPFSize(t *testing.T, file []byte, size uint32) {
+	_, index, err := readMPFIndex(bytes.NewReader(file))
+	if err != nil || index == nil {
+		t.Fatal("MPF index not found")
+	}
+	// The index written by JoinMPF is big-endian.
+	entry := make([]byte, 8)
+	binary.BigEndian.PutUint32(entry, index.ImageLengths[1])
+	binary.BigEndian.PutUint32(entry[4:], index.ImageOffsets[1]-index.Offset)
+	pos := bytes.Index(file, entry)
+	if pos < 0 {
+		t.Fatal("MP Entry not found")
+	}
+	binary.BigEndian.PutUint32(file[pos:], size)
+}
+
+func TestSplitMPF(t *testing.T) {
+	mpf := testMPF(t)
+	tests := []struct {
+		name   string
+		file   func() []byte
+		images int // Expected number of images, or 0 for an error.
+	}{
+		{"valid", func() []byte { return mpf }, 2},
+		{"not MPF", func() []byte { return testJPEG(t, 8, 8) }, 0},
+		{"truncated", func() []byte { return mpf[:len(mpf)-10] }, 0},
+		{"huge size", func() []byte {
+			file := append([]byte{}, mpf...)
+			testSetMPFSize(t, file, 0xFFFFFF00)
+			return file
+		}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			images, err := SplitMPF(bytes.NewReader(test.file()))
+			if test.images == 0 {
+				if err == nil {
+					t.Error("invalid MPF file accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(images) != test.images {
+				t.Fatalf("%d images, expected %d", len(images), test.images)
+			}
+			for i, image := range images {
+				for _, seg := range testSegments(t, image.Data) {
+					if seg.Marker == jseg.APP0+2 && isMPFSegment(seg.Data) {
+						t.Errorf("image %d has an MPF segment", i+1)
+					}
+				}
+			}
+			if images[1].Entry.Type() != MPTypeLargeThumbnailVGA {
+				t.Errorf("second image has type 0x%X", images[1].Entry.Type())
+			}
+			// Joining the split images gives the same file.
+			var out WriteBuffer
+			if err := JoinMPF(&out, images); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), mpf) {
+				t.Error("joined file differs from the original")
+			}
+		})
+	}
+}
+
+// MPF callbacks that record the trees of each image.
+type testMPFRecorder struct {
+	mpf  []MPF
+	errs []error
+	edit func(imageIdx uint32, mpf *MPF)
+}
+
+func (r *testMPFRecorder) ReadMPF(format FileFormat, imageIdx uint32, mpf MPF, err error) error {
+	r.mpf = append(r.mpf, mpf)
+	r.errs = append(r.errs, err)
+	return nil
+}
+
+func (r *testMPFRecorder) ReadWriteMPF(format FileFormat, imageIdx uint32, mpf *MPF, err error) error {
+	if r.edit != nil {
+		r.edit(imageIdx, mpf)
+	}
+	return r.ReadMPF(format, imageIdx, *mpf, err)
+}
+
+func TestReadMPF(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   []byte
+		images int
+		fail   bool
+	}{
+		{"MPF", testMPF(t), 2, false},
+		{"no MPF", testJPEG(t, 8, 8), 0, false},
+		{"invalid tree", testInsertSegment(testJPEG(t, 8, 8), jseg.APP0+2, []byte("MPF\000MM\000\052\000\000\000\010\000")), 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var r testMPFRecorder
+			err := Read(bytes.NewReader(test.file), ReadControl{ReadMPF: &r})
+			if (err != nil) != test.fail {
+				t.Fatalf("error %v", err)
+			}
+			if len(r.mpf) != test.images {
+				t.Fatalf("%d MPF segments, expected %d", len(r.mpf), test.images)
+			}
+			if test.images == 0 {
+				return
+			}
+			for i, mpf := range r.mpf {
+				if r.errs[i] != nil {
+					t.Errorf("image %d: %v", i+1, r.errs[i])
+				}
+				if (mpf.Index != nil) != (i == 0) || mpf.Attribute == nil {
+					t.Errorf("image %d: index %v, attribute %v", i+1, mpf.Index != nil, mpf.Attribute != nil)
+				}
+			}
+			entries, err := r.mpf[0].Entries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 || entries[1].Type() != MPTypeLargeThumbnailVGA {
+				t.Errorf("MP entries %v", entries)
+			}
+		})
+	}
+}
+
+func TestReadWriteMPF(t *testing.T) {
+	mpf := testMPF(t)
+	tests := []struct {
+		name string
+		edit func(imageIdx uint32, mpf *MPF)
+		fail bool
+	}{
+		{"unchanged", nil, false},
+		{"add field", func(imageIdx uint32, mpf *MPF) {
+			mpf.Attribute.AddFields([]tiff.Field{longField(jseg.MPFIndividualImageNumber, imageIdx+1, mpf.Attribute.Order)})
+		}, false},
+		{"remove index", func(imageIdx uint32, mpf *MPF) {
+			mpf.Index = nil
+		}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := testReadWrite(t, mpf, ReadWriteControl{ReadWriteMPF: &testMPFRecorder{edit: test.edit}})
+			if test.fail {
+				if err == nil {
+					t.Error("invalid MPF edit accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r testMPFRecorder
+			if err := Read(bytes.NewReader(out), ReadControl{ReadMPF: &r}); err != nil {
+				t.Fatal(err)
+			}
+			for i, mpf := range r.mpf {
+				fields := mpf.Attribute.FindFields([]tiff.Tag{jseg.MPFIndividualImageNumber})
+				if (len(fields) == 1) != (test.edit != nil) {
+					t.Errorf("image %d: %d image number fields", i+1, len(fields))
+				}
+			}
+			// The image positions in the index are still valid.
+			images, err := SplitMPF(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(images) != 2 || images[1].Entry.Type() != MPTypeLargeThumbnailVGA {
+				t.Errorf("%d images", len(images))
+			}
+		})
+	}
+}
+
+func TestJoinMPF(t *testing.T) {
+	primary := MPFImage{Entry: MPEntry{Attribute: MPTypeBaselinePrimary}, Data: testJPEG(t, 16, 16)}
+	frame := MPFImage{Entry: MPEntry{Attribute: MPTypePanorama}, Data: testJPEG(t, 8, 8)}
+	// An image that already has an MPF segment, and trailing data.
+	existing := MPFImage{Entry: MPEntry{Attribute: MPTypePanorama}, Data: append(testMPF(t), "trailer"...)}
+	tests := []struct {
+		name   string
+		images []MPFImage
+		fail   bool
+	}{
+		{"panorama", []MPFImage{primary, frame, frame}, false},
+		{"existing MPF", []MPFImage{primary, existing}, false},
+		{"one image", []MPFImage{primary}, true},
+		{"invalid image", []MPFImage{primary, {Entry: MPEntry{Attribute: MPTypeLargeThumbnailVGA}, Data: []byte("not a JPEG")}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out WriteBuffer
+			err := JoinMPF(&out, test.images)
+			if test.fail {
+				if err == nil {
+					t.Error("invalid images accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r testMPFRecorder
+			if err := Read(bytes.NewReader(out.Bytes()), ReadControl{ReadMPF: &r}); err != nil {
+				t.Fatal(err)
+			}
+			if len(r.mpf) != len(test.images) {
+				t.Fatalf("%d MPF segments, expected %d", len(r.mpf), len(test.images))
+			}
+			for i, mpf := range r.mpf {
+				var number int64
+				if fields := mpf.Attribute.FindFields([]tiff.Tag{jseg.MPFIndividualImageNumber}); len(fields) > 0 {
+					number = fields[0].AnyInteger(0, mpf.Attribute.Order)
+				}
+				if number != int64(i) {
+					t.Errorf("image %d has number %d", i+1, number)
+				}
+			}
+			images, err := SplitMPF(bytes.NewReader(out.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, image := range images {
+				if image.Entry.Attribute != test.images[i].Entry.Attribute {
+					t.Errorf("image %d has attribute 0x%X", i+1, image.Entry.Attribute)
+				}
+			}
+			if bytes.Contains(out.Bytes(), []byte("trailer")) {
+				t.Error("trailing data not dropped")
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package exif44
+
+import (
+	"fmt"
+	tiff "github.com/garyhouston/tiff66"
+	"github.com/hashicorp/go-multierror"
+	"strings"
+	"unicode/utf8"
+)
+
+// Reconciliation of Exif, IPTC and XMP metadata following the
+// Metadata Working Group's "Guidelines for Handling Image Metadata"
+// 2.0. When reading, Exif is preferred for the properties it can
+// hold, provided its text is valid UTF-8. IPTC is preferred to XMP
+// only if its digest shows that it was modified by a tool that
+// didn't update the XMP. XMP is preferred for ratings, which have no
+// standard Exif field.
+
+// Source of a reconciled value.
+type MWGSource uint8
+
+const (
+	MWGNone MWGSource = iota
+	MWGExif
+	MWGIPTC
+	MWGXMP
+)
+
+// Mapping from MWG sources to strings.
+var MWGSourceNames = map[MWGSource]string{
+	MWGNone: "none",
+	MWGExif: "Exif",
+	MWGIPTC: "IPTC",
+	MWGXMP:  "XMP",
+}
+
+// A reconciled value, expressed as an XMP property.
+type MWGValue struct {
+	Name     string      // MWG name, e.g., "DateTimeOriginal".
+	Property XMPProperty // Reconciled value, or the zero value if not found.
+	Source   MWGSource   // Source of the reconciled value.
+	Conflict bool        // True if the sources had different values.
+}
+
+// An MWG property and where it's stored.
+type mwgProperty struct {
+	name     string
+	mappings []xmpMapping // Exif mappings: the value, then any companion fields.
+	iptc     []IPTCTag    // Corresponding IPTC datasets, if any.
+	xmpFirst bool         // True if XMP is preferred to Exif.
+}
+
+// Return the mapping for an Exif field with a given XMP property.
+func findMapping(space tiff.TagSpace, tag tiff.Tag, ns, name string) xmpMapping {
+	for _, m := range xmpMappings {
+		if m.space == space && m.tag == tag && m.ns == ns && m.name == name {
+			return m
+		}
+	}
+	panic(fmt.Sprintf("No XMP mapping for %s:%s", ns, name))
+}
+
+// Properties reconciled by ReconcileMWG.
+var mwgProperties = []mwgProperty{
+	{name: "DateTimeOriginal", mappings: []xmpMapping{findMapping(tiff.ExifSpace, DateTimeOriginal, NSphotoshop, "DateCreated")}, iptc: []IPTCTag{IPTCDateCreated, IPTCTimeCreated}},
+	{name: "CreateDate", mappings: []xmpMapping{findMapping(tiff.ExifSpace, DateTimeDigitized, NSxmp, "CreateDate")}},
+	{name: "ModifyDate", mappings: []xmpMapping{findMapping(tiff.TIFFSpace, tiff.DateTime, NSxmp, "ModifyDate")}},
+	{name: "Description", mappings: []xmpMapping{findMapping(tiff.TIFFSpace, tiff.ImageDescription, NSdc, "description")}, iptc: []IPTCTag{IPTCCaptionAbstract}},
+	{name: "Copyright", mappings: []xmpMapping{findMapping(tiff.TIFFSpace, tiff.Copyright, NSdc, "rights")}, iptc: []IPTCTag{IPTCCopyrightNotice}},
+	{name: "Creator", mappings: []xmpMapping{findMapping(tiff.TIFFSpace, tiff.Artist, NSdc, "creator")}, iptc: []IPTCTag{IPTCByline}},
+	{name: "Rating", mappings: []xmpMapping{findMapping(tiff.TIFFSpace, Rating, NSxmp, "Rating")}, xmpFirst: true},
+	{name: "GPSLatitude", mappings: []xmpMapping{findMapping(tiff.GPSSpace, GPSLatitude, NSexif, "GPSLatitude")}},
+	{name: "GPSLongitude", mappings: []xmpMapping{findMapping(tiff.GPSSpace, GPSLongitude, NSexif, "GPSLongitude")}},
+	{name: "GPSAltitude", mappings: []xmpMapping{findMapping(tiff.GPSSpace, GPSAltitude, NSexif, "GPSAltitude"), findMapping(tiff.GPSSpace, GPSAltitudeRef, NSexif, "GPSAltitudeRef")}},
+}
+
+// Convert IPTC DateCreated and TimeCreated values, "YYYYMMDD" and
+// "HHMMSS+HHMM", to an ISO 8601 date.
+func iptcDateToISO(date, tm string) string {
+	if len(date) != 8 {
+		return ""
+	}
+	iso := date[0:4] + "-" + date[4:6] + "-" + date[6:8]
+	if len(tm) >= 6 {
+		iso += "T" + tm[0:2] + ":" + tm[2:4] + ":" + tm[4:6]
+		if len(tm) == 11 {
+			iso += tm[6:9] + ":" + tm[9:11]
+		}
+	}
+	return iso
+}
+
+// Convert an ISO 8601 date to IPTC DateCreated and TimeCreated values.
+func isoDateToIPTC(iso string) (date, tm string, err error) {
+	exifDate, _, offset, err := isoDateToExif(iso)
+	if err != nil {
+		return "", "", err
+	}
+	date = strings.Replace(exifDate[:10], ":", "", -1)
+	if strings.Contains(iso, "T") {
+		tm = strings.Replace(exifDate[11:], ":", "", -1)
+		if offset == "" {
+			offset = "+00:00"
+		}
+		tm += strings.Replace(offset, ":", "", -1)
+	}
+	return date, tm, nil
+}
+
+// Return the IPTC value of an MWG property as an XMP property.
+func (p mwgProperty) iptcProperty(iptc *IPTC) (XMPProperty, bool) {
+	m := p.mappings[0]
+	if iptc == nil || len(p.iptc) == 0 {
+		return XMPProperty{}, false
+	}
+	values := iptc.Strings(p.iptc[0])
+	if len(values) == 0 {
+		return XMPProperty{}, false
+	}
+	switch m.conv {
+	case convDate:
+		iso := iptcDateToISO(values[0], iptc.Value(p.iptc[1]))
+		return XMPText(m.ns, m.name, iso), iso != ""
+	case convCreator:
+		return XMPArray(m.ns, m.name, XMPSeq, values), true
+	}
+	return XMPLangAlt(m.ns, m.name, values[0]), true
+}
+
+// Return the Exif value of an MWG property as an XMP property.
+func (p mwgProperty) exifProperty(exif *Exif) (XMPProperty, bool) {
+	if exif == nil || exif.TIFF == nil {
+		return XMPProperty{}, false
+	}
+	prop, found := exifToXMPProperty(exif, p.mappings[0])
+	if !found {
+		return prop, false
+	}
+	// Exif text should be UTF-8, but may be in another encoding.
+	for _, v := range prop.Values() {
+		if !utf8.ValidString(v) {
+			return prop, false
+		}
+	}
+	return prop, true
+}
+
+// Remove fractional seconds from an ISO 8601 date, since IPTC can't
+// store them.
+func truncateISODate(iso string) string {
+	if dot := strings.IndexByte(iso, '.'); dot >= 0 {
+		end := dot + 1
+		for end < len(iso) && iso[end] >= '0' && iso[end] <= '9' {
+			end++
+		}
+		iso = iso[:dot] + iso[end:]
+	}
+	return iso
+}
+
+// Check if two properties have the same values. Dates are compared
+// without fractional seconds.
+func sameValues(a, b XMPProperty, conv xmpConversion) bool {
+	va, vb := a.Values(), b.Values()
+	if conv == convDate {
+		va, vb = []string{truncateISODate(a.Value)}, []string{truncateISODate(b.Value)}
+	}
+	if a.Kind == XMPAlt {
+		va = []string{a.Text()}
+	}
+	if b.Kind == XMPAlt {
+		vb = []string{b.Text()}
+	}
+	if len(va) != len(vb) {
+		return false
+	}
+	for i := range va {
+		if strings.TrimSpace(va[i]) != strings.TrimSpace(vb[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reconcile the values of common properties in Exif, IPTC and XMP,
+// following the MWG guidelines: DateTimeOriginal, CreateDate,
+// ModifyDate, Description, Copyright, Creator, Rating, GPSLatitude,
+// GPSLongitude and GPSAltitude. Any of the sources may be nil.
+func ReconcileMWG(exif *Exif, meta *XMPMeta, iptc *IPTC) []MWGValue {
+	// IPTC is only preferred to XMP if its digest doesn't match,
+	// showing that it was modified without updating the XMP.
+	iptcChanged := false
+	if iptc != nil && FindImageResource(iptc.Resources, ImageResourceIPTCDigest) >= 0 {
+		iptcChanged = CheckIPTCDigest(iptc.Resources) != nil
+	}
+	values := make([]MWGValue, 0, len(mwgProperties))
+	for _, p := range mwgProperties {
+		var candidates []MWGValue
+		exifProp, haveExif := p.exifProperty(exif)
+		var xmpProp *XMPProperty
+		if meta != nil {
+			xmpProp = meta.Get(p.mappings[0].ns, p.mappings[0].name)
+		}
+		iptcProp, haveIPTC := p.iptcProperty(iptc)
+		if haveExif && !p.xmpFirst {
+			candidates = append(candidates, MWGValue{Property: exifProp, Source: MWGExif})
+		}
+		if haveIPTC && iptcChanged {
+			candidates = append(candidates, MWGValue{Property: iptcProp, Source: MWGIPTC})
+		}
+		if xmpProp != nil {
+			candidates = append(candidates, MWGValue{Property: *xmpProp, Source: MWGXMP})
+		}
+		if haveIPTC && !iptcChanged {
+			candidates = append(candidates, MWGValue{Property: iptcProp, Source: MWGIPTC})
+		}
+		if haveExif && p.xmpFirst {
+			candidates = append(candidates, MWGValue{Property: exifProp, Source: MWGExif})
+		}
+		value := MWGValue{Name: p.name}
+		if len(candidates) > 0 {
+			value = candidates[0]
+			value.Name = p.name
+			for _, c := range candidates[1:] {
+				if !sameValues(value.Property, c.Property, p.mappings[0].conv) {
+					value.Conflict = true
+				}
+			}
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// Return the reconciled value with the given MWG name, or nil if not
+// found.
+func FindMWGValue(values []MWGValue, name string) *MWGValue {
+	for i := range values {
+		if values[i].Name == name {
+			return &values[i]
+		}
+	}
+	return nil
+}
+
+// Write reconciled values to Exif, IPTC and XMP, so that they are
+// consistent. Any of the destinations may be nil. Following the MWG
+// guidelines, IPTC is only updated if it already has datasets, and
+// Exif and XMP are updated or created. Returns a multierror structure
+// if any values couldn't be converted.
+func ApplyMWG(values []MWGValue, exif *Exif, meta *XMPMeta, iptc *IPTC) error {
+	var err error
+	for _, value := range values {
+		if value.Source == MWGNone {
+			continue
+		}
+		var p *mwgProperty
+		for i := range mwgProperties {
+			if mwgProperties[i].name == value.Name {
+				p = &mwgProperties[i]
+			}
+		}
+		if p == nil {
+			err = multierror.Append(err, fmt.Errorf("Unknown MWG property %s", value.Name))
+			continue
+		}
+		m := p.mappings[0]
+		prop := value.Property
+		prop.NS, prop.Name = m.ns, m.name
+		if meta != nil {
+			meta.Set(prop)
+		}
+		if exif != nil && exif.TIFF != nil {
+			if convErr := xmpToExifFields(prop, exif, m); convErr != nil {
+				err = multierror.Append(err, convErr)
+			}
+		}
+		// Copy companion fields, such as GPSAltitudeRef, from the
+		// source of the value.
+		for _, cm := range p.mappings[1:] {
+			switch {
+			case value.Source == MWGExif && exif != nil && exif.TIFF != nil && meta != nil:
+				if cprop, found := exifToXMPProperty(exif, cm); found {
+					meta.Set(cprop)
+				}
+			case value.Source == MWGXMP && exif != nil && exif.TIFF != nil && meta != nil:
+				if cprop := meta.Get(cm.ns, cm.name); cprop != nil {
+					if convErr := xmpToExifFields(*cprop, exif, cm); convErr != nil {
+						err = multierror.Append(err, convErr)
+					}
+				}
+			}
+		}
+		if iptc != nil && len(iptc.Datasets) > 0 && len(p.iptc) > 0 {
+			switch m.conv {
+			case convDate:
+				date, tm, convErr := isoDateToIPTC(prop.Text())
+				if convErr != nil {
+					err = multierror.Append(err, convErr)
+					continue
+				}
+				iptc.Set(p.iptc[0], []string{date})
+				if tm != "" {
+					iptc.Set(p.iptc[1], []string{tm})
+				}
+			case convCreator:
+				iptc.Set(p.iptc[0], prop.Values())
+			default:
+				iptc.Set(p.iptc[0], []string{prop.Text()})
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+package exif44
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"strconv"
+	"testing"
+
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// Return IPTC data with the given datasets and, if 'digest' is 1, a
+// matching digest resource or, if 2, a digest that doesn't match.
+func testIPTC(datasets []IPTCDataset, digest int) *IPTC {
+	iim := MakeIPTCDatasets(datasets)
+	iptc := &IPTC{Datasets: datasets, Resources: []ImageResource{{Signature: []byte("8BIM"), ID: ImageResourceIPTC, Data: iim}}}
+	if digest > 0 {
+		sum := md5.Sum(iim)
+		if digest == 2 {
+			sum[0] ^= 0xFF
+		}
+		iptc.Resources = append(iptc.Resources, ImageResource{Signature: []byte("8BIM"), ID: ImageResourceIPTCDigest, Data: sum[:]})
+	}
+	return iptc
+}
+
+// Return an Exif tree with the given fields in IFD0.
+func testExifIFD0(fields ...tiff.Field) *Exif {
+	exif := testExif("Acme")
+	exif.TIFF.AddFields(fields)
+	return exif
+}
+
+// Return XMP metadata with the given properties.
+func testXMPMeta(props ...XMPProperty) *XMPMeta {
+	meta := &XMPMeta{}
+	for _, prop := range props {
+		meta.Set(prop)
+	}
+	return meta
+}
+
+func TestReconcileMWG(t *testing.T) {
+	order := binary.BigEndian
+	caption := []IPTCDataset{{IPTCCaptionAbstract, []byte("IPTC caption")}}
+	xmpDesc := XMPLangAlt(NSdc, "description", "XMP caption")
+	tests := []struct {
+		name     string
+		exif     *Exif
+		meta     *XMPMeta
+		iptc     *IPTC
+		mwgName  string
+		source   MWGSource
+		value    string // Expected text of the reconciled value.
+		conflict bool
+	}{
+		{"Exif over XMP", testExifIFD0(testASCII(tiff.ImageDescription, "Exif caption")), testXMPMeta(xmpDesc), nil, "Description", MWGExif, "Exif caption", true},
+		{"same values", testExifIFD0(testASCII(tiff.ImageDescription, "XMP caption ")), testXMPMeta(xmpDesc), nil, "Description", MWGExif, "XMP caption", false},
+		{"Exif not UTF-8", testExifIFD0(testASCII(tiff.ImageDescription, "caf\xe9")), testXMPMeta(xmpDesc), nil, "Description", MWGXMP, "XMP caption", false},
+		{"XMP over IPTC", nil, testXMPMeta(xmpDesc), testIPTC(caption, 1), "Description", MWGXMP, "XMP caption", true},
+		{"XMP over IPTC without digest", nil, testXMPMeta(xmpDesc), testIPTC(caption, 0), "Description", MWGXMP, "XMP caption", true},
+		{"IPTC with changed digest", nil, testXMPMeta(xmpDesc), testIPTC(caption, 2), "Description", MWGIPTC, "IPTC caption", true},
+		{"IPTC only", nil, nil, testIPTC(caption, 1), "Description", MWGIPTC, "IPTC caption", false},
+		{"Exif over changed IPTC", testExifIFD0(testASCII(tiff.ImageDescription, "Exif caption")), nil, testIPTC(caption, 2), "Description", MWGExif, "Exif caption", true},
+		{"Rating XMP first", testExifIFD0(integersField(Rating, tiff.SHORT, []int64{3}, order)), testXMPMeta(XMPText(NSxmp, "Rating", "5")), nil, "Rating", MWGXMP, "5", true},
+		{"Rating Exif only", testExifIFD0(integersField(Rating, tiff.SHORT, []int64{3}, order)), nil, nil, "Rating", MWGExif, "3", false},
+		{"IPTC date", nil, nil, testIPTC([]IPTCDataset{{IPTCDateCreated, []byte("20040110")}, {IPTCTimeCreated, []byte("133704+0100")}}, 0), "DateTimeOriginal", MWGIPTC, "2004-01-10T13:37:04+01:00", false},
+		{"dates without subseconds", testExif("Acme", testASCII(DateTimeOriginal, "2004:01:10 13:37:04"), testASCII(SubSecTimeOriginal, "25")), testXMPMeta(XMPText(NSphotoshop, "DateCreated", "2004-01-10T13:37:04")), nil, "DateTimeOriginal", MWGExif, "2004-01-10T13:37:04.25", false},
+		{"not found", nil, nil, nil, "Creator", MWGNone, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value := FindMWGValue(ReconcileMWG(test.exif, test.meta, test.iptc), test.mwgName)
+			if value == nil {
+				t.Fatal("value not found")
+			}
+			if value.Source != test.source || value.Property.Text() != test.value || value.Conflict != test.conflict {
+				t.Errorf("%s value %q, conflict %v", MWGSourceNames[value.Source], value.Property.Text(), value.Conflict)
+			}
+		})
+	}
+}
+
+func TestApplyMWG(t *testing.T) {
+	order := binary.BigEndian
+	// An IPTC date and time is written to Exif and XMP, and back
+	// to IPTC.
+	iptc := testIPTC([]IPTCDataset{{IPTCDateCreated, []byte("20040110")}, {IPTCTimeCreated, []byte("133704+0100")}}, 0)
+	exif, meta := testExif("Acme"), &XMPMeta{}
+	values := ReconcileMWG(exif, meta, iptc)
+	out := testIPTC([]IPTCDataset{{IPTCObjectName, []byte("name")}}, 0)
+	if err := ApplyMWG(values, exif, meta, out); err != nil {
+		t.Fatal(err)
+	}
+	if date, tm := out.Value(IPTCDateCreated), out.Value(IPTCTimeCreated); date != "20040110" || tm != "133704+0100" {
+		t.Errorf("IPTC date %q, time %q", date, tm)
+	}
+	if field := findField(exif.Exif, DateTimeOriginal); field == nil || field.ASCII() != "2004:01:10 13:37:04" {
+		t.Error("Exif DateTimeOriginal not set")
+	}
+	if field := findField(exif.Exif, OffsetTimeOriginal); field == nil || field.ASCII() != "+01:00" {
+		t.Error("Exif OffsetTimeOriginal not set")
+	}
+	if prop := meta.Get(NSphotoshop, "DateCreated"); prop == nil || prop.Value != "2004-01-10T13:37:04+01:00" {
+		t.Errorf("XMP DateCreated %v", prop)
+	}
+
+	// Companion fields are copied from the value's source, and
+	// the destinations may be nil.
+	gpsExif := testExif("Acme")
+	makeSpaceNode(gpsExif, tiff.GPSSpace).AddFields([]tiff.Field{
+		integersField(GPSAltitudeRef, tiff.BYTE, []int64{1}, order),
+		rationalsField(GPSAltitude, tiff.RATIONAL, [][2]int64{{100, 1}}, order),
+	})
+	gpsMeta := testXMPMeta(XMPText(NSexif, "GPSAltitude", "200/1"), XMPText(NSexif, "GPSAltitudeRef", "0"))
+	tests := []struct {
+		name     string
+		exif     *Exif // Source and destination.
+		meta     *XMPMeta
+		altitude string // Expected XMP GPSAltitude.
+		altRef   string // Expected GPSAltitudeRef in XMP and Exif, or "".
+	}{
+		{"from Exif", gpsExif, &XMPMeta{}, "100/1", "1"},
+		{"from Exif without Exif destination", nil, &XMPMeta{}, "", ""},
+		{"from XMP", testExif("Acme"), gpsMeta, "200/1", "0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := test.exif
+			if source == nil {
+				source = gpsExif
+			}
+			values := ReconcileMWG(source, test.meta, nil)
+			if err := ApplyMWG(values, test.exif, test.meta, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := ApplyMWG(values, nil, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			if test.altRef == "" {
+				if prop := test.meta.Get(NSexif, "GPSAltitudeRef"); prop != nil {
+					t.Errorf("unexpected XMP GPSAltitudeRef %v", prop)
+				}
+				return
+			}
+			if prop := test.meta.Get(NSexif, "GPSAltitude"); prop == nil || prop.Value != test.altitude {
+				t.Errorf("XMP GPSAltitude %v", prop)
+			}
+			if prop := test.meta.Get(NSexif, "GPSAltitudeRef"); prop == nil || prop.Value != test.altRef {
+				t.Errorf("XMP GPSAltitudeRef %v", prop)
+			}
+			field := findField(test.exif.GPS, GPSAltitudeRef)
+			if field == nil || field.AnyInteger(0, order) != int64(test.altRef[0]-'0') {
+				t.Error("Exif GPSAltitudeRef not set")
+			}
+		})
+	}
+}
+
+func TestXMPToExif(t *testing.T) {
+	order := binary.BigEndian
+	tests := []struct {
+		name  string
+		prop  XMPProperty
+		space tiff.TagSpace
+		tag   tiff.Tag
+		value string // Expected ASCII value, or integer as text.
+		fail  bool
+	}{
+		{"description", XMPLangAlt(NSdc, "description", "caption"), tiff.TIFFSpace, tiff.ImageDescription, "caption", false},
+		{"creators", XMPArray(NSdc, "creator", XMPSeq, []string{"A", "B"}), tiff.TIFFSpace, tiff.Artist, "A; B", false},
+		{"rating", XMPText(NSxmp, "Rating", "4"), tiff.TIFFSpace, Rating, "4", false},
+		{"date", XMPText(NSexif, "DateTimeOriginal", "2004-01-10T13:37"), tiff.ExifSpace, DateTimeOriginal, "2004:01:10 13:37:00", false},
+		{"latitude", XMPText(NSexif, "GPSLatitude", "51,30S"), tiff.GPSSpace, GPSLatitudeRef, "S", false},
+		{"invalid rating", XMPText(NSxmp, "Rating", "five"), tiff.TIFFSpace, Rating, "", true},
+		{"invalid date", XMPText(NSexif, "DateTimeOriginal", "yesterday"), tiff.ExifSpace, DateTimeOriginal, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exif := testExif("Acme")
+			err := XMPToExif(testXMPMeta(test.prop), exif)
+			if (err != nil) != test.fail {
+				t.Fatalf("error %v", err)
+			}
+			field := findField(exifSpaceNode(exif, test.space), test.tag)
+			if test.fail {
+				if field != nil {
+					t.Error("field set from invalid property")
+				}
+				return
+			}
+			var value string
+			switch {
+			case field == nil:
+			case field.Type == tiff.ASCII:
+				value = field.ASCII()
+			default:
+				value = strconv.FormatInt(field.AnyInteger(0, order), 10)
+			}
+			if value != test.value {
+				t.Errorf("field value %q, expected %q", value, test.value)
+			}
+		})
+	}
+}
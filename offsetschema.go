@@ -0,0 +1,118 @@
+package exif44
+
+import (
+	"errors"
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// Rewriting of maker notes that aren't decoded, using the Microsoft
+// OffsetSchema field. Such maker notes may contain offsets that become
+// invalid when the maker note is moved. Since the layout of the
+// rewritten Exif data is determined by tiff66, the maker note can't
+// be kept at its original position; instead the distance it has moved
+// is recorded in OffsetSchema, a signed LONG in the Exif IFD, which
+// readers such as ExifTool add to the maker note's offsets.
+
+// Handling of maker notes that aren't decoded when writing.
+type UnknownMakerNotePolicy uint8
+
+const (
+	UnknownMakerNoteReject       UnknownMakerNotePolicy = iota // Return an error, as per CheckMakerNote.
+	UnknownMakerNoteOffsetSchema                               // Write the maker note, recording its move in OffsetSchema.
+)
+
+// Check if an Exif tree contains a maker note that wasn't decoded.
+func unknownMakerNote(exif Exif) bool {
+	return exif.MakerNote == nil && exif.Exif != nil && findField(exif.Exif, MakerNote) != nil
+}
+
+// Return the OffsetSchema field of an Exif tree, or nil if it's not
+// present or isn't a single SLONG.
+func offsetSchemaField(exif Exif) *tiff.Field {
+	field := findField(exif.Exif, OffsetSchema)
+	if field == nil || field.Type != tiff.SLONG || field.Count != 1 {
+		return nil
+	}
+	return field
+}
+
+// Add an OffsetSchema field to the Exif IFD of a tree with a maker note
+// that wasn't decoded, if not already present, replacing one that
+// isn't a single SLONG. Its value is set by updateOffsetSchema once the
+// tree has been serialized.
+func addOffsetSchema(exif Exif) {
+	if !unknownMakerNote(exif) || offsetSchemaField(exif) != nil {
+		return
+	}
+	exif.Exif.DeleteFields([]tiff.Tag{OffsetSchema})
+	exif.Exif.AddFields([]tiff.Field{{Tag: OffsetSchema, Type: tiff.SLONG, Count: 1, Data: make([]byte, 4)}})
+}
+
+// Return the position of a maker note that wasn't decoded in
+// serialized TIFF data, and the position of the data of the
+// OffsetSchema field, which is 0 if not present or not a single SLONG.
+// Returns an error if the field's data lies outside the buffer.
+func offsetSchemaPos(exif Exif, buf []byte) (uint32, uint32, bool, error) {
+	if !unknownMakerNote(exif) {
+		return 0, 0, false, nil
+	}
+	makerPos, found := makerNotePos(exif, buf)
+	if !found {
+		return 0, 0, false, nil
+	}
+	if offsetSchemaField(exif) == nil {
+		return makerPos, 0, true, nil
+	}
+	order := exif.TIFF.Order
+	exifIFD := findField(exif.TIFF, tiff.ExifIFD)
+	schemaPos, found := fieldDataPos(buf, order, uint32(exifIFD.AnyInteger(0, order)), OffsetSchema)
+	if !found {
+		return makerPos, 0, true, nil
+	}
+	if schemaPos == 0 || uint64(schemaPos)+4 > uint64(len(buf)) {
+		return 0, 0, false, errors.New("OffsetSchema field lies outside the Exif data")
+	}
+	return makerPos, schemaPos, true, nil
+}
+
+// Update the OffsetSchema fields in serialized TIFF data 'newData',
+// which was produced by decoding and rewriting 'oldData', for maker
+// notes that weren't decoded. The fields are set so that the offsets
+// in each maker note still resolve to the positions they referred to
+// in the original data. Images are matched by their position in the
+// chain of IFDs.
+func updateOffsetSchema(oldData, newData []byte) error {
+	// Errors were reported when the data was first decoded.
+	oldExif, _ := GetExifTree(oldData)
+	newExif, _ := GetExifTree(newData)
+	oldNode, newNode := oldExif, newExif
+	for oldNode != nil && newNode != nil {
+		oldPos, oldSchemaPos, oldFound, err := offsetSchemaPos(*oldNode, oldData)
+		if err != nil {
+			return err
+		}
+		newPos, newSchemaPos, newFound, err := offsetSchemaPos(*newNode, newData)
+		if err != nil {
+			return err
+		}
+		if oldFound && newFound && newSchemaPos != 0 {
+			// The position that the maker note's offsets
+			// assume.
+			base := int64(oldPos)
+			if oldSchemaPos != 0 {
+				base -= int64(int32(oldNode.Exif.Order.Uint32(oldData[oldSchemaPos:])))
+			}
+			newNode.Exif.Order.PutUint32(newData[newSchemaPos:], uint32(int32(int64(newPos)-base)))
+		}
+		oldNode, newNode = nextExif(oldNode), nextExif(newNode)
+	}
+	return nil
+}
+
+// Return the Exif tree of the next image in a TIFF chain, or nil.
+func nextExif(exif *Exif) *Exif {
+	if exif.TIFF.Next == nil {
+		return nil
+	}
+	return makeExif(exif.TIFF.Next)
+}
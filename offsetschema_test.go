@@ -0,0 +1,103 @@
+package exif44
+
+import (
+	"bytes"
+	"testing"
+
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// Return the position of the maker note and the OffsetSchema value in
+// TIFF data, and whether the field is present.
+func testOffsetSchema(t *testing.T, data []byte) (uint32, int32, bool) {
+	exif, _ := GetExifTree(data)
+	makerPos, found := makerNotePos(*exif, data)
+	if !found {
+		t.Fatal("maker note not found")
+	}
+	field := offsetSchemaField(*exif)
+	if field == nil {
+		return makerPos, 0, false
+	}
+	return makerPos, int32(exif.Exif.Order.Uint32(field.Data)), true
+}
+
+// Exif callback that adds a field, so that the maker note moves.
+var testGrowExif = testExifFunc(func(exif *Exif) {
+	exif.Exif.AddFields([]tiff.Field{testASCII(ImageUniqueID, "0123456789abcdef0123456789abcdef")})
+})
+
+func TestOffsetSchema(t *testing.T) {
+	makerNote := append([]byte("ACME\000\001"), bytes.Repeat([]byte{7}, 40)...)
+	single := testTIFF(t, testMakerNoteExif("Acme", makerNote))
+
+	// An OffsetSchema with two values and a pointer past the end of
+	// the data, which must be ignored.
+	badSchema := testMakerNoteExif("Acme", makerNote)
+	badSchema.Exif.AddFields([]tiff.Field{{Tag: OffsetSchema, Type: tiff.SLONG, Count: 2, Data: make([]byte, 8)}})
+	bad := testTIFF(t, badSchema)
+	parsed, _ := GetExifTree(bad)
+	exifIFD := findField(parsed.TIFF, tiff.ExifIFD).Long(0, parsed.TIFF.Order)
+	entry, found := fieldEntryPos(bad, parsed.TIFF.Order, exifIFD, OffsetSchema)
+	if !found {
+		t.Fatal("OffsetSchema entry not found")
+	}
+	parsed.TIFF.Order.PutUint32(bad[entry+8:], 0xFFFFFF00)
+
+	// A duplicate Exif segment without a maker note, which comes
+	// first in the merged data.
+	other := testTIFF(t, testExif("Acme", testASCII(ImageUniqueID, "fedcba9876543210fedcba9876543210fedcba9876543210")))
+
+	tests := []struct {
+		name      string
+		segments  [][]byte
+		duplicate DuplicateExifPolicy
+		orig      int // Index of the segment with the maker note.
+	}{
+		{"single", [][]byte{single}, DuplicateExifKeepAll, 0},
+		{"malformed schema", [][]byte{bad}, DuplicateExifKeepAll, 0},
+		{"merged", [][]byte{other, single}, DuplicateExifMerge, 1},
+		{"last", [][]byte{other, single}, DuplicateExifKeepLast, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := testJPEGFile(t, test.segments, nil)
+			origPos, _, _ := testOffsetSchema(t, test.segments[test.orig])
+			control := ReadWriteControl{ReadWriteExif: testGrowExif, DuplicateExif: test.duplicate}
+			if _, err := testReadWrite(t, in, control); err == nil {
+				t.Fatal("undecoded maker note accepted with default policy")
+			}
+			control.UnknownMakerNote = UnknownMakerNoteOffsetSchema
+			out := in
+			// The schema must accumulate over repeated rewrites.
+			for i := 0; i < 2; i++ {
+				var err error
+				if out, err = testReadWrite(t, out, control); err != nil {
+					t.Fatal(err)
+				}
+				control.DuplicateExif = DuplicateExifKeepAll
+				newPos, schema, found := testOffsetSchema(t, testJPEGTIFF(t, out))
+				if !found {
+					t.Fatal("OffsetSchema not written")
+				}
+				if int64(newPos)-int64(schema) != int64(origPos) {
+					t.Errorf("rewrite %d: maker note at %d with OffsetSchema %d, originally at %d", i+1, newPos, schema, origPos)
+				}
+			}
+		})
+	}
+}
+
+func TestOffsetSchemaTIFF(t *testing.T) {
+	in := testTIFF(t, testMakerNoteExif("Acme", []byte("ACME\000\001\002\003\004\005")))
+	control := ReadWriteControl{ReadWriteExif: testGrowExif, UnknownMakerNote: UnknownMakerNoteOffsetSchema}
+	out, err := testReadWrite(t, in, control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origPos, _, _ := testOffsetSchema(t, in)
+	newPos, schema, found := testOffsetSchema(t, out)
+	if !found || int64(newPos)-int64(schema) != int64(origPos) {
+		t.Errorf("maker note at %d with OffsetSchema %d, originally at %d", newPos, schema, origPos)
+	}
+}
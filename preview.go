@@ -0,0 +1,362 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+	"io"
+	"io/ioutil"
+)
+
+// Support for locating the JPEG preview images embedded in Exif data:
+// the Exif thumbnail, JPEG images in the IFDs and SubIFDs of
+// TIFF-based raw files such as CR2, NEF and ARW, and the previews
+// in Canon1, Nikon2, Olympus1 and Sony1 maker notes. Some previews are
+// held in the Exif tree, while others are only located by an offset,
+// which may point outside the Exif segment of a JPEG file.
+
+// Source of a preview image.
+type PreviewSource uint8
+
+const (
+	PreviewIFD      PreviewSource = iota + 1 // JPEG image in a TIFF IFD or SubIFD.
+	PreviewCanon1                            // Canon1 PreviewImageInfo.
+	PreviewNikon2                            // Nikon2 PreviewIFD.
+	PreviewOlympus1                          // Olympus1 maker note or CameraSettings IFD.
+	PreviewSony1                             // Sony1 PreviewImage.
+)
+
+// Mapping from preview sources to strings.
+var PreviewSourceNames = map[PreviewSource]string{
+	PreviewIFD:      "TIFF IFD",
+	PreviewCanon1:   "Canon PreviewImageInfo",
+	PreviewNikon2:   "Nikon PreviewIFD",
+	PreviewOlympus1: "Olympus PreviewImage",
+	PreviewSony1:    "Sony PreviewImage",
+}
+
+// Base from which the offset of a preview image is measured.
+type PreviewBase uint8
+
+const (
+	PreviewBaseTIFF          PreviewBase = iota // TIFF header of the Exif data or TIFF file.
+	PreviewBaseMakerNote                        // Start of the maker note.
+	PreviewBaseMakerNoteTIFF                    // TIFF header in the maker note, as in Nikon2 maker notes.
+	PreviewBaseField                            // The preview is the value of a field, and the offset is 0.
+)
+
+// A preview image embedded in Exif data.
+type Preview struct {
+	Source PreviewSource
+	Width  uint32 // Width and height, or 0 if unknown.
+	Height uint32
+	Base   PreviewBase
+	Offset uint32
+	Length uint32
+	Data   []byte // The JPEG data, or nil if it's not held in the Exif tree.
+}
+
+// Size of the Nikon2 maker note label, which precedes its TIFF header.
+const nikon2LabelSize = 10
+
+// Return the frame header marker and dimensions of a JPEG image, with
+// a zero marker if there's no frame header.
+func jpegFrame(data []byte) (jseg.Marker, uint32, uint32) {
+	if !jseg.IsJPEGHeader(data) {
+		return 0, 0, 0
+	}
+	scanner, err := jseg.NewScanner(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, 0
+	}
+	for {
+		marker, buf, err := scanner.Scan()
+		if err != nil || marker == jseg.SOS || marker == jseg.EOI {
+			return 0, 0, 0
+		}
+		if isSOF(marker) && len(buf) >= 5 {
+			return marker, uint32(binary.BigEndian.Uint16(buf[3:])), uint32(binary.BigEndian.Uint16(buf[1:]))
+		}
+	}
+}
+
+// Check if a frame header marker is for lossless JPEG, which is used
+// for raw image data rather than previews.
+func isLossless(marker jseg.Marker) bool {
+	return marker == jseg.SOF3 || marker == jseg.SOF7 || marker == jseg.SOF11 || marker == jseg.SOF15
+}
+
+// Set the dimensions of a preview from its JPEG data, if not already
+// known.
+func (p *Preview) setDimensions() {
+	if p.Width == 0 && p.Data != nil {
+		_, p.Width, p.Height = jpegFrame(p.Data)
+	}
+}
+
+// Append the JPEG images in a TIFF IFD, its SubIFDs and the following
+// IFDs to a list of previews.
+func ifdPreviews(node *tiff.IFDNode, previews []Preview) []Preview {
+	for ; node != nil; node = node.Next {
+		if node.GetSpace() != tiff.TIFFSpace {
+			return previews
+		}
+		compression := findField(node, tiff.Compression)
+		jpegStrips := compression != nil && compression.Count > 0 && compression.Type.IsIntegral() && (compression.AnyInteger(0, node.Order) == 6 || compression.AnyInteger(0, node.Order) == 7)
+		for _, imageData := range node.GetImageData() {
+			if len(imageData.Segments) != 1 || !(imageData.OffsetTag == tiff.JPEGInterchangeFormat || imageData.OffsetTag == tiff.StripOffsets && jpegStrips) {
+				continue
+			}
+			data := []byte(imageData.Segments[0])
+			marker, width, height := jpegFrame(data)
+			if marker == 0 || isLossless(marker) {
+				continue
+			}
+			offset := findField(node, imageData.OffsetTag)
+			previews = append(previews, Preview{Source: PreviewIFD, Width: width, Height: height, Base: PreviewBaseTIFF, Offset: uint32(offset.AnyInteger(0, node.Order)), Length: uint32(len(data)), Data: data})
+		}
+		for _, sub := range node.SubIFDs {
+			if sub.Tag == tiff.SubIFDs {
+				previews = ifdPreviews(sub.Node, previews)
+			}
+		}
+	}
+	return previews
+}
+
+// Return a preview located by a pair of offset and length fields, or
+// false if the fields aren't present or the length is zero.
+func offsetPreview(node *tiff.IFDNode, source PreviewSource, base PreviewBase, offsetTag, lengthTag tiff.Tag) (Preview, bool) {
+	offset, length := findField(node, offsetTag), findField(node, lengthTag)
+	if offset == nil || length == nil || offset.Count == 0 || length.Count == 0 || !offset.Type.IsIntegral() || !length.Type.IsIntegral() {
+		return Preview{}, false
+	}
+	preview := Preview{Source: source, Base: base, Offset: uint32(offset.AnyInteger(0, node.Order)), Length: uint32(length.AnyInteger(0, node.Order))}
+	return preview, preview.Length > 0
+}
+
+// Return a preview held in the value of a field, or false if the
+// field isn't present or doesn't contain a JPEG image.
+func fieldPreview(node *tiff.IFDNode, source PreviewSource, tag tiff.Tag) (Preview, bool) {
+	field := findField(node, tag)
+	if field == nil || !jseg.IsJPEGHeader(field.Data) {
+		return Preview{}, false
+	}
+	return Preview{Source: source, Base: PreviewBaseField, Length: uint32(len(field.Data)), Data: field.Data}, true
+}
+
+// Append the previews in a maker note to a list of previews.
+func makerNotePreviews(exif Exif, previews []Preview) []Preview {
+	maker := exif.MakerNote
+	if maker == nil {
+		return previews
+	}
+	switch maker.GetSpace() {
+	case tiff.Canon1Space:
+		// PreviewImageInfo is an array of LONGs giving the
+		// length, width, height and offset from index 2.
+		info := findField(maker, Canon1PreviewImageInfo)
+		if info != nil && info.Type == tiff.LONG && info.Count >= 6 {
+			preview := Preview{Source: PreviewCanon1, Base: PreviewBaseTIFF, Length: info.Long(2, maker.Order), Width: info.Long(3, maker.Order), Height: info.Long(4, maker.Order), Offset: info.Long(5, maker.Order)}
+			if preview.Length > 0 {
+				previews = append(previews, preview)
+			}
+		}
+	case tiff.Nikon2Space:
+		// Maker notes with a label have their own TIFF header,
+		// and others use the offsets of the Exif data.
+		base := PreviewBaseTIFF
+		if field := findField(exif.Exif, MakerNote); field != nil && bytes.HasPrefix(field.Data, []byte("Nikon\000")) {
+			base = PreviewBaseMakerNoteTIFF
+		}
+		for _, sub := range maker.SubIFDs {
+			if sub.Tag != Nikon2PreviewIFD {
+				continue
+			}
+			for _, imageData := range sub.Node.GetImageData() {
+				if imageData.OffsetTag == Nikon2PreviewImageStart && len(imageData.Segments) == 1 {
+					offset := findField(sub.Node, Nikon2PreviewImageStart)
+					data := []byte(imageData.Segments[0])
+					previews = append(previews, Preview{Source: PreviewNikon2, Base: base, Offset: uint32(offset.AnyInteger(0, sub.Node.Order)), Length: uint32(len(data)), Data: data})
+				}
+			}
+		}
+	case tiff.Olympus1Space:
+		// Offsets in maker notes with the "OLYMPUS" label are
+		// relative to the maker note, and otherwise to the TIFF
+		// header.
+		base := PreviewBaseTIFF
+		if field := findField(exif.Exif, MakerNote); field != nil && bytes.HasPrefix(field.Data, []byte("OLYMPUS\000")) {
+			base = PreviewBaseMakerNote
+		}
+		if preview, ok := fieldPreview(maker, PreviewOlympus1, Olympus1PreviewImageData); ok {
+			previews = append(previews, preview)
+		}
+		if preview, ok := offsetPreview(maker, PreviewOlympus1, base, Olympus1PreviewImageStart, Olympus1PreviewImageLength); ok {
+			previews = append(previews, preview)
+		}
+		if preview, ok := offsetPreview(maker, PreviewOlympus1, base, Olympus1PreviewImageStart2, Olympus1PreviewImageLength2); ok {
+			previews = append(previews, preview)
+		}
+		if settings := findSpaceNode(maker, tiff.Olympus1CameraSettingsSpace); settings != nil {
+			if preview, ok := offsetPreview(settings, PreviewOlympus1, base, Olympus1CSPreviewImageStart, Olympus1CSPreviewImageLength); ok {
+				previews = append(previews, preview)
+			}
+		}
+	case tiff.Sony1Space:
+		if preview, ok := fieldPreview(maker, PreviewSony1, Sony1PreviewImage); ok {
+			previews = append(previews, preview)
+		} else if length, offset, found := outsidePreview(exif); found && length > 0 {
+			// Stored outside the Exif data that was read.
+			previews = append(previews, Preview{Source: PreviewSony1, Base: PreviewBaseTIFF, Offset: offset, Length: length})
+		}
+	}
+	return previews
+}
+
+// Return the previews embedded in an Exif tree, including the Exif
+// thumbnail. Previews that are located by an offset rather than held
+// in the tree have a nil Data field; ReadPreviews can be used to
+// extract them from the file.
+func Previews(exif Exif) []Preview {
+	var previews []Preview
+	if exif.TIFF != nil {
+		previews = ifdPreviews(exif.TIFF, previews)
+	}
+	previews = makerNotePreviews(exif, previews)
+	for i := range previews {
+		previews[i].setDimensions()
+	}
+	return previews
+}
+
+// Return the position of the entry for a field in serialized TIFF
+// data, by searching the IFD at 'pos'.
+func fieldEntryPos(buf []byte, order binary.ByteOrder, pos uint32, tag tiff.Tag) (uint32, bool) {
+	if pos+2 < pos || pos+2 > uint32(len(buf)) {
+		return 0, false
+	}
+	entries := order.Uint16(buf[pos:])
+	if pos+tiff.TableSize(entries) > uint32(len(buf)) {
+		return 0, false
+	}
+	for i := uint32(0); i < uint32(entries); i++ {
+		entryPos := pos + 2 + i*tiff.TableEntrySize
+		if tiff.Tag(order.Uint16(buf[entryPos:])) == tag {
+			return entryPos, true
+		}
+	}
+	return 0, false
+}
+
+// Return the position of the data of a field in serialized TIFF data,
+// by finding its entry in the IFD at 'pos'.
+func fieldDataPos(buf []byte, order binary.ByteOrder, pos uint32, tag tiff.Tag) (uint32, bool) {
+	entryPos, found := fieldEntryPos(buf, order, pos, tag)
+	if !found {
+		return 0, false
+	}
+	entry := buf[entryPos:]
+	if tiff.Type(order.Uint16(entry[2:])).Size()*order.Uint32(entry[4:]) <= 4 {
+		// Data is in the entry itself.
+		return entryPos + 8, true
+	}
+	return order.Uint32(entry[8:]), true
+}
+
+// Return the position of the maker note in serialized TIFF data, by
+// finding its entry in the Exif IFD.
+func makerNotePos(exif Exif, buf []byte) (uint32, bool) {
+	order := exif.TIFF.Order
+	exifIFD := findField(exif.TIFF, tiff.ExifIFD)
+	if exifIFD == nil || exifIFD.Count == 0 || !exifIFD.Type.IsIntegral() {
+		return 0, false
+	}
+	return fieldDataPos(buf, order, uint32(exifIFD.AnyInteger(0, order)), MakerNote)
+}
+
+// Return the position of the TIFF header in a JPEG file, from its
+// first Exif segment.
+func jpegTIFFPos(file []byte) (uint32, error) {
+	reader := bytes.NewReader(file)
+	scanner, err := jseg.NewScanner(reader)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		marker, buf, err := scanner.Scan()
+		if err != nil {
+			return 0, err
+		}
+		if marker == jseg.SOS || marker == jseg.EOI {
+			return 0, errors.New("No Exif segment found")
+		}
+		if marker == jseg.APP0+1 && isExifSegment(buf) {
+			pos, err := reader.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return 0, err
+			}
+			return uint32(pos) - uint32(len(buf)) + HeaderSize, nil
+		}
+	}
+}
+
+// Read a JPEG or TIFF file and return the previews embedded in the
+// Exif data of its first image, as per Previews, with the data of
+// previews located by offsets read from the file. These include
+// Canon previews stored after the Exif segment of a JPEG file.
+// Previews whose offsets lie outside the file are returned with nil
+// Data.
+func ReadPreviews(reader io.ReadSeeker) ([]Preview, error) {
+	format, err := fileType(reader)
+	if err != nil {
+		return nil, err
+	}
+	if format != FileJPEG && format != FileTIFF {
+		return nil, errors.New("Previews can only be read from JPEG and TIFF files")
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	tiffPos := uint32(0)
+	if format == FileJPEG {
+		if tiffPos, err = jpegTIFFPos(file); err != nil {
+			return nil, err
+		}
+	}
+	// The buffer extends to the end of the file, so that offsets
+	// beyond the Exif segment can be resolved.
+	buf := file[tiffPos:]
+	exif, err := GetExifTree(buf)
+	previews := Previews(*exif)
+	makerPos, makerFound := makerNotePos(*exif, buf)
+	for i := range previews {
+		preview := &previews[i]
+		if preview.Data != nil {
+			continue
+		}
+		start := preview.Offset
+		if preview.Base == PreviewBaseMakerNote || preview.Base == PreviewBaseMakerNoteTIFF {
+			if !makerFound {
+				continue
+			}
+			start += makerPos
+			if preview.Base == PreviewBaseMakerNoteTIFF {
+				start += nikon2LabelSize
+			}
+		}
+		end := start + preview.Length
+		if end < start || end > uint32(len(buf)) {
+			continue
+		}
+		preview.Data = buf[start:end]
+		preview.setDimensions()
+	}
+	return previews, err
+}
@@ -0,0 +1,75 @@
+package exif44
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPreviews(t *testing.T) {
+	preview := testJPEG(t, 32, 24)
+	thumbnail := testJPEG(t, 16, 8)
+	withThumbnail := testExif("Acme")
+	if err := withThumbnail.SetThumbnail(thumbnail); err != nil {
+		t.Fatal(err)
+	}
+	canon := func(pos func(file []byte) uint32) func() []byte {
+		return func() []byte {
+			file := testJPEGFile(t, [][]byte{testCanonTIFF(t)}, preview)
+			testSetPreview(t, file, pos(file), uint32(len(preview)))
+			return file
+		}
+	}
+	tests := []struct {
+		name   string
+		file   func() []byte
+		source PreviewSource
+		data   []byte // Expected data from ReadPreviews, or nil.
+		held   bool   // Data is held in the Exif tree.
+		width  uint32
+		height uint32
+	}{
+		{"thumbnail", func() []byte { return testJPEGFile(t, [][]byte{testTIFF(t, withThumbnail)}, nil) }, PreviewIFD, thumbnail, true, 16, 8},
+		{"TIFF thumbnail", func() []byte { return testTIFF(t, withThumbnail) }, PreviewIFD, thumbnail, true, 16, 8},
+		{"Canon trailer", canon(func(file []byte) uint32 { return uint32(len(file) - len(preview)) }), PreviewCanon1, preview, false, 32, 24},
+		{"Canon past end", canon(func(file []byte) uint32 { return uint32(len(file)) }), PreviewCanon1, nil, false, 0, 0},
+		{"Sony field", func() []byte { return testJPEGFile(t, [][]byte{testSonyTIFF(t)}, nil) }, PreviewSony1, []byte{0xFF, 0xD8, 0xFF, 0xD9, 0, 0, 0, 0}, true, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := test.file()
+			var exif *Exif
+			if bytes.HasPrefix(file, []byte{0xFF, 0xD8}) {
+				exif, _ = GetExifTree(testJPEGTIFF(t, file))
+			} else {
+				exif, _ = GetExifTree(file)
+			}
+			previews := Previews(*exif)
+			if len(previews) != 1 || previews[0].Source != test.source {
+				t.Fatalf("previews %+v", previews)
+			}
+			if (previews[0].Data != nil) != test.held {
+				t.Errorf("data held in the Exif tree: %v", previews[0].Data != nil)
+			}
+			previews, err := ReadPreviews(bytes.NewReader(file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(previews) != 1 {
+				t.Fatalf("%d previews", len(previews))
+			}
+			p := previews[0]
+			if !bytes.Equal(p.Data, test.data) || p.Length != uint32(len(preview)) && p.Length != uint32(len(test.data)) {
+				t.Errorf("preview of length %d, data of length %d", p.Length, len(p.Data))
+			}
+			if p.Width != test.width || p.Height != test.height {
+				t.Errorf("preview is %dx%d", p.Width, p.Height)
+			}
+		})
+	}
+	if _, err := ReadPreviews(bytes.NewReader(testPSD(t, 1, nil))); err == nil {
+		t.Error("previews read from PSD file")
+	}
+	if _, err := ReadPreviews(bytes.NewReader(testJPEG(t, 8, 8))); err == nil {
+		t.Error("previews read from JPEG file without Exif")
+	}
+}
@@ -0,0 +1,160 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// Support for Photoshop PSD and PSB (large document) files. Exif is
+// stored in TIFF format, without an Exif header, in an image
+// resource. The sections of the file are length-prefixed rather than
+// located with offsets, so only the length of the image resources
+// section needs to be updated when the Exif data changes.
+
+// Magic number at the start of a PSD or PSB file.
+var psdMagic = []byte("8BPS")
+
+// Size of the PSD file header.
+const PSDHeaderSize = 26
+
+// Check if a slice starts with a PSD or PSB header.
+func IsPSDHeader(buf []byte) bool {
+	return bytes.HasPrefix(buf, psdMagic)
+}
+
+// Layout of a PSD file, giving the position and size of the image
+// resources section.
+type psdLayout struct {
+	resourcesPos uint32 // Position of the image resources data, after its length field.
+	resourcesLen uint32
+}
+
+// Find the image resources section in a PSD or PSB file.
+func getPSDLayout(buf []byte) (*psdLayout, error) {
+	order := binary.BigEndian
+	bufsize := uint32(len(buf))
+	if !IsPSDHeader(buf) || bufsize < PSDHeaderSize {
+		return nil, errors.New("Invalid PSD header")
+	}
+	version := order.Uint16(buf[4:])
+	if version != 1 && version != 2 {
+		return nil, errors.New("Unknown PSD version")
+	}
+	// Color mode data section.
+	pos := uint32(PSDHeaderSize)
+	if pos+4 > bufsize {
+		return nil, errors.New("PSD color mode section is truncated")
+	}
+	colorLen := order.Uint32(buf[pos:])
+	pos += 4 + colorLen
+	if pos < colorLen || pos+4 > bufsize {
+		return nil, errors.New("PSD color mode section extends past end of file")
+	}
+	resourcesLen := order.Uint32(buf[pos:])
+	pos += 4
+	if pos+resourcesLen < pos || pos+resourcesLen > bufsize {
+		return nil, errors.New("PSD image resources section extends past end of file")
+	}
+	return &psdLayout{resourcesPos: pos, resourcesLen: resourcesLen}, nil
+}
+
+// Return the description of the image in a PSD or PSB file, from its
+// validated header.
+func psdImageInfo(buf []byte) ImageInfo {
+	order := binary.BigEndian
+	return ImageInfo{Format: FilePSD, Height: order.Uint32(buf[14:]), Width: order.Uint32(buf[18:])}
+}
+
+// Read a PSD file, passing any Exif and IPTC resources to the
+// callbacks.
+func readPSD(reader io.Reader, control ReadControl) error {
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	layout, err := getPSDLayout(buf)
+	if err != nil {
+		return err
+	}
+	if control.ReadImageInfo != nil {
+		if err := control.ReadImageInfo.ReadImageInfo(psdImageInfo(buf)); err != nil {
+			return err
+		}
+	}
+	resBuf := buf[layout.resourcesPos : layout.resourcesPos+layout.resourcesLen]
+	resources, err := GetImageResources(resBuf)
+	// Errors from decoding the image resources are passed to the
+	// callbacks, if there's anything to pass them with.
+	reported := false
+	if control.ReadExif != nil {
+		if i := FindImageResource(resources, ImageResourceExif); i >= 0 {
+			if exifErr := readTIFFBuf(FilePSD, 0, resources[i].Data, err, control); exifErr != nil {
+				return exifErr
+			}
+			reported = true
+		}
+	}
+	if control.ReadIPTC != nil && FindImageResource(resources, ImageResourceIPTC) >= 0 {
+		iptc, _, iptcErr := getIPTC(resBuf)
+		if iptcErr = control.ReadIPTC.ReadIPTC(FilePSD, 0, iptc, iptcErr); iptcErr != nil {
+			return iptcErr
+		}
+		reported = true
+	}
+	if reported {
+		return nil
+	}
+	// The resources may have been lost due to errors.
+	return err
+}
+
+// Read and write a PSD file, processing the Exif resource and
+// rewriting the image resources section.
+func readWritePSD(reader io.Reader, writer io.Writer, control ReadWriteControl) error {
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	layout, err := getPSDLayout(buf)
+	if err != nil {
+		return err
+	}
+	if control.ReadImageInfo != nil {
+		if err := control.ReadImageInfo.ReadImageInfo(psdImageInfo(buf)); err != nil {
+			return err
+		}
+	}
+	resEnd := layout.resourcesPos + layout.resourcesLen
+	resources, err := GetImageResources(buf[layout.resourcesPos:resEnd])
+	if err != nil {
+		// Resources that couldn't be decoded would be lost.
+		return err
+	}
+	var newTIFF []byte
+	if i := FindImageResource(resources, ImageResourceExif); i >= 0 {
+		copyBuf := make([]byte, len(resources[i].Data))
+		copy(copyBuf, resources[i].Data)
+		newTIFF, err = readWriteTIFFBuf(FilePSD, 0, copyBuf, copyBuf, nil, false, control)
+	} else if control.ExifRequired != nil && control.ExifRequired.ExifRequired(FilePSD, 0) {
+		newTIFF, err = createTIFF(FilePSD, 0, control)
+	}
+	if err != nil {
+		return err
+	}
+	resources = SetImageResource(resources, ImageResourceExif, newTIFF)
+	resBuf, err := MakeImageResources(resources)
+	if err != nil {
+		return err
+	}
+	lenBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(lenBuf, uint32(len(resBuf)))
+	for _, out := range [][]byte{buf[:layout.resourcesPos-4], lenBuf, resBuf, buf[resEnd:]} {
+		if _, err := writer.Write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// Return a PSD file of version 1 or 2 with the given image resources.
+func testPSD(t *testing.T, version uint16, resources []ImageResource) []byte {
+	order := binary.BigEndian
+	buf := make([]byte, PSDHeaderSize)
+	copy(buf, psdMagic)
+	order.PutUint16(buf[4:], version)
+	order.PutUint16(buf[12:], 3)   // Channels.
+	order.PutUint32(buf[14:], 480) // Height.
+	order.PutUint32(buf[18:], 640) // Width.
+	order.PutUint16(buf[22:], 8)   // Depth.
+	order.PutUint16(buf[24:], 3)   // RGB color mode.
+	// Empty color mode data.
+	buf = append(buf, 0, 0, 0, 0)
+	resBuf, err := MakeImageResources(resources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	length := make([]byte, 4)
+	order.PutUint32(length, uint32(len(resBuf)))
+	buf = append(append(buf, length...), resBuf...)
+	// Layer and mask information, and image data.
+	return append(buf, "layers and image data"...)
+}
+
+func TestGetImageResources(t *testing.T) {
+	resources := []ImageResource{
+		{Signature: []byte("8BIM"), ID: 0x03ED, Data: make([]byte, 16)},
+		{Signature: []byte("8BIM"), ID: ImageResourceExif, Name: "odd", Data: []byte("odd")},
+		{Signature: []byte("MeSa"), ID: 0x0001, Name: "ab", Data: nil},
+	}
+	valid, err := MakeImageResources(resources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badData := append([]byte{}, valid...)
+	binary.BigEndian.PutUint32(badData[resources[0].Size()-20:], 0xFFFFFFF0)
+	tests := []struct {
+		name      string
+		buf       []byte
+		resources int
+		fail      bool
+	}{
+		{"valid", valid, 3, false},
+		{"empty", nil, 0, false},
+		{"bad signature", append(append([]byte{}, valid...), "XXXX\000\001\000\000\000\000\000\000"...), 3, true},
+		{"truncated header", valid[:len(valid)-3], 2, true},
+		{"truncated name", valid[:resources[0].Size()+8], 1, true},
+		{"data past end", badData, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := GetImageResources(test.buf)
+			if (err != nil) != test.fail {
+				t.Errorf("error %v", err)
+			}
+			if len(got) != test.resources {
+				t.Fatalf("%d resources, expected %d", len(got), test.resources)
+			}
+			for i, res := range got {
+				if !bytes.Equal(res.Signature, resources[i].Signature) || res.ID != resources[i].ID || res.Name != resources[i].Name || !bytes.Equal(res.Data, resources[i].Data) {
+					t.Errorf("resource %d is %+v", i, res)
+				}
+			}
+		})
+	}
+	if _, err := MakeImageResources([]ImageResource{{Signature: []byte("8BI")}}); err == nil {
+		t.Error("invalid signature accepted")
+	}
+}
+
+func TestSetImageResource(t *testing.T) {
+	resources := []ImageResource{
+		{Signature: []byte("8BIM"), ID: 0x03ED, Data: []byte{1}},
+		{Signature: []byte("8BIM"), ID: ImageResourceExif, Data: []byte{2}},
+	}
+	resources = SetImageResource(resources, ImageResourceExif, []byte{3})
+	if len(resources) != 2 || resources[1].Data[0] != 3 {
+		t.Errorf("resources %v after replacing", resources)
+	}
+	resources = SetImageResource(resources, ImageResourceIPTC, []byte{4})
+	if len(resources) != 3 || FindImageResource(resources, ImageResourceIPTC) != 2 {
+		t.Errorf("resources %v after adding", resources)
+	}
+	resources = SetImageResource(resources, ImageResourceExif, nil)
+	if len(resources) != 2 || FindImageResource(resources, ImageResourceExif) >= 0 {
+		t.Errorf("resources %v after deleting", resources)
+	}
+}
+
+// ImageInfo callback that records each description.
+type testImageInfoRecorder []ImageInfo
+
+func (r *testImageInfoRecorder) ReadImageInfo(info ImageInfo) error {
+	*r = append(*r, info)
+	return nil
+}
+
+func TestReadPSD(t *testing.T) {
+	other := ImageResource{Signature: []byte("8BIM"), ID: 0x03ED, Data: make([]byte, 16)}
+	exifRes := ImageResource{Signature: []byte("8BIM"), ID: ImageResourceExif, Data: testTIFF(t, testExif("Acme"))}
+	valid := testPSD(t, 1, []ImageResource{other, exifRes})
+	// A file whose image resources extend past its end.
+	truncated := valid[:PSDHeaderSize+4+4+10]
+	badVersion := append([]byte{}, valid...)
+	badVersion[5] = 3
+	tests := []struct {
+		name string
+		file []byte
+		exif bool
+		fail bool
+	}{
+		{"PSD", valid, true, false},
+		{"PSB", testPSD(t, 2, []ImageResource{exifRes}), true, false},
+		{"no Exif", testPSD(t, 1, []ImageResource{other}), false, false},
+		{"truncated", truncated, false, true},
+		{"bad version", badVersion, false, true},
+		{"bad color mode length", append(append(append([]byte{}, valid[:PSDHeaderSize]...), 0xFF, 0xFF, 0xFF, 0xF0), valid[PSDHeaderSize+4:]...), false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var infos testImageInfoRecorder
+			var exifs []Exif
+			control := ReadControl{ReadImageInfo: &infos, ReadExif: testReadExifFunc(func(exif Exif, err error) { exifs = append(exifs, exif) })}
+			err := Read(bytes.NewReader(test.file), control)
+			if (err != nil) != test.fail {
+				t.Fatalf("error %v", err)
+			}
+			if test.fail {
+				return
+			}
+			if len(infos) != 1 || infos[0].Format != FilePSD || infos[0].Width != 640 || infos[0].Height != 480 {
+				t.Errorf("image info %+v", infos)
+			}
+			if (len(exifs) == 1) != test.exif {
+				t.Errorf("%d Exif trees", len(exifs))
+			}
+		})
+	}
+}
+
+// Callbacks are made for PSD files whichever of them are set, and
+// errors from decoding the image resources are passed to the Exif
+// callback.
+func TestReadPSDCallbacks(t *testing.T) {
+	exifRes := ImageResource{Signature: []byte("8BIM"), ID: ImageResourceExif, Data: testTIFF(t, testExif("Acme"))}
+	iptcRes := ImageResource{Signature: []byte("8BIM"), ID: ImageResourceIPTC, Data: MakeIPTCDatasets([]IPTCDataset{{IPTCObjectName, []byte("name")}})}
+	valid := testPSD(t, 1, []ImageResource{exifRes, iptcRes})
+	// The resources section extends into the layer data, which
+	// isn't a valid image resource.
+	corrupt := append([]byte{}, valid...)
+	lengthPos := PSDHeaderSize + 4
+	binary.BigEndian.PutUint32(corrupt[lengthPos:], binary.BigEndian.Uint32(corrupt[lengthPos:])+8)
+	tests := []struct {
+		name             string
+		file             []byte
+		info, exif, iptc bool // Callbacks set.
+		exifErr          bool // Error expected in the Exif callback.
+	}{
+		{"all", valid, true, true, true, false},
+		{"image info only", valid, true, false, false, false},
+		{"IPTC only", valid, false, false, true, false},
+		{"resource error", corrupt, true, true, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var control ReadControl
+			var infos testImageInfoRecorder
+			var exifs, names []string
+			if test.info {
+				control.ReadImageInfo = &infos
+			}
+			if test.exif {
+				control.ReadExif = testReadExifFunc(func(exif Exif, err error) {
+					if (err != nil) != test.exifErr {
+						t.Errorf("Exif callback error %v", err)
+					}
+					exifs = append(exifs, findField(exif.TIFF, tiff.Make).ASCII())
+				})
+			}
+			if test.iptc {
+				control.ReadIPTC = testIPTCFunc(func(iptc *IPTC) { names = append(names, iptc.Value(IPTCObjectName)) })
+			}
+			if err := Read(bytes.NewReader(test.file), control); err != nil {
+				t.Fatal(err)
+			}
+			if test.info && (len(infos) != 1 || infos[0].Format != FilePSD) {
+				t.Errorf("image info %+v", infos)
+			}
+			if test.exif && (len(exifs) != 1 || exifs[0] != "Acme") {
+				t.Errorf("Exif makes %q", exifs)
+			}
+			if test.iptc && (len(names) != 1 || names[0] != "name") {
+				t.Errorf("IPTC object names %q", names)
+			}
+		})
+	}
+}
+
+func TestReadWritePSD(t *testing.T) {
+	other := ImageResource{Signature: []byte("8BIM"), ID: 0x03ED, Name: "name", Data: make([]byte, 15)}
+	exifRes := ImageResource{Signature: []byte("8BIM"), ID: ImageResourceExif, Data: testTIFF(t, testExif("Acme"))}
+	tests := []struct {
+		name      string
+		resources []ImageResource
+		required  bool // Exif data is created if missing.
+		exif      bool // Exif resource expected in the output.
+	}{
+		{"modified", []ImageResource{other, exifRes}, false, true},
+		{"no Exif", []ImageResource{other}, false, false},
+		{"created", []ImageResource{other}, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := testPSD(t, 1, test.resources)
+			control := ReadWriteControl{ReadWriteExif: testGrowExif}
+			if test.required {
+				control.ExifRequired = testExifRequired{}
+			}
+			out, err := testReadWrite(t, in, control)
+			if err != nil {
+				t.Fatal(err)
+			}
+			layout, err := getPSDLayout(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(out, []byte("layers and image data")) || !bytes.Equal(out[:layout.resourcesPos-4], in[:layout.resourcesPos-4]) {
+				t.Error("data outside the image resources changed")
+			}
+			resources, err := GetImageResources(out[layout.resourcesPos : layout.resourcesPos+layout.resourcesLen])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i := FindImageResource(resources, 0x03ED); i < 0 || resources[i].Name != "name" || !bytes.Equal(resources[i].Data, other.Data) {
+				t.Error("other resource changed")
+			}
+			i := FindImageResource(resources, ImageResourceExif)
+			if (i >= 0) != test.exif {
+				t.Fatalf("Exif resource found: %v", i >= 0)
+			}
+			if i < 0 {
+				return
+			}
+			exif, err := GetExifTree(resources[i].Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if findField(exif.Exif, ImageUniqueID) == nil {
+				t.Error("Exif data not updated")
+			}
+		})
+	}
+	// Undecodable image resources would be lost on writing.
+	in := testPSD(t, 1, []ImageResource{other})
+	layout, _ := getPSDLayout(in)
+	copy(in[layout.resourcesPos:], "XXXX")
+	if _, err := testReadWrite(t, in, ReadWriteControl{}); err == nil {
+		t.Error("invalid image resources accepted")
+	}
+}
@@ -0,0 +1,280 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"io"
+	"io/ioutil"
+)
+
+// Support for Fujifilm RAF raw files. A RAF file starts with a
+// header giving the positions of an embedded JPEG preview, which
+// contains the Exif data, a directory of RAF records, and the CFA
+// (raw sensor) data. All values in the header and directory are big
+// endian. Record names are from ExifTool 10.63, FujiFilm RAF tags.
+
+// Magic number at the start of a RAF file.
+var rafMagic = []byte("FUJIFILMCCD-RAW ")
+
+// Size of the fixed part of the RAF header, up to the end of the
+// CFA length.
+const RAFHeaderSize = 0x6C
+
+// Positions of the offset and length fields in the RAF header.
+const (
+	rafJPEGOffsetPos      = 0x54
+	rafJPEGLengthPos      = 0x58
+	rafCFAHeaderOffsetPos = 0x5C
+	rafCFAHeaderLengthPos = 0x60
+	rafCFAOffsetPos       = 0x64
+	rafCFALengthPos       = 0x68
+)
+
+// Check if a slice starts with a RAF header.
+func IsRAFHeader(buf []byte) bool {
+	return bytes.HasPrefix(buf, rafMagic)
+}
+
+// Decoded RAF header.
+type RAFHeader struct {
+	FormatVersion   string // E.g., "0201".
+	CameraID        []byte
+	Camera          string // Camera model name.
+	DirVersion      string // RAF directory version, e.g., "0100".
+	JPEGOffset      uint32 // Position of the embedded JPEG in the file.
+	JPEGLength      uint32
+	CFAHeaderOffset uint32 // Position of the RAF directory in the file.
+	CFAHeaderLength uint32
+	CFAOffset       uint32 // Position of the raw sensor data in the file.
+	CFALength       uint32
+}
+
+// Return a string from a NUL-padded byte slice.
+func paddedString(buf []byte) string {
+	if end := bytes.IndexByte(buf, 0); end >= 0 {
+		buf = buf[:end]
+	}
+	return string(buf)
+}
+
+// Decode a RAF header from the start of a slice.
+func GetRAFHeader(buf []byte) (*RAFHeader, error) {
+	if !IsRAFHeader(buf) {
+		return nil, errors.New("Invalid RAF header")
+	}
+	if len(buf) < RAFHeaderSize {
+		return nil, errors.New("RAF header is truncated")
+	}
+	order := binary.BigEndian
+	var header RAFHeader
+	header.FormatVersion = string(buf[0x10:0x14])
+	header.CameraID = append([]byte{}, buf[0x14:0x1C]...)
+	header.Camera = paddedString(buf[0x1C:0x3C])
+	header.DirVersion = string(buf[0x3C:0x40])
+	header.JPEGOffset = order.Uint32(buf[rafJPEGOffsetPos:])
+	header.JPEGLength = order.Uint32(buf[rafJPEGLengthPos:])
+	header.CFAHeaderOffset = order.Uint32(buf[rafCFAHeaderOffsetPos:])
+	header.CFAHeaderLength = order.Uint32(buf[rafCFAHeaderLengthPos:])
+	header.CFAOffset = order.Uint32(buf[rafCFAOffsetPos:])
+	header.CFALength = order.Uint32(buf[rafCFALengthPos:])
+	return &header, nil
+}
+
+// Write the offsets and lengths from a RAF header into the start of
+// a slice that already contains the rest of the header.
+func (header RAFHeader) putOffsets(buf []byte) {
+	order := binary.BigEndian
+	order.PutUint32(buf[rafJPEGOffsetPos:], header.JPEGOffset)
+	order.PutUint32(buf[rafJPEGLengthPos:], header.JPEGLength)
+	order.PutUint32(buf[rafCFAHeaderOffsetPos:], header.CFAHeaderOffset)
+	order.PutUint32(buf[rafCFAHeaderLengthPos:], header.CFAHeaderLength)
+	order.PutUint32(buf[rafCFAOffsetPos:], header.CFAOffset)
+	order.PutUint32(buf[rafCFALengthPos:], header.CFALength)
+}
+
+// RAFTag is the type of a record in a RAF directory.
+type RAFTag uint16
+
+// Some of the record types that may be found in a RAF directory.
+const (
+	RAFRawImageFullSize    = 0x100
+	RAFRawImageCropTopLeft = 0x110
+	RAFRawImageCroppedSize = 0x111
+	RAFRawImageAspectRatio = 0x115
+	RAFRawImageSize        = 0x121
+	RAFFujiLayout          = 0x130
+	RAFXTransLayout        = 0x131
+	RAFWBGRGBLevelsAuto    = 0x2000
+	RAFWBGRGBLevels        = 0x2FF0
+	RAFRelativeExposure    = 0x9200
+	RAFRawExposureBias     = 0x9650
+	RAFRAFData             = 0xC000
+)
+
+// Mapping from RAF record types to strings.
+var RAFTagNames = map[RAFTag]string{
+	RAFRawImageFullSize:    "RawImageFullSize",
+	RAFRawImageCropTopLeft: "RawImageCropTopLeft",
+	RAFRawImageCroppedSize: "RawImageCroppedSize",
+	RAFRawImageAspectRatio: "RawImageAspectRatio",
+	RAFRawImageSize:        "RawImageSize",
+	RAFFujiLayout:          "FujiLayout",
+	RAFXTransLayout:        "XTransLayout",
+	RAFWBGRGBLevelsAuto:    "WB_GRGBLevelsAuto",
+	RAFWBGRGBLevels:        "WB_GRGBLevels",
+	RAFRelativeExposure:    "RelativeExposure",
+	RAFRawExposureBias:     "RawExposureBias",
+	RAFRAFData:             "RAFData",
+}
+
+// A record in a RAF directory.
+type RAFRecord struct {
+	Tag  RAFTag
+	Data []byte // Record data, which points into the original buffer.
+}
+
+// Decode the records in a RAF directory. Data will be read if
+// possible even if errors occur, and a multierror structure may be
+// returned.
+func GetRAFDirectory(buf []byte) ([]RAFRecord, error) {
+	order := binary.BigEndian
+	bufsize := uint32(len(buf))
+	if bufsize < 4 {
+		return nil, errors.New("RAF directory is too small")
+	}
+	count := order.Uint32(buf)
+	pos := uint32(4)
+	var err error
+	records := make([]RAFRecord, 0, 20)
+	for i := uint32(0); i < count; i++ {
+		if pos+4 < pos || pos+4 > bufsize {
+			err = multierror.Append(err, fmt.Errorf("RAF directory entry %d is past end of input", i))
+			break
+		}
+		tag := RAFTag(order.Uint16(buf[pos:]))
+		size := uint32(order.Uint16(buf[pos+2:]))
+		pos += 4
+		if pos+size > bufsize {
+			err = multierror.Append(err, fmt.Errorf("Data for RAF record 0x%04X extends past end of input", tag))
+			break
+		}
+		records = append(records, RAFRecord{Tag: tag, Data: buf[pos : pos+size]})
+		pos += size
+	}
+	return records, err
+}
+
+// Return the raw image dimensions from the RawImageFullSize record in a
+// RAF directory, which stores the height before the width.
+func RAFRawDimensions(records []RAFRecord) (width, height uint32, found bool) {
+	for _, rec := range records {
+		if rec.Tag == RAFRawImageFullSize && len(rec.Data) >= 4 {
+			height = uint32(binary.BigEndian.Uint16(rec.Data))
+			width = uint32(binary.BigEndian.Uint16(rec.Data[2:]))
+			return width, height, true
+		}
+	}
+	return 0, 0, false
+}
+
+type ReadRAF interface {
+	// Callback for processing the header and directory of a
+	// Fujifilm RAF file, read-only. It's called before any
+	// callbacks for the embedded JPEG. Any errors from decoding
+	// the directory will be available in err, which may be a
+	// multierror structure. Returning a non-nil error will
+	// terminate processing.
+	ReadRAF(header RAFHeader, records []RAFRecord, err error) error
+}
+
+// Return the slice of a RAF file containing the embedded JPEG.
+func rafJPEG(buf []byte, header *RAFHeader) ([]byte, error) {
+	end := header.JPEGOffset + header.JPEGLength
+	if end < header.JPEGOffset || end > uint32(len(buf)) {
+		return nil, errors.New("Embedded JPEG extends past end of RAF file")
+	}
+	return buf[header.JPEGOffset:end], nil
+}
+
+// Read a RAF file, invoking the RAF callback and then processing the
+// embedded JPEG.
+func readRAF(reader io.Reader, control ReadControl) error {
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	header, err := GetRAFHeader(buf)
+	if err != nil {
+		return err
+	}
+	if control.ReadRAF != nil {
+		end := header.CFAHeaderOffset + header.CFAHeaderLength
+		var records []RAFRecord
+		if end < header.CFAHeaderOffset || end > uint32(len(buf)) {
+			err = errors.New("RAF directory extends past end of file")
+		} else {
+			records, err = GetRAFDirectory(buf[header.CFAHeaderOffset:end])
+		}
+		if err = control.ReadRAF.ReadRAF(*header, records, err); err != nil {
+			return err
+		}
+	}
+	jpeg, err := rafJPEG(buf, header)
+	if err != nil {
+		return err
+	}
+	return readJPEG(FileRAF, bytes.NewReader(jpeg), control)
+}
+
+// Read and write a RAF file, processing the embedded JPEG. Since the
+// size of the JPEG may change, the positions of any data following
+// it are updated in the header.
+func readWriteRAF(reader io.Reader, writer io.Writer, control ReadWriteControl) error {
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	header, err := GetRAFHeader(buf)
+	if err != nil {
+		return err
+	}
+	if header.JPEGOffset < RAFHeaderSize {
+		return errors.New("Embedded JPEG overlaps RAF header")
+	}
+	jpeg, err := rafJPEG(buf, header)
+	if err != nil {
+		return err
+	}
+	var newJPEG WriteBuffer
+	if err := readWriteJPEG(FileRAF, bytes.NewReader(jpeg), &newJPEG, control); err != nil {
+		return err
+	}
+	jpegOut := newJPEG.Bytes()
+	// Pad the JPEG so that the alignment of following data is
+	// unchanged.
+	oldEnd := header.JPEGOffset + header.JPEGLength
+	padding := (4 - (len(jpegOut)-len(jpeg))%4) % 4
+	delta := int64(len(jpegOut)+padding) - int64(len(jpeg))
+	shift := func(offset uint32) uint32 {
+		if offset >= oldEnd {
+			return uint32(int64(offset) + delta)
+		}
+		return offset
+	}
+	newHeader := *header
+	newHeader.JPEGLength = uint32(len(jpegOut))
+	newHeader.CFAHeaderOffset = shift(header.CFAHeaderOffset)
+	newHeader.CFAOffset = shift(header.CFAOffset)
+	headerBuf := make([]byte, header.JPEGOffset)
+	copy(headerBuf, buf)
+	newHeader.putOffsets(headerBuf)
+	for _, out := range [][]byte{headerBuf, jpegOut, make([]byte, padding), buf[oldEnd:]} {
+		if _, err := writer.Write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// Return a RAF directory with the given records.
+func testRAFDirectory(records []RAFRecord) []byte {
+	order := binary.BigEndian
+	buf := make([]byte, 4)
+	order.PutUint32(buf, uint32(len(records)))
+	for _, rec := range records {
+		entry := make([]byte, 4)
+		order.PutUint16(entry, uint16(rec.Tag))
+		order.PutUint16(entry[2:], uint16(len(rec.Data)))
+		buf = append(append(buf, entry...), rec.Data...)
+	}
+	return buf
+}
+
+// Return a RAF file with an embedded JPEG, a directory and raw data.
+func testRAF(jpeg, dir []byte) []byte {
+	header := RAFHeader{JPEGOffset: 0x94, JPEGLength: uint32(len(jpeg))}
+	header.CFAHeaderOffset = header.JPEGOffset + header.JPEGLength
+	header.CFAHeaderLength = uint32(len(dir))
+	header.CFAOffset = header.CFAHeaderOffset + header.CFAHeaderLength
+	header.CFALength = 8
+	buf := make([]byte, header.JPEGOffset)
+	copy(buf, rafMagic)
+	copy(buf[0x10:], "0201FF129502X-T1")
+	copy(buf[0x3C:], "0100")
+	header.putOffsets(buf)
+	buf = append(append(buf, jpeg...), dir...)
+	return append(buf, "CFA data"...)
+}
+
+// Records for a RAF directory, with a full size of 6000x4000.
+var testRAFRecords = []RAFRecord{
+	{Tag: RAFRawImageFullSize, Data: []byte{0x0F, 0xA0, 0x17, 0x70}},
+	{Tag: RAFRawImageAspectRatio, Data: []byte{0, 2, 0, 3}},
+}
+
+func TestGetRAFDirectory(t *testing.T) {
+	valid := testRAFDirectory(testRAFRecords)
+	tests := []struct {
+		name    string
+		buf     []byte
+		records int
+		fail    bool
+	}{
+		{"valid", valid, 2, false},
+		{"too small", valid[:3], 0, true},
+		{"entry truncated", valid[:len(valid)-6], 1, true},
+		{"data truncated", valid[:len(valid)-1], 1, true},
+		{"huge count", append([]byte{0xFF, 0xFF, 0xFF, 0xFF}, valid[4:]...), 2, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records, err := GetRAFDirectory(test.buf)
+			if (err != nil) != test.fail {
+				t.Errorf("error %v", err)
+			}
+			if len(records) != test.records {
+				t.Errorf("%d records, expected %d", len(records), test.records)
+			}
+		})
+	}
+	if width, height, found := RAFRawDimensions(testRAFRecords); !found || width != 6000 || height != 4000 {
+		t.Errorf("dimensions %dx%d", width, height)
+	}
+}
+
+// RAF callback that records the header and directory.
+type testRAFRecorder struct {
+	header  RAFHeader
+	records []RAFRecord
+	err     error
+}
+
+func (r *testRAFRecorder) ReadRAF(header RAFHeader, records []RAFRecord, err error) error {
+	r.header, r.records, r.err = header, records, err
+	return nil
+}
+
+func TestReadRAF(t *testing.T) {
+	jpeg := testJPEGFile(t, [][]byte{testTIFF(t, testExif("FUJIFILM"))}, nil)
+	dir := testRAFDirectory(testRAFRecords)
+	valid := testRAF(jpeg, dir)
+	// A file whose directory extends past its end.
+	badDir := append([]byte{}, valid...)
+	binary.BigEndian.PutUint32(badDir[rafCFAHeaderLengthPos:], 0xFFFFFF00)
+	// A file whose embedded JPEG extends past its end.
+	badJPEG := append([]byte{}, valid...)
+	binary.BigEndian.PutUint32(badJPEG[rafJPEGLengthPos:], 0xFFFFFF00)
+	tests := []struct {
+		name    string
+		file    []byte
+		records int
+		dirErr  bool // Directory error passed to the callback.
+		fail    bool
+	}{
+		{"valid", valid, 2, false, false},
+		{"directory past end", badDir, 0, true, false},
+		{"JPEG past end", badJPEG, 2, false, true},
+		{"truncated header", valid[:RAFHeaderSize-1], 0, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var r testRAFRecorder
+			exifCalls := 0
+			control := ReadControl{ReadRAF: &r, ReadExif: testReadExifFunc(func(Exif, error) { exifCalls++ })}
+			err := Read(bytes.NewReader(test.file), control)
+			if (err != nil) != test.fail {
+				t.Fatalf("error %v", err)
+			}
+			if len(r.records) != test.records || (r.err != nil) != test.dirErr {
+				t.Errorf("%d records, error %v", len(r.records), r.err)
+			}
+			if test.fail {
+				return
+			}
+			if r.header.Camera != "X-T1" || r.header.FormatVersion != "0201" || r.header.DirVersion != "0100" {
+				t.Errorf("header %+v", r.header)
+			}
+			if exifCalls != 1 {
+				t.Errorf("%d calls of the Exif callback", exifCalls)
+			}
+		})
+	}
+}
+
+func TestReadWriteRAF(t *testing.T) {
+	jpeg := testJPEGFile(t, [][]byte{testTIFF(t, testExif("FUJIFILM"))}, nil)
+	dir := testRAFDirectory(testRAFRecords)
+	for _, extra := range []int{0, 1, 2, 3} {
+		// Vary the size of the Exif data so that all paddings are
+		// used.
+		grow := testExifFunc(func(exif *Exif) {
+			testGrowExif(exif)
+			exif.TIFF.AddFields([]tiff.Field{testASCII(tiff.Software, string(bytes.Repeat([]byte("s"), 4+extra)))})
+		})
+		in := testRAF(jpeg, dir)
+		out, err := testReadWrite(t, in, ReadWriteControl{ReadWriteExif: grow})
+		if err != nil {
+			t.Fatal(err)
+		}
+		oldHeader, _ := GetRAFHeader(in)
+		header, err := GetRAFHeader(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.JPEGLength <= oldHeader.JPEGLength || header.Camera != oldHeader.Camera {
+			t.Errorf("header %+v", header)
+		}
+		if (header.CFAOffset-oldHeader.CFAOffset)%4 != 0 {
+			t.Errorf("raw data moved by %d", header.CFAOffset-oldHeader.CFAOffset)
+		}
+		dirOut := out[header.CFAHeaderOffset : header.CFAHeaderOffset+header.CFAHeaderLength]
+		if !bytes.Equal(dirOut, dir) || string(out[header.CFAOffset:header.CFAOffset+header.CFALength]) != "CFA data" {
+			t.Error("data following the JPEG not relocated")
+		}
+		var exifs []Exif
+		control := ReadControl{ReadExif: testReadExifFunc(func(exif Exif, err error) { exifs = append(exifs, exif) })}
+		if err := Read(bytes.NewReader(out), control); err != nil {
+			t.Fatal(err)
+		}
+		if len(exifs) != 1 || findField(exifs[0].Exif, ImageUniqueID) == nil {
+			t.Error("Exif data not updated")
+		}
+	}
+	overlap := testRAF(jpeg, dir)
+	binary.BigEndian.PutUint32(overlap[rafJPEGOffsetPos:], RAFHeaderSize-4)
+	if _, err := testReadWrite(t, overlap, ReadWriteControl{}); err == nil {
+		t.Error("JPEG overlapping the header accepted")
+	}
+}
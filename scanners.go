@@ -5,6 +5,7 @@ import (
 	"errors"
 	jseg "github.com/garyhouston/jpegsegs"
 	tiff "github.com/garyhouston/tiff66"
+	"github.com/hashicorp/go-multierror"
 	"io"
 	"io/ioutil"
 	"os"
@@ -12,9 +13,18 @@ import (
 
 // Control structure for Read and ReadFile, with optional callbacks.
 type ReadControl struct {
-	ReadExif ReadExif // Callback to process Exif tree, or nil.
+	ReadExif      ReadExif      // Callback to process Exif tree, or nil.
+	ReadRAF       ReadRAF       // Callback to process RAF header and directory, or nil.
+	ReadSegment   ReadSegment   // Callback to process JPEG segments, or nil.
+	ReadXMP       ReadXMP       // Callback to process XMP, or nil.
+	ReadIPTC      ReadIPTC      // Callback to process IPTC-IIM, or nil.
+	ReadICC       ReadICC       // Callback to process ICC profiles, or nil.
+	ReadJFIF      ReadJFIF      // Callback to process JFIF and JFXX segments, or nil.
+	ReadMPF       ReadMPF       // Callback to process MPF trees, or nil.
+	ReadTrailer   ReadTrailer   // Callback to process data after the last JPEG image, or nil.
+	ReadImageInfo ReadImageInfo // Callback to receive a description of each image, or nil.
 	// Additional callbacks could be added, e.g., for processing
-	// other types of metadata, JPEG blocks, or full MPF trees.
+	// other types of metadata.
 }
 
 type ReadExif interface {
@@ -24,16 +34,41 @@ type ReadExif interface {
 	// pointers.  For JPEG files, it will be called on the Exif
 	// segment for each image in the file (multiple images are
 	// supported via Multi-Picture Format, MPF), and the Next
-	// pointer may link to a thumbnail image. Any errors from
-	// decoding the data will be available in err, which may be
-	// a multierror structure. Returning a non-nil error will
-	// terminate processing.
+	// pointer may link to a thumbnail image. For CRW files, it
+	// will be called once with a tree synthesized from the CIFF
+	// records. Any errors from decoding the data will be
+	// available in err, which may be a multierror
+	// structure. Returning a non-nil error will terminate
+	// processing.
 	ReadExif(format FileFormat, imageIdx uint32, exif Exif, err error) error
 }
 
+type ReadSegment interface {
+	// Callback for processing JPEG segments, read-only. It will
+	// be called for each marker segment preceding the first SOS
+	// (start of scan) marker in each image of a JPEG file,
+	// including Exif and MPF segments, in the order they appear
+	// in the file. 'payload' is the segment data following the
+	// length field, and is only valid until the callback
+	// returns. Returning a non-nil error will terminate
+	// processing.
+	ReadSegment(format FileFormat, imageIdx uint32, marker jseg.Marker, payload []byte) error
+}
+
+type ReadTrailer interface {
+	// Callback for processing trailer data, read-only. It will be
+	// called if a JPEG file contains data after the end of its
+	// last image, e.g., a Motion Photo video or Samsung SEFT
+	// trailer. For files using Multi-Picture Format, the trailer
+	// follows the last MPF image. Returning a non-nil error will
+	// terminate processing.
+	ReadTrailer(format FileFormat, trailer []byte) error
+}
+
 // Read processes its input, which is expected to be an open image
-// file in a supported format, currently JPEG or TIFF. It invokes
-// any callbacks in the control structure.
+// file in a supported format, currently JPEG, TIFF, Canon CRW,
+// Fujifilm RAF or Photoshop PSD. It invokes any callbacks in the
+// control structure.
 func Read(reader io.ReadSeeker, control ReadControl) error {
 	fileType, err := fileType(reader)
 	if err != nil {
@@ -48,8 +83,20 @@ func Read(reader io.ReadSeeker, control ReadControl) error {
 				return err
 			}
 		}
+	} else if fileType == FileCRW {
+		if err := readCRW(reader, control); err != nil {
+			return err
+		}
+	} else if fileType == FileRAF {
+		if err := readRAF(reader, control); err != nil {
+			return err
+		}
+	} else if fileType == FilePSD {
+		if err := readPSD(reader, control); err != nil {
+			return err
+		}
 	} else {
-		if err := readJPEG(reader, control); err != nil {
+		if err := readJPEG(FileJPEG, reader, control); err != nil {
 			return err
 		}
 	}
@@ -72,22 +119,39 @@ type FileFormat uint8
 const (
 	FileTIFF = 1
 	FileJPEG = 2
+	FileCRW  = 3 // Canon CIFF raw files, read only.
+	FileRAF  = 4 // Fujifilm raw files, with Exif in an embedded JPEG.
+	FilePSD  = 5 // Photoshop PSD and PSB files.
 )
 
+// Number of bytes needed to identify any supported file format.
+const fileTypeSize = 16
+
 // Determine type of stream. Anything not supported is an error. This will
 // read a few bytes from the reader, changing the position.
 func fileType(file io.Reader) (FileFormat, error) {
-	buf := make([]byte, tiff.HeaderSize)
-	if _, err := io.ReadFull(file, buf); err != nil {
+	buf := make([]byte, fileTypeSize)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && (err != io.ErrUnexpectedEOF || n < tiff.HeaderSize) {
 		return 0, err
 	}
+	buf = buf[:n]
 	if jseg.IsJPEGHeader(buf) {
 		return FileJPEG, nil
 	}
 	if validTIFF, _, _ := tiff.GetHeader(buf); validTIFF {
 		return FileTIFF, nil
 	}
-	return 0, errors.New("File doesn't have a TIFF or JPEG header")
+	if validCIFF, _, _ := GetCIFFHeader(buf); validCIFF {
+		return FileCRW, nil
+	}
+	if IsRAFHeader(buf) {
+		return FileRAF, nil
+	}
+	if IsPSDHeader(buf) {
+		return FilePSD, nil
+	}
+	return 0, errors.New("File doesn't have a TIFF, JPEG, CRW, RAF or PSD header")
 }
 
 func readTIFF(reader io.Reader, control ReadControl) error {
@@ -95,45 +159,129 @@ func readTIFF(reader io.Reader, control ReadControl) error {
 	if err != nil {
 		return err
 	}
-	return readTIFFBuf(FileTIFF, 0, buf, control)
+	return readTIFFBuf(FileTIFF, 0, buf, nil, control)
+}
+
+// Read a CRW file and pass an Exif tree synthesized from its CIFF
+// records to the callback.
+func readCRW(reader io.Reader, control ReadControl) error {
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	// Any errors from decoding the CIFF heap are passed to the
+	// callback. Errors from decoding the synthesized tree aren't
+	// expected.
+	heap, err := GetCIFFTree(buf)
+	if control.ReadImageInfo != nil {
+		if infoErr := control.ReadImageInfo.ReadImageInfo(ImageInfo{Format: FileCRW}); infoErr != nil {
+			return infoErr
+		}
+	}
+	if control.ReadExif == nil {
+		return nil
+	}
+	exif, exifErr := heap.MakeExif()
+	if exifErr != nil {
+		return exifErr
+	}
+	return control.ReadExif.ReadExif(FileCRW, 0, *exif, err)
 }
 
 // State for the MPF image iterator.
 type scanData struct {
+	format  FileFormat
 	control ReadControl
+	entries []MPEntry // MP entries from the first image, if needed.
+	end     int64     // End of the last image read.
 }
 
 // Function to be applied to each MPF image.
 func (scan *scanData) MPFApply(reader io.ReadSeeker, index uint32, length uint32) error {
 	if index > 0 {
-		return readJPEGImage(index, reader, &jseg.MPFCheck{}, scan.control)
+		if _, err := readJPEGImageInfo(scan.format, index, reader, scan.entries, scan.control.ReadImageInfo); err != nil {
+			return err
+		}
+		if err := readJPEGImage(scan.format, index, reader, &jseg.MPFCheck{}, scan.control); err != nil {
+			return err
+		}
+		return imageEnd(reader, &scan.end)
 	}
 	return nil
 }
 
-func readJPEG(reader io.ReadSeeker, control ReadControl) error {
+// Update 'end' if the reader's position, following the EOI of an
+// image, is beyond it.
+func imageEnd(reader io.Seeker, end *int64) error {
+	pos, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if pos > *end {
+		*end = pos
+	}
+	return nil
+}
+
+// Read a JPEG stream. 'format' is FileJPEG, or the format of a file
+// that contains an embedded JPEG stream.
+func readJPEG(format FileFormat, reader io.ReadSeeker, control ReadControl) error {
+	entries, err := readJPEGImageInfo(format, 0, reader, nil, control.ReadImageInfo)
+	if err != nil {
+		return err
+	}
 	var index jseg.MPFGetIndex
-	if err := readJPEGImage(0, reader, &index, control); err != nil {
+	if err := readJPEGImage(format, 0, reader, &index, control); err != nil {
+		return err
+	}
+	scandata := &scanData{entries: entries}
+	if err := imageEnd(reader, &scandata.end); err != nil {
 		return err
 	}
 	if index.Index != nil {
-		scandata := &scanData{}
+		scandata.format = format
 		scandata.control = control
 		err := index.Index.ImageIterate(reader, scandata)
 		if err != nil {
 			return err
 		}
 	}
+	if control.ReadTrailer != nil {
+		if _, err := reader.Seek(scandata.end, io.SeekStart); err != nil {
+			return err
+		}
+		trailer, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		if len(trailer) > 0 {
+			return control.ReadTrailer.ReadTrailer(format, trailer)
+		}
+	}
 	return nil
 }
 
 // Process a single image in a JPEG file. A file using the
 // Multi-Picture Format extension will contain multiple images.
-func readJPEGImage(imageIdx uint32, reader io.ReadSeeker, mpfProcessor jseg.MPFProcessor, control ReadControl) error {
+func readJPEGImage(format FileFormat, imageIdx uint32, reader io.ReadSeeker, mpfProcessor jseg.MPFProcessor, control ReadControl) error {
+	// The number of Exif segments is needed to report duplicates.
+	exifCount, exifOrdinal := 0, 0
+	if control.ReadExif != nil {
+		// Must be done before creating the scanner.
+		exifSegments, err := getExifSegments(reader)
+		if err != nil {
+			return err
+		}
+		exifCount = len(exifSegments)
+	}
 	scanner, err := jseg.NewScanner(reader)
 	if err != nil {
 		return err
 	}
+	var xmp xmpCollector
+	var iptc iptcCollector
+	var icc iccCollector
+	var jfif jfifCollector
 	for {
 		marker, buf, err := scanner.Scan()
 		if err != nil {
@@ -141,35 +289,124 @@ func readJPEGImage(imageIdx uint32, reader io.ReadSeeker, mpfProcessor jseg.MPFP
 		}
 		if marker == jseg.SOS || marker == jseg.EOI {
 			// No more metadata expected.
+			if control.ReadXMP != nil && xmp.found {
+				packet, err := xmp.result()
+				if err = control.ReadXMP.ReadXMP(format, imageIdx, packet, err); err != nil {
+					return err
+				}
+			}
+			if control.ReadIPTC != nil && iptc.found {
+				data, _, err := iptc.result()
+				if err = control.ReadIPTC.ReadIPTC(format, imageIdx, data, err); err != nil {
+					return err
+				}
+			}
+			if control.ReadICC != nil && icc.found {
+				profile, err := icc.result()
+				if err = control.ReadICC.ReadICC(format, imageIdx, profile, err); err != nil {
+					return err
+				}
+			}
+			if control.ReadJFIF != nil && jfif.found {
+				data, err := jfif.result()
+				if err = control.ReadJFIF.ReadJFIF(format, imageIdx, data, err); err != nil {
+					return err
+				}
+			}
+			if marker == jseg.SOS && control.ReadTrailer != nil {
+				// Find the end of the image, so that any
+				// trailer can be located.
+				return skipToEOI(scanner)
+			}
 			return nil
 		}
+		if control.ReadSegment != nil {
+			if err := control.ReadSegment.ReadSegment(format, imageIdx, marker, buf); err != nil {
+				return err
+			}
+		}
 		if marker == jseg.APP0+1 && control.ReadExif != nil {
 			isExif, next := GetHeader(buf)
 			if isExif {
 				// Copy the buffer so that data in the Exif tree can remain valid if the callback decides to save it.
-				copyBuf := make([]byte, len(buf[next:]))
-				copy(copyBuf, buf[next:])
-				if err := readTIFFBuf(FileJPEG, imageIdx, copyBuf, control); err != nil {
+				segment := func(buf []byte) error {
+					if control.ReadSegment != nil {
+						return control.ReadSegment.ReadSegment(format, imageIdx, marker, buf)
+					}
+					return nil
+				}
+				copyBuf, err := readExifSegments(reader, scanner, buf[next:], segment)
+				if err != nil {
+					return err
+				}
+				dupErr := duplicateExifError(imageIdx, exifOrdinal, exifCount)
+				exifOrdinal++
+				if err := readTIFFBuf(format, imageIdx, copyBuf, dupErr, control); err != nil {
 					return err
 				}
 			}
 		}
+		if marker == jseg.APP0+1 && control.ReadXMP != nil {
+			xmp.add(buf)
+		}
+		if marker == jseg.APP0+13 && control.ReadIPTC != nil {
+			iptc.add(buf)
+		}
+		if marker == jseg.APP0+2 && control.ReadICC != nil {
+			icc.add(buf)
+		}
+		if marker == jseg.APP0 && control.ReadJFIF != nil {
+			jfif.add(buf)
+		}
 		if marker == jseg.APP0+2 {
-			_, _, err := mpfProcessor.ProcessAPP2(nil, reader, buf)
+			isMPF, _, err := mpfProcessor.ProcessAPP2(nil, reader, buf)
 			if err != nil {
 				return err
 			}
+			if isMPF && control.ReadMPF != nil {
+				// Copy the buffer so that data in the MPF trees can remain valid if the callback decides to save it.
+				copyBuf := append([]byte{}, buf...)
+				mpf, err := getMPF(imageIdx, copyBuf)
+				if err = control.ReadMPF.ReadMPF(format, imageIdx, mpf, err); err != nil {
+					return err
+				}
+			}
 		}
 	}
 }
 
-func readTIFFBuf(format FileFormat, imageIdx uint32, buf []byte, control ReadControl) error {
+// Scan a JPEG image up to and including its EOI marker.
+func skipToEOI(scanner *jseg.Scanner) error {
+	for {
+		marker, _, err := scanner.Scan()
+		if err != nil {
+			return err
+		}
+		if marker == jseg.EOI {
+			return nil
+		}
+	}
+}
+
+// Read a TIFF buffer and apply the Exif callback. readErr, if not nil,
+// is an error from reading the container, such as a duplicate Exif
+// segment, and is passed to the callback with any errors from reading
+// the tree.
+func readTIFFBuf(format FileFormat, imageIdx uint32, buf []byte, readErr error, control ReadControl) error {
 	exif, err := GetExifTree(buf)
+	if readErr != nil {
+		err = multierror.Append(err, readErr)
+	}
 	for {
+		if format == FileTIFF && control.ReadImageInfo != nil {
+			if infoErr := control.ReadImageInfo.ReadImageInfo(tiffImageInfo(format, imageIdx, exif.TIFF)); infoErr != nil {
+				return infoErr
+			}
+		}
 		if err = control.ReadExif.ReadExif(format, imageIdx, *exif, err); err != nil {
 			return err
 		}
-		if format == FileJPEG || exif.TIFF.Next == nil {
+		if format != FileTIFF || exif.TIFF.Next == nil {
 			return nil
 		}
 		exif = makeExif(exif.TIFF.Next)
@@ -179,11 +416,24 @@ func readTIFFBuf(format FileFormat, imageIdx uint32, buf []byte, control ReadCon
 
 // Control structure for ReadWrite and ReadWriteFile, with optional callbacks.
 type ReadWriteControl struct {
-	ReadWriteExif ReadWriteExif // Callback to process Exif tree, or nil.
-	ExifRequired  ExifRequired  // Check whether Exif block should be added if not present.
+	ReadWriteExif     ReadWriteExif          // Callback to process Exif tree, or nil.
+	ExifRequired      ExifRequired           // Check whether Exif block should be added if not present.
+	ReadWriteSegment  ReadWriteSegment       // Callback to process JPEG segments, or nil.
+	ReadWriteXMP      ReadWriteXMP           // Callback to process XMP, or nil.
+	ReadWriteIPTC     ReadWriteIPTC          // Callback to process IPTC-IIM, or nil.
+	ReadWriteICC      ReadWriteICC           // Callback to process ICC profiles, or nil.
+	ReadWriteJFIF     ReadWriteJFIF          // Callback to process JFIF and JFXX segments, or nil.
+	ReadWriteMPF      ReadWriteMPF           // Callback to process MPF trees, or nil.
+	DropJFIF          bool                   // Remove JFIF and JFXX segments from images with Exif segments.
+	ReadWriteTrailer  ReadWriteTrailer       // Callback to process data after the last JPEG image, or nil.
+	ExifOverflow      ExifOverflowPolicy     // Handling of Exif data too large for a JPEG segment.
+	DuplicateExif     DuplicateExifPolicy    // Handling of JPEG images with multiple Exif segments.
+	NormalizeSegments bool                   // Write JPEG metadata segments in the standard order.
+	ReadImageInfo     ReadImageInfo          // Callback to receive a description of each image, or nil.
+	UnknownMakerNote  UnknownMakerNotePolicy // Handling of maker notes that aren't decoded.
 
 	// Additional callbacks could be added, e.g., for processing
-	// other types of metadata, JPEG blocks, or full MPF trees.
+	// other types of metadata.
 }
 
 type ReadWriteExif interface {
@@ -200,6 +450,34 @@ type ReadWriteExif interface {
 	ReadWriteExif(format FileFormat, imageIdx uint32, exif *Exif, err error) error
 }
 
+type ReadWriteSegment interface {
+	// Callback for processing JPEG segments, read-write. It will
+	// be called for each marker segment preceding the first SOS
+	// (start of scan) marker in each image of a JPEG file, as
+	// per ReadSegment, after Exif segments have been processed
+	// by the ReadWriteExif callback. It returns the segments to
+	// be written in place of the given segment: the segment
+	// itself to leave it unchanged, an empty slice to delete it,
+	// or multiple segments to insert new ones. 'payload' is only
+	// valid until the callback returns. MPF segments must be
+	// returned unmodified if additional images in the file are
+	// to be retained. Returning a non-nil error will terminate
+	// processing.
+	ReadWriteSegment(format FileFormat, imageIdx uint32, marker jseg.Marker, payload []byte) ([]jseg.Segment, error)
+}
+
+type ReadWriteTrailer interface {
+	// Callback for processing trailer data, read-write. It will
+	// be called once for a JPEG file, with the data following the
+	// end of its last image, which may be empty. It returns the
+	// trailer to be written: the trailer itself to leave it
+	// unchanged, nil to remove it, or new data to replace or
+	// create it. If there's no trailer callback, any trailer is
+	// copied unchanged. Returning a non-nil error will terminate
+	// processing.
+	ReadWriteTrailer(format FileFormat, trailer []byte) ([]byte, error)
+}
+
 type ExifRequired interface {
 	// Callback to determine whether an Exif block should be
 	// created if not already present for the specfied image
@@ -210,20 +488,27 @@ type ExifRequired interface {
 }
 
 // ReadWrite processes its input, which is expected to be an open image
-// file in a supported format, currently JPEG or TIFF. It invokes
-// any callbacks in the control structure.
+// file in a supported format, currently JPEG, TIFF, Fujifilm RAF or
+// Photoshop PSD. It invokes any callbacks in the control structure.
 func ReadWrite(reader io.ReadSeeker, writer io.WriteSeeker, control ReadWriteControl) error {
 	fileType, err := fileType(reader)
 	if err != nil {
 		return err
 	}
+	if fileType == FileCRW {
+		return errors.New("Writing CRW files is not supported")
+	}
 	if _, err := reader.Seek(0, 0); err != nil {
 		return err
 	}
 	if fileType == FileTIFF {
 		return readWriteTIFF(reader, writer, control)
+	} else if fileType == FileRAF {
+		return readWriteRAF(reader, writer, control)
+	} else if fileType == FilePSD {
+		return readWritePSD(reader, writer, control)
 	} else {
-		return readWriteJPEG(reader, writer, control)
+		return readWriteJPEG(FileJPEG, reader, writer, control)
 	}
 }
 
@@ -249,7 +534,7 @@ func readWriteTIFF(infile io.Reader, outfile io.Writer, control ReadWriteControl
 	}
 	if inbuf == nil {
 	}
-	outbuf, err := readWriteTIFFBuf(FileTIFF, 0, inbuf, control)
+	outbuf, err := readWriteTIFFBuf(FileTIFF, 0, inbuf, inbuf, nil, false, control)
 	if outbuf == nil && err == nil {
 		err = errors.New("TIFF file would contain no fields, not writing.")
 	}
@@ -262,9 +547,13 @@ func readWriteTIFF(infile io.Reader, outfile io.Writer, control ReadWriteControl
 
 // State for MPF image iterator.
 type iterData struct {
+	format     FileFormat
 	writer     io.WriteSeeker
 	newOffsets []uint32
 	control    ReadWriteControl
+	entries    []MPEntry     // MP entries from the first image, if needed.
+	end        int64         // End of the last image read.
+	images     []imageExtent // Positions of the images following the first.
 }
 
 // Function to be applied to each MPF image.
@@ -275,18 +564,51 @@ func (iter *iterData) MPFApply(reader io.ReadSeeker, index uint32, length uint32
 			return err
 		}
 		iter.newOffsets[index] = uint32(pos)
-		return readWriteJPEGImage(index, reader, iter.writer, &jseg.MPFCheck{}, iter.control)
+		inPos, err := reader.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if _, err := readJPEGImageInfo(iter.format, index, reader, iter.entries, iter.control.ReadImageInfo); err != nil {
+			return err
+		}
+		if err := readWriteJPEGImage(iter.format, index, reader, iter.writer, &jseg.MPFCheck{}, nil, iter.control); err != nil {
+			return err
+		}
+		image := imageExtent{inStart: inPos, outStart: pos}
+		if image.inEnd, err = reader.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+		if image.outEnd, err = iter.writer.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+		iter.images = append(iter.images, image)
+		return imageEnd(reader, &iter.end)
 	}
 	return nil
 }
 
-func readWriteJPEG(reader io.ReadSeeker, writer io.WriteSeeker, control ReadWriteControl) error {
+// Read and write a JPEG stream. 'format' is FileJPEG, or the format of
+// a file that contains an embedded JPEG stream.
+func readWriteJPEG(format FileFormat, reader io.ReadSeeker, writer io.WriteSeeker, control ReadWriteControl) error {
+	entries, err := readJPEGImageInfo(format, 0, reader, nil, control.ReadImageInfo)
+	if err != nil {
+		return err
+	}
 	var mpfIndex jseg.MPFIndexRewriter
-	if err := readWriteJPEGImage(0, reader, writer, &mpfIndex, control); err != nil {
+	var preview makerPreview
+	if err := readWriteJPEGImage(format, 0, reader, writer, &mpfIndex, &preview, control); err != nil {
+		return err
+	}
+	iter := iterData{entries: entries}
+	if err := imageEnd(reader, &iter.end); err != nil {
+		return err
+	}
+	end, err := writer.Seek(0, io.SeekCurrent)
+	if err != nil {
 		return err
 	}
 	if mpfIndex.Tree != nil {
-		var iter iterData
+		iter.format = format
 		iter.writer = writer
 		iter.control = control
 		index := mpfIndex.Index
@@ -295,7 +617,7 @@ func readWriteJPEG(reader io.ReadSeeker, writer io.WriteSeeker, control ReadWrit
 		if err != nil {
 			return err
 		}
-		end, err := writer.Seek(0, io.SeekCurrent)
+		end, err = writer.Seek(0, io.SeekCurrent)
 		if err != nil {
 			return err
 		}
@@ -303,21 +625,173 @@ func readWriteJPEG(reader io.ReadSeeker, writer io.WriteSeeker, control ReadWrit
 			return err
 		}
 	}
-	return nil
+	trailer, err := readWriteTrailer(format, reader, writer, iter.end, end, control)
+	if err != nil {
+		return err
+	}
+	return preview.relocate(writer, iter.images, iter.end, end, trailer)
+}
+
+// Copy the trailer following the last image of a JPEG stream, from
+// 'inEnd' in the input to 'outEnd' in the output, passing it through
+// the trailer callback if there is one. Returns the trailer written
+// by the callback, or nil if the trailer was copied unchanged.
+func readWriteTrailer(format FileFormat, reader io.ReadSeeker, writer io.WriteSeeker, inEnd, outEnd int64, control ReadWriteControl) ([]byte, error) {
+	if _, err := reader.Seek(inEnd, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := writer.Seek(outEnd, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if control.ReadWriteTrailer == nil {
+		_, err := io.Copy(writer, reader)
+		return nil, err
+	}
+	trailer, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if trailer, err = control.ReadWriteTrailer.ReadWriteTrailer(format, trailer); err != nil {
+		return nil, err
+	}
+	if trailer == nil {
+		trailer = []byte{}
+	}
+	_, err = writer.Write(trailer)
+	return trailer, err
 }
 
 // Process a single image in a JPEG file. A file using Multi-Picture
-// Format will contain multiple images.
-func readWriteJPEGImage(imageIdx uint32, reader io.ReadSeeker, writer io.WriteSeeker, mpfProcessor jseg.MPFProcessor, control ReadWriteControl) error {
-	needExif := control.ExifRequired != nil && control.ExifRequired.ExifRequired(FileJPEG, imageIdx)
-	if needExif {
+// Format will contain multiple images. 'preview', if not nil, records
+// any maker note preview located by the first Exif segment, to be
+// relocated once the rest of the file has been written.
+func readWriteJPEGImage(format FileFormat, imageIdx uint32, reader io.ReadSeeker, writer io.WriteSeeker, mpfProcessor jseg.MPFProcessor, preview *makerPreview, control ReadWriteControl) error {
+	if control.ReadWriteMPF != nil {
+		mpfProcessor = &mpfEditor{processor: mpfProcessor, format: format, imageIdx: imageIdx, callback: control.ReadWriteMPF}
+	}
+	// Must be done before creating the scanner.
+	exifSegments, err := getExifSegments(reader)
+	if err != nil {
+		return err
+	}
+	exifCount, exifOrdinal := len(exifSegments), 0
+	needExif := exifCount == 0 && control.ExifRequired != nil && control.ExifRequired.ExifRequired(format, imageIdx)
+	// XMP, ICC and IPTC segments are collected before any are
+	// written, since they may be split over multiple segments.
+	var xmp xmpCollector
+	var iptc iptcCollector
+	var icc iccCollector
+	var jfif jfifCollector
+	if control.ReadWriteXMP != nil || control.ReadWriteIPTC != nil || control.ReadWriteICC != nil || control.ReadWriteJFIF != nil {
 		// Must be done before creating the scanner.
-		haveExif, err := findExif(reader)
+		if err := collectMetadata(reader, &xmp, &iptc, &icc, &jfif); err != nil {
+			return err
+		}
+	}
+	var replacements []*replacement
+	if control.ReadWriteXMP != nil {
+		packet, err := xmp.result()
+		if err = control.ReadWriteXMP.ReadWriteXMP(format, imageIdx, &packet, err); err != nil {
+			return err
+		}
+		segments, err := makeXMPSegments(packet)
+		if err != nil {
+			return err
+		}
+		replacements = append(replacements, &replacement{
+			marker:       jseg.APP0 + 1,
+			match:        isAnyXMPSegment,
+			found:        xmp.found,
+			segments:     segments,
+			createBefore: afterExif,
+		})
+	}
+	if control.ReadWriteICC != nil {
+		profile, err := icc.result()
+		if err = control.ReadWriteICC.ReadWriteICC(format, imageIdx, &profile, err); err != nil {
+			return err
+		}
+		segments, err := makeICCSegments(profile)
 		if err != nil {
 			return err
 		}
-		if haveExif {
-			needExif = false
+		if profile.Data == nil {
+			// Retain a profile that couldn't be reassembled.
+			segments = icc.incompleteSegments()
+		}
+		replacements = append(replacements, &replacement{
+			marker:       jseg.APP0 + 2,
+			match:        IsICCSegment,
+			found:        icc.found,
+			segments:     segments,
+			createBefore: afterAPP1,
+		})
+	}
+	if control.ReadWriteIPTC != nil {
+		data, datasets, err := iptc.result()
+		if err = control.ReadWriteIPTC.ReadWriteIPTC(format, imageIdx, &data, err); err != nil {
+			return err
+		}
+		segments := iptc.undecodedSegments()
+		if segments == nil {
+			if segments, err = makeIPTCSegments(data, datasets); err != nil {
+				return err
+			}
+		}
+		replacements = append(replacements, &replacement{
+			marker:       jseg.APP0 + 13,
+			match:        IsPhotoshopSegment,
+			found:        iptc.found,
+			segments:     segments,
+			createBefore: afterAPP1,
+		})
+	}
+	// The Exif specification doesn't allow JFIF segments in
+	// images with Exif segments.
+	dropJFIF := control.DropJFIF && (exifCount > 0 || needExif)
+	var jfifReplacement *replacement
+	if control.ReadWriteJFIF != nil || dropJFIF {
+		var segments [][]byte
+		if control.ReadWriteJFIF != nil {
+			data, err := jfif.result()
+			if err = control.ReadWriteJFIF.ReadWriteJFIF(format, imageIdx, &data, err); err != nil {
+				return err
+			}
+			if !dropJFIF {
+				if segments, err = makeJFIFSegments(data); err != nil {
+					return err
+				}
+			}
+		}
+		jfifReplacement = &replacement{
+			marker:       jseg.APP0,
+			match:        isAnyJFIFSegment,
+			found:        jfif.found,
+			segments:     segments,
+			createBefore: atStart,
+		}
+	}
+	var exifReplacement *replacement
+	if needExif {
+		// Create an Exif segment at the start of the output,
+		// after any JFIF segments, since the JFIF specification
+		// requires its segment to come first.
+		segments, err := createExif(format, imageIdx, control)
+		if err != nil {
+			return err
+		}
+		exifReplacement = &replacement{
+			marker:       jseg.APP0 + 1,
+			match:        func(buf []byte) bool { return false },
+			segments:     segments,
+			createBefore: afterJFIF,
+		}
+	}
+	// New JFIF and Exif segments precede any others created at the
+	// same position.
+	for _, r := range []*replacement{exifReplacement, jfifReplacement} {
+		if r != nil {
+			replacements = append([]*replacement{r}, replacements...)
 		}
 	}
 	scanner, err := jseg.NewScanner(reader)
@@ -328,94 +802,263 @@ func readWriteJPEGImage(imageIdx uint32, reader io.ReadSeeker, writer io.WriteSe
 	if err != nil {
 		return err
 	}
-	if needExif {
-		// Create an Exif segment at the start of the output.
-		buf, err := createExif(imageIdx, control)
-		if err != nil {
-			return err
+	// Segments preceding the first SOS are passed to the segment
+	// callback. MPF processing is done on the resulting segments
+	// just before they are written, since it records the output
+	// position.
+	inMetadata := true
+	write := func(marker jseg.Marker, data []byte) error {
+		if marker == jseg.APP0+2 {
+			var err error
+			if _, data, err = mpfProcessor.ProcessAPP2(writer, reader, data); err != nil {
+				return err
+			}
 		}
-		if buf != nil {
-			if err = dumper.Dump(jseg.APP0+1, buf); err != nil {
+		if preview != nil && marker == jseg.APP0+1 && isExifSegment(data) {
+			if err := preview.writeSegment(writer); err != nil {
 				return err
 			}
 		}
+		return dumper.Dump(marker, data)
+	}
+	// Metadata segments held back if they are to be reordered.
+	var order segmentOrder
+	dump := func(marker jseg.Marker, buf []byte) error {
+		segments := []jseg.Segment{{Marker: marker, Data: buf}}
+		if inMetadata && marker != jseg.SOS && marker != jseg.EOI && control.ReadWriteSegment != nil {
+			var err error
+			segments, err = control.ReadWriteSegment.ReadWriteSegment(format, imageIdx, marker, buf)
+			if err != nil {
+				return err
+			}
+		}
+		for _, seg := range segments {
+			if control.NormalizeSegments {
+				if inMetadata && seg.Marker != jseg.SOS && seg.Marker != jseg.EOI {
+					if err := order.add(reader, seg.Marker, seg.Data); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := order.flush(reader, write); err != nil {
+					return err
+				}
+			}
+			if err := write(seg.Marker, seg.Data); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 	for {
 		marker, buf, err := scanner.Scan()
 		if err != nil {
 			return err
 		}
+		// New segments are created before this one even if
+		// it's replaced.
+		for _, r := range replacements {
+			if !r.found && r.createBefore(marker, buf) {
+				if err := r.dump(dump); err != nil {
+					return err
+				}
+			}
+		}
+		replaced := false
+		for _, r := range replacements {
+			if marker == r.marker && r.match(buf) {
+				// Replace the first matching segment and drop
+				// the others.
+				if err := r.dump(dump); err != nil {
+					return err
+				}
+				replaced = true
+			}
+		}
+		if replaced {
+			continue
+		}
 		if marker == jseg.APP0+1 {
 			isExif, next := GetHeader(buf)
 			if isExif {
 				// Copy the buffer so that data in the Exif tree can remain valid if the callback decides to save it.
-				copyBuf := make([]byte, len(buf[next:]))
-				copy(copyBuf, buf[next:])
-				newTIFF, err := readWriteTIFFBuf(FileJPEG, imageIdx, copyBuf, control)
+				tiffPos, err := reader.Seek(0, io.SeekCurrent)
 				if err != nil {
 					return err
 				}
-				if newTIFF == nil {
-					// Skip empty TIFF tree.
-					continue
+				tiffPos += int64(next) - int64(len(buf))
+				copyBuf, err := readExifSegments(reader, scanner, buf[next:], nil)
+				if err != nil {
+					return err
 				}
-				buf = append(header, newTIFF...)
-			}
-
-		}
-		if marker == jseg.APP0+2 {
-			_, buf, err = mpfProcessor.ProcessAPP2(writer, reader, buf)
-			if err != nil {
-				return err
+				if preview != nil && exifOrdinal == 0 {
+					if err := preview.read(reader, tiffPos, copyBuf); err != nil {
+						return err
+					}
+				}
+				ordinal := exifOrdinal
+				exifOrdinal++
+				origBuf := copyBuf
+				var mergeErr error
+				if exifCount > 1 && control.DuplicateExif != DuplicateExifKeepAll {
+					if ordinal > 0 {
+						// Dropped, or already merged.
+						continue
+					}
+					// Index of the segment whose maker note is
+					// written.
+					makerNoteIdx := 0
+					switch control.DuplicateExif {
+					case DuplicateExifKeepLast:
+						ordinal = exifCount - 1
+						copyBuf = exifSegments[ordinal]
+						makerNoteIdx = ordinal
+					case DuplicateExifMerge:
+						copyBuf, mergeErr = mergeExifSegments(exifSegments)
+						makerNoteIdx = makerNoteSegment(exifSegments)
+					}
+					origBuf = exifSegments[makerNoteIdx]
+					if preview != nil && makerNoteIdx > 0 {
+						if err := checkDuplicatePreview(origBuf); err != nil {
+							return err
+						}
+					}
+				}
+				dupErr := duplicateExifError(imageIdx, ordinal, exifCount)
+				if mergeErr != nil {
+					dupErr = multierror.Append(dupErr, mergeErr)
+				}
+				newTIFF, err := readWriteTIFFBuf(format, imageIdx, copyBuf, origBuf, dupErr, preview != nil, control)
+				if err != nil {
+					return err
+				}
+				segments, err := makeExifSegments(imageIdx, newTIFF, control.ExifOverflow)
+				if err != nil {
+					return err
+				}
+				if preview != nil && ordinal == 0 {
+					preview.setSegments(segments)
+				}
+				// An empty TIFF tree results in no segments.
+				for _, segment := range segments {
+					if err := dump(marker, segment); err != nil {
+						return err
+					}
+				}
+				continue
 			}
 		}
-		if err := dumper.Dump(marker, buf); err != nil {
+		if err := dump(marker, buf); err != nil {
 			return err
 		}
+		if marker == jseg.SOS {
+			inMetadata = false
+		}
 		if marker == jseg.EOI {
 			return nil
 		}
 	}
 }
 
-// Check if a JPEG image has an Exif block.
-func findExif(reader io.ReadSeeker) (bool, error) {
+// Segments of one metadata type that replace the original segments
+// when a JPEG image is rewritten.
+type replacement struct {
+	marker       jseg.Marker
+	match        func(buf []byte) bool                     // Check if a segment is to be replaced.
+	found        bool                                      // True if the image had matching segments.
+	segments     [][]byte                                  // New segment data.
+	done         bool                                      // True once the new segments are written.
+	createBefore func(marker jseg.Marker, buf []byte) bool // Position for new segments, if none were found.
+}
+
+// Write the new segments, if not already done.
+func (r *replacement) dump(dump func(marker jseg.Marker, buf []byte) error) error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+	for _, seg := range r.segments {
+		if err := dump(r.marker, seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Position for creating new segments at the start of the image.
+func atStart(marker jseg.Marker, buf []byte) bool {
+	return true
+}
+
+// Position for creating new segments after any JFIF and JFXX segments.
+func afterJFIF(marker jseg.Marker, buf []byte) bool {
+	return marker != jseg.APP0 || !isAnyJFIFSegment(buf)
+}
+
+// Position for creating new segments after any APP0 and Exif segments.
+func afterExif(marker jseg.Marker, buf []byte) bool {
+	isExif, _ := GetHeader(buf)
+	return marker != jseg.APP0 && (marker != jseg.APP0+1 || !isExif)
+}
+
+// Position for creating new segments after any APP0 and APP1 segments.
+func afterAPP1(marker jseg.Marker, buf []byte) bool {
+	return marker != jseg.APP0 && marker != jseg.APP0+1
+}
+
+// Collect the XMP, IPTC, ICC and JFIF segments in a JPEG image.
+func collectMetadata(reader io.ReadSeeker, xmp *xmpCollector, iptc *iptcCollector, icc *iccCollector, jfif *jfifCollector) error {
 	readerSave, err := reader.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return false, err
+		return err
 	}
 	scanner, err := jseg.NewScanner(reader)
 	if err != nil {
-		return false, err
+		return err
 	}
-	haveExif := false
 	for {
 		marker, buf, err := scanner.Scan()
 		if err != nil {
-			return false, err
+			return err
 		}
 		if marker == jseg.SOS || marker == jseg.EOI {
 			// No more metadata expected.
 			break
 		}
+		if marker == jseg.APP0 {
+			jfif.add(buf)
+		}
 		if marker == jseg.APP0+1 {
-			haveExif, _ = GetHeader(buf)
-			if haveExif {
-				break
-			}
+			xmp.add(buf)
+		}
+		if marker == jseg.APP0+2 {
+			icc.add(buf)
+		}
+		if marker == jseg.APP0+13 {
+			iptc.add(buf)
 		}
 	}
 	// Reset the file position.
 	_, err = reader.Seek(readerSave, io.SeekStart)
-	if err != nil {
-		return false, err
+	return err
+}
+
+// Create an empty Exif node, call the ReadWrite callback on it, and
+// serialize the result as JPEG APP1 segment data, applying the
+// overflow policy if required. Returns nil if the callback empties
+// the node.
+func createExif(format FileFormat, imageIdx uint32, control ReadWriteControl) ([][]byte, error) {
+	newTIFF, err := createTIFF(format, imageIdx, control)
+	if newTIFF == nil || err != nil {
+		return nil, err
 	}
-	return haveExif, nil
+	return makeExifSegments(imageIdx, newTIFF, control.ExifOverflow)
 }
 
 // Create an empty Exif node, call the ReadWrite callback on it, and
-// serialize the result. Returns nil if the callback empties the node.
-func createExif(imageIdx uint32, control ReadWriteControl) ([]byte, error) {
+// serialize the result in TIFF format. Returns nil if the callback
+// empties the node.
+func createTIFF(format FileFormat, imageIdx uint32, control ReadWriteControl) ([]byte, error) {
 	node := tiff.NewIFDNode(tiff.TIFFSpace)
 	node.Order = binary.LittleEndian // arbitrary
 	exif := Exif{TIFF: node}
@@ -425,15 +1068,14 @@ func createExif(imageIdx uint32, control ReadWriteControl) ([]byte, error) {
 	if _, err := exif.TIFF.PutIFDTree(buf, tiff.HeaderSize); err != nil {
 		return nil, err
 	}
-	newTIFF, err := readWriteTIFFBuf(FileJPEG, imageIdx, buf, control)
+	newTIFF, err := readWriteTIFFBuf(format, imageIdx, buf, buf, nil, false, control)
 	if newTIFF == nil {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	buf = append(header, newTIFF...)
-	return buf, nil
+	return newTIFF, nil
 }
 
 // Create an Exif IFD and add it to a TIFF tree.
@@ -460,12 +1102,26 @@ func addExifIFD(exif *Exif) {
 
 // Given a tiff buffer, applies callbacks and returns a newly
 // allocated buffer, or nil if an error occurs or if there was no
-// output to be written.
-func readWriteTIFFBuf(format FileFormat, imageIdx uint32, buf []byte, control ReadWriteControl) ([]byte, error) {
+// output to be written. dupErr, if not nil, is passed to the callback
+// with any errors from reading the tree. origBuf is the TIFF data as
+// read from the file, which differs from buf if duplicate Exif segments
+// were merged; OffsetSchema fields are calculated from the positions
+// in it. If relocatePreview is true,
+// the caller relocates any maker note preview stored outside the Exif
+// data, so it isn't treated as a maker note complexity.
+func readWriteTIFFBuf(format FileFormat, imageIdx uint32, buf, origBuf []byte, dupErr error, relocatePreview bool, control ReadWriteControl) ([]byte, error) {
 	exif, err := GetExifTree(buf)
+	if dupErr != nil {
+		err = multierror.Append(err, dupErr)
+	}
 	exif.TIFF.Fix()
 	exifNode := exif
 	for exifNode != nil {
+		if format == FileTIFF && control.ReadImageInfo != nil {
+			if err := control.ReadImageInfo.ReadImageInfo(tiffImageInfo(format, imageIdx, exifNode.TIFF)); err != nil {
+				return nil, err
+			}
+		}
 		if exifNode.Exif == nil && control.ExifRequired != nil && control.ExifRequired.ExifRequired(format, imageIdx) == true {
 			addExifIFD(exifNode)
 		}
@@ -474,13 +1130,15 @@ func readWriteTIFFBuf(format FileFormat, imageIdx uint32, buf []byte, control Re
 				return nil, err
 			}
 		}
-		if err = exifNode.CheckMakerNote(); err != nil {
+		if control.UnknownMakerNote == UnknownMakerNoteOffsetSchema {
+			addOffsetSchema(*exifNode)
+		} else if err = exifNode.CheckMakerNote(); err != nil {
 			return nil, err
 		}
-		if err = exifNode.MakerNoteComplexities(); err != nil {
+		if err = exifNode.makerNoteComplexities(relocatePreview); err != nil {
 			return nil, err
 		}
-		if format == FileJPEG || exifNode.TIFF.Next == nil {
+		if format != FileTIFF || exifNode.TIFF.Next == nil {
 			exifNode = nil
 		} else {
 			exifNode = makeExif(exifNode.TIFF.Next)
@@ -495,6 +1153,13 @@ func readWriteTIFFBuf(format FileFormat, imageIdx uint32, buf []byte, control Re
 	bufSize := tiff.HeaderSize + exif.TreeSize()
 	outbuf := make([]byte, bufSize)
 	tiff.PutHeader(outbuf, exif.TIFF.Order, tiff.HeaderSize)
-	_, err = exif.TIFF.PutIFDTree(outbuf, tiff.HeaderSize)
-	return outbuf, err
+	if _, err = exif.TIFF.PutIFDTree(outbuf, tiff.HeaderSize); err != nil {
+		return nil, err
+	}
+	if control.UnknownMakerNote == UnknownMakerNoteOffsetSchema {
+		if err := updateOffsetSchema(origBuf, outbuf); err != nil {
+			return nil, err
+		}
+	}
+	return outbuf, nil
 }
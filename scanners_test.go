@@ -0,0 +1,252 @@
+package exif44
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	jseg "github.com/garyhouston/jpegsegs"
+)
+
+// Segment callbacks that record the segments of each image, and
+// optionally replace them.
+type testSegmentRecorder struct {
+	markers [][]jseg.Marker // Markers for each image.
+	err     error           // Error to return from each call.
+	replace func(marker jseg.Marker, payload []byte) []jseg.Segment
+}
+
+func (r *testSegmentRecorder) ReadSegment(format FileFormat, imageIdx uint32, marker jseg.Marker, payload []byte) error {
+	for uint32(len(r.markers)) <= imageIdx {
+		r.markers = append(r.markers, nil)
+	}
+	r.markers[imageIdx] = append(r.markers[imageIdx], marker)
+	return r.err
+}
+
+func (r *testSegmentRecorder) ReadWriteSegment(format FileFormat, imageIdx uint32, marker jseg.Marker, payload []byte) ([]jseg.Segment, error) {
+	if err := r.ReadSegment(format, imageIdx, marker, payload); err != nil {
+		return nil, err
+	}
+	if r.replace != nil {
+		return r.replace(marker, payload), nil
+	}
+	return []jseg.Segment{{Marker: marker, Data: payload}}, nil
+}
+
+// Return the markers of the segments before the SOS marker in a JPEG
+// file.
+func testMarkers(t *testing.T, file []byte) []jseg.Marker {
+	var markers []jseg.Marker
+	for _, seg := range testSegments(t, file) {
+		markers = append(markers, seg.Marker)
+	}
+	return markers
+}
+
+func TestReadSegment(t *testing.T) {
+	exif := testTIFF(t, testExif("Acme"))
+	file := testInsertSegment(testJPEGFile(t, [][]byte{exif}, nil), jseg.COM, []byte("comment"))
+	mpf := testMPF(t)
+	tests := []struct {
+		name string
+		file []byte
+		err  error
+	}{
+		{"JPEG", file, nil},
+		{"MPF", mpf, nil},
+		{"error", file, errors.New("stop")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := testSegmentRecorder{err: test.err}
+			err := Read(bytes.NewReader(test.file), ReadControl{ReadSegment: &r, ReadExif: testReadExifFunc(func(Exif, error) {})})
+			if err != test.err {
+				t.Fatalf("error %v", err)
+			}
+			if test.err != nil {
+				if len(r.markers) != 1 || len(r.markers[0]) != 1 {
+					t.Errorf("processing continued after error: %v", r.markers)
+				}
+				return
+			}
+			images, err := SplitMPF(bytes.NewReader(test.file))
+			if err != nil {
+				images = []MPFImage{{Data: test.file}}
+			}
+			if len(r.markers) != len(images) {
+				t.Fatalf("segments for %d images, expected %d", len(r.markers), len(images))
+			}
+			for i := range images {
+				// The MPF segments are removed by SplitMPF.
+				expected := testMarkers(t, images[i].Data)
+				var got []jseg.Marker
+				for _, marker := range r.markers[i] {
+					if marker != jseg.APP0+2 {
+						got = append(got, marker)
+					}
+				}
+				if len(got) != len(expected) {
+					t.Fatalf("image %d: markers %v, expected %v", i+1, got, expected)
+				}
+				for j := range got {
+					if got[j] != expected[j] {
+						t.Errorf("image %d: markers %v, expected %v", i+1, got, expected)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReadWriteSegment(t *testing.T) {
+	file := testInsertSegment(testJPEGFile(t, [][]byte{testTIFF(t, testExif("Acme"))}, nil), jseg.COM, []byte("comment"))
+	comment := func(text string) jseg.Segment {
+		return jseg.Segment{Marker: jseg.COM, Data: []byte(text)}
+	}
+	tests := []struct {
+		name     string
+		replace  func(jseg.Marker, []byte) []jseg.Segment
+		comments []string // Expected comments in the output.
+	}{
+		{"unchanged", nil, []string{"comment"}},
+		{"delete", func(marker jseg.Marker, payload []byte) []jseg.Segment {
+			if marker == jseg.COM {
+				return nil
+			}
+			return []jseg.Segment{{Marker: marker, Data: payload}}
+		}, nil},
+		{"insert", func(marker jseg.Marker, payload []byte) []jseg.Segment {
+			if marker == jseg.COM {
+				return []jseg.Segment{comment("first"), {Marker: marker, Data: payload}, comment("last")}
+			}
+			return []jseg.Segment{{Marker: marker, Data: payload}}
+		}, []string{"first", "comment", "last"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := testSegmentRecorder{replace: test.replace}
+			var exifSeen bool
+			replace := r.replace
+			r.replace = func(marker jseg.Marker, payload []byte) []jseg.Segment {
+				// The Exif callback runs before the segment callback.
+				if marker == jseg.APP0+1 && isExifSegment(payload) && bytes.Contains(payload, []byte("0123456789abcdef")) {
+					exifSeen = true
+				}
+				if replace == nil {
+					return []jseg.Segment{{Marker: marker, Data: payload}}
+				}
+				return replace(marker, payload)
+			}
+			out, err := testReadWrite(t, file, ReadWriteControl{ReadWriteSegment: &r, ReadWriteExif: testGrowExif})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !exifSeen {
+				t.Error("modified Exif segment not passed to the callback")
+			}
+			var comments []string
+			for _, seg := range testSegments(t, out) {
+				if seg.Marker == jseg.COM {
+					comments = append(comments, string(seg.Data))
+				}
+			}
+			if len(comments) != len(test.comments) {
+				t.Fatalf("comments %q, expected %q", comments, test.comments)
+			}
+			for i := range comments {
+				if comments[i] != test.comments[i] {
+					t.Errorf("comments %q, expected %q", comments, test.comments)
+				}
+			}
+		})
+	}
+	stop := errors.New("stop")
+	if _, err := testReadWrite(t, file, ReadWriteControl{ReadWriteSegment: &testSegmentRecorder{err: stop}}); err != stop {
+		t.Errorf("error %v", err)
+	}
+}
+
+// Trailer callback that records the trailer.
+type testTrailerRecorder struct {
+	calls   int
+	trailer []byte
+}
+
+func (r *testTrailerRecorder) ReadTrailer(format FileFormat, trailer []byte) error {
+	r.calls++
+	r.trailer = append([]byte{}, trailer...)
+	return nil
+}
+
+func TestReadTrailer(t *testing.T) {
+	trailer := []byte("trailer data")
+	tests := []struct {
+		name    string
+		file    []byte
+		trailer []byte // Expected trailer, or nil if not called.
+	}{
+		{"JPEG", testJPEGFile(t, nil, trailer), trailer},
+		{"no trailer", testJPEGFile(t, nil, nil), nil},
+		{"MPF", append(testMPF(t), trailer...), trailer},
+		{"MPF without trailer", testMPF(t), nil},
+		// Bytes that look like an EOI marker, to be found by
+		// scanning rather than searching.
+		{"EOI in trailer", testJPEGFile(t, nil, []byte{0xFF, 0xD9, 1}), []byte{0xFF, 0xD9, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var r testTrailerRecorder
+			if err := Read(bytes.NewReader(test.file), ReadControl{ReadTrailer: &r}); err != nil {
+				t.Fatal(err)
+			}
+			if test.trailer == nil {
+				if r.calls != 0 {
+					t.Errorf("trailer %q", r.trailer)
+				}
+				return
+			}
+			if r.calls != 1 || !bytes.Equal(r.trailer, test.trailer) {
+				t.Errorf("%d calls, trailer %q", r.calls, r.trailer)
+			}
+		})
+	}
+}
+
+func TestReadWriteTrailer(t *testing.T) {
+	trailer := []byte("trailer data")
+	replace := testTrailerFunc(func([]byte) []byte { return []byte("new") })
+	tests := []struct {
+		name     string
+		file     []byte
+		callback ReadWriteTrailer
+		trailer  []byte // Expected trailer in the output.
+	}{
+		{"no callback", testJPEGFile(t, nil, trailer), nil, trailer},
+		{"unchanged", testJPEGFile(t, nil, trailer), testTrailerFunc(func(b []byte) []byte { return b }), trailer},
+		{"replaced", testJPEGFile(t, nil, trailer), replace, []byte("new")},
+		{"removed", testJPEGFile(t, nil, trailer), testTrailerFunc(func([]byte) []byte { return nil }), nil},
+		{"created", testJPEGFile(t, nil, nil), replace, []byte("new")},
+		{"MPF no callback", append(testMPF(t), trailer...), nil, trailer},
+		{"MPF replaced", append(testMPF(t), trailer...), replace, []byte("new")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := testReadWrite(t, test.file, ReadWriteControl{ReadWriteTrailer: test.callback})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r testTrailerRecorder
+			if err := Read(bytes.NewReader(out), ReadControl{ReadTrailer: &r}); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(r.trailer, test.trailer) {
+				t.Errorf("trailer %q, expected %q", r.trailer, test.trailer)
+			}
+			if images, err := SplitMPF(bytes.NewReader(out)); err == nil && len(images) != 2 {
+				t.Errorf("%d MPF images", len(images))
+			}
+		})
+	}
+}
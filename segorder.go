@@ -0,0 +1,96 @@
+package exif44
+
+import (
+	jseg "github.com/garyhouston/jpegsegs"
+	"io"
+	"sort"
+)
+
+// Normalisation of the order of the segments preceding the image data
+// in a JPEG image. The standard order is JFIF APP0, Exif APP1, XMP
+// APP1, ICC APP2, MPF APP2, then other APPn segments by marker, then
+// the remaining segments such as quantization and Huffman tables and
+// the frame header, in their original order.
+
+// Return the position of a segment in the standard order. Segments
+// of equal rank keep their original order.
+func segmentRank(marker jseg.Marker, buf []byte) int {
+	switch {
+	case marker == jseg.APP0 && isAnyJFIFSegment(buf):
+		return 0
+	case marker == jseg.APP0+1 && isExifSegment(buf):
+		return 1
+	case marker == jseg.APP0+1 && isAnyXMPSegment(buf):
+		return 2
+	case marker == jseg.APP0+2 && IsICCSegment(buf):
+		return 3
+	case marker == jseg.APP0+2 && isMPFSegment(buf):
+		return 4
+	case marker >= jseg.APP0 && marker <= jseg.APP0+15:
+		return 5 + int(marker-jseg.APP0)
+	}
+	return 21
+}
+
+func isExifSegment(buf []byte) bool {
+	isExif, _ := GetHeader(buf)
+	return isExif
+}
+
+func isMPFSegment(buf []byte) bool {
+	isMPF, _ := jseg.GetMPFHeader(buf)
+	return isMPF
+}
+
+// A segment held back for reordering, with the reader position
+// following the input segment it derives from.
+type pendingSegment struct {
+	marker  jseg.Marker
+	data    []byte
+	readPos int64
+}
+
+// Segments collected while writing the metadata of a JPEG image,
+// which are written in the standard order when the image data is
+// reached.
+type segmentOrder struct {
+	segments []pendingSegment
+}
+
+// Hold back a copy of a segment, since the scanner reuses its buffer.
+// The reader is positioned following the input segment.
+func (o *segmentOrder) add(reader io.Seeker, marker jseg.Marker, data []byte) error {
+	pos, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	o.segments = append(o.segments, pendingSegment{marker: marker, data: append([]byte{}, data...), readPos: pos})
+	return nil
+}
+
+// Write the held segments in the standard order. The reader is
+// temporarily returned to each segment's input position while it's
+// written, since MPF processing depends on it.
+func (o *segmentOrder) flush(reader io.ReadSeeker, write func(marker jseg.Marker, buf []byte) error) error {
+	if len(o.segments) == 0 {
+		return nil
+	}
+	sort.SliceStable(o.segments, func(i, j int) bool {
+		return segmentRank(o.segments[i].marker, o.segments[i].data) < segmentRank(o.segments[j].marker, o.segments[j].data)
+	})
+	readerSave, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	for _, seg := range o.segments {
+		if _, err := reader.Seek(seg.readPos, io.SeekStart); err != nil {
+			return err
+		}
+		if err := write(seg.marker, seg.data); err != nil {
+			return err
+		}
+	}
+	o.segments = nil
+	_, err = reader.Seek(readerSave, io.SeekStart)
+	return err
+}
@@ -0,0 +1,120 @@
+package exif44
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	jseg "github.com/garyhouston/jpegsegs"
+)
+
+// Return the markers of a JPEG file's metadata segments, named by
+// their kind, and of the other segments before the SOS marker.
+func testSegmentKinds(t *testing.T, file []byte) []string {
+	var kinds []string
+	for _, seg := range testSegments(t, file) {
+		kind := fmt.Sprintf("%X", seg.Marker)
+		switch {
+		case seg.Marker == jseg.APP0 && isAnyJFIFSegment(seg.Data):
+			kind = "JFIF"
+		case seg.Marker == jseg.APP0+1 && isExifSegment(seg.Data):
+			kind = "Exif"
+		case seg.Marker == jseg.APP0+1 && isAnyXMPSegment(seg.Data):
+			kind = "XMP"
+		case seg.Marker == jseg.APP0+2 && IsICCSegment(seg.Data):
+			kind = "ICC"
+		case seg.Marker == jseg.APP0+2 && isMPFSegment(seg.Data):
+			kind = "MPF"
+		case seg.Marker == jseg.APP0+13:
+			kind = "APP13"
+		case seg.Marker == jseg.COM:
+			kind = "COM"
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds
+}
+
+func TestNormalizeSegments(t *testing.T) {
+	var meta XMPMeta
+	meta.Set(XMPText(NSxmp, "Rating", "3"))
+	xmp := append(append([]byte{}, xmpHeader...), meta.Packet(0)...)
+	jumble := func(file []byte) []byte {
+		// Each segment is inserted before the previous one.
+		file = testInsertSegment(file, jseg.APP0, testJFIFSegment)
+		file = testInsertSegment(file, jseg.APP0+2, testICCSegment(1, 1, testICCProfile()))
+		file = testInsertSegment(file, jseg.APP0+1, xmp)
+		file = testInsertSegment(file, jseg.APP0+13, testIPTCSegment(t, nil))
+		return testInsertSegment(file, jseg.COM, []byte("comment"))
+	}
+	plain := jumble(testJPEGFile(t, [][]byte{testTIFF(t, testExif("Acme"))}, nil))
+	// The segments are inserted in the primary image, before the
+	// MPF segment, so the MPF offsets remain valid.
+	mpf := jumble(testMPF(t))
+	tests := []struct {
+		name      string
+		file      []byte
+		normalize bool
+		metadata  []string // Expected metadata segments.
+	}{
+		{"unchanged", plain, false, []string{"COM", "APP13", "XMP", "ICC", "JFIF", "Exif"}},
+		{"normalized", plain, true, []string{"JFIF", "Exif", "XMP", "ICC", "APP13", "COM"}},
+		{"MPF", mpf, true, []string{"JFIF", "Exif", "XMP", "ICC", "MPF", "APP13", "COM"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := testReadWrite(t, test.file, ReadWriteControl{NormalizeSegments: test.normalize})
+			if err != nil {
+				t.Fatal(err)
+			}
+			in := testSegmentKinds(t, test.file)
+			kinds := testSegmentKinds(t, out)
+			if len(kinds) != len(in) {
+				t.Fatalf("segments %v, expected the same number as %v", kinds, in)
+			}
+			got := fmt.Sprint(kinds[:len(test.metadata)])
+			if want := fmt.Sprint(test.metadata); got != want {
+				t.Errorf("metadata segments %s, expected %s", got, want)
+			}
+			// The other segments keep their order.
+			if got, want := fmt.Sprint(kinds[len(test.metadata):]), fmt.Sprint(in[len(test.metadata):]); got != want {
+				t.Errorf("segments %s, expected %s", got, want)
+			}
+			if images, err := SplitMPF(bytes.NewReader(out)); err == nil && len(images) != 2 {
+				t.Errorf("%d MPF images", len(images))
+			} else if err != nil && test.name == "MPF" {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCreatedSegmentOrder(t *testing.T) {
+	icc := testInsertSegment(testJPEG(t, 8, 8), jseg.APP0+2, testICCSegment(1, 1, testICCProfile()))
+	tests := []struct {
+		name     string
+		file     []byte
+		metadata []string // Expected metadata segments.
+	}{
+		{"ICC first", icc, []string{"Exif", "ICC"}},
+		{"JFIF and ICC", testInsertSegment(icc, jseg.APP0, testJFIFSegment), []string{"JFIF", "Exif", "ICC"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The Exif segment is created before the
+			// replaced ICC segment.
+			control := ReadWriteControl{ExifRequired: testExifRequired{}, ReadWriteICC: testICCFunc(func(*ICCProfile) {})}
+			out, err := testReadWrite(t, test.file, control)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kinds := testSegmentKinds(t, out)
+			if len(kinds) < len(test.metadata) {
+				t.Fatalf("segments %v", kinds)
+			}
+			if got, want := fmt.Sprint(kinds[:len(test.metadata)]), fmt.Sprint(test.metadata); got != want {
+				t.Errorf("metadata segments %s, expected %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package exif44
+
+import (
+	"encoding/binary"
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+)
+
+// Support for rewriting JPEG files with Sony maker notes whose
+// PreviewImage field is too large for the Exif segment. The preview
+// is then stored after the end of the JPEG image, or as a following
+// image of an MPF file, and is located by an offset from the TIFF
+// header of the Exif segment.
+
+// Size of the Sony1 maker note labels, which precede the IFD.
+const sony1LabelSize = 12
+
+// Return the PreviewImage field of a Sony1 maker note, if its data
+// lies outside the Exif data that was read. In that case, tiff66
+// replaces the field's data with its original count and offset, as
+// two LONGs in the maker note's byte order.
+func sonyPreviewImage(exif Exif) *tiff.Field {
+	if exif.MakerNote == nil || exif.MakerNote.GetSpace() != tiff.Sony1Space {
+		return nil
+	}
+	field := findField(exif.MakerNote, Sony1PreviewImage)
+	if field == nil || field.Type != tiff.UNDEFINED || field.Count != 8 || jseg.IsJPEGHeader(field.Data) {
+		return nil
+	}
+	return field
+}
+
+// Return the length and offset of a Sony preview image.
+func sonyOutsidePreview(exif Exif) (uint32, uint32, bool) {
+	field := sonyPreviewImage(exif)
+	if field == nil {
+		return 0, 0, false
+	}
+	order := exif.MakerNote.Order
+	return order.Uint32(field.Data), order.Uint32(field.Data[4:]), true
+}
+
+// Return the positions of the count and offset of a Sony preview image
+// in TIFF data. The Sony1 maker note's offsets are relative to the
+// TIFF header. The count and offset in the field's entry are restored;
+// the data written for the field is unused.
+func sonyPreviewFields(tiffData []byte, order binary.ByteOrder, makerPos uint32) (uint32, uint32, bool) {
+	pos, found := fieldEntryPos(tiffData, order, makerPos+sony1LabelSize, Sony1PreviewImage)
+	if !found {
+		return 0, 0, false
+	}
+	return pos + 4, pos + 8, true
+}
@@ -0,0 +1,229 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	jseg "github.com/garyhouston/jpegsegs"
+	tiff "github.com/garyhouston/tiff66"
+	"image"
+	"image/color"
+	"image/jpeg"
+)
+
+// Support for the thumbnail in IFD1 of a JPEG file's Exif data. A
+// JPEG thumbnail is located by the JPEGInterchangeFormat and
+// JPEGInterchangeFormatLength fields, and an uncompressed thumbnail
+// by the StripOffsets and StripByteCounts fields.
+
+// Standard size of Exif thumbnails.
+const (
+	ThumbnailWidth  = 160
+	ThumbnailHeight = 120
+)
+
+// Return the image data of a JPEG thumbnail in an IFD, or nil if not
+// found.
+func thumbnailImageData(node *tiff.IFDNode) *tiff.ImageData {
+	if node == nil {
+		return nil
+	}
+	imageData := node.GetImageData()
+	for i := range imageData {
+		if imageData[i].OffsetTag == tiff.JPEGInterchangeFormat && len(imageData[i].Segments) == 1 {
+			return &imageData[i]
+		}
+	}
+	return nil
+}
+
+// Return the JPEG thumbnail from IFD1 of an Exif tree, or nil if not
+// found.
+func getThumbnail(exif Exif) []byte {
+	if exif.TIFF == nil {
+		return nil
+	}
+	if imageData := thumbnailImageData(exif.TIFF.Next); imageData != nil {
+		return imageData.Segments[0]
+	}
+	return nil
+}
+
+// Return the thumbnail from IFD1 of an Exif tree, and whether it's a
+// JPEG image. For an uncompressed thumbnail, the data from its strips
+// is concatenated. The data is nil if there's no thumbnail.
+func (exif Exif) Thumbnail() ([]byte, bool) {
+	if thumbnail := getThumbnail(exif); thumbnail != nil {
+		return thumbnail, true
+	}
+	if exif.TIFF == nil || exif.TIFF.Next == nil {
+		return nil, false
+	}
+	imageData := exif.TIFF.Next.GetImageData()
+	for i := range imageData {
+		if imageData[i].OffsetTag == tiff.StripOffsets {
+			var data []byte
+			for _, segment := range imageData[i].Segments {
+				data = append(data, segment...)
+			}
+			return data, false
+		}
+	}
+	return nil, false
+}
+
+// Replace the thumbnail in IFD1 of an Exif tree with a JPEG image.
+// An existing JPEG thumbnail is replaced in place and its length
+// updated; otherwise, including when the thumbnail is uncompressed,
+// IFD1 is replaced by a new one.
+func (exif *Exif) SetThumbnail(thumbnail []byte) error {
+	if !jseg.IsJPEGHeader(thumbnail) {
+		return errors.New("Thumbnail isn't a JPEG image")
+	}
+	if exif.TIFF == nil {
+		return errors.New("Exif tree has no IFD0")
+	}
+	if getThumbnail(*exif) != nil {
+		return setThumbnail(*exif, thumbnail)
+	}
+	ifd1, err := makeThumbnailIFD(thumbnail, exif.TIFF.Order)
+	if err != nil {
+		return err
+	}
+	exif.TIFF.Next = ifd1
+	return nil
+}
+
+// Remove IFD1 and its thumbnail from an Exif tree.
+func (exif *Exif) DeleteThumbnail() {
+	if exif.TIFF != nil {
+		exif.TIFF.Next = nil
+	}
+}
+
+// Create an IFD1 node containing a JPEG thumbnail. The node is
+// serialized and decoded again, so that its image data is set as for
+// trees read from TIFF data.
+func makeThumbnailIFD(thumbnail []byte, order binary.ByteOrder) (*tiff.IFDNode, error) {
+	node := tiff.NewIFDNode(tiff.TIFFSpace)
+	node.Order = order
+	resolution := make([]byte, 8)
+	order.PutUint32(resolution, 72)
+	order.PutUint32(resolution[4:], 1)
+	// Thumbnail offset will be set below.
+	node.AddFields([]tiff.Field{
+		integerField(tiff.Compression, tiff.SHORT, 6, order),
+		{Tag: tiff.XResolution, Type: tiff.RATIONAL, Count: 1, Data: resolution},
+		{Tag: tiff.YResolution, Type: tiff.RATIONAL, Count: 1, Data: resolution},
+		integerField(tiff.ResolutionUnit, tiff.SHORT, 2, order),
+		integerField(tiff.JPEGInterchangeFormat, tiff.LONG, 0, order),
+		integerField(tiff.JPEGInterchangeFormatLength, tiff.LONG, int64(len(thumbnail)), order)})
+	size := tiff.HeaderSize + node.TreeSize()
+	node.FindFields([]tiff.Tag{tiff.JPEGInterchangeFormat})[0].PutLong(size, 0, order)
+	buf := make([]byte, size+uint32(len(thumbnail)))
+	tiff.PutHeader(buf, order, tiff.HeaderSize)
+	if _, err := node.PutIFDTree(buf, tiff.HeaderSize); err != nil {
+		return nil, err
+	}
+	copy(buf[size:], thumbnail)
+	return tiff.GetIFDTree(buf, order, tiff.HeaderSize, tiff.TIFFSpace)
+}
+
+// Replace the JPEG thumbnail in IFD1 of an Exif tree, which must
+// already have one.
+func setThumbnail(exif Exif, thumbnail []byte) error {
+	if exif.TIFF == nil {
+		return errors.New("Exif tree has no thumbnail")
+	}
+	ifd1 := exif.TIFF.Next
+	imageData := thumbnailImageData(ifd1)
+	if imageData == nil {
+		return errors.New("Exif tree has no thumbnail")
+	}
+	imageData.Segments[0] = thumbnail
+	length := make([]byte, 4)
+	ifd1.Order.PutUint32(length, uint32(len(thumbnail)))
+	ifd1.DeleteFields([]tiff.Tag{tiff.JPEGInterchangeFormatLength})
+	ifd1.AddFields([]tiff.Field{{Tag: tiff.JPEGInterchangeFormatLength, Type: tiff.LONG, Count: 1, Data: length}})
+	return nil
+}
+
+// Smallest thumbnail dimension that shrinkJPEG will produce.
+const minThumbnailSize = 16
+
+// Return a JPEG image at half the width and height of the original,
+// or nil if it's already too small to be reduced.
+func shrinkJPEG(data []byte) ([]byte, error) {
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	bounds := src.Bounds()
+	width, height := bounds.Dx()/2, bounds.Dy()/2
+	if width < minThumbnailSize || height < minThumbnailSize {
+		return nil, nil
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// Average each 2x2 block of pixels.
+			var r, g, b uint32
+			for _, p := range []image.Point{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				pr, pg, pb, _ := src.At(bounds.Min.X+2*x+p.X, bounds.Min.Y+2*y+p.Y).RGBA()
+				r, g, b = r+pr, g+pg, b+pb
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r >> 10), G: uint8(g >> 10), B: uint8(b >> 10), A: 0xFF})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 75}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Return a JPEG thumbnail of an image, such as a decoded primary
+// image, scaled to fit within the standard thumbnail size while
+// keeping its aspect ratio. Each thumbnail pixel is the average of
+// the image pixels it covers.
+func MakeThumbnail(src image.Image) ([]byte, error) {
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	if srcWidth == 0 || srcHeight == 0 {
+		return nil, errors.New("Image is empty")
+	}
+	width, height := srcWidth, srcHeight
+	if width > ThumbnailWidth || height > ThumbnailHeight {
+		if width*ThumbnailHeight > height*ThumbnailWidth {
+			width, height = ThumbnailWidth, srcHeight*ThumbnailWidth/srcWidth
+		} else {
+			width, height = srcWidth*ThumbnailHeight/srcHeight, ThumbnailHeight
+		}
+		if width == 0 {
+			width = 1
+		}
+		if height == 0 {
+			height = 1
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcHeight/height, (y+1)*srcHeight/height
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcWidth/width, (x+1)*srcWidth/width
+			var r, g, b, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, _ := src.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(b / n >> 8), A: 0xFF})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 75}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,142 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+
+	tiff "github.com/garyhouston/tiff66"
+)
+
+func TestMakeThumbnail(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		thumbWidth    int // Expected thumbnail width, or 0 for an error.
+		thumbHeight   int
+	}{
+		{"landscape", 640, 480, 160, 120},
+		{"portrait", 480, 640, 90, 120},
+		{"wide", 1000, 100, 160, 16},
+		{"small", 100, 50, 100, 50},
+		{"very wide", 10000, 1, 160, 1},
+		{"empty", 0, 0, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			thumbnail, err := MakeThumbnail(image.NewGray(image.Rect(10, 10, 10+test.width, 10+test.height)))
+			if test.thumbWidth == 0 {
+				if err == nil {
+					t.Error("empty image accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			config, err := jpeg.DecodeConfig(bytes.NewReader(thumbnail))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Width != test.thumbWidth || config.Height != test.thumbHeight {
+				t.Errorf("thumbnail is %dx%d", config.Width, config.Height)
+			}
+		})
+	}
+}
+
+// Return big-endian TIFF data with an uncompressed thumbnail in IFD1.
+func testStripThumbnailTIFF() []byte {
+	order := binary.BigEndian
+	ifd0 := testRawIFD(8, []testEntry{{tiff.Make, tiff.ASCII, 5, []byte("Acme\000")}})
+	ifd0 = append(ifd0, 0)
+	ifd1Pos := uint32(8 + len(ifd0))
+	order.PutUint32(ifd0[tiff.TableSize(1)-4:], ifd1Pos)
+	offset := make([]byte, 4)
+	order.PutUint32(offset, ifd1Pos+tiff.TableSize(3))
+	ifd1 := testRawIFD(ifd1Pos, []testEntry{
+		{tiff.Compression, tiff.SHORT, 1, []byte{0, 1}},
+		{tiff.StripOffsets, tiff.LONG, 1, offset},
+		{tiff.StripByteCounts, tiff.LONG, 1, []byte{0, 0, 0, 4}},
+	})
+	buf := []byte("MM\000\052\000\000\000\010")
+	buf = append(append(buf, ifd0...), ifd1...)
+	return append(buf, "RGBA"...)
+}
+
+func TestSetThumbnail(t *testing.T) {
+	small, large := testJPEG(t, 16, 16), testJPEG(t, 64, 48)
+	withThumbnail := testExif("Acme")
+	if err := withThumbnail.SetThumbnail(small); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		tiff  []byte
+		start []byte // Thumbnail before it's replaced.
+		jpeg  bool
+	}{
+		{"none", testTIFF(t, testExif("Acme")), nil, false},
+		{"JPEG", testTIFF(t, withThumbnail), small, true},
+		{"uncompressed", testStripThumbnailTIFF(), []byte("RGBA"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exif, err := GetExifTree(test.tiff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, isJPEG := exif.Thumbnail(); !bytes.Equal(data, test.start) || isJPEG != test.jpeg {
+				t.Errorf("thumbnail %q, JPEG %v", data, isJPEG)
+			}
+			if err := exif.SetThumbnail([]byte("not a JPEG")); err == nil {
+				t.Error("invalid thumbnail accepted")
+			}
+			if err := exif.SetThumbnail(large); err != nil {
+				t.Fatal(err)
+			}
+			// The new thumbnail survives serialization.
+			exif, err = GetExifTree(testTIFF(t, exif))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, isJPEG := exif.Thumbnail(); !bytes.Equal(data, large) || !isJPEG {
+				t.Error("thumbnail not replaced")
+			}
+			length := findField(exif.TIFF.Next, tiff.JPEGInterchangeFormatLength)
+			if length == nil || length.AnyInteger(0, exif.TIFF.Order) != int64(len(large)) {
+				t.Error("thumbnail length not updated")
+			}
+			if findField(exif.TIFF.Next, tiff.StripOffsets) != nil {
+				t.Error("strips not removed")
+			}
+			exif.DeleteThumbnail()
+			if data, _ := exif.Thumbnail(); data != nil {
+				t.Error("thumbnail not deleted")
+			}
+		})
+	}
+}
+
+func TestReadWriteThumbnail(t *testing.T) {
+	thumbnail := testJPEG(t, 32, 24)
+	in := testJPEGFile(t, [][]byte{testTIFF(t, testExif("Acme"))}, nil)
+	set := testExifFunc(func(exif *Exif) {
+		if err := exif.SetThumbnail(thumbnail); err != nil {
+			t.Fatal(err)
+		}
+	})
+	out, err := testReadWrite(t, in, ReadWriteControl{ReadWriteExif: set})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exif, err := GetExifTree(testJPEGTIFF(t, out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, isJPEG := exif.Thumbnail(); !bytes.Equal(data, thumbnail) || !isJPEG {
+		t.Error("thumbnail not written")
+	}
+}
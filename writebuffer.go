@@ -0,0 +1,54 @@
+package exif44
+
+import (
+	"errors"
+	"io"
+)
+
+// WriteBuffer is an in-memory io.WriteSeeker, which can be used as
+// the output of ReadWrite when the result needs further processing,
+// e.g., when a JPEG stream is embedded in another file format.
+type WriteBuffer struct {
+	buf []byte
+	pos int64
+}
+
+func (wb *WriteBuffer) Write(p []byte) (int, error) {
+	end := wb.pos + int64(len(p))
+	if end > int64(len(wb.buf)) {
+		if end > int64(cap(wb.buf)) {
+			newbuf := make([]byte, end, 2*end)
+			copy(newbuf, wb.buf)
+			wb.buf = newbuf
+		} else {
+			wb.buf = wb.buf[:end]
+		}
+	}
+	copy(wb.buf[wb.pos:], p)
+	wb.pos = end
+	return len(p), nil
+}
+
+func (wb *WriteBuffer) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = wb.pos + offset
+	case io.SeekEnd:
+		pos = int64(len(wb.buf)) + offset
+	default:
+		return 0, errors.New("WriteBuffer.Seek: invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("WriteBuffer.Seek: negative position")
+	}
+	wb.pos = pos
+	return pos, nil
+}
+
+// Bytes returns the data written to the buffer.
+func (wb *WriteBuffer) Bytes() []byte {
+	return wb.buf
+}
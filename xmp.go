@@ -0,0 +1,341 @@
+package exif44
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"sort"
+)
+
+// Support for XMP in JPEG files. The main XMP packet is stored in an
+// APP1 segment with its own header. If it's too large for a single
+// segment, some of the properties may be moved to an "extended" XMP
+// document, which is split over additional APP1 segments. The main
+// packet then has an xmpNote:HasExtendedXMP property giving the GUID
+// of the extended document, which is the MD5 digest of its
+// serialization.
+
+// Header at the start of an APP1 segment containing the main XMP
+// packet.
+var xmpHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+// Header at the start of an APP1 segment containing part of an
+// extended XMP document. It's followed by the GUID (32 hex digits),
+// the full length of the document and the offset of this part, both
+// big-endian 32 bit values.
+var xmpExtHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+
+// Size of the extended XMP header, up to the start of the data: the
+// 35 byte signature, GUID, length and offset.
+const xmpExtHeaderSize = 35 + 32 + 4 + 4
+
+// Maximum size of a JPEG segment's data, following the length field.
+const maxSegmentData = 65533
+
+// Maximum size of the main XMP packet, which must fit in a segment
+// after the 29 byte header.
+const maxXMPPacket = maxSegmentData - 29
+
+// Check if an APP1 segment contains the main XMP packet.
+func IsXMPSegment(buf []byte) bool {
+	return bytes.HasPrefix(buf, xmpHeader)
+}
+
+// Check if an APP1 segment contains part of an extended XMP document.
+func IsExtendedXMPSegment(buf []byte) bool {
+	return bytes.HasPrefix(buf, xmpExtHeader) && len(buf) >= xmpExtHeaderSize
+}
+
+// Check if an APP1 segment contains main or extended XMP.
+func isAnyXMPSegment(buf []byte) bool {
+	return IsXMPSegment(buf) || IsExtendedXMPSegment(buf)
+}
+
+// XMP data from a JPEG image.
+type XMP struct {
+	Packet   []byte // Main XMP packet, or nil if not present.
+	Extended []byte // Extended XMP document, or nil if not present.
+}
+
+// Return the GUID that identifies an extended XMP document.
+func ExtendedXMPGUID(extended []byte) string {
+	return fmt.Sprintf("%X", md5.Sum(extended))
+}
+
+// Decode the XMP packet and any extended XMP, returning the
+// properties from both. The xmpNote:HasExtendedXMP property is
+// removed. Properties will be read if possible even if errors occur,
+// and a multierror structure may be returned.
+func (xmp XMP) Meta() (*XMPMeta, error) {
+	var err error
+	if xmp.Packet == nil {
+		return &XMPMeta{Prefixes: make(map[string]string)}, nil
+	}
+	meta, packetErr := ParseXMP(xmp.Packet)
+	if packetErr != nil {
+		err = multierror.Append(err, packetErr)
+	}
+	meta.Delete(NSxmpNote, "HasExtendedXMP")
+	if xmp.Extended != nil {
+		ext, extErr := ParseXMP(xmp.Extended)
+		if extErr != nil {
+			err = multierror.Append(err, extErr)
+		}
+		for ns, prefix := range ext.Prefixes {
+			if _, found := meta.Prefixes[ns]; !found {
+				meta.Prefixes[ns] = prefix
+			}
+		}
+		for _, prop := range ext.Properties {
+			meta.Set(prop)
+		}
+	}
+	return meta, err
+}
+
+// Serialize XMP properties into the packet, discarding any extended
+// XMP. If the packet is too large, it will be split when written.
+func (xmp *XMP) SetMeta(meta *XMPMeta) {
+	xmp.Packet = meta.Packet(2048)
+	xmp.Extended = nil
+}
+
+// Split XMP properties into a main packet and an extended document,
+// moving the largest properties to the extended document until the
+// main packet fits in a segment.
+func splitXMP(meta *XMPMeta) (XMP, error) {
+	main := &XMPMeta{Prefixes: meta.Prefixes, Properties: append([]XMPProperty{}, meta.Properties...)}
+	ext := &XMPMeta{Prefixes: meta.Prefixes}
+	// Placeholder GUID of the correct size.
+	main.Set(XMPText(NSxmpNote, "HasExtendedXMP", ExtendedXMPGUID(nil)))
+	type candidate struct {
+		prop XMPProperty
+		size int
+	}
+	candidates := make([]candidate, 0, len(main.Properties))
+	for _, prop := range main.Properties {
+		if prop.NS != NSxmpNote || prop.Name != "HasExtendedXMP" {
+			single := XMPMeta{Prefixes: meta.Prefixes, Properties: []XMPProperty{prop}}
+			candidates = append(candidates, candidate{prop: prop, size: len(single.XMPMetaElement())})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].size > candidates[j].size
+	})
+	for _, c := range candidates {
+		if len(main.Packet(0)) <= maxXMPPacket {
+			break
+		}
+		main.Delete(c.prop.NS, c.prop.Name)
+		ext.Properties = append(ext.Properties, c.prop)
+	}
+	if len(main.Packet(0)) > maxXMPPacket {
+		return XMP{}, errors.New("XMP packet is too large even after moving properties to extended XMP")
+	}
+	extended := ext.XMPMetaElement()
+	main.Set(XMPText(NSxmpNote, "HasExtendedXMP", ExtendedXMPGUID(extended)))
+	// Use any remaining space for padding.
+	padding := maxXMPPacket - len(main.Packet(0))
+	if padding > 2048 {
+		padding = 2048
+	}
+	return XMP{Packet: main.Packet(padding), Extended: extended}, nil
+}
+
+// Return the APP1 segment data for XMP, splitting it into main and
+// extended parts if required.
+func makeXMPSegments(xmp XMP) ([][]byte, error) {
+	if xmp.Packet == nil {
+		if xmp.Extended != nil {
+			return nil, errors.New("Extended XMP without main XMP packet")
+		}
+		return nil, nil
+	}
+	if xmp.Extended != nil {
+		// Ensure that the main packet refers to the extended
+		// document.
+		guid := ExtendedXMPGUID(xmp.Extended)
+		if !bytes.Contains(xmp.Packet, []byte(guid)) {
+			meta, err := ParseXMP(xmp.Packet)
+			if err != nil {
+				return nil, err
+			}
+			meta.Set(XMPText(NSxmpNote, "HasExtendedXMP", guid))
+			xmp.Packet = meta.Packet(0)
+		}
+	}
+	if len(xmp.Packet) > maxXMPPacket {
+		meta, err := xmp.Meta()
+		if err != nil {
+			return nil, err
+		}
+		if xmp, err = splitXMP(meta); err != nil {
+			return nil, err
+		}
+	}
+	segments := [][]byte{append(append([]byte{}, xmpHeader...), xmp.Packet...)}
+	if xmp.Extended != nil {
+		guid := []byte(ExtendedXMPGUID(xmp.Extended))
+		length := uint32(len(xmp.Extended))
+		chunkSize := uint32(maxSegmentData - xmpExtHeaderSize)
+		for offset := uint32(0); offset < length; offset += chunkSize {
+			end := offset + chunkSize
+			if end > length {
+				end = length
+			}
+			buf := make([]byte, xmpExtHeaderSize+int(end-offset))
+			pos := copy(buf, xmpExtHeader)
+			pos += copy(buf[pos:], guid)
+			binary.BigEndian.PutUint32(buf[pos:], length)
+			binary.BigEndian.PutUint32(buf[pos+4:], offset)
+			copy(buf[pos+8:], xmp.Extended[offset:end])
+			segments = append(segments, buf)
+		}
+	}
+	return segments, nil
+}
+
+// Part of an extended XMP document, being reassembled. The length is
+// taken from the segments and can't be trusted, so the document is
+// only allocated once all of its parts are found.
+type xmpExtension struct {
+	length uint32
+	chunks map[uint32][]byte // Data by offset.
+}
+
+// Return the reassembled document, or nil if any parts are missing or
+// overlap.
+func (ext *xmpExtension) assemble() []byte {
+	offsets := make([]uint32, 0, len(ext.chunks))
+	for offset := range ext.chunks {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	end := uint32(0)
+	for _, offset := range offsets {
+		if offset != end {
+			return nil
+		}
+		end += uint32(len(ext.chunks[offset]))
+	}
+	if end != ext.length {
+		return nil
+	}
+	data := make([]byte, 0, ext.length)
+	for _, offset := range offsets {
+		data = append(data, ext.chunks[offset]...)
+	}
+	return data
+}
+
+// Collects the XMP segments in a JPEG image.
+type xmpCollector struct {
+	found      bool // True if any XMP segments were found.
+	packet     []byte
+	extensions map[string]*xmpExtension
+	err        error
+}
+
+// Add an APP1 segment to the collection if it contains XMP. Returns
+// true if it did.
+func (c *xmpCollector) add(buf []byte) bool {
+	if IsXMPSegment(buf) {
+		c.found = true
+		if c.packet != nil {
+			c.err = multierror.Append(c.err, errors.New("Multiple XMP segments, ignoring all but the first"))
+			return true
+		}
+		c.packet = append([]byte{}, buf[len(xmpHeader):]...)
+		return true
+	}
+	if !IsExtendedXMPSegment(buf) {
+		return false
+	}
+	c.found = true
+	pos := len(xmpExtHeader)
+	guid := string(buf[pos : pos+32])
+	length := binary.BigEndian.Uint32(buf[pos+32:])
+	offset := binary.BigEndian.Uint32(buf[pos+36:])
+	data := buf[xmpExtHeaderSize:]
+	if c.extensions == nil {
+		c.extensions = make(map[string]*xmpExtension)
+	}
+	ext := c.extensions[guid]
+	if ext == nil {
+		ext = &xmpExtension{length: length, chunks: make(map[uint32][]byte)}
+		c.extensions[guid] = ext
+	}
+	end := offset + uint32(len(data))
+	if ext.length != length || end < offset || end > length {
+		c.err = multierror.Append(c.err, fmt.Errorf("Extended XMP segment for %s at offset %d is inconsistent", guid, offset))
+		return true
+	}
+	if _, dup := ext.chunks[offset]; dup {
+		c.err = multierror.Append(c.err, fmt.Errorf("Duplicate extended XMP segment for %s at offset %d", guid, offset))
+		return true
+	}
+	ext.chunks[offset] = append([]byte{}, data...)
+	return true
+}
+
+// Return the collected XMP. Extended XMP is only included if the
+// main packet refers to it and all of its parts were found.
+func (c *xmpCollector) result() (XMP, error) {
+	xmp := XMP{Packet: c.packet}
+	err := c.err
+	if c.packet == nil {
+		if c.extensions != nil {
+			err = multierror.Append(err, errors.New("Extended XMP without main XMP packet"))
+		}
+		return xmp, err
+	}
+	var guid string
+	if c.extensions != nil {
+		meta, _ := ParseXMP(c.packet)
+		if prop := meta.Get(NSxmpNote, "HasExtendedXMP"); prop != nil {
+			guid = prop.Value
+		}
+	}
+	for id, ext := range c.extensions {
+		if id != guid {
+			err = multierror.Append(err, fmt.Errorf("Ignoring extended XMP %s that isn't referenced by main packet", id))
+			continue
+		}
+		data := ext.assemble()
+		if data == nil {
+			err = multierror.Append(err, fmt.Errorf("Extended XMP %s is incomplete", id))
+			continue
+		}
+		xmp.Extended = data
+	}
+	return xmp, err
+}
+
+type ReadXMP interface {
+	// Callback for processing XMP data, read-only. For JPEG
+	// files, it will be called once for each image that contains
+	// XMP, after all metadata segments of the image have been
+	// read. Any extended XMP will have been reassembled. Any
+	// errors from decoding the segments will be available in err,
+	// which may be a multierror structure. Returning a non-nil
+	// error will terminate processing.
+	ReadXMP(format FileFormat, imageIdx uint32, xmp XMP, err error) error
+}
+
+type ReadWriteXMP interface {
+	// Callback for processing XMP data, read-write. For JPEG
+	// files, it will be called once for each image, with an
+	// empty XMP structure if the image has no XMP. Setting Packet
+	// to nil will delete the XMP, or setting it on an empty
+	// structure will create it. The XMP segments will be written
+	// where the first XMP segment was found, or otherwise after
+	// any JFIF and Exif segments. A packet that's too large for a
+	// segment will be split into main and extended XMP. Any
+	// errors from decoding the segments will be available in err,
+	// which may be a multierror structure. Returning a non-nil
+	// error will terminate processing.
+	ReadWriteXMP(format FileFormat, imageIdx uint32, xmp *XMP, err error) error
+}
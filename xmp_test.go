@@ -0,0 +1,102 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Return an extended XMP segment.
+func testExtendedXMPSegment(guid string, length, offset uint32, data []byte) []byte {
+	buf := append(append([]byte{}, xmpExtHeader...), guid...)
+	buf = append(buf, make([]byte, 8)...)
+	binary.BigEndian.PutUint32(buf[len(buf)-8:], length)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], offset)
+	return append(buf, data...)
+}
+
+func TestXMPCollector(t *testing.T) {
+	extended := bytes.Repeat([]byte("<x:extended/>"), 10)
+	guid := ExtendedXMPGUID(extended)
+	var meta XMPMeta
+	meta.Set(XMPText(NSxmpNote, "HasExtendedXMP", guid))
+	main := append(append([]byte{}, xmpHeader...), meta.Packet(0)...)
+	length := uint32(len(extended))
+	first := testExtendedXMPSegment(guid, length, 0, extended[:50])
+	second := testExtendedXMPSegment(guid, length, 50, extended[50:])
+	tests := []struct {
+		name     string
+		segments [][]byte
+		extended bool // Extended XMP is returned.
+		fail     bool
+	}{
+		{"main only", [][]byte{main}, false, false},
+		{"extended", [][]byte{main, first, second}, true, false},
+		{"reversed", [][]byte{second, first, main}, true, false},
+		{"missing part", [][]byte{main, second}, false, true},
+		{"duplicate part", [][]byte{main, first, first}, false, true},
+		{"duplicate complete", [][]byte{main, first, second, second}, true, true},
+		{"overlap", [][]byte{main, first, testExtendedXMPSegment(guid, length, 40, extended[40:])}, false, true},
+		{"huge length", [][]byte{main, testExtendedXMPSegment(guid, 0xFFFFFFFF, 0, extended)}, false, true},
+		{"inconsistent length", [][]byte{main, first, testExtendedXMPSegment(guid, length+1, 50, extended[50:])}, false, true},
+		{"past end", [][]byte{main, first, testExtendedXMPSegment(guid, length, 0xFFFFFFF0, extended[50:])}, false, true},
+		{"unreferenced", [][]byte{main, testExtendedXMPSegment(ExtendedXMPGUID(nil), length, 0, extended)}, false, true},
+		{"no main packet", [][]byte{first, second}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var c xmpCollector
+			for _, seg := range test.segments {
+				if !c.add(seg) {
+					t.Fatal("XMP segment not accepted")
+				}
+			}
+			xmp, err := c.result()
+			if (err != nil) != test.fail {
+				t.Errorf("error %v", err)
+			}
+			if test.extended && !bytes.Equal(xmp.Extended, extended) || !test.extended && xmp.Extended != nil {
+				t.Errorf("extended XMP %q", xmp.Extended)
+			}
+		})
+	}
+}
+
+func TestXMPSegments(t *testing.T) {
+	var meta XMPMeta
+	meta.Set(XMPText(NSxmp, "Rating", "3"))
+	packet := meta.Packet(0)
+	tests := []struct {
+		name string
+		xmp  XMP
+	}{
+		{"packet", XMP{Packet: packet}},
+		{"empty", XMP{}},
+		{"extended", XMP{Packet: packet, Extended: bytes.Repeat([]byte("x"), 2*maxSegmentData)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			segments, err := makeXMPSegments(test.xmp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var c xmpCollector
+			for _, seg := range segments {
+				if len(seg) > maxSegmentData {
+					t.Errorf("segment of %d bytes", len(seg))
+				}
+				c.add(seg)
+			}
+			xmp, err := c.result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(xmp.Extended, test.xmp.Extended) {
+				t.Errorf("extended XMP of %d bytes, expected %d", len(xmp.Extended), len(test.xmp.Extended))
+			}
+			if test.xmp.Packet == nil && xmp.Packet != nil {
+				t.Error("unexpected XMP packet")
+			}
+		})
+	}
+}
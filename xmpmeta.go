@@ -0,0 +1,475 @@
+package exif44
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// A simplified data model for XMP, sufficient for reading and
+// writing the usual properties. Properties are identified by
+// namespace URI and local name. Qualifiers other than xml:lang are
+// not supported.
+
+// Some XMP namespaces.
+const (
+	NSxmp       = "http://ns.adobe.com/xap/1.0/"
+	NSxmpNote   = "http://ns.adobe.com/xmp/note/"
+	NSxmpMM     = "http://ns.adobe.com/xap/1.0/mm/"
+	NSxmpRights = "http://ns.adobe.com/xap/1.0/rights/"
+	NSdc        = "http://purl.org/dc/elements/1.1/"
+	NSphotoshop = "http://ns.adobe.com/photoshop/1.0/"
+	NStiff      = "http://ns.adobe.com/tiff/1.0/"
+	NSexif      = "http://ns.adobe.com/exif/1.0/"
+	NSexifEX    = "http://cipa.jp/exif/1.0/"
+	NSaux       = "http://ns.adobe.com/exif/1.0/aux/"
+	NSrdf       = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	NSx         = "adobe:ns:meta/"
+	NSxml       = "http://www.w3.org/XML/1998/namespace"
+	NSGCamera   = "http://ns.google.com/photos/1.0/camera/"
+	NSContainer = "http://ns.google.com/photos/1.0/container/"
+	NSItem      = "http://ns.google.com/photos/1.0/container/item/"
+)
+
+// Preferred prefixes for well-known namespaces.
+var XMPPrefixes = map[string]string{
+	NSxmp:       "xmp",
+	NSxmpNote:   "xmpNote",
+	NSxmpMM:     "xmpMM",
+	NSxmpRights: "xmpRights",
+	NSdc:        "dc",
+	NSphotoshop: "photoshop",
+	NStiff:      "tiff",
+	NSexif:      "exif",
+	NSexifEX:    "exifEX",
+	NSaux:       "aux",
+	NSGCamera:   "GCamera",
+	NSContainer: "Container",
+	NSItem:      "Item",
+}
+
+// Kind of an XMP property value.
+type XMPKind uint8
+
+const (
+	XMPSimple XMPKind = iota // Simple text value.
+	XMPStruct                // Structure, with fields in Items.
+	XMPBag                   // Unordered array.
+	XMPSeq                   // Ordered array.
+	XMPAlt                   // Array of alternatives, e.g., languages.
+)
+
+// An XMP property, which may be simple, a structure or an array.
+type XMPProperty struct {
+	NS    string        // Namespace URI; empty for array items.
+	Name  string        // Local name; empty for array items.
+	Kind  XMPKind       // Kind of value.
+	Value string        // Value of a simple property or array item.
+	Lang  string        // xml:lang qualifier, if any.
+	Items []XMPProperty // Array items or structure fields.
+}
+
+// Decoded XMP metadata.
+type XMPMeta struct {
+	Prefixes   map[string]string // Namespace prefixes found in the packet, by URI.
+	Properties []XMPProperty     // Top-level properties.
+}
+
+// Return a simple property with a text value.
+func XMPText(ns, name, value string) XMPProperty {
+	return XMPProperty{NS: ns, Name: name, Value: value}
+}
+
+// Return an array property with simple text items.
+func XMPArray(ns, name string, kind XMPKind, values []string) XMPProperty {
+	prop := XMPProperty{NS: ns, Name: name, Kind: kind}
+	for _, v := range values {
+		prop.Items = append(prop.Items, XMPProperty{Value: v})
+	}
+	return prop
+}
+
+// Return a language alternative property with a single x-default item.
+func XMPLangAlt(ns, name, value string) XMPProperty {
+	return XMPProperty{NS: ns, Name: name, Kind: XMPAlt, Items: []XMPProperty{{Value: value, Lang: "x-default"}}}
+}
+
+// Return the text of a property: the value of a simple property, the
+// x-default (or first) item of a language alternative, or the first
+// item of other arrays.
+func (prop XMPProperty) Text() string {
+	switch prop.Kind {
+	case XMPSimple:
+		return prop.Value
+	case XMPAlt:
+		for _, item := range prop.Items {
+			if item.Lang == "x-default" {
+				return item.Value
+			}
+		}
+	}
+	if len(prop.Items) > 0 && prop.Kind != XMPStruct {
+		return prop.Items[0].Value
+	}
+	return ""
+}
+
+// Return the values of the items of an array property, or the value
+// of a simple property as a single item.
+func (prop XMPProperty) Values() []string {
+	if prop.Kind == XMPSimple {
+		return []string{prop.Value}
+	}
+	values := make([]string, 0, len(prop.Items))
+	for _, item := range prop.Items {
+		values = append(values, item.Value)
+	}
+	return values
+}
+
+// Return a structure field, or nil if not found.
+func (prop *XMPProperty) Field(ns, name string) *XMPProperty {
+	for i := range prop.Items {
+		if prop.Items[i].NS == ns && prop.Items[i].Name == name {
+			return &prop.Items[i]
+		}
+	}
+	return nil
+}
+
+// Return a top-level property, or nil if not found.
+func (meta *XMPMeta) Get(ns, name string) *XMPProperty {
+	for i := range meta.Properties {
+		if meta.Properties[i].NS == ns && meta.Properties[i].Name == name {
+			return &meta.Properties[i]
+		}
+	}
+	return nil
+}
+
+// Add a top-level property, replacing any existing property with the
+// same name.
+func (meta *XMPMeta) Set(prop XMPProperty) {
+	if existing := meta.Get(prop.NS, prop.Name); existing != nil {
+		*existing = prop
+		return
+	}
+	meta.Properties = append(meta.Properties, prop)
+}
+
+// Delete a top-level property.
+func (meta *XMPMeta) Delete(ns, name string) {
+	out := meta.Properties[:0]
+	for _, prop := range meta.Properties {
+		if prop.NS != ns || prop.Name != name {
+			out = append(out, prop)
+		}
+	}
+	meta.Properties = out
+}
+
+// Element in a generic XML tree, used when decoding RDF.
+type xmlElement struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	children []*xmlElement
+	text     string
+}
+
+// Decode an XML document into a generic element tree, returning a
+// dummy root element and the namespace prefixes that were declared.
+func parseXMLTree(packet []byte) (*xmlElement, map[string]string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(packet))
+	decoder.Strict = false
+	root := &xmlElement{}
+	stack := []*xmlElement{root}
+	prefixes := make(map[string]string)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return root, prefixes, err
+		}
+		top := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" {
+					prefixes[attr.Value] = attr.Name.Local
+				}
+			}
+			elem := &xmlElement{name: t.Name, attrs: t.Attr}
+			top.children = append(top.children, elem)
+			stack = append(stack, elem)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			top.text += string(t)
+		}
+	}
+	return root, prefixes, nil
+}
+
+// Return an attribute value, or "" if not found.
+func (elem *xmlElement) attr(space, local string) string {
+	for _, attr := range elem.attrs {
+		if attr.Name.Space == space && attr.Name.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// Return true if an attribute is syntax rather than a property.
+func isRDFSyntaxAttr(attr xml.Attr) bool {
+	return attr.Name.Space == "xmlns" || attr.Name.Space == NSrdf || attr.Name.Space == NSxml || attr.Name.Space == "" && attr.Name.Local == "xmlns"
+}
+
+// Add the properties expressed as attributes and child elements of a
+// node element (e.g., rdf:Description) to a property list.
+func rdfNodeProperties(elem *xmlElement, props []XMPProperty) ([]XMPProperty, error) {
+	var err error
+	for _, attr := range elem.attrs {
+		if !isRDFSyntaxAttr(attr) {
+			props = append(props, XMPProperty{NS: attr.Name.Space, Name: attr.Name.Local, Value: attr.Value})
+		}
+	}
+	for _, child := range elem.children {
+		prop, propErr := rdfPropertyValue(child)
+		if propErr != nil {
+			err = propErr
+			continue
+		}
+		prop.NS = child.name.Space
+		prop.Name = child.name.Local
+		props = append(props, prop)
+	}
+	return props, err
+}
+
+// Decode the value of a property element or array item.
+func rdfPropertyValue(elem *xmlElement) (XMPProperty, error) {
+	var prop XMPProperty
+	prop.Lang = elem.attr(NSxml, "lang")
+	if resource := elem.attr(NSrdf, "resource"); resource != "" {
+		prop.Value = resource
+		return prop, nil
+	}
+	if elem.attr(NSrdf, "parseType") == "Resource" {
+		prop.Kind = XMPStruct
+		var err error
+		prop.Items, err = rdfNodeProperties(elem, nil)
+		return prop, err
+	}
+	// Shorthand structure with fields as attributes.
+	for _, attr := range elem.attrs {
+		if !isRDFSyntaxAttr(attr) {
+			prop.Kind = XMPStruct
+			var err error
+			prop.Items, err = rdfNodeProperties(elem, nil)
+			return prop, err
+		}
+	}
+	if len(elem.children) == 0 {
+		prop.Value = elem.text
+		return prop, nil
+	}
+	if len(elem.children) > 1 {
+		return prop, fmt.Errorf("Unexpected content in XMP property %s", elem.name.Local)
+	}
+	child := elem.children[0]
+	if child.name.Space != NSrdf {
+		return prop, fmt.Errorf("Unexpected element %s in XMP property %s", child.name.Local, elem.name.Local)
+	}
+	switch child.name.Local {
+	case "Bag", "Seq", "Alt":
+		prop.Kind = map[string]XMPKind{"Bag": XMPBag, "Seq": XMPSeq, "Alt": XMPAlt}[child.name.Local]
+		for _, li := range child.children {
+			if li.name.Space != NSrdf || li.name.Local != "li" {
+				continue
+			}
+			item, err := rdfPropertyValue(li)
+			if err != nil {
+				return prop, err
+			}
+			prop.Items = append(prop.Items, item)
+		}
+	case "Description":
+		prop.Kind = XMPStruct
+		var err error
+		prop.Items, err = rdfNodeProperties(child, nil)
+		return prop, err
+	default:
+		return prop, fmt.Errorf("Unexpected element rdf:%s in XMP property %s", child.name.Local, elem.name.Local)
+	}
+	return prop, nil
+}
+
+// Find all rdf:Description elements in a tree.
+func findDescriptions(elem *xmlElement, found []*xmlElement) []*xmlElement {
+	for _, child := range elem.children {
+		if child.name.Space == NSrdf && child.name.Local == "Description" {
+			found = append(found, child)
+		} else {
+			found = findDescriptions(child, found)
+		}
+	}
+	return found
+}
+
+// Decode an XMP packet, or a serialized x:xmpmeta element as used for
+// extended XMP. Properties will be read if possible even if errors
+// occur.
+func ParseXMP(packet []byte) (*XMPMeta, error) {
+	root, prefixes, err := parseXMLTree(packet)
+	meta := &XMPMeta{Prefixes: prefixes}
+	descriptions := findDescriptions(root, nil)
+	if len(descriptions) == 0 && err == nil {
+		err = errors.New("No rdf:Description found in XMP packet")
+	}
+	for _, desc := range descriptions {
+		var descErr error
+		meta.Properties, descErr = rdfNodeProperties(desc, meta.Properties)
+		if descErr != nil && err == nil {
+			err = descErr
+		}
+	}
+	return meta, err
+}
+
+// Return the prefix to use for a namespace, allocating new prefixes
+// as required.
+func (meta *XMPMeta) prefix(ns string, used map[string]string) string {
+	if p, found := used[ns]; found {
+		return p
+	}
+	p, found := XMPPrefixes[ns]
+	if !found {
+		p, found = meta.Prefixes[ns]
+	}
+	taken := func(p string) bool {
+		for _, u := range used {
+			if u == p {
+				return true
+			}
+		}
+		return p == "x" || p == "rdf" || p == "xml"
+	}
+	if !found || p == "" || taken(p) {
+		for i := 1; ; i++ {
+			p = fmt.Sprintf("ns%d", i)
+			if !taken(p) {
+				break
+			}
+		}
+	}
+	used[ns] = p
+	return p
+}
+
+// Escape a string for use in XML text or attributes.
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// Serialize a property value.
+func (meta *XMPMeta) writeProperty(buf *bytes.Buffer, prop XMPProperty, used map[string]string, indent string) {
+	var name string
+	if prop.Name == "" {
+		name = "rdf:li"
+	} else {
+		name = meta.prefix(prop.NS, used) + ":" + prop.Name
+	}
+	lang := ""
+	if prop.Lang != "" {
+		lang = fmt.Sprintf(" xml:lang=\"%s\"", xmlEscape(prop.Lang))
+	}
+	switch prop.Kind {
+	case XMPSimple:
+		fmt.Fprintf(buf, "%s<%s%s>%s</%s>\n", indent, name, lang, xmlEscape(prop.Value), name)
+	case XMPStruct:
+		fmt.Fprintf(buf, "%s<%s%s rdf:parseType=\"Resource\">\n", indent, name, lang)
+		for _, field := range prop.Items {
+			meta.writeProperty(buf, field, used, indent+" ")
+		}
+		fmt.Fprintf(buf, "%s</%s>\n", indent, name)
+	default:
+		array := map[XMPKind]string{XMPBag: "rdf:Bag", XMPSeq: "rdf:Seq", XMPAlt: "rdf:Alt"}[prop.Kind]
+		fmt.Fprintf(buf, "%s<%s%s>\n%s <%s>\n", indent, name, lang, indent, array)
+		for _, item := range prop.Items {
+			item.NS, item.Name = "", ""
+			meta.writeProperty(buf, item, used, indent+"  ")
+		}
+		fmt.Fprintf(buf, "%s </%s>\n%s</%s>\n", indent, array, indent, name)
+	}
+}
+
+// Collect the namespaces used by a property and its fields.
+func collectNamespaces(prop XMPProperty, namespaces map[string]bool) {
+	if prop.NS != "" {
+		namespaces[prop.NS] = true
+	}
+	for _, item := range prop.Items {
+		collectNamespaces(item, namespaces)
+	}
+}
+
+// Serialize the metadata as an x:xmpmeta element, without the packet
+// wrapper, as used for extended XMP.
+func (meta *XMPMeta) XMPMetaElement() []byte {
+	namespaces := make(map[string]bool)
+	for _, prop := range meta.Properties {
+		collectNamespaces(prop, namespaces)
+	}
+	sorted := make([]string, 0, len(namespaces))
+	for ns := range namespaces {
+		sorted = append(sorted, ns)
+	}
+	sort.Strings(sorted)
+	used := make(map[string]string)
+	var decls []string
+	for _, ns := range sorted {
+		decls = append(decls, fmt.Sprintf("xmlns:%s=\"%s\"", meta.prefix(ns, used), xmlEscape(ns)))
+	}
+	var buf bytes.Buffer
+	buf.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	buf.WriteString(" <rdf:RDF xmlns:rdf=\"" + NSrdf + "\">\n")
+	buf.WriteString("  <rdf:Description rdf:about=\"\"")
+	for _, decl := range decls {
+		buf.WriteString("\n    " + decl)
+	}
+	buf.WriteString(">\n")
+	for _, prop := range meta.Properties {
+		meta.writeProperty(&buf, prop, used, "   ")
+	}
+	buf.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n")
+	return buf.Bytes()
+}
+
+// Serialize the metadata as an XMP packet, with the packet wrapper
+// and 'padding' bytes of whitespace to allow in-place editing.
+func (meta *XMPMeta) Packet(padding int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("<?xpacket begin=\"\xEF\xBB\xBF\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	buf.Write(meta.XMPMetaElement())
+	for padding > 0 {
+		n := padding
+		if n > 100 {
+			n = 100
+		}
+		buf.WriteString(strings.Repeat(" ", n-1) + "\n")
+		padding -= n
+	}
+	buf.WriteString("<?xpacket end=\"w\"?>")
+	return buf.Bytes()
+}